@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// default cap on the combined decoded size of a request's attachments
+const defaultMaxAttachmentBytes = 10 << 20
+
+// default cap on the number of attachments in a request
+const defaultMaxAttachments = 10
+
+// what a request's attachments must stay within
+type attachmentLimits struct {
+	// combined decoded size
+	maxBytes int64
+	maxCount int
+	// accepted content types, see emailConfig.allowedAttachmentTypes
+	allowedTypes []string
+}
+
+// types detected from content that say too little to contradict a declared
+// type: unrecognized data and any text
+var genericContentTypes = map[string]bool{
+	"application/octet-stream": true,
+	"text/plain":               true,
+}
+
+// formats stored as zip archives besides those matched by zipBasedType's
+// prefixes and suffix
+var zipContentTypes = map[string]bool{
+	"application/zip":                         true,
+	"application/x-zip-compressed":            true,
+	"application/java-archive":                true,
+	"application/vnd.android.package-archive": true,
+	"application/vnd.ms-xpsdocument":          true,
+	"application/vnd.visio":                   true,
+}
+
+// report whether content of the media type is a zip archive, as Office Open
+// XML, OpenDocument and +zip types such as EPUB are
+func zipBasedType(mediaType string) bool {
+	return zipContentTypes[mediaType] ||
+		strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mediaType, "application/vnd.oasis.opendocument.") ||
+		strings.HasSuffix(mediaType, "+zip")
+}
+
+// how long fetching all of a request's attachments given by URL may take,
+// replaceable in tests
+var attachmentFetchTimeout = 30 * time.Second
+
+// dialer that refuses to connect to addresses that aren't publicly routable,
+// so URLs given in requests can't reach the service's own network or cloud
+// metadata endpoints; the check runs on the address actually dialed, after
+// DNS resolution and on every redirect
+var publicDialer = &net.Dialer{
+	Timeout: 10 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			return err
+		}
+		if !isPublicAddr(ip) {
+			return fmt.Errorf("%s is not a public address", ip)
+		}
+		return nil
+	},
+}
+
+// ranges IsGlobalUnicast and IsPrivate let through that aren't reachable on
+// the internet, such as carrier-grade NAT which hosts some metadata services
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// report whether the address is publicly routable, rejecting loopback,
+// private, link-local (including 169.254.169.254) and reserved addresses
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// client used to fetch attachments given by URL, replaceable in tests; it
+// only connects to public addresses, without a proxy, and only follows
+// redirects to other https URLs
+var attachmentClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         publicDialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(r *http.Request, via []*http.Request) error {
+		if r.URL.Scheme != "https" {
+			return errors.New("redirected to a URL that is not https")
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	},
+}
+
+// structure for a file attached to an email
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	// base64 encoded file contents
+	Content string `json:"content"`
+	// optional https URL the contents are fetched from instead
+	URL string `json:"url,omitempty"`
+	// optional Content-ID, without angle brackets, making the attachment an
+	// inline image the HTML body references as cid:<content_id>
+	ContentID string `json:"content_id,omitempty"`
+
+	data []byte
+}
+
+// report whether the attachment is shown inside the HTML body rather than
+// offered as a download
+func (a Attachment) inline() bool {
+	return a.ContentID != ""
+}
+
+// split attachments into the inline images and the rest, keeping their order
+func splitInline(attachments []Attachment) (inline, attached []Attachment) {
+	for _, attachment := range attachments {
+		if attachment.inline() {
+			inline = append(inline, attachment)
+		} else {
+			attached = append(attached, attachment)
+		}
+	}
+	return inline, attached
+}
+
+// matches cid: URLs in HTML, capturing the Content-ID
+var cidReference = regexp.MustCompile(`(?i)cid:([^"'\s<>()]+)`)
+
+// check that the inline attachments have distinct, well formed Content-IDs,
+// that the HTML references each of them, and that every cid: URL in the HTML
+// refers to one of them
+func validateInlineAttachments(attachments []Attachment, html string) error {
+	ids := make(map[string]bool)
+	for _, attachment := range attachments {
+		if !attachment.inline() {
+			continue
+		}
+		if _, err := sanitizeHeaderValue(attachment.ContentID); err != nil || strings.ContainsAny(attachment.ContentID, "<> \t") {
+			return fmt.Errorf("attachment '%s' has an invalid content_id", attachment.Filename)
+		}
+		if ids[attachment.ContentID] {
+			return fmt.Errorf("content_id '%s' is used by more than one attachment", attachment.ContentID)
+		}
+		ids[attachment.ContentID] = true
+	}
+	if len(ids) > 0 && html == "" {
+		return fmt.Errorf("attachments with a content_id require an HTML message")
+	}
+
+	referenced := make(map[string]bool)
+	for _, match := range cidReference.FindAllStringSubmatch(html, -1) {
+		// cid URLs are URL encoded Content-IDs
+		id, err := url.PathUnescape(match[1])
+		if err != nil || !ids[id] {
+			return fmt.Errorf("HTML message references cid:%s, which is not the content_id of an attachment", match[1])
+		}
+		referenced[id] = true
+	}
+	for _, attachment := range attachments {
+		if attachment.inline() && !referenced[attachment.ContentID] {
+			return fmt.Errorf("attachment '%s' has content_id '%s', which the HTML message does not reference", attachment.Filename, attachment.ContentID)
+		}
+	}
+	return nil
+}
+
+// decode or fetch the attachments and check they are within the limits and
+// that their content is of the declared type, filling in the type when none
+// is declared
+func validateAttachments(ctx context.Context, attachments []Attachment, limits attachmentLimits) error {
+	if len(attachments) > limits.maxCount {
+		return fmt.Errorf("emails may have at most %d attachments", limits.maxCount)
+	}
+	// one deadline for all of the fetches, so many slow URLs can't hold the
+	// request up for longer than a single one
+	fetchCtx, cancel := context.WithTimeout(ctx, attachmentFetchTimeout)
+	defer cancel()
+	var total int64
+	for i := range attachments {
+		attachment := &attachments[i]
+		if attachment.Filename == "" {
+			return fmt.Errorf("attachment %d is missing a filename", i)
+		}
+		if _, err := sanitizeHeaderValue(attachment.Filename); err != nil {
+			return fmt.Errorf("attachment filename is not valid: %v", err)
+		}
+		if _, err := sanitizeHeaderValue(attachment.ContentType); err != nil {
+			return fmt.Errorf("attachment content type is not valid: %v", err)
+		}
+
+		if attachment.URL != "" {
+			if attachment.Content != "" {
+				return fmt.Errorf("attachment '%s' must have either content or a url, not both", attachment.Filename)
+			}
+			data, contentType, err := fetchAttachment(fetchCtx, attachment.URL, limits.maxBytes-total)
+			if err == errFetchTooLarge {
+				return tooLargeError(fmt.Sprintf("attachments exceed the maximum total size of %d bytes", limits.maxBytes))
+			}
+			if err != nil && fetchCtx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("attachments given by url took longer than %s to fetch", attachmentFetchTimeout)
+			}
+			if err != nil {
+				return fmt.Errorf("attachment '%s': %w", attachment.Filename, err)
+			}
+			if attachment.ContentType == "" {
+				attachment.ContentType = contentType
+			}
+			// kept encoded so a stored scheduled job doesn't fetch it again
+			attachment.Content, attachment.URL = base64.StdEncoding.EncodeToString(data), ""
+		}
+
+		data, err := base64.StdEncoding.DecodeString(attachment.Content)
+		if err != nil {
+			return fmt.Errorf("attachment '%s' is not valid base64", attachment.Filename)
+		}
+		attachment.data = data
+
+		total += int64(len(data))
+		if total > limits.maxBytes {
+			return tooLargeError(fmt.Sprintf("attachments exceed the maximum total size of %d bytes", limits.maxBytes))
+		}
+
+		detected, _, _ := mime.ParseMediaType(detectContentType(data))
+		declared := "application/octet-stream"
+		if attachment.ContentType != "" {
+			if declared, _, err = mime.ParseMediaType(attachment.ContentType); err != nil {
+				return fmt.Errorf("attachment '%s' has an invalid content type", attachment.Filename)
+			}
+		}
+		// declaring no type or an unknown one leaves the content to tell
+		if declared == "application/octet-stream" {
+			declared = detected
+			attachment.ContentType = detected
+		}
+		// a zip archive only passes for a type stored as one, such as .docx
+		if detected == "application/zip" && zipBasedType(declared) {
+			detected = declared
+		}
+		if !genericContentTypes[detected] && detected != declared {
+			return fmt.Errorf("attachment '%s' is declared as %s but its content is %s", attachment.Filename, declared, detected)
+		}
+		if !contentTypeAllowed(declared, limits.allowedTypes) {
+			return fmt.Errorf("attachment '%s' has content type %s, which is not allowed", attachment.Filename, declared)
+		}
+	}
+	return nil
+}
+
+// returned by fetchAttachment for files over the size limit
+var errFetchTooLarge = errors.New("attachment is too large")
+
+// download an attachment from an https URL, failing when it is larger than
+// maxBytes. Returns the media type the server gave, empty when it gave none
+// or only a generic one, leaving the content to tell
+func fetchAttachment(ctx context.Context, rawURL string, maxBytes int64) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, "", errors.New("url must be an absolute https URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := attachmentClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not fetch url: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching url returned status %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > maxBytes {
+		return nil, "", errFetchTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not fetch url: %v", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", errFetchTooLarge
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "application/octet-stream" || contentType == "binary/octet-stream" {
+		contentType = ""
+	}
+	return data, contentType, nil
+}
+
+// sniff the content type of data, recognizing executables as well as the
+// types http.DetectContentType knows
+func detectContentType(data []byte) string {
+	switch {
+	case isPortableExecutable(data):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		return "application/x-executable"
+	}
+	return http.DetectContentType(data)
+}
+
+// report whether data is a Windows executable: an MZ header whose offset at
+// 0x3c points to a PE signature
+func isPortableExecutable(data []byte) bool {
+	if len(data) < 0x40 || !bytes.HasPrefix(data, []byte("MZ")) {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(data[0x3c:]))
+	return offset <= len(data)-4 && bytes.Equal(data[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// report whether the media type matches the allowlist, exactly or through a
+// "type/*" entry; "*/*" or an empty allowlist allows every type
+func contentTypeAllowed(mediaType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, entry := range allowed {
+		if entry == "*/*" || entry == mediaType || strings.HasSuffix(entry, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(entry, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// write an attachment as a base64 encoded part, shown inline and identified
+// by its Content-ID when it has one
+func writeAttachment(mw *multipart.Writer, attachment Attachment) {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	data := attachment.data
+	if data == nil {
+		data, _ = base64.StdEncoding.DecodeString(attachment.Content)
+	}
+
+	disposition := "attachment"
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+	}
+	if attachment.inline() {
+		disposition = "inline"
+		header.Set("Content-ID", "<"+attachment.ContentID+">")
+	}
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+
+	// writes go to an in-memory buffer and cannot fail
+	part, _ := mw.CreatePart(header)
+	writeBase64Lines(part, data)
+}
+
+// base64 encode data wrapped at 76 characters per line
+func writeBase64Lines(w io.Writer, data []byte) {
+	const lineLength = 76
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > lineLength {
+		w.Write([]byte(encoded[:lineLength] + "\r\n"))
+		encoded = encoded[lineLength:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
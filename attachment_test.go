@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve attachment downloads over TLS, pointing attachmentClient at the
+// server for the duration of the test
+func newAttachmentServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	previous := attachmentClient
+	attachmentClient = srv.Client()
+	t.Cleanup(func() { attachmentClient = previous })
+	return srv
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":          true,
+		"2606:2800:220:1::":      true,
+		"127.0.0.1":              false,
+		"::1":                    false,
+		"10.1.2.3":               false,
+		"172.16.0.1":             false,
+		"192.168.1.1":            false,
+		"169.254.169.254":        false,
+		"100.100.100.200":        false,
+		"0.0.0.0":                false,
+		"::ffff:127.0.0.1":       false,
+		"::ffff:169.254.169.254": false,
+		"fd00:ec2::254":          false,
+		"fe80::1":                false,
+		"224.0.0.1":              false,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestFetchAttachmentRefusesNonPublicAddresses(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("attachment fetched from a loopback address")
+	}))
+	defer srv.Close()
+
+	_, _, err := fetchAttachment(context.Background(), srv.URL+"/secret", 1<<20)
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("err = %v, want the loopback address refused", err)
+	}
+}
+
+func TestValidateAttachmentsFetchesURL(t *testing.T) {
+	srv := newAttachmentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("%PDF-1.4 report"))
+	})
+
+	attachments := []Attachment{{Filename: "report.pdf", URL: srv.URL + "/report.pdf"}}
+	if err := validateAttachments(context.Background(), attachments, attachmentLimits{maxBytes: 1 << 20, maxCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// the fetched content is kept encoded in place of the url
+	if got := attachments[0]; got.URL != "" || got.Content != base64.StdEncoding.EncodeToString([]byte("%PDF-1.4 report")) || got.ContentType != "application/pdf" {
+		t.Errorf("attachment = %+v, want the fetched PDF", got)
+	}
+}
+
+func TestValidateAttachmentsFetchRejections(t *testing.T) {
+	srv := newAttachmentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("more than eight bytes"))
+	})
+	limits := attachmentLimits{maxBytes: 8, maxCount: 1}
+
+	for name, attachment := range map[string]Attachment{
+		"http url":        {Filename: "a.txt", URL: "http://example.com/a.txt"},
+		"relative url":    {Filename: "a.txt", URL: "/a.txt"},
+		"content and url": {Filename: "a.txt", Content: "aGk=", URL: srv.URL + "/a.txt"},
+		"missing file":    {Filename: "a.txt", URL: srv.URL + "/missing"},
+	} {
+		if err := validateAttachments(context.Background(), []Attachment{attachment}, limits); err == nil {
+			t.Errorf("%s: attachment accepted, want an error", name)
+		}
+	}
+
+	var tooLarge tooLargeError
+	err := validateAttachments(context.Background(), []Attachment{{Filename: "a.txt", URL: srv.URL + "/a.txt"}}, limits)
+	if !errors.As(err, &tooLarge) {
+		t.Errorf("err = %v, want a file over the limit rejected as too large", err)
+	}
+}
+
+func TestValidateAttachmentsFetchesWithinOneDeadline(t *testing.T) {
+	previous := attachmentFetchTimeout
+	attachmentFetchTimeout = 300 * time.Millisecond
+	defer func() { attachmentFetchTimeout = previous }()
+	// each fetch is well within the deadline, but not all three together
+	srv := newAttachmentServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		w.Write([]byte("hello"))
+	})
+
+	attachments := []Attachment{
+		{Filename: "a.txt", URL: srv.URL + "/a"},
+		{Filename: "b.txt", URL: srv.URL + "/b"},
+		{Filename: "c.txt", URL: srv.URL + "/c"},
+	}
+	start := time.Now()
+	err := validateAttachments(context.Background(), attachments, attachmentLimits{maxBytes: 1 << 20, maxCount: 3})
+	if err == nil || !strings.Contains(err.Error(), "took longer than") {
+		t.Errorf("err = %v, want the fetches to run out of time", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fetches took %s, want them stopped at the deadline", elapsed)
+	}
+}
+
+func TestFormatMessageWithAttachment(t *testing.T) {
+	content := []byte("%PDF-1.4 quarterly report")
+	attachments := []Attachment{{Filename: "report.pdf", ContentType: "application/pdf", Content: base64.StdEncoding.EncodeToString(content)}}
+	if err := validateAttachments(context.Background(), attachments, attachmentLimits{maxBytes: 1 << 20, maxCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Report", Message: "Attached", Attachments: attachments})
+
+	parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/mixed")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0].header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("parts = %+v, want the text followed by the attachment", parts)
+	}
+	attached := parts[1]
+	if got := attached.header.Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("attachment Content-Type = %q, want application/pdf", got)
+	}
+	if got := attached.header.Get("Content-Disposition"); got != `attachment; filename=report.pdf` {
+		t.Errorf("Content-Disposition = %q", got)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(attached.body, "\r\n"), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("base64 line of %d characters, want at most 76", len(line))
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(attached.body, "\r\n", ""))
+	if err != nil || !bytes.Equal(decoded, content) {
+		t.Errorf("attachment body = %q (%v), want the original content", attached.body, err)
+	}
+}
+
+func TestAttachmentsDefaultToOctetStream(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello", Attachments: []Attachment{{Filename: "data.bin", Content: "aGk="}}})
+	parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/mixed")
+	if got := parts[1].header.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("attachment Content-Type = %q, want application/octet-stream", got)
+	}
+}
+
+func TestValidateAttachmentsRejections(t *testing.T) {
+	limits := attachmentLimits{maxBytes: 8, maxCount: 2}
+	for name, attachments := range map[string][]Attachment{
+		"no filename":        {{Content: "aGk="}},
+		"bad base64":         {{Filename: "a.txt", Content: "not base64!"}},
+		"too many":           {{Filename: "a.txt", Content: "aGk="}, {Filename: "b.txt", Content: "aGk="}, {Filename: "c.txt", Content: "aGk="}},
+		"too large":          {{Filename: "a.txt", Content: base64.StdEncoding.EncodeToString([]byte("more than eight bytes"))}},
+		"too large together": {{Filename: "a.txt", Content: "aGVsbG8="}, {Filename: "b.txt", Content: "aGVsbG8="}},
+		"filename CRLF":      {{Filename: "a.txt\r\nX-Evil: 1", Content: "aGk="}},
+		"bad content type":   {{Filename: "a.txt", ContentType: "text/", Content: "aGk="}},
+	} {
+		if err := validateAttachments(context.Background(), attachments, limits); err == nil {
+			t.Errorf("%s: attachments accepted, want an error", name)
+		}
+	}
+}
+
+// a minimal Windows executable header
+func portableExecutable() []byte {
+	data := make([]byte, 0x44)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], "PE\x00\x00")
+	return data
+}
+
+func TestValidateAttachmentsChecksContent(t *testing.T) {
+	pdf := []byte("%PDF-1.4 report")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	for name, test := range map[string]struct {
+		declared string
+		content  []byte
+		wantErr  bool
+	}{
+		"matching type":            {"application/pdf", pdf, false},
+		"type with parameters":     {"text/plain; charset=utf-8", []byte("hello"), false},
+		"text declared precisely":  {"text/csv", []byte("a,b\n1,2\n"), false},
+		"image declared as pdf":    {"application/pdf", png, true},
+		"executable declared text": {"text/plain", portableExecutable(), true},
+		"elf declared as pdf":      {"application/pdf", []byte("\x7fELF\x02\x01\x01"), true},
+		"undeclared executable":    {"", portableExecutable(), false},
+		"octet-stream for a pdf":   {"application/octet-stream", pdf, false},
+	} {
+		attachments := []Attachment{{Filename: "file", ContentType: test.declared, Content: base64.StdEncoding.EncodeToString(test.content)}}
+		err := validateAttachments(context.Background(), attachments, attachmentLimits{maxBytes: 1 << 20, maxCount: 1})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %v", name, err, test.wantErr)
+		}
+	}
+
+	// the detected type is filled in when none is declared
+	attachments := []Attachment{{Filename: "report", Content: base64.StdEncoding.EncodeToString(pdf)}, {Filename: "tool.exe", Content: base64.StdEncoding.EncodeToString(portableExecutable())}}
+	if err := validateAttachments(context.Background(), attachments, attachmentLimits{maxBytes: 1 << 20, maxCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if attachments[0].ContentType != "application/pdf" || attachments[1].ContentType != "application/x-msdownload" {
+		t.Errorf("content types = %q, %q, want the detected types", attachments[0].ContentType, attachments[1].ContentType)
+	}
+}
+
+func TestValidateAttachmentsChecksAllowedTypes(t *testing.T) {
+	limits := attachmentLimits{maxBytes: 1 << 20, maxCount: 1, allowedTypes: []string{"application/pdf", "image/*"}}
+	for declared, content := range map[string]string{
+		"application/pdf": "%PDF-1.4 report",
+		"image/png":       "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+		"image/svg+xml":   "<svg></svg>",
+	} {
+		attachments := []Attachment{{Filename: "file", ContentType: declared, Content: base64.StdEncoding.EncodeToString([]byte(content))}}
+		if err := validateAttachments(context.Background(), attachments, limits); err != nil {
+			t.Errorf("%s: %v, want it allowed", declared, err)
+		}
+	}
+	for _, content := range []string{"hello", string(portableExecutable())} {
+		attachments := []Attachment{{Filename: "file", Content: base64.StdEncoding.EncodeToString([]byte(content))}}
+		if err := validateAttachments(context.Background(), attachments, limits); err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%q: err = %v, want its type refused", attachments[0].ContentType, err)
+		}
+	}
+
+	// the defaults refuse executables, "*/*" lets any type through
+	executable := []Attachment{{Filename: "file", Content: base64.StdEncoding.EncodeToString(portableExecutable())}}
+	limits.allowedTypes = defaultAllowedAttachmentTypes
+	if err := validateAttachments(context.Background(), executable, limits); err == nil {
+		t.Error("executable allowed by the default types")
+	}
+	limits.allowedTypes = []string{"*/*"}
+	if err := validateAttachments(context.Background(), executable, limits); err != nil {
+		t.Errorf("executable refused with */*: %v", err)
+	}
+}
+
+func TestValidateAttachmentsChecksZipDeclaredTypes(t *testing.T) {
+	zip := base64.StdEncoding.EncodeToString([]byte("PK\x03\x04\x14\x00\x00\x00\x08\x00"))
+	for declared, wantErr := range map[string]bool{
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": false,
+		"application/vnd.oasis.opendocument.text":                                 false,
+		"application/epub+zip":                                                    false,
+		"application/zip":                                                         false,
+		"":                                                                        false,
+		"application/pdf":                                                         true,
+		"image/png":                                                               true,
+	} {
+		attachments := []Attachment{{Filename: "file", ContentType: declared, Content: zip}}
+		err := validateAttachments(context.Background(), attachments, attachmentLimits{maxBytes: 1 << 20, maxCount: 1})
+		if (err != nil) != wantErr {
+			t.Errorf("zip declared as %q: err = %v, want error %v", declared, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// checks requests carry one of the configured API keys
+type apiKeyAuth struct {
+	keys []string
+}
+
+// extract the API key from an Authorization bearer token or X-API-Key header
+func requestAPIKey(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// report whether the key matches one of the configured keys
+func (a *apiKeyAuth) valid(key string) bool {
+	if key == "" {
+		return false
+	}
+	matched := 0
+	for _, candidate := range a.keys {
+		// compare in constant time so keys can't be guessed from response timing
+		matched |= subtle.ConstantTimeCompare([]byte(key), []byte(candidate))
+	}
+	return matched == 1
+}
+
+// wrap a handler so it rejects requests without a valid API key
+func (a *apiKeyAuth) require(next http.HandlerFunc) http.HandlerFunc {
+	if len(a.keys) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.valid(requestAPIKey(r)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "Missing or invalid API key")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	auth := &apiKeyAuth{keys: []string{"key-one", "key-two"}}
+	handler := auth.require(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	for name, header := range map[string][2]string{
+		"bearer token":  {"Authorization", "Bearer key-one"},
+		"X-API-Key":     {"X-API-Key", "key-two"},
+		"padded bearer": {"Authorization", "Bearer  key-two "},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/get-all-emails", nil)
+		r.Header.Set(header[0], header[1])
+		if w := record(handler, r); w.Code != http.StatusNoContent {
+			t.Errorf("%s: status = %d, want the request let through", name, w.Code)
+		}
+	}
+
+	for name, header := range map[string][2]string{
+		"no key":        {},
+		"wrong key":     {"X-API-Key", "key-three"},
+		"prefix of key": {"X-API-Key", "key-"},
+		"basic auth":    {"Authorization", "Basic a2V5LW9uZQ=="},
+		"empty bearer":  {"Authorization", "Bearer "},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/get-all-emails", nil)
+		if header[0] != "" {
+			r.Header.Set(header[0], header[1])
+		}
+		w := record(handler, r)
+		if got := w.Header().Get("WWW-Authenticate"); got != "Bearer" {
+			t.Errorf("%s: WWW-Authenticate = %q, want Bearer", name, got)
+		}
+		assertError(t, w, http.StatusUnauthorized, errCodeUnauthorized)
+	}
+}
+
+func TestAPIKeyAuthWithoutKeysIsOpen(t *testing.T) {
+	handler := (&apiKeyAuth{}).require(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	if w := record(handler, httptest.NewRequest(http.MethodGet, "/get-all-emails", nil)); w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want requests let through when no keys are configured", w.Code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// outcome of one email of a /send-batch request: the status and body a
+// /send-email request for it alone would have received
+type batchResult struct {
+	Index      int             `json:"index"`
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// handles requests to send several distinct emails at once, each processed
+// as its own /send-email request
+func (s *server) sendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only POST method
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	r, span := startRequestSpan(r, "send_batch")
+	defer span.End()
+
+	if s.smtpUnavailable(w) {
+		return
+	}
+
+	var requests []EmailRequest
+	if !s.decodeEmailRequest(w, r, &requests) {
+		return
+	}
+	if len(requests) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "batch must contain at least one email")
+		return
+	}
+
+	// the recipient limit applies to the batch as a whole, so splitting a
+	// send into a batch doesn't get around it
+	count := 0
+	for _, request := range requests {
+		count += len(request.allAddresses())
+	}
+	if count > s.config.maxRecipients {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Too many recipients: %d addresses given across the batch, at most %d are allowed", count, s.config.maxRecipients))
+		return
+	}
+
+	// each email counts against the client's rate limit, the request itself
+	// having paid for the first
+	if s.limiter.enabled() {
+		if len(requests) > int(s.limiter.burst) {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("batch of %d emails exceeds the rate limit burst of %d", len(requests), int(s.limiter.burst)))
+			return
+		}
+		if ok, wait := s.limiter.allowN(s.limiter.clientIP(r), len(requests)-1); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests, try again later")
+			return
+		}
+	}
+
+	results := make([]batchResult, len(requests))
+	status := http.StatusOK
+	for i, request := range requests {
+		rec := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+		s.send(rec, r, request)
+		results[i] = batchResult{Index: i, StatusCode: rec.status, Body: bytes.TrimSpace(rec.body.Bytes())}
+		if rec.status >= http.StatusMultipleChoices {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	writeJSON(w, status, map[string]any{"results": results})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSendBatchProcessesEachEmail(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	batch := `[
+		{"recipients":["a@example.com"],"subject":"First","message":"One"},
+		{"recipients":["not-an-address"],"subject":"Second","message":"Two"},
+		{"recipients":["b@example.com","c@example.com"],"subject":"Third","message":"Three"}
+	]`
+	w := record(s.sendBatchHandler, jsonRequest("/send-batch?wait=true", batch))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207 with one email invalid: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Results []batchResult `json:"results"`
+	}
+	decodeBody(t, w, &response)
+	if len(response.Results) != 3 {
+		t.Fatalf("results = %+v, want one per email", response.Results)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusBadRequest, http.StatusOK} {
+		if result := response.Results[i]; result.Index != i || result.StatusCode != want {
+			t.Errorf("result %d = %d %d, want index %d with status %d", i, result.Index, result.StatusCode, i, want)
+		}
+	}
+	var third sendResponse
+	if err := json.Unmarshal(response.Results[2].Body, &third); err != nil || len(third.Results) != 2 {
+		t.Errorf("third body = %s, %v, want the /send-email response for its two recipients", response.Results[2].Body, err)
+	}
+
+	// each valid email is sent with its own subject
+	subjects := make(map[string]string)
+	for _, message := range sent.wait(t, 3) {
+		subjects[message.to[0]] = parseMessage(t, message.msg).Header.Get("Subject")
+	}
+	for to, want := range map[string]string{"a@example.com": "First", "b@example.com": "Third", "c@example.com": "Third"} {
+		if subjects[to] != want {
+			t.Errorf("subject to %s = %q, want %q", to, subjects[to], want)
+		}
+	}
+}
+
+func TestSendBatchReturnsOKWhenEveryEmailIsSent(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	batch := `[{"recipients":["a@example.com"],"subject":"Hi","message":"One"},{"recipients":["b@example.com"],"subject":"Hi","message":"Two"}]`
+	if w := record(s.sendBatchHandler, jsonRequest("/send-batch?wait=true", batch)); w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendBatchValidatesTheBatch(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	s.config.maxRecipients = 2
+	for name, test := range map[string]struct {
+		body, want string
+	}{
+		"empty":  {`[]`, "at least one email"},
+		"object": {`{"recipients":["a@example.com"],"subject":"Hi","message":"One"}`, ""},
+		// the limit is across the batch, not per email
+		"too many recipients": {`[{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"One"},{"recipients":["c@example.com"],"subject":"Hi","message":"Two"}]`, "at most 2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := record(s.sendBatchHandler, jsonRequest("/send-batch", test.body))
+			if body := w.Body.String(); !strings.Contains(body, test.want) {
+				t.Errorf("body = %s, want %q", body, test.want)
+			}
+			assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+		})
+	}
+	if messages := sent.all(); len(messages) != 0 {
+		t.Errorf("sent %d messages for rejected batches", len(messages))
+	}
+}
+
+func TestSendBatchCountsEachEmailAgainstTheRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.limiter = newRateLimiter(1, 3, false)
+	batch := func(n int) *http.Request {
+		emails := make([]string, n)
+		for i := range emails {
+			emails[i] = `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","dry_run":true}`
+		}
+		r := jsonRequest("/send-batch", "["+strings.Join(emails, ",")+"]")
+		r.RemoteAddr = "192.0.2.1:4321"
+		return r
+	}
+
+	w := record(s.sendBatchHandler, batch(4))
+	if body := w.Body.String(); !strings.Contains(body, "burst of 3") {
+		t.Errorf("body = %s, want the burst named", body)
+	}
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	// the middleware takes the first token, the handler the rest
+	handler := s.limiter.limit(s.sendBatchHandler)
+	if w := record(handler, batch(3)); w.Code != http.StatusOK {
+		t.Fatalf("batch within the burst: status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	w = record(handler, batch(1))
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After on a rate limited batch")
+	}
+	assertError(t, w, http.StatusTooManyRequests, errCodeRateLimited)
+}
+
+func TestSendBatchOnlyAllowsPost(t *testing.T) {
+	s := newTestServer(t)
+	w := record(s.sendBatchHandler, httptest.NewRequest(http.MethodGet, "/send-batch", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
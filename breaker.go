@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// default consecutive failures that open the circuit and how long it stays
+// open before a probe is let through
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// returned instead of attempting a send while the circuit is open
+var errCircuitOpen = errors.New("SMTP server is unavailable, circuit breaker is open")
+
+// states of a circuit breaker
+const (
+	// sends go through
+	breakerClosed = iota
+	// sends fail fast until the cooldown has passed
+	breakerOpen
+	// a single probe send decides whether to close or reopen
+	breakerHalfOpen
+)
+
+// stops sending to an SMTP server that keeps failing so requests fail fast,
+// letting a single probe through after each cooldown; a nil breaker is
+// always closed
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// report whether a send may be attempted, moving an open circuit whose
+// cooldown has passed to half-open and admitting the caller as its probe
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// the probe is still in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// time until the circuit lets a probe through, zero when sends are allowed
+func (b *circuitBreaker) retryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return max(b.cooldown-b.now().Sub(b.openedAt), 0)
+	case breakerHalfOpen:
+		return b.cooldown
+	default:
+		return 0
+	}
+}
+
+// record the outcome of an attempted send; rejections the server replied
+// with don't count against it, only failures to reach or talk to it do
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || !isServerFailure(err) {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// report whether a send error means the server is unreachable or failing,
+// rather than it permanently rejecting the message or a recipient
+func isServerFailure(err error) bool {
+	return !isPermanent(err)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// a breaker opening after threshold failures, on a clock the test moves
+func newTestBreaker(threshold int) (*circuitBreaker, *time.Time) {
+	now := time.Now()
+	breaker := newCircuitBreaker(threshold, time.Minute)
+	breaker.now = func() time.Time { return now }
+	return breaker, &now
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	breaker, _ := newTestBreaker(3)
+	down := errors.New("connection refused")
+
+	breaker.record(down)
+	breaker.record(down)
+	// a success resets the count
+	breaker.record(nil)
+	breaker.record(down)
+	breaker.record(down)
+	if !breaker.allow() {
+		t.Fatal("breaker opened before 3 consecutive failures")
+	}
+	breaker.record(down)
+	if breaker.allow() {
+		t.Error("breaker still closed after 3 consecutive failures")
+	}
+	if got := breaker.retryAfter(); got != time.Minute {
+		t.Errorf("retryAfter = %s, want the cooldown", got)
+	}
+}
+
+func TestCircuitBreakerIgnoresRejections(t *testing.T) {
+	breaker, _ := newTestBreaker(1)
+	breaker.record(&textproto.Error{Code: 550, Msg: "no such user"})
+	if !breaker.allow() {
+		t.Error("a rejected recipient opened the breaker")
+	}
+}
+
+func TestCircuitBreakerProbesAfterTheCooldown(t *testing.T) {
+	breaker, now := newTestBreaker(1)
+	breaker.record(errors.New("connection refused"))
+
+	*now = now.Add(30 * time.Second)
+	if breaker.allow() || breaker.retryAfter() != 30*time.Second {
+		t.Fatalf("allowed = true or retryAfter = %s during the cooldown", breaker.retryAfter())
+	}
+
+	// a failed probe reopens the circuit for another cooldown
+	*now = now.Add(30 * time.Second)
+	if !breaker.allow() {
+		t.Fatal("no probe let through after the cooldown")
+	}
+	if breaker.allow() {
+		t.Error("a second send let through while the probe is in flight")
+	}
+	breaker.record(errors.New("connection refused"))
+	if breaker.allow() {
+		t.Fatal("breaker closed after a failed probe")
+	}
+
+	// a successful probe closes it
+	*now = now.Add(time.Minute)
+	if !breaker.allow() {
+		t.Fatal("no probe let through after the second cooldown")
+	}
+	breaker.record(nil)
+	if !breaker.allow() || !breaker.allow() || breaker.retryAfter() != 0 {
+		t.Error("breaker still open after a successful probe")
+	}
+}
+
+func TestSendWithRetryFailsFastWhileOpen(t *testing.T) {
+	recordSleeps(t)
+	breaker, now := newTestBreaker(2)
+	attempts := flakySendMail(t, 2)
+	config := emailConfig{breaker: breaker, retry: retryPolicy{maxAttempts: 5}}
+
+	results, err := sendWithRetry(context.Background(), config, "me@example.com", testEnvelopes("a@example.com"))
+	if !errors.Is(err, errCircuitOpen) || *attempts != 2 || results[0].Status != recipientFailed {
+		t.Fatalf("results = %+v, %v after %d attempts, want the breaker to stop the retries after 2", results, err, *attempts)
+	}
+
+	// the server has come back by the time the cooldown has passed
+	*now = now.Add(time.Minute)
+	results, err = sendWithRetry(context.Background(), config, "me@example.com", testEnvelopes("a@example.com"))
+	if err != nil || results[0].Status != recipientSent {
+		t.Errorf("results = %+v, %v, want the probe sent once the server is back", results, err)
+	}
+}
+
+func TestSendRespondsUnavailableWhileOpen(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	breaker, _ := newTestBreaker(1)
+	breaker.record(errors.New("connection refused"))
+	s.config.breaker = breaker
+
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`))
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	assertError(t, w, http.StatusServiceUnavailable, errCodeUnavailable)
+	if got := sent.all(); len(got) != 0 {
+		t.Errorf("%d messages sent, want none", len(got))
+	}
+}
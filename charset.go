@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// charset message bodies are sent in unless a request asks for another
+const defaultCharset = "utf-8"
+
+// charsets message bodies can be sent in, by their MIME names
+var charsets = map[string]encoding.Encoding{
+	"utf-8":        unicode.UTF8,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"iso-8859-2":   charmap.ISO8859_2,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"windows-1252": charmap.Windows1252,
+	"koi8-r":       charmap.KOI8R,
+	"shift_jis":    japanese.ShiftJIS,
+	"euc-jp":       japanese.EUCJP,
+	"iso-2022-jp":  japanese.ISO2022JP,
+	"euc-kr":       korean.EUCKR,
+	"gbk":          simplifiedchinese.GBK,
+	"gb18030":      simplifiedchinese.GB18030,
+	"big5":         traditionalchinese.Big5,
+}
+
+// the charset the request's bodies are sent in
+func (request EmailRequest) charset() string {
+	if request.Charset == "" {
+		return defaultCharset
+	}
+	return request.Charset
+}
+
+// lowercase the request's charset and check it is supported and can
+// represent every character of the message bodies
+func (request *EmailRequest) validateCharset() error {
+	request.Charset = strings.ToLower(strings.TrimSpace(request.Charset))
+	if request.Charset != "" && charsets[request.Charset] == nil {
+		names := make([]string, 0, len(charsets))
+		for name := range charsets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("charset must be one of %s", strings.Join(names, ", "))
+	}
+	return request.checkBodiesEncode()
+}
+
+// check the message bodies can be represented in the request's charset
+func (request EmailRequest) checkBodiesEncode() error {
+	encoder := charsets[request.charset()].NewEncoder()
+	bodies := []struct{ field, body string }{{"message", request.Message}, {"html_message", request.HTMLMessage}}
+	for _, body := range bodies {
+		if _, err := encoder.String(body.body); err != nil {
+			return fmt.Errorf("%s contains characters that can't be represented in charset %s", body.field, request.charset())
+		}
+	}
+	return nil
+}
+
+// content in the charset, with characters it can't represent replaced;
+// bodies have been checked by checkBodiesEncode so none normally are
+func encodeCharset(charset, content string) []byte {
+	encoded, err := encoding.ReplaceUnsupported(charsets[charset].NewEncoder()).String(content)
+	if err != nil {
+		return []byte(content)
+	}
+	return []byte(encoded)
+}
+
+// the media type of a text part in the charset
+func textContentType(mediaType, charset string) string {
+	return mime.FormatMediaType(mediaType, map[string]string{"charset": charset})
+}
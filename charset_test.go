@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// the charset parameter of the content type
+func charsetOf(t *testing.T, contentType string) string {
+	t.Helper()
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("Content-Type %q: %v", contentType, err)
+	}
+	return params["charset"]
+}
+
+func TestFormatMessageDeclaresUTF8ByDefault(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"})
+	if got := charsetOf(t, msg.Header.Get("Content-Type")); got != "utf-8" {
+		t.Errorf("charset = %q, want utf-8", got)
+	}
+}
+
+func TestFormatMessageEncodesBodiesInTheCharset(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Café", Charset: "iso-8859-1"})
+	if got := charsetOf(t, msg.Header.Get("Content-Type")); got != "iso-8859-1" {
+		t.Errorf("charset = %q, want iso-8859-1", got)
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != "Caf\xe9\r\n" {
+		t.Errorf("body = %q, want it in ISO-8859-1", decoded)
+	}
+}
+
+func TestFormatMessageDeclaresTheCharsetOfEachPart(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Grüße", HTMLMessage: "<p>Grüße</p>", Charset: "windows-1252"})
+	parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative")
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want text and HTML", len(parts))
+	}
+	for _, part := range parts {
+		contentType := part.header.Get("Content-Type")
+		if got := charsetOf(t, contentType); got != "windows-1252" {
+			t.Errorf("%s part charset = %q, want windows-1252", contentType, got)
+		}
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(part.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(decoded), "Gr\xfc\xdfe") {
+			t.Errorf("%s part = %q, want it in Windows-1252", contentType, decoded)
+		}
+	}
+}
+
+func TestValidateCharset(t *testing.T) {
+	for name, test := range map[string]struct {
+		request EmailRequest
+		want    string
+	}{
+		"default":             {EmailRequest{Message: "日本"}, ""},
+		"normalized":          {EmailRequest{Message: "Café", Charset: " ISO-8859-1 "}, ""},
+		"japanese":            {EmailRequest{Message: "日本", Charset: "shift_jis"}, ""},
+		"unknown":             {EmailRequest{Message: "Hello", Charset: "ebcdic"}, "charset must be one of"},
+		"text not in latin-1": {EmailRequest{Message: "日本", Charset: "iso-8859-1"}, "message contains characters"},
+		"html not in latin-1": {EmailRequest{Message: "Hello", HTMLMessage: "<p>日本</p>", Charset: "iso-8859-1"}, "html_message contains characters"},
+		"not in koi8-r":       {EmailRequest{Message: "Café", Charset: "koi8-r"}, "charset koi8-r"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := test.request.validateCharset()
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("err = %v, want the charset accepted", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want %q", err, test.want)
+			}
+		})
+	}
+
+	request := EmailRequest{Message: "Café", Charset: " ISO-8859-1 "}
+	request.validateCharset()
+	if request.Charset != "iso-8859-1" {
+		t.Errorf("charset = %q, want it lowercased and trimmed", request.Charset)
+	}
+}
+
+func TestSendRejectsUnsupportedCharsets(t *testing.T) {
+	s := newTestServer(t)
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","charset":"ebcdic"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MongoDB defaults used when the environment doesn't override them
+const (
+	defaultMongoURI        = "mongodb://localhost:27017"
+	defaultMongoDatabase   = "micemail"
+	defaultMongoCollection = "emails"
+	defaultMongoTimeout    = 5 * time.Second
+	// startup waits this long for MongoDB to become reachable
+	defaultMongoConnectAttempts = 10
+	defaultMongoConnectTimeout  = time.Minute
+)
+
+// structure to store MongoDB connection settings
+type mongoConfig struct {
+	uri        string
+	database   string
+	collection string
+	// limit on how long a single database operation may take
+	timeout time.Duration
+	// how reaching MongoDB at startup is retried, giving up after
+	// connectTimeout in total
+	connectRetry   retryPolicy
+	connectTimeout time.Duration
+}
+
+// get MongoDB settings from environment variables, falling back to defaults
+func getMongoConfig() (mongoConfig, error) {
+	config := mongoConfig{
+		uri:        envOrDefault("MONGODB_URI", defaultMongoURI),
+		database:   envOrDefault("MONGODB_DATABASE", defaultMongoDatabase),
+		collection: envOrDefault("MONGODB_COLLECTION", defaultMongoCollection),
+		timeout:    defaultMongoTimeout,
+		connectRetry: retryPolicy{
+			maxAttempts: defaultMongoConnectAttempts,
+			base:        defaultBackoffBase,
+			max:         defaultBackoffMax,
+		},
+		connectTimeout: defaultMongoConnectTimeout,
+	}
+	if err := durationFromEnv("MONGODB_TIMEOUT", &config.timeout); err != nil {
+		return mongoConfig{}, err
+	}
+	if err := intFromEnv("MONGODB_CONNECT_ATTEMPTS", 1, &config.connectRetry.maxAttempts); err != nil {
+		return mongoConfig{}, err
+	}
+	if err := durationFromEnv("MONGODB_CONNECT_TIMEOUT", &config.connectTimeout); err != nil {
+		return mongoConfig{}, err
+	}
+	return config, nil
+}
+
+// address the HTTP server listens on when LISTEN_ADDR and PORT are unset
+const defaultListenAddr = ":8080"
+
+// get the HTTP listen address from LISTEN_ADDR, or PORT as a shorthand
+func getListenAddr() (string, error) {
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = defaultListenAddr
+		if port := os.Getenv("PORT"); port != "" {
+			addr = ":" + port
+		}
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("listen address '%s' is not valid: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("listen address '%s' has an invalid port", addr)
+	}
+	return addr, nil
+}
+
+// attachment content types accepted when ALLOWED_ATTACHMENT_TYPES is unset
+var defaultAllowedAttachmentTypes = []string{"application/pdf", "image/*", "text/plain", "text/csv"}
+
+// default limit on the number of addresses a single request may send to
+const defaultMaxRecipients = 100
+
+// default limit on the size of a request body, large enough for base64
+// encoded attachments at the default attachment limit
+const defaultMaxBodyBytes = 25 << 20
+
+// structure to store email configuration
+type emailConfig struct {
+	senderEmail string
+	senderName  string
+	password    string
+	smtpServer  string
+	smtpPort    string
+	// SMTP login, the sender email address when empty
+	username string
+	// envelope sender bounces are returned to, the sender email address when empty
+	returnPath string
+	// servers tried in order when sending through smtpServer fails
+	fallbacks []smtpEndpoint
+	// signs outgoing messages, nil when DKIM is not configured
+	dkim *dkimConfig
+	// shared by every send through the configured servers, nil when disabled
+	breaker *circuitBreaker
+	// SMTP connections kept open between sends, nil when pooling is disabled
+	pool *smtpPool
+	// limits the rate of messages sent through the configured servers, nil
+	// when unlimited
+	throttle *sendThrottle
+	// delivers messages instead of the SMTP servers when set, see SMTP_MODE
+	sender Sender
+	// one of authModePlain or authModeXOAUTH2
+	authMode   string
+	oauthToken string
+	// one of tlsModeNone, tlsModeStartTLS or tlsModeTLS
+	tlsMode   string
+	tlsConfig *tls.Config
+	// only dial public addresses, for servers given by SMTP overrides
+	publicOnly bool
+	// limit on connecting to the SMTP server and on each step of the
+	// conversation with it; SMTP_TIMEOUT must be positive
+	smtpTimeout time.Duration
+	// limit on the combined decoded size of attachments per request
+	maxAttachmentBytes int64
+	// limit on the number of attachments per request
+	maxAttachments int
+	// attachment content types accepted, "image/*" accepts any image and
+	// "*/*" any type; defaults to defaultAllowedAttachmentTypes
+	allowedAttachmentTypes []string
+	// limit on the combined number of recipients, cc and bcc addresses per request
+	maxRecipients int
+	// limit on the size of a request body and of the message body within it
+	maxBodyBytes int64
+	// accept requests with an empty subject as long as they have a body
+	allowEmptySubject bool
+	// subject and plain text body used when a request has none
+	defaultSubject string
+	defaultBody    string
+	// number of send workers and how many jobs may wait for them
+	queueWorkers int
+	queueSize    int
+	// SMTP connections used at once to send a single job's envelopes
+	sendConcurrency int
+	// send requests handled at once, zero is unlimited
+	maxInFlightSends int
+	// per client IP limit on send requests, zero disables rate limiting
+	rateLimitPerMin int
+	rateLimitBurst  int
+	// use X-Forwarded-For to identify clients behind a proxy
+	trustForwardedFor bool
+	// keys accepted by the API, authentication is disabled when empty
+	apiKeys []string
+	// origins browsers may call the API from, CORS is disabled when empty
+	corsAllowedOrigins []string
+	// how long responses are replayed for a repeated Idempotency-Key
+	idempotencyTTL time.Duration
+	// key used to sign callback payloads, unsigned when empty
+	webhookSecret string
+	// how failed SMTP sends are retried
+	retry retryPolicy
+	// reject recipients whose domain has no MX or address records
+	validateMX bool
+	// check the sender domain's SPF record authorizes the SMTP server at startup
+	checkSPF bool
+	// recipient domains that are refused, nil when blocking is off
+	blockedDomains domainSet
+	// externally reachable base URL of the service, used in unsubscribe and
+	// confirmation links
+	publicURL string
+	// key unsubscribe links are signed with, required with publicURL
+	unsubscribeSecret string
+	// send newly seen recipients a confirmation link in place of the email,
+	// sending only to those who have confirmed
+	requireConfirmation bool
+	// how long deleted recipients can be restored before they are purged
+	recipientRetention time.Duration
+}
+
+// get email configuration from environment variables
+func getEmailConfig() (emailConfig, error) {
+	config := emailConfig{
+		senderEmail: os.Getenv("SENDER_EMAIL"),
+		senderName:  os.Getenv("SENDER_NAME"),
+		password:    os.Getenv("EMAIL_PASSWORD"),
+		authMode:    os.Getenv("SMTP_AUTH"),
+		oauthToken:  os.Getenv("SMTP_OAUTH_TOKEN"),
+		smtpServer:  os.Getenv("SMTP_SERVER"),
+		smtpPort:    os.Getenv("SMTP_PORT"),
+		tlsMode:     os.Getenv("SMTP_TLS_MODE"),
+
+		webhookSecret:     os.Getenv("WEBHOOK_SECRET"),
+		unsubscribeSecret: os.Getenv("UNSUBSCRIBE_SECRET"),
+		smtpTimeout:       defaultSMTPTimeout,
+
+		maxAttachmentBytes: defaultMaxAttachmentBytes,
+		maxAttachments:     defaultMaxAttachments,
+		maxRecipients:      defaultMaxRecipients,
+		maxBodyBytes:       defaultMaxBodyBytes,
+		queueWorkers:       defaultQueueWorkers,
+		queueSize:          defaultQueueSize,
+		sendConcurrency:    defaultSendConcurrency,
+		maxInFlightSends:   defaultMaxInFlightSends,
+		rateLimitPerMin:    defaultRateLimitPerMin,
+		rateLimitBurst:     defaultRateLimitBurst,
+		idempotencyTTL:     defaultIdempotencyTTL,
+		recipientRetention: defaultRecipientRetention,
+		retry: retryPolicy{
+			maxAttempts: defaultMaxAttempts,
+			base:        defaultBackoffBase,
+			max:         defaultBackoffMax,
+		},
+	}
+
+	switch os.Getenv("SMTP_MODE") {
+	case "", smtpModeSMTP:
+	case smtpModeMock:
+		config.sender = &mockSender{}
+	default:
+		return emailConfig{}, fmt.Errorf("SMTP_MODE must be one of smtp or mock")
+	}
+	// the mock sender needs no SMTP server or credentials
+	needSMTP := config.sender == nil
+
+	if config.senderEmail == "" || needSMTP && (config.smtpServer == "" || config.smtpPort == "") {
+		return emailConfig{}, fmt.Errorf("one or more environment variables are not set")
+	}
+
+	switch config.authMode {
+	case "", authModePlain:
+		config.authMode = authModePlain
+		if config.password == "" && needSMTP {
+			return emailConfig{}, fmt.Errorf("EMAIL_PASSWORD is not set")
+		}
+	case authModeXOAUTH2:
+		if config.oauthToken == "" && needSMTP {
+			return emailConfig{}, fmt.Errorf("SMTP_OAUTH_TOKEN is not set")
+		}
+	default:
+		return emailConfig{}, fmt.Errorf("SMTP_AUTH must be one of plain or xoauth2")
+	}
+
+	if !isValidEmail(config.senderEmail) {
+		return emailConfig{}, fmt.Errorf("sender email address is not valid")
+	}
+	if config.returnPath = strings.TrimSpace(os.Getenv("RETURN_PATH")); config.returnPath != "" && !isValidEmail(config.returnPath) {
+		return emailConfig{}, fmt.Errorf("RETURN_PATH is not a valid email address")
+	}
+	// catch a sender the SMTP account isn't allowed to send as before any email bounces
+	if allowed := splitList(os.Getenv("ALLOWED_SENDER_DOMAINS")); len(allowed) > 0 {
+		domains := newDomainSet(allowed)
+		if !domains.contains(emailDomain(config.senderEmail)) {
+			return emailConfig{}, fmt.Errorf("SENDER_EMAIL domain %s is not in ALLOWED_SENDER_DOMAINS", emailDomain(config.senderEmail))
+		}
+		if config.returnPath != "" && !domains.contains(emailDomain(config.returnPath)) {
+			return emailConfig{}, fmt.Errorf("RETURN_PATH domain %s is not in ALLOWED_SENDER_DOMAINS", emailDomain(config.returnPath))
+		}
+	}
+
+	switch config.tlsMode {
+	case "":
+		config.tlsMode = tlsModeStartTLS
+	case tlsModeNone, tlsModeStartTLS, tlsModeTLS:
+	default:
+		return emailConfig{}, fmt.Errorf("SMTP_TLS_MODE must be one of none, starttls or tls")
+	}
+
+	// verify the server certificate against SMTP_TLS_SERVER_NAME, defaulting to the SMTP host
+	serverName := os.Getenv("SMTP_TLS_SERVER_NAME")
+	if serverName == "" {
+		serverName = config.smtpServer
+	}
+	config.tlsConfig = &tls.Config{ServerName: serverName}
+
+	senderName, err := sanitizeHeaderValue(config.senderName)
+	if err != nil {
+		return emailConfig{}, fmt.Errorf("sender name is not valid: %v", err)
+	}
+	config.senderName = senderName
+
+	if err := intFromEnv("MAX_ATTACHMENT_BYTES", 0, &config.maxAttachmentBytes); err != nil {
+		return emailConfig{}, err
+	}
+	if err := intFromEnv("MAX_ATTACHMENTS", 0, &config.maxAttachments); err != nil {
+		return emailConfig{}, err
+	}
+	for _, contentType := range splitList(os.Getenv("ALLOWED_ATTACHMENT_TYPES")) {
+		config.allowedAttachmentTypes = append(config.allowedAttachmentTypes, strings.ToLower(contentType))
+	}
+	if len(config.allowedAttachmentTypes) == 0 {
+		config.allowedAttachmentTypes = defaultAllowedAttachmentTypes
+	}
+	if err := intFromEnv("MAX_BODY_BYTES", 1, &config.maxBodyBytes); err != nil {
+		return emailConfig{}, err
+	}
+	if err := intFromEnv("MAX_RECIPIENTS", 1, &config.maxRecipients); err != nil {
+		return emailConfig{}, err
+	}
+	if err := boolFromEnv("ALLOW_EMPTY_SUBJECT", &config.allowEmptySubject); err != nil {
+		return emailConfig{}, err
+	}
+	if config.defaultSubject, err = sanitizeHeaderValue(os.Getenv("DEFAULT_SUBJECT")); err != nil {
+		return emailConfig{}, fmt.Errorf("DEFAULT_SUBJECT is not valid: %v", err)
+	}
+	// a default subject means no request is sent with an empty one
+	if config.allowEmptySubject && config.defaultSubject != "" {
+		return emailConfig{}, fmt.Errorf("ALLOW_EMPTY_SUBJECT cannot be combined with DEFAULT_SUBJECT")
+	}
+	config.defaultBody = os.Getenv("DEFAULT_BODY")
+	if err := intFromEnv("QUEUE_WORKERS", 1, &config.queueWorkers); err != nil {
+		return emailConfig{}, err
+	}
+	if err := intFromEnv("QUEUE_SIZE", 1, &config.queueSize); err != nil {
+		return emailConfig{}, err
+	}
+	if err := intFromEnv("SEND_CONCURRENCY", 1, &config.sendConcurrency); err != nil {
+		return emailConfig{}, err
+	}
+	if err := intFromEnv("MAX_IN_FLIGHT_SENDS", 0, &config.maxInFlightSends); err != nil {
+		return emailConfig{}, err
+	}
+
+	if err := intFromEnv("RATE_LIMIT_PER_MIN", 0, &config.rateLimitPerMin); err != nil {
+		return emailConfig{}, err
+	}
+	if err := intFromEnv("RATE_LIMIT_BURST", 1, &config.rateLimitBurst); err != nil {
+		return emailConfig{}, err
+	}
+	if err := boolFromEnv("TRUST_FORWARDED_FOR", &config.trustForwardedFor); err != nil {
+		return emailConfig{}, err
+	}
+
+	if config.fallbacks, err = parseSMTPServers(os.Getenv("SMTP_SERVERS")); err != nil {
+		return emailConfig{}, err
+	}
+
+	if path := os.Getenv("DKIM_PRIVATE_KEY_PATH"); path != "" {
+		selector := os.Getenv("DKIM_SELECTOR")
+		if selector == "" {
+			return emailConfig{}, fmt.Errorf("DKIM_SELECTOR must be set with DKIM_PRIVATE_KEY_PATH")
+		}
+		signer, err := loadDKIMKey(path)
+		if err != nil {
+			return emailConfig{}, fmt.Errorf("DKIM_PRIVATE_KEY_PATH could not be loaded: %v", err)
+		}
+		config.dkim = &dkimConfig{
+			domain:   envOrDefault("DKIM_DOMAIN", emailDomain(config.senderEmail)),
+			selector: selector,
+			signer:   signer,
+		}
+	}
+
+	breakerThreshold, breakerCooldown := defaultBreakerThreshold, defaultBreakerCooldown
+	if err := intFromEnv("CIRCUIT_BREAKER_THRESHOLD", 0, &breakerThreshold); err != nil {
+		return emailConfig{}, err
+	}
+	if err := durationFromEnv("CIRCUIT_BREAKER_COOLDOWN", &breakerCooldown); err != nil {
+		return emailConfig{}, err
+	}
+	if breakerThreshold > 0 {
+		config.breaker = newCircuitBreaker(breakerThreshold, breakerCooldown)
+	}
+
+	poolSize, poolIdleTimeout := 0, defaultSMTPPoolIdleTimeout
+	if err := intFromEnv("SMTP_POOL_SIZE", 0, &poolSize); err != nil {
+		return emailConfig{}, err
+	}
+	if err := durationFromEnv("SMTP_POOL_IDLE_TIMEOUT", &poolIdleTimeout); err != nil {
+		return emailConfig{}, err
+	}
+	if poolSize > 0 {
+		config.pool = newSMTPPool(poolSize, poolIdleTimeout)
+	}
+
+	sendRate := 0
+	if err := intFromEnv("SMTP_SEND_RATE", 0, &sendRate); err != nil {
+		return emailConfig{}, err
+	}
+	if sendRate > 0 {
+		config.throttle = newSendThrottle(sendRate)
+	}
+
+	if err := intFromEnv("SMTP_MAX_RETRIES", 1, &config.retry.maxAttempts); err != nil {
+		return emailConfig{}, err
+	}
+	if err := durationFromEnv("SMTP_TIMEOUT", &config.smtpTimeout); err != nil {
+		return emailConfig{}, err
+	}
+	if err := durationFromEnv("SMTP_BACKOFF_BASE", &config.retry.base); err != nil {
+		return emailConfig{}, err
+	}
+	if err := durationFromEnv("SMTP_BACKOFF_MAX", &config.retry.max); err != nil {
+		return emailConfig{}, err
+	}
+	if config.retry.max < config.retry.base {
+		return emailConfig{}, fmt.Errorf("SMTP_BACKOFF_MAX must not be less than SMTP_BACKOFF_BASE")
+	}
+
+	if err := durationFromEnv("IDEMPOTENCY_TTL", &config.idempotencyTTL); err != nil {
+		return emailConfig{}, err
+	}
+	if err := durationFromEnv("RECIPIENT_RETENTION", &config.recipientRetention); err != nil {
+		return emailConfig{}, err
+	}
+
+	if err := boolFromEnv("VALIDATE_MX", &config.validateMX); err != nil {
+		return emailConfig{}, err
+	}
+	if err := boolFromEnv("CHECK_SPF", &config.checkSPF); err != nil {
+		return emailConfig{}, err
+	}
+
+	// a list file replaces the built-in disposable domains and turns blocking on
+	blockDisposable := false
+	if err := boolFromEnv("BLOCK_DISPOSABLE_DOMAINS", &blockDisposable); err != nil {
+		return emailConfig{}, err
+	}
+	if path := os.Getenv("DISPOSABLE_DOMAINS_FILE"); path != "" {
+		if config.blockedDomains, err = loadDomainSet(path); err != nil {
+			return emailConfig{}, fmt.Errorf("DISPOSABLE_DOMAINS_FILE could not be loaded: %v", err)
+		}
+	} else if blockDisposable {
+		config.blockedDomains = newDomainSet(builtinDisposableDomains)
+	}
+
+	if raw := os.Getenv("PUBLIC_URL"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return emailConfig{}, fmt.Errorf("PUBLIC_URL must be an absolute http or https URL")
+		}
+		config.publicURL = strings.TrimSuffix(raw, "/")
+	}
+	// unsigned links would let anyone unsubscribe any address
+	if config.publicURL != "" && config.unsubscribeSecret == "" {
+		return emailConfig{}, fmt.Errorf("PUBLIC_URL needs UNSUBSCRIBE_SECRET to sign unsubscribe links")
+	}
+	if err := boolFromEnv("REQUIRE_CONFIRMATION", &config.requireConfirmation); err != nil {
+		return emailConfig{}, err
+	}
+	if config.requireConfirmation && config.publicURL == "" {
+		return emailConfig{}, fmt.Errorf("REQUIRE_CONFIRMATION needs PUBLIC_URL for the confirmation links")
+	}
+
+	config.apiKeys = splitList(os.Getenv("API_KEYS"))
+	config.corsAllowedOrigins = splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+
+	return config, nil
+}
+
+// value of the named environment variable, or def when unset
+func envOrDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// override value with the integer in the named environment variable, if set
+func intFromEnv[T int | int64](name string, min T, value *T) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || T(n) < min {
+		return fmt.Errorf("%s must be an integer of at least %d", name, min)
+	}
+	*value = T(n)
+	return nil
+}
+
+// override value with the positive duration in the named environment variable, if set
+func durationFromEnv(name string, value *time.Duration) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("%s must be a positive duration such as 5s", name)
+	}
+	*value = d
+	return nil
+}
+
+// override value with the boolean in the named environment variable, if set
+func boolFromEnv(name string, value *bool) error {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false", name)
+	}
+	*value = b
+	return nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// set the environment getEmailConfig needs
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	t.Setenv("SENDER_EMAIL", "me@example.com")
+	t.Setenv("EMAIL_PASSWORD", "secret")
+	t.Setenv("SMTP_SERVER", "smtp.example.com")
+	t.Setenv("SMTP_PORT", "587")
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+func TestMaxAttachmentBytesSetting(t *testing.T) {
+	setConfigEnv(t, nil)
+	if config, err := getEmailConfig(); err != nil || config.maxAttachmentBytes != defaultMaxAttachmentBytes {
+		t.Errorf("limit = %d, %v, want %d by default", config.maxAttachmentBytes, err, defaultMaxAttachmentBytes)
+	}
+	t.Setenv("MAX_ATTACHMENT_BYTES", "1024")
+	if config, err := getEmailConfig(); err != nil || config.maxAttachmentBytes != 1024 {
+		t.Errorf("limit = %d, %v, want MAX_ATTACHMENT_BYTES", config.maxAttachmentBytes, err)
+	}
+	t.Setenv("MAX_ATTACHMENT_BYTES", "-1")
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("negative MAX_ATTACHMENT_BYTES accepted")
+	}
+}
+
+func TestAttachmentLimitSettings(t *testing.T) {
+	setConfigEnv(t, nil)
+	config, err := getEmailConfig()
+	if err != nil || config.maxAttachments != defaultMaxAttachments || !slices.Equal(config.allowedAttachmentTypes, defaultAllowedAttachmentTypes) {
+		t.Errorf("limit = %d, types = %v, %v, want %d and the default types", config.maxAttachments, config.allowedAttachmentTypes, err, defaultMaxAttachments)
+	}
+
+	t.Setenv("MAX_ATTACHMENTS", "3")
+	t.Setenv("ALLOWED_ATTACHMENT_TYPES", "Application/PDF, image/*")
+	config, err = getEmailConfig()
+	if err != nil || config.maxAttachments != 3 || !slices.Equal(config.allowedAttachmentTypes, []string{"application/pdf", "image/*"}) {
+		t.Errorf("limit = %d, types = %v, %v, want MAX_ATTACHMENTS and ALLOWED_ATTACHMENT_TYPES", config.maxAttachments, config.allowedAttachmentTypes, err)
+	}
+
+	t.Setenv("MAX_ATTACHMENTS", "-1")
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("negative MAX_ATTACHMENTS accepted")
+	}
+}
+
+func TestSenderNameRejectsLineBreaks(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SENDER_NAME": "Acme\r\nBcc: victim@example.com"})
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "sender name") {
+		t.Errorf("err = %v, want the sender name rejected", err)
+	}
+}
+
+func TestEmailConfigRequiresSMTPSettings(t *testing.T) {
+	setConfigEnv(t, nil)
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.senderEmail != "me@example.com" || config.smtpServer != "smtp.example.com" || config.smtpPort != "587" {
+		t.Errorf("config = %+v, want the environment's settings", config)
+	}
+
+	for name, value := range map[string]string{
+		"SMTP_SERVER":    "",
+		"SMTP_PORT":      "",
+		"EMAIL_PASSWORD": "",
+		"SENDER_EMAIL":   "not-an-address",
+	} {
+		setConfigEnv(t, map[string]string{name: value})
+		if _, err := getEmailConfig(); err == nil {
+			t.Errorf("%s=%q: config accepted, want an error", name, value)
+		}
+	}
+}
+
+func TestTLSModeSetting(t *testing.T) {
+	setConfigEnv(t, nil)
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.tlsMode != tlsModeStartTLS || config.tlsConfig.ServerName != "smtp.example.com" {
+		t.Errorf("tlsMode = %q, server name = %q, want starttls verified against the SMTP host", config.tlsMode, config.tlsConfig.ServerName)
+	}
+
+	setConfigEnv(t, map[string]string{"SMTP_TLS_MODE": "tls", "SMTP_TLS_SERVER_NAME": "mail.example.com"})
+	config, err = getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.tlsMode != tlsModeTLS || config.tlsConfig.ServerName != "mail.example.com" {
+		t.Errorf("tlsMode = %q, server name = %q, want tls verified against SMTP_TLS_SERVER_NAME", config.tlsMode, config.tlsConfig.ServerName)
+	}
+
+	setConfigEnv(t, map[string]string{"SMTP_TLS_MODE": "ssl"})
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("SMTP_TLS_MODE=ssl accepted, want an error")
+	}
+}
+
+func TestXOAUTH2Setting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_AUTH": "xoauth2", "EMAIL_PASSWORD": ""})
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("xoauth2 accepted without SMTP_OAUTH_TOKEN")
+	}
+	t.Setenv("SMTP_OAUTH_TOKEN", "ya29.token")
+	if config, err := getEmailConfig(); err != nil || config.authMode != authModeXOAUTH2 {
+		t.Errorf("authMode = %q, %v, want xoauth2 without a password", config.authMode, err)
+	}
+
+	setConfigEnv(t, map[string]string{"SMTP_AUTH": "login"})
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("SMTP_AUTH=login accepted, want an error")
+	}
+}
+
+func TestQueueSettings(t *testing.T) {
+	setConfigEnv(t, nil)
+	config, err := getEmailConfig()
+	if err != nil || config.queueWorkers != defaultQueueWorkers || config.queueSize != defaultQueueSize {
+		t.Errorf("workers = %d, size = %d, %v, want the defaults", config.queueWorkers, config.queueSize, err)
+	}
+	t.Setenv("QUEUE_WORKERS", "8")
+	t.Setenv("QUEUE_SIZE", "500")
+	if config, err := getEmailConfig(); err != nil || config.queueWorkers != 8 || config.queueSize != 500 {
+		t.Errorf("workers = %d, size = %d, %v, want 8 and 500", config.queueWorkers, config.queueSize, err)
+	}
+	for _, env := range []map[string]string{
+		{"QUEUE_WORKERS": "0", "QUEUE_SIZE": "1"},
+		{"QUEUE_WORKERS": "1", "QUEUE_SIZE": "0"},
+	} {
+		setConfigEnv(t, env)
+		if _, err := getEmailConfig(); err == nil {
+			t.Errorf("%v accepted, want an error", env)
+		}
+	}
+}
+
+func TestRateLimitSettings(t *testing.T) {
+	setConfigEnv(t, nil)
+	config, err := getEmailConfig()
+	if err != nil || config.rateLimitPerMin != defaultRateLimitPerMin || config.rateLimitBurst != defaultRateLimitBurst || config.trustForwardedFor {
+		t.Errorf("config = %+v, %v, want the default rate limit", config, err)
+	}
+	setConfigEnv(t, map[string]string{"RATE_LIMIT_PER_MIN": "0", "TRUST_FORWARDED_FOR": "true"})
+	if config, err := getEmailConfig(); err != nil || config.rateLimitPerMin != 0 || !config.trustForwardedFor {
+		t.Errorf("config = %+v, %v, want rate limiting off behind a proxy", config, err)
+	}
+	for _, env := range []map[string]string{
+		{"RATE_LIMIT_PER_MIN": "-1"},
+		{"RATE_LIMIT_PER_MIN": "1", "RATE_LIMIT_BURST": "0"},
+		{"RATE_LIMIT_BURST": "1", "TRUST_FORWARDED_FOR": "maybe"},
+	} {
+		setConfigEnv(t, env)
+		if _, err := getEmailConfig(); err == nil {
+			t.Errorf("%v accepted, want an error", env)
+		}
+	}
+}
+
+func TestAPIKeysSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"API_KEYS": " key-one ,, key-two"})
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.apiKeys) != 2 || config.apiKeys[0] != "key-one" || config.apiKeys[1] != "key-two" {
+		t.Errorf("apiKeys = %q, want the trimmed non-empty keys", config.apiKeys)
+	}
+}
+
+func TestMongoConfig(t *testing.T) {
+	t.Setenv("MONGODB_URI", "")
+	t.Setenv("MONGODB_DATABASE", "")
+	t.Setenv("MONGODB_COLLECTION", "")
+	t.Setenv("MONGODB_TIMEOUT", "")
+	config, err := getMongoConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.uri != defaultMongoURI || config.database != defaultMongoDatabase || config.collection != defaultMongoCollection || config.timeout != defaultMongoTimeout {
+		t.Errorf("config = %+v, want the defaults", config)
+	}
+
+	t.Setenv("MONGODB_URI", "mongodb://db.internal:27017/?replicaSet=rs0")
+	t.Setenv("MONGODB_DATABASE", "mail")
+	t.Setenv("MONGODB_COLLECTION", "recipients")
+	t.Setenv("MONGODB_TIMEOUT", "2s")
+	config, err = getMongoConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.uri != "mongodb://db.internal:27017/?replicaSet=rs0" || config.database != "mail" || config.collection != "recipients" || config.timeout != 2*time.Second {
+		t.Errorf("config = %+v, want the environment's settings", config)
+	}
+
+	for _, value := range []string{"0s", "soon"} {
+		t.Setenv("MONGODB_TIMEOUT", value)
+		if _, err := getMongoConfig(); err == nil {
+			t.Errorf("MONGODB_TIMEOUT=%s accepted, want an error", value)
+		}
+	}
+}
+
+func TestMongoConnectRetrySettings(t *testing.T) {
+	t.Setenv("MONGODB_CONNECT_ATTEMPTS", "")
+	t.Setenv("MONGODB_CONNECT_TIMEOUT", "")
+	config, err := getMongoConfig()
+	if err != nil || config.connectRetry.maxAttempts != defaultMongoConnectAttempts || config.connectTimeout != defaultMongoConnectTimeout {
+		t.Errorf("config = %+v, %v, want the default attempts and timeout", config, err)
+	}
+
+	t.Setenv("MONGODB_CONNECT_ATTEMPTS", "3")
+	t.Setenv("MONGODB_CONNECT_TIMEOUT", "45s")
+	config, err = getMongoConfig()
+	if err != nil || config.connectRetry.maxAttempts != 3 || config.connectTimeout != 45*time.Second {
+		t.Errorf("config = %+v, %v, want the environment's attempts and timeout", config, err)
+	}
+
+	t.Setenv("MONGODB_CONNECT_ATTEMPTS", "0")
+	if _, err := getMongoConfig(); err == nil || !strings.Contains(err.Error(), "MONGODB_CONNECT_ATTEMPTS") {
+		t.Errorf("err = %v, want fewer than one attempt rejected", err)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	for env, want := range map[[2]string]string{
+		{"", ""}:               defaultListenAddr,
+		{"", "9000"}:           ":9000",
+		{"127.0.0.1:8081", ""}: "127.0.0.1:8081",
+		// LISTEN_ADDR takes precedence over PORT
+		{"[::1]:8082", "9000"}: "[::1]:8082",
+	} {
+		t.Setenv("LISTEN_ADDR", env[0])
+		t.Setenv("PORT", env[1])
+		if got, err := getListenAddr(); err != nil || got != want {
+			t.Errorf("LISTEN_ADDR=%q PORT=%q: addr = %q, %v, want %q", env[0], env[1], got, err, want)
+		}
+	}
+
+	for _, addr := range []string{"8080", "localhost:http-alt", ":70000"} {
+		t.Setenv("LISTEN_ADDR", addr)
+		if _, err := getListenAddr(); err == nil {
+			t.Errorf("LISTEN_ADDR=%q accepted, want an error", addr)
+		}
+	}
+}
+
+func TestRetrySettings(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_MAX_RETRIES": "5", "SMTP_BACKOFF_BASE": "100ms", "SMTP_BACKOFF_MAX": "2s"})
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (retryPolicy{maxAttempts: 5, base: 100 * time.Millisecond, max: 2 * time.Second}); config.retry != want {
+		t.Errorf("retry = %+v, want %+v", config.retry, want)
+	}
+
+	for name, env := range map[string]map[string]string{
+		"no attempts":    {"SMTP_MAX_RETRIES": "0"},
+		"max below base": {"SMTP_BACKOFF_BASE": "5s", "SMTP_BACKOFF_MAX": "1s"},
+		"not a duration": {"SMTP_BACKOFF_BASE": "soon"},
+		"not an integer": {"SMTP_MAX_RETRIES": "three"},
+	} {
+		setConfigEnv(t, map[string]string{"SMTP_MAX_RETRIES": "", "SMTP_BACKOFF_BASE": "", "SMTP_BACKOFF_MAX": ""})
+		for key, value := range env {
+			t.Setenv(key, value)
+		}
+		if _, err := getEmailConfig(); err == nil {
+			t.Errorf("%s: config accepted, want an error", name)
+		}
+	}
+}
+
+func TestMaxRecipientsSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"MAX_RECIPIENTS": ""})
+	if config, err := getEmailConfig(); err != nil || config.maxRecipients != defaultMaxRecipients {
+		t.Errorf("maxRecipients = %d, %v, want the default %d", config.maxRecipients, err, defaultMaxRecipients)
+	}
+
+	t.Setenv("MAX_RECIPIENTS", "10")
+	if config, err := getEmailConfig(); err != nil || config.maxRecipients != 10 {
+		t.Errorf("maxRecipients = %d, %v, want 10", config.maxRecipients, err)
+	}
+
+	t.Setenv("MAX_RECIPIENTS", "0")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "MAX_RECIPIENTS") {
+		t.Errorf("MAX_RECIPIENTS=0: err = %v, want it rejected", err)
+	}
+}
+
+func TestMaxBodyBytesSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"MAX_BODY_BYTES": ""})
+	if config, err := getEmailConfig(); err != nil || config.maxBodyBytes != defaultMaxBodyBytes {
+		t.Errorf("maxBodyBytes = %d, %v, want the default %d", config.maxBodyBytes, err, defaultMaxBodyBytes)
+	}
+
+	t.Setenv("MAX_BODY_BYTES", "2048")
+	if config, err := getEmailConfig(); err != nil || config.maxBodyBytes != 2048 {
+		t.Errorf("maxBodyBytes = %d, %v, want 2048", config.maxBodyBytes, err)
+	}
+
+	t.Setenv("MAX_BODY_BYTES", "0")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "MAX_BODY_BYTES") {
+		t.Errorf("MAX_BODY_BYTES=0: err = %v, want it rejected", err)
+	}
+}
+
+func TestSMTPServersSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_SERVERS": "backup.example.com:2525"})
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []smtpEndpoint{{server: "backup.example.com", port: "2525"}}; !slices.Equal(config.fallbacks, want) {
+		t.Errorf("fallbacks = %+v, want %+v", config.fallbacks, want)
+	}
+
+	t.Setenv("SMTP_SERVERS", "backup.example.com")
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("entry without a port accepted")
+	}
+}
+
+func TestSendConcurrencySetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SEND_CONCURRENCY": ""})
+	if config, err := getEmailConfig(); err != nil || config.sendConcurrency != defaultSendConcurrency {
+		t.Errorf("sendConcurrency = %d, %v, want the default %d", config.sendConcurrency, err, defaultSendConcurrency)
+	}
+
+	t.Setenv("SEND_CONCURRENCY", "2")
+	if config, err := getEmailConfig(); err != nil || config.sendConcurrency != 2 {
+		t.Errorf("sendConcurrency = %d, %v, want 2", config.sendConcurrency, err)
+	}
+
+	t.Setenv("SEND_CONCURRENCY", "0")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "SEND_CONCURRENCY") {
+		t.Errorf("SEND_CONCURRENCY=0: err = %v, want it rejected", err)
+	}
+}
+
+func TestCircuitBreakerSettings(t *testing.T) {
+	setConfigEnv(t, map[string]string{"CIRCUIT_BREAKER_THRESHOLD": "3", "CIRCUIT_BREAKER_COOLDOWN": "1m"})
+	config, err := getEmailConfig()
+	if err != nil || config.breaker == nil || config.breaker.threshold != 3 || config.breaker.cooldown != time.Minute {
+		t.Errorf("breaker = %+v, %v, want a threshold of 3 and a cooldown of 1m", config.breaker, err)
+	}
+
+	t.Setenv("CIRCUIT_BREAKER_THRESHOLD", "0")
+	if config, err := getEmailConfig(); err != nil || config.breaker != nil {
+		t.Errorf("breaker = %+v, %v, want it disabled", config.breaker, err)
+	}
+}
+
+func TestRecipientRetentionSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"RECIPIENT_RETENTION": ""})
+	if config, err := getEmailConfig(); err != nil || config.recipientRetention != defaultRecipientRetention {
+		t.Errorf("recipientRetention = %s, %v, want the default %s", config.recipientRetention, err, defaultRecipientRetention)
+	}
+
+	t.Setenv("RECIPIENT_RETENTION", "48h")
+	if config, err := getEmailConfig(); err != nil || config.recipientRetention != 48*time.Hour {
+		t.Errorf("recipientRetention = %s, %v, want 48h", config.recipientRetention, err)
+	}
+}
+
+func TestReturnPathSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"RETURN_PATH": ""})
+	if config, err := getEmailConfig(); err != nil || config.envelopeSender() != "me@example.com" {
+		t.Errorf("envelope sender = %s, %v, want the sender email by default", config.envelopeSender(), err)
+	}
+
+	t.Setenv("RETURN_PATH", " bounces@example.com ")
+	if config, err := getEmailConfig(); err != nil || config.envelopeSender() != "bounces@example.com" {
+		t.Errorf("envelope sender = %s, %v, want RETURN_PATH", config.envelopeSender(), err)
+	}
+
+	t.Setenv("RETURN_PATH", "not-an-address")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "RETURN_PATH") {
+		t.Errorf("err = %v, want the invalid RETURN_PATH rejected", err)
+	}
+
+	t.Setenv("RETURN_PATH", "bounces@elsewhere.example")
+	t.Setenv("ALLOWED_SENDER_DOMAINS", "example.com")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "RETURN_PATH") {
+		t.Errorf("err = %v, want a RETURN_PATH outside ALLOWED_SENDER_DOMAINS rejected", err)
+	}
+}
+
+func TestSMTPTimeoutSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_TIMEOUT": ""})
+	if config, err := getEmailConfig(); err != nil || config.smtpTimeout != defaultSMTPTimeout {
+		t.Errorf("smtpTimeout = %s, %v, want the default %s", config.smtpTimeout, err, defaultSMTPTimeout)
+	}
+
+	t.Setenv("SMTP_TIMEOUT", "5s")
+	if config, err := getEmailConfig(); err != nil || config.smtpTimeout != 5*time.Second {
+		t.Errorf("smtpTimeout = %s, %v, want 5s", config.smtpTimeout, err)
+	}
+
+	for _, value := range []string{"soon", "0", "0s", "-5s"} {
+		t.Setenv("SMTP_TIMEOUT", value)
+		if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "SMTP_TIMEOUT") {
+			t.Errorf("SMTP_TIMEOUT=%s: err = %v, want it rejected", value, err)
+		}
+	}
+}
+
+func TestAllowedSenderDomains(t *testing.T) {
+	for allowed, wantAllowed := range map[string]bool{
+		"":                           true,
+		"example.com":                true,
+		"other.example, Example.com": true,
+		"*.mail.example.com":         false,
+		"other.example":              false,
+	} {
+		setConfigEnv(t, map[string]string{"ALLOWED_SENDER_DOMAINS": allowed, "RETURN_PATH": ""})
+		_, err := getEmailConfig()
+		if (err == nil) != wantAllowed {
+			t.Errorf("ALLOWED_SENDER_DOMAINS=%q: err = %v, want allowed %v", allowed, err, wantAllowed)
+		}
+		if err != nil && !strings.Contains(err.Error(), "SENDER_EMAIL domain example.com") {
+			t.Errorf("ALLOWED_SENDER_DOMAINS=%q: err = %v, want the sender's domain named", allowed, err)
+		}
+	}
+
+	// subdomains are allowed by a wildcard entry
+	setConfigEnv(t, map[string]string{"ALLOWED_SENDER_DOMAINS": "*.example.com", "SENDER_EMAIL": "me@mail.example.com"})
+	if _, err := getEmailConfig(); err != nil {
+		t.Errorf("sender at a subdomain: %v", err)
+	}
+}
+
+func TestSMTPPoolSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_POOL_SIZE": "", "SMTP_POOL_IDLE_TIMEOUT": ""})
+	if config, err := getEmailConfig(); err != nil || config.pool != nil {
+		t.Errorf("pool = %+v, %v, want pooling disabled by default", config.pool, err)
+	}
+
+	t.Setenv("SMTP_POOL_SIZE", "4")
+	t.Setenv("SMTP_POOL_IDLE_TIMEOUT", "30s")
+	if config, err := getEmailConfig(); err != nil || config.pool == nil || config.pool.size != 4 || config.pool.idleTimeout != 30*time.Second {
+		t.Errorf("pool = %+v, %v, want SMTP_POOL_SIZE and SMTP_POOL_IDLE_TIMEOUT", config.pool, err)
+	}
+
+	t.Setenv("SMTP_POOL_SIZE", "-1")
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("negative SMTP_POOL_SIZE accepted")
+	}
+}
+
+func TestSendRateSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_SEND_RATE": ""})
+	if config, err := getEmailConfig(); err != nil || config.throttle != nil {
+		t.Errorf("throttle = %v, %v, want none by default", config.throttle, err)
+	}
+
+	t.Setenv("SMTP_SEND_RATE", "20")
+	if config, err := getEmailConfig(); err != nil || config.throttle == nil || config.throttle.interval != 50*time.Millisecond {
+		t.Errorf("throttle = %+v, %v, want one message every 50ms", config.throttle, err)
+	}
+
+	t.Setenv("SMTP_SEND_RATE", "fast")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "SMTP_SEND_RATE") {
+		t.Errorf("err = %v, want the invalid SMTP_SEND_RATE rejected", err)
+	}
+}
+
+func TestMaxInFlightSendsSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"MAX_IN_FLIGHT_SENDS": ""})
+	if config, err := getEmailConfig(); err != nil || config.maxInFlightSends != defaultMaxInFlightSends {
+		t.Errorf("max in-flight sends = %d, %v, want %d by default", config.maxInFlightSends, err, defaultMaxInFlightSends)
+	}
+
+	t.Setenv("MAX_IN_FLIGHT_SENDS", "0")
+	if config, err := getEmailConfig(); err != nil || config.maxInFlightSends != 0 {
+		t.Errorf("max in-flight sends = %d, %v, want 0 to turn the limit off", config.maxInFlightSends, err)
+	}
+
+	t.Setenv("MAX_IN_FLIGHT_SENDS", "-1")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "MAX_IN_FLIGHT_SENDS") {
+		t.Errorf("err = %v, want a negative MAX_IN_FLIGHT_SENDS rejected", err)
+	}
+}
+
+func TestRequireConfirmationSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"REQUIRE_CONFIRMATION": "", "PUBLIC_URL": "", "UNSUBSCRIBE_SECRET": "secret"})
+	if config, err := getEmailConfig(); err != nil || config.requireConfirmation {
+		t.Errorf("requireConfirmation = %v, %v, want it off by default", config.requireConfirmation, err)
+	}
+
+	t.Setenv("REQUIRE_CONFIRMATION", "true")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "PUBLIC_URL") {
+		t.Errorf("err = %v, want PUBLIC_URL required for the links", err)
+	}
+
+	t.Setenv("PUBLIC_URL", "https://mail.example.com")
+	if config, err := getEmailConfig(); err != nil || !config.requireConfirmation {
+		t.Errorf("requireConfirmation = %v, %v, want REQUIRE_CONFIRMATION", config.requireConfirmation, err)
+	}
+}
+
+func TestDefaultSubjectAndBodySettings(t *testing.T) {
+	setConfigEnv(t, map[string]string{"DEFAULT_SUBJECT": "Notification", "DEFAULT_BODY": "You have a new notification."})
+	if config, err := getEmailConfig(); err != nil || config.defaultSubject != "Notification" || config.defaultBody != "You have a new notification." {
+		t.Errorf("defaults = %q %q, %v, want the environment's", config.defaultSubject, config.defaultBody, err)
+	}
+
+	t.Setenv("DEFAULT_SUBJECT", "Hi\r\nBcc: victim@example.com")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "DEFAULT_SUBJECT") {
+		t.Errorf("err = %v, want header injection through DEFAULT_SUBJECT rejected", err)
+	}
+
+	// a default subject and allowing an empty one contradict each other
+	t.Setenv("DEFAULT_SUBJECT", "Notification")
+	t.Setenv("ALLOW_EMPTY_SUBJECT", "true")
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "ALLOW_EMPTY_SUBJECT") {
+		t.Errorf("err = %v, want DEFAULT_SUBJECT with ALLOW_EMPTY_SUBJECT rejected", err)
+	}
+}
+
+func TestPublicURLNeedsUnsubscribeSecret(t *testing.T) {
+	setConfigEnv(t, map[string]string{"PUBLIC_URL": "https://mail.example.com/", "UNSUBSCRIBE_SECRET": ""})
+	if _, err := getEmailConfig(); err == nil || !strings.Contains(err.Error(), "UNSUBSCRIBE_SECRET") {
+		t.Errorf("err = %v, want UNSUBSCRIBE_SECRET required", err)
+	}
+
+	t.Setenv("UNSUBSCRIBE_SECRET", "secret")
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.publicURL != "https://mail.example.com" || config.unsubscribeSecret != "secret" {
+		t.Errorf("publicURL = %q, unsubscribeSecret = %q", config.publicURL, config.unsubscribeSecret)
+	}
+}
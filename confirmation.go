@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// confirmation status of a stored recipient; recipients stored without one
+// predate REQUIRE_CONFIRMATION and count as confirmed
+const (
+	recipientUnconfirmed = "unconfirmed"
+	recipientConfirmed   = "confirmed"
+)
+
+// reported for sends whose recipients were all asked to confirm instead
+const statusUnconfirmed = "unconfirmed"
+
+// returned when no recipient is waiting for the confirmation token
+var errConfirmTokenNotFound = errors.New("confirmation token not found")
+
+// the email newly seen recipients get in place of the one requested, the
+// template rendering the confirm_url variable
+const (
+	confirmationSubject  = "Please confirm your email address"
+	confirmationTemplate = "Please confirm that you want to receive emails at this address by following this link:\n\n{{.confirm_url}}\n\nIf you weren't expecting this email you can ignore it."
+)
+
+// the subset of addresses that are stored and have not been left unconfirmed;
+// deleted recipients keep their confirmation
+func (s mongoEmailStore) confirmed(ctx context.Context, emails []string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	if len(emails) == 0 {
+		return set, nil
+	}
+	cursor, err := s.collection.Find(ctx,
+		bson.M{"email": bson.M{"$in": emails}, "status": bson.M{"$ne": recipientUnconfirmed}},
+		options.Find().SetProjection(bson.M{"email": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var recipient storedRecipient
+		if err := cursor.Decode(&recipient); err != nil {
+			return nil, err
+		}
+		set[recipient.Email] = true
+	}
+	return set, cursor.Err()
+}
+
+// store the addresses that aren't stored yet as unconfirmed, each with a new
+// confirmation token, and issue one to unconfirmed addresses that have none
+// because they were imported. Returns the tokens issued along with the
+// failures
+func (s mongoEmailStore) insertUnconfirmed(ctx context.Context, addresses, tags []string) (map[string]string, []storageError) {
+	tokens := make(map[string]string)
+	if len(addresses) == 0 {
+		return tokens, nil
+	}
+	candidates := make([]string, len(addresses))
+	models := make([]mongo.WriteModel, 0, len(addresses))
+	issue := make([]mongo.WriteModel, 0, len(addresses))
+	for i, address := range addresses {
+		candidates[i] = newUUID()
+		update := bson.M{
+			"$setOnInsert": bson.M{"email": address, "status": recipientUnconfirmed, "confirmToken": candidates[i]},
+		}
+		if len(tags) > 0 {
+			update["$addToSet"] = bson.M{"tags": bson.M{"$each": tags}}
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"email": address}).
+			SetUpdate(update).
+			SetUpsert(true))
+		issue = append(issue, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"email": address, "status": recipientUnconfirmed, "confirmToken": bson.M{"$exists": false}, "deletedAt": bson.M{"$exists": false}}).
+			SetUpdate(bson.M{"$set": bson.M{"confirmToken": candidates[i]}}))
+	}
+	_, err := s.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	failures := storageErrors(addresses, err)
+	if _, err := s.collection.BulkWrite(ctx, issue, options.BulkWrite().SetOrdered(false)); err != nil && len(failures) == 0 {
+		failures = storageErrors(addresses, err)
+	}
+
+	// the candidates that were stored are the tokens issued
+	cursor, err := s.collection.Find(ctx,
+		bson.M{"confirmToken": bson.M{"$in": candidates}},
+		options.Find().SetProjection(bson.M{"email": 1, "confirmToken": 1}))
+	if err != nil {
+		return tokens, storageErrors(addresses, err)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var issued struct {
+			Email        string `bson:"email"`
+			ConfirmToken string `bson:"confirmToken"`
+		}
+		if err := cursor.Decode(&issued); err != nil {
+			return tokens, storageErrors(addresses, err)
+		}
+		tokens[issued.Email] = issued.ConfirmToken
+	}
+	if err := cursor.Err(); err != nil {
+		return tokens, storageErrors(addresses, err)
+	}
+	return tokens, failures
+}
+
+// mark the recipient waiting for the token confirmed, returning its address
+func (s mongoEmailStore) confirm(ctx context.Context, token string) (string, error) {
+	var recipient storedRecipient
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"confirmToken": token},
+		bson.M{"$set": bson.M{"status": recipientConfirmed, "confirmedAt": time.Now()}, "$unset": bson.M{"confirmToken": ""}},
+	).Decode(&recipient)
+	if err == mongo.ErrNoDocuments {
+		return "", errConfirmTokenNotFound
+	}
+	return recipient.Email, err
+}
+
+// remove the addresses that haven't confirmed from the request when
+// confirmation is required, returning the ones removed
+func (s *server) removeUnconfirmed(ctx context.Context, request *EmailRequest) ([]string, error) {
+	if !s.config.requireConfirmation {
+		return nil, nil
+	}
+	addresses := request.allAddresses()
+	confirmed, err := s.emails.confirmed(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+	unconfirmed := make(map[string]bool)
+	for _, address := range addresses {
+		unconfirmed[address] = !confirmed[address]
+	}
+	return request.removeSuppressed(unconfirmed), nil
+}
+
+// store the unconfirmed addresses and send the newly seen ones, and imported
+// ones yet to get a link, a link to confirm with; addresses already waiting
+// got their link when first sent to. Failures are logged rather than failing
+// the send they came with
+func (s *server) requestConfirmation(ctx context.Context, unconfirmed, tags []string) {
+	if len(unconfirmed) == 0 {
+		return
+	}
+	tokens, storageErrs := s.emails.insertUnconfirmed(ctx, unconfirmed, tags)
+	if len(storageErrs) > 0 {
+		loggerFrom(ctx).Error("Could not store unconfirmed recipients", "failed", len(storageErrs), "error", storageErrs[0].Error)
+	}
+	if len(tokens) == 0 {
+		return
+	}
+
+	// a single job rendering each recipient's own link
+	request := EmailRequest{
+		Subject:   confirmationSubject,
+		Template:  confirmationTemplate,
+		Variables: make(map[string]map[string]string),
+	}
+	for _, address := range unconfirmed {
+		if token, ok := tokens[address]; ok {
+			request.Recipients = append(request.Recipients, address)
+			request.Variables[address] = map[string]string{"confirm_url": confirmURL(s.config, token)}
+		}
+	}
+	if _, err := s.queue.submit(ctx, job{request: request}); err != nil {
+		loggerFrom(ctx).Error("Could not queue confirmation email", "recipients", len(request.Recipients), "error", err)
+	}
+}
+
+// link recipients follow to confirm their address
+func confirmURL(config emailConfig, token string) string {
+	return config.publicURL + "/confirm?token=" + url.QueryEscape(token)
+}
+
+// handles confirmation links, marking the recipient waiting for the token
+// confirmed so it receives subsequent sends
+func (s *server) confirmHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "token query parameter is required")
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	email, err := s.emails.confirm(ctx, token)
+	if err == errConfirmTokenNotFound {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Confirmation link is invalid or has already been used")
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": recipientConfirmed, "email": email})
+}
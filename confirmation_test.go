@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// a test server requiring confirmation, with a confirmed recipient
+func newConfirmingServer(t *testing.T) (*server, *memEmailStore) {
+	t.Helper()
+	s := newTestServer(t)
+	s.config.requireConfirmation = true
+	s.config.publicURL = "https://mail.example.com"
+	store := newMemEmailStore("confirmed@example.com")
+	s.emails = store
+	return s, store
+}
+
+// the decoded text of a single part message
+func messageText(t *testing.T, msg []byte) string {
+	t.Helper()
+	parsed := parseMessage(t, msg)
+	body := io.Reader(parsed.Body)
+	if parsed.Header.Get("Content-Transfer-Encoding") == "quoted-printable" {
+		body = quotedprintable.NewReader(body)
+	}
+	text, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(text)
+}
+
+func TestSendAsksNewRecipientsToConfirm(t *testing.T) {
+	sent := recordSends(t)
+	s, store := newConfirmingServer(t)
+
+	w := sendRequest(t, s, `{"recipients":["confirmed@example.com","new@example.com"],"subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if !slices.Equal(response.Unconfirmed, []string{"new@example.com"}) {
+		t.Errorf("unconfirmed = %v, want new@example.com", response.Unconfirmed)
+	}
+
+	// the new recipient gets a link to confirm with instead of the email
+	subjects := make(map[string]string)
+	var confirmation []byte
+	for _, message := range sent.wait(t, 2) {
+		subjects[message.to[0]] = parseMessage(t, message.msg).Header.Get("Subject")
+		if message.to[0] == "new@example.com" {
+			confirmation = message.msg
+		}
+	}
+	if subjects["confirmed@example.com"] != "Hi" || subjects["new@example.com"] != confirmationSubject {
+		t.Fatalf("subjects = %v, want the email to the confirmed recipient alone", subjects)
+	}
+	token := store.find("new@example.com").confirmToken
+	if link := confirmURL(s.config, token); token == "" || !strings.Contains(messageText(t, confirmation), link) {
+		t.Errorf("confirmation = %s, want the link %s", messageText(t, confirmation), link)
+	}
+
+	// confirming the link lets later sends through
+	w = record(s.confirmHandler, httptest.NewRequest(http.MethodGet, "/confirm?token="+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if confirmed, _ := store.confirmed(context.Background(), []string{"new@example.com"}); !confirmed["new@example.com"] {
+		t.Error("new@example.com not confirmed by its link")
+	}
+	if w := sendRequest(t, s, `{"recipients":["new@example.com"],"subject":"Again","message":"Hello"}`); w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want the confirmed recipient sent to: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendToUnconfirmedRecipientsOnly(t *testing.T) {
+	sent := recordSends(t)
+	s, _ := newConfirmingServer(t)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		w := sendRequest(t, s, `{"recipients":["new@example.com"],"subject":"Hi","message":"Hello"}`)
+		var response struct {
+			Status      string   `json:"status"`
+			Unconfirmed []string `json:"unconfirmed"`
+		}
+		decodeBody(t, w, &response)
+		if w.Code != http.StatusOK || response.Status != statusUnconfirmed || len(response.Unconfirmed) != 1 {
+			t.Errorf("attempt %d: status = %d, body = %+v, want the recipient reported unconfirmed", attempt, w.Code, response)
+		}
+	}
+	// the link is only sent when the address is first seen
+	if n := queuedJobs(s); n != 1 {
+		t.Errorf("queued %d jobs, want a single confirmation", n)
+	}
+	if messages := sent.wait(t, 1); parseMessage(t, messages[0].msg).Header.Get("Subject") != confirmationSubject {
+		t.Errorf("sent %q, want the confirmation", parseMessage(t, messages[0].msg).Header.Get("Subject"))
+	}
+}
+
+func TestRefusedSendAsksNobodyToConfirm(t *testing.T) {
+	s, store := newConfirmingServer(t)
+	jobs := newMemJobStore()
+	s.queue = newIdleQueue(jobs, 0)
+
+	w := sendRequest(t, s, `{"recipients":["confirmed@example.com","new@example.com"],"subject":"Hi","message":"Hello"}`)
+	assertError(t, w, http.StatusServiceUnavailable, errCodeUnavailable)
+	// the refused send is recorded as failed, and no confirmation job is queued
+	if len(jobs.jobs) != 1 || jobs.count(jobFailed) != 1 {
+		t.Errorf("got %d jobs, %d failed, want the refused send alone", len(jobs.jobs), jobs.count(jobFailed))
+	}
+	if recipient := store.find("new@example.com"); recipient != nil && recipient.confirmToken != "" {
+		t.Error("new@example.com issued a confirmation token for a refused send")
+	}
+}
+
+func TestImportedRecipientsConfirmBeforeBeingSentTo(t *testing.T) {
+	sent := recordSends(t)
+	s, store := newConfirmingServer(t)
+
+	w := record(s.importEmailsHandler, importRequest("application/json", `["a@example.com"]`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("import status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if messages := sent.all(); len(messages) != 0 {
+		t.Error("importing sent a confirmation email")
+	}
+
+	w = sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"News","message":"Hello"}`)
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if response.Status != statusUnconfirmed {
+		t.Fatalf("imported address sent to without confirming: %+v", response)
+	}
+	messages := sent.wait(t, 1)
+	if parseMessage(t, messages[0].msg).Header.Get("Subject") != confirmationSubject {
+		t.Fatalf("first message isn't the confirmation email:\n%s", messages[0].msg)
+	}
+
+	token := store.find("a@example.com").confirmToken
+	w = record(s.confirmHandler, httptest.NewRequest(http.MethodGet, "/confirm?token="+token, nil))
+	if token == "" || w.Code != http.StatusOK {
+		t.Fatalf("confirm status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if confirmed, _ := store.confirmed(context.Background(), []string{"a@example.com"}); !confirmed["a@example.com"] {
+		t.Error("imported address not confirmed by its link")
+	}
+}
+
+func TestConfirmRejectsBadRequests(t *testing.T) {
+	s, store := newConfirmingServer(t)
+	tokens, _ := store.insertUnconfirmed(context.Background(), []string{"new@example.com"}, nil)
+	confirm := func(token string) *httptest.ResponseRecorder {
+		return record(s.confirmHandler, httptest.NewRequest(http.MethodGet, "/confirm?token="+token, nil))
+	}
+
+	if w := confirm(tokens["new@example.com"]); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	// a link can only be used once
+	assertError(t, confirm(tokens["new@example.com"]), http.StatusNotFound, errCodeNotFound)
+	assertError(t, confirm("unknown"), http.StatusNotFound, errCodeNotFound)
+	assertError(t, confirm(""), http.StatusBadRequest, errCodeInvalidRequest)
+
+	w := record(s.confirmHandler, httptest.NewRequest(http.MethodPost, "/confirm?token=unknown", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestMongoEmailStoreInsertUnconfirmedTokensNewAddresses(t *testing.T) {
+	withMockMongo(t, func(mt *mtest.T) {
+		// only the second address was inserted, the first is already stored
+		// and confirmed, so the token lookup finds the second alone
+		namespace := mt.Coll.Database().Name() + "." + mt.Coll.Name()
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(
+				bson.E{Key: "n", Value: 2},
+				bson.E{Key: "upserted", Value: bson.A{bson.D{{Key: "index", Value: 1}, {Key: "_id", Value: "id-1"}}}},
+			),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}),
+			mtest.CreateCursorResponse(0, namespace, mtest.FirstBatch, bson.D{{Key: "email", Value: "new@example.com"}, {Key: "confirmToken", Value: "token-1"}}),
+		)
+		tokens, failures := mongoEmailStore{collection: mt.Coll}.insertUnconfirmed(context.Background(), []string{"old@example.com", "new@example.com"}, nil)
+		if len(failures) != 0 || len(tokens) != 1 || tokens["new@example.com"] != "token-1" {
+			t.Fatalf("tokens = %v, failures = %+v, want a token for new@example.com alone", tokens, failures)
+		}
+
+		upsert := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(1).Value().Document()
+		candidate := upsert.Lookup("u", "$setOnInsert", "confirmToken").StringValue()
+		if status := upsert.Lookup("u", "$setOnInsert", "status").StringValue(); status != recipientUnconfirmed || candidate == "" {
+			t.Errorf("inserted status %q with token %q, want unconfirmed with a token", status, candidate)
+		}
+		// imported addresses still unconfirmed and without a token are issued one
+		issue := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(1).Value().Document()
+		if _, err := issue.LookupErr("q", "confirmToken", "$exists"); err != nil || issue.Lookup("u", "$set", "confirmToken").StringValue() != candidate {
+			t.Errorf("issue update = %s, want the candidate token set where there is none", issue)
+		}
+		lookup := mt.GetStartedEvent().Command.Lookup("filter", "confirmToken", "$in").Array()
+		if values, _ := lookup.Values(); len(values) != 2 || values[1].StringValue() != candidate {
+			t.Errorf("token lookup = %s, want the candidates", lookup)
+		}
+	})
+}
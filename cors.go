@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// methods and request headers browsers may use in cross-origin requests
+const (
+	corsAllowedMethods = "GET, POST, PATCH, DELETE, OPTIONS"
+	corsAllowedHeaders = "Authorization, Content-Encoding, Content-Type, Idempotency-Key, X-API-Key"
+)
+
+// allows browser clients on the configured origins to call the API
+type cors struct {
+	// allowed origins, "*" allows any origin
+	origins []string
+}
+
+// report whether cross-origin requests from the origin are allowed
+func (c *cors) allowed(origin string) bool {
+	return slices.Contains(c.origins, "*") || slices.Contains(c.origins, origin)
+}
+
+// wrap a handler to add CORS headers for allowed origins and answer their
+// preflight requests; requests from other origins get no CORS headers, so
+// browsers block them
+func (c *cors) handle(next http.Handler) http.Handler {
+	if len(c.origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !c.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, Idempotent-Replayed")
+
+		// a preflight asks which method and headers the real request may use
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parse a comma separated list, dropping blank entries
+func splitList(raw string) []string {
+	var values []string
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
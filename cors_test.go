@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// a handler counting the requests that reach it
+func countingHandler(calls *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestCORSPreflight(t *testing.T) {
+	var calls int
+	handler := (&cors{origins: []string{"https://app.example.com"}}).handle(countingHandler(&calls))
+	r := httptest.NewRequest(http.MethodOptions, "/send-email", nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusNoContent || calls != 0 {
+		t.Fatalf("status = %d, handler calls = %d, want a 204 answered by the middleware", w.Code, calls)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://app.example.com",
+		"Access-Control-Allow-Methods": corsAllowedMethods,
+		"Access-Control-Allow-Headers": corsAllowedHeaders,
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	for name, test := range map[string]struct {
+		origins    []string
+		origin     string
+		wantHeader string
+	}{
+		"allowed":     {[]string{"https://app.example.com"}, "https://app.example.com", "https://app.example.com"},
+		"disallowed":  {[]string{"https://app.example.com"}, "https://evil.example.com", ""},
+		"wildcard":    {[]string{"*"}, "https://any.example.com", "https://any.example.com"},
+		"no origin":   {[]string{"*"}, "", ""},
+		"not enabled": {nil, "https://app.example.com", ""},
+	} {
+		var calls int
+		r := httptest.NewRequest(http.MethodPost, "/send-email", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		(&cors{origins: test.origins}).handle(countingHandler(&calls)).ServeHTTP(w, r)
+
+		if calls != 1 {
+			t.Errorf("%s: handler called %d times, want once", name, calls)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.wantHeader {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", name, got, test.wantHeader)
+		}
+	}
+}
+
+func TestCORSAllowedOriginsSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"CORS_ALLOWED_ORIGINS": " https://a.example.com, ,https://b.example.com"})
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(config.corsAllowedOrigins, []string{"https://a.example.com", "https://b.example.com"}) {
+		t.Errorf("corsAllowedOrigins = %v", config.corsAllowedOrigins)
+	}
+}
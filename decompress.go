@@ -0,0 +1,30 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// limit the request body to maxBodyBytes, transparently decompressing a gzip
+// body so the limit applies to its decompressed size and a small compressed
+// body can't expand without bound; reports whether an error response has
+// been written instead
+func (s *server) limitRequestBody(w http.ResponseWriter, r *http.Request) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.maxBodyBytes)
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return true
+	case "gzip", "x-gzip":
+		decompressed, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "Request body is not valid gzip")
+			return false
+		}
+		r.Body = http.MaxBytesReader(w, decompressed, s.config.maxBodyBytes)
+		return true
+	default:
+		writeJSONError(w, http.StatusUnsupportedMediaType, errCodeMediaType, "Content-Encoding must be gzip")
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// the body gzipped
+func gzipped(t *testing.T, body string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// a JSON send request with the encoded body
+func encodedRequest(encoding string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/send-email?dry_run=true", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", encoding)
+	return r
+}
+
+func TestSendAcceptsGzipBodies(t *testing.T) {
+	s := newTestServer(t)
+	body := gzipped(t, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)
+	for _, encoding := range []string{"gzip", "x-gzip", " GZIP "} {
+		if w := record(s.sendEmailHandler, encodedRequest(encoding, body)); w.Code != http.StatusOK {
+			t.Errorf("Content-Encoding %q: status = %d, want 200: %s", encoding, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSendLimitsTheDecompressedSize(t *testing.T) {
+	s := newTestServer(t)
+	s.config.maxBodyBytes = 1024
+	// compresses to well under the limit
+	body := gzipped(t, `{"recipients":["a@example.com"],"subject":"Hi","message":"`+strings.Repeat("a", 64<<10)+`"}`)
+	if len(body) >= 1024 {
+		t.Fatalf("compressed body is %d bytes, want it under the limit", len(body))
+	}
+	assertError(t, record(s.sendEmailHandler, encodedRequest("gzip", body)), http.StatusRequestEntityTooLarge, errCodeTooLarge)
+}
+
+func TestSendRejectsBadEncodings(t *testing.T) {
+	s := newTestServer(t)
+	assertError(t, record(s.sendEmailHandler, encodedRequest("gzip", []byte(`{"recipients":[]}`))), http.StatusBadRequest, errCodeInvalidRequest)
+	assertError(t, record(s.sendEmailHandler, encodedRequest("br", []byte(`{}`))), http.StatusUnsupportedMediaType, errCodeMediaType)
+}
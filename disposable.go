@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// commonly used throwaway email domains, blocked when no list file is configured
+var builtinDisposableDomains = []string{
+	"10minutemail.com",
+	"discard.email",
+	"dispostable.com",
+	"fakeinbox.com",
+	"getnada.com",
+	"guerrillamail.com",
+	"maildrop.cc",
+	"mailinator.com",
+	"mailnesia.com",
+	"mintemail.com",
+	"sharklasers.com",
+	"temp-mail.org",
+	"tempmail.com",
+	"throwawaymail.com",
+	"trashmail.com",
+	"yopmail.com",
+}
+
+// set of domains, "*.example.com" entries match every subdomain of example.com
+type domainSet map[string]bool
+
+func newDomainSet(domains []string) domainSet {
+	set := make(domainSet, len(domains))
+	for _, domain := range domains {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			set[domain] = true
+		}
+	}
+	return set
+}
+
+// read a domain list with one domain per line, blank lines and # comments are ignored
+func loadDomainSet(path string) (domainSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		domains = append(domains, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	return newDomainSet(domains), nil
+}
+
+// report whether the domain is listed exactly or falls under a wildcard entry
+func (s domainSet) contains(domain string) bool {
+	domain = strings.ToLower(domain)
+	if s[domain] {
+		return true
+	}
+	for i := strings.Index(domain, "."); i >= 0; i = strings.Index(domain, ".") {
+		domain = domain[i+1:]
+		if s["*."+domain] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainSetContains(t *testing.T) {
+	set := newDomainSet([]string{"Mailinator.com", " *.throwaway.example ", ""})
+	for domain, want := range map[string]bool{
+		"mailinator.com":        true,
+		"MAILINATOR.COM":        true,
+		"sub.mailinator.com":    false,
+		"throwaway.example":     false,
+		"a.throwaway.example":   true,
+		"a.b.throwaway.example": true,
+		"notthrowaway.example":  false,
+		"example.com":           false,
+	} {
+		if got := set.contains(domain); got != want {
+			t.Errorf("contains(%s) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestLoadDomainSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(path, []byte("# throwaway providers\nfirst.example\n\n  second.example # trailing comment\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	set, err := loadDomainSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 2 || !set.contains("first.example") || !set.contains("second.example") {
+		t.Errorf("set = %v, want the two listed domains", set)
+	}
+
+	if _, err := loadDomainSet(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestDisposableDomainSettings(t *testing.T) {
+	setConfigEnv(t, map[string]string{"BLOCK_DISPOSABLE_DOMAINS": "", "DISPOSABLE_DOMAINS_FILE": ""})
+	if config, err := getEmailConfig(); err != nil || config.blockedDomains != nil {
+		t.Errorf("blockedDomains = %v, %v, want blocking off by default", config.blockedDomains, err)
+	}
+
+	t.Setenv("BLOCK_DISPOSABLE_DOMAINS", "true")
+	if config, err := getEmailConfig(); err != nil || !config.blockedDomains.contains("mailinator.com") {
+		t.Errorf("blockedDomains = %v, %v, want the built-in list", config.blockedDomains, err)
+	}
+
+	// a list file replaces the built-in list
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	os.WriteFile(path, []byte("only.example\n"), 0o600)
+	t.Setenv("DISPOSABLE_DOMAINS_FILE", path)
+	if config, err := getEmailConfig(); err != nil || config.blockedDomains.contains("mailinator.com") || !config.blockedDomains.contains("only.example") {
+		t.Errorf("blockedDomains = %v, %v, want the file's list alone", config.blockedDomains, err)
+	}
+}
+
+func TestSendRejectsDisposableDomains(t *testing.T) {
+	s := newTestServer(t)
+	s.config.blockedDomains = newDomainSet(builtinDisposableDomains)
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"bcc":["someone@Mailinator.com"],"subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
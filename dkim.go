@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// key and identity used to DKIM sign outgoing messages
+type dkimConfig struct {
+	domain   string
+	selector string
+	signer   crypto.Signer
+}
+
+// read a PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) private key
+func loadDKIMKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not contain an RSA or Ed25519 private key", path)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA or Ed25519 private key", path)
+	}
+	return signer, nil
+}
+
+// prepend a DKIM-Signature header to the message using relaxed/relaxed
+// canonicalization, which survives the whitespace changes relays commonly make
+func (d *dkimConfig) sign(msg []byte) ([]byte, error) {
+	options := &dkim.SignOptions{
+		Domain:                 d.domain,
+		Selector:               d.selector,
+		Signer:                 d.signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+	}
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(msg), options); err != nil {
+		return nil, err
+	}
+	return signed.Bytes(), nil
+}
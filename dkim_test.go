@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// verify the message's DKIM signatures against the public key, published as
+// if in DNS for the selector at example.com
+func verifyDKIM(t *testing.T, msg []byte, public any) []*dkim.Verification {
+	t.Helper()
+	// Ed25519 records carry the raw key, RSA ones the DER encoded key
+	var record string
+	if key, ok := public.(ed25519.PublicKey); ok {
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key)
+	} else {
+		der, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "mail._domainkey.example.com" {
+				t.Errorf("looked up %s, want the selector's record", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifications
+}
+
+func TestDKIMSignedMessagesVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		signer *dkimConfig
+		public any
+	}{
+		"rsa":     {&dkimConfig{domain: "example.com", selector: "mail", signer: rsaKey}, &rsaKey.PublicKey},
+		"ed25519": {&dkimConfig{domain: "example.com", selector: "mail", signer: edKey}, edPublic},
+	} {
+		config := emailConfig{senderEmail: "me@example.com", dkim: test.signer}
+		envelopes, err := buildEnvelopes(config, EmailRequest{Recipients: []string{"a@example.com"}, Subject: "Hi", Message: "Hello", HTMLMessage: "<p>Hello</p>"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := envelopes[0].msg
+		if !bytes.HasPrefix(msg, []byte("DKIM-Signature: ")) {
+			t.Fatalf("%s: message doesn't start with a DKIM-Signature header:\n%s", name, msg)
+		}
+
+		verifications := verifyDKIM(t, msg, test.public)
+		if len(verifications) != 1 || verifications[0].Err != nil || verifications[0].Domain != "example.com" {
+			t.Errorf("%s: verifications = %+v, want one valid signature for example.com", name, verifications[0])
+		}
+
+		// a relay altering the body breaks the signature
+		tampered := bytes.Replace(msg, []byte("Hello"), []byte("Goodbye"), 1)
+		if verifications := verifyDKIM(t, tampered, test.public); len(verifications) != 1 || verifications[0].Err == nil {
+			t.Errorf("%s: tampered message verified", name)
+		}
+	}
+}
+
+func TestLoadDKIMKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for name, path := range map[string]string{
+		"pkcs1":         write("rsa.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})),
+		"pkcs8 ed25519": write("ed25519.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+	} {
+		if _, err := loadDKIMKey(path); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	for name, path := range map[string]string{
+		"missing":   filepath.Join(dir, "missing.pem"),
+		"not pem":   write("key.txt", []byte("not a key")),
+		"not a key": write("garbage.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")})),
+	} {
+		if _, err := loadDKIMKey(path); err == nil {
+			t.Errorf("%s: key loaded", name)
+		}
+	}
+}
+
+func TestDKIMSettings(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0o600)
+
+	setConfigEnv(t, map[string]string{"DKIM_PRIVATE_KEY_PATH": path, "DKIM_SELECTOR": "", "DKIM_DOMAIN": ""})
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("DKIM key accepted without a selector")
+	}
+
+	t.Setenv("DKIM_SELECTOR", "mail")
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.dkim == nil || config.dkim.domain != "example.com" || config.dkim.selector != "mail" {
+		t.Errorf("dkim = %+v, want the sender's domain and the selector", config.dkim)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// returned when a stored recipient is not known
+var errEmailNotFound = errors.New("email not found")
+
+// a stored recipient address
+type storedRecipient struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty" json:"_id"`
+	Email string             `bson:"email" json:"email"`
+	Tags  []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+	// unconfirmed or confirmed when REQUIRE_CONFIRMATION is on
+	Status string `bson:"status,omitempty" json:"status,omitempty"`
+}
+
+// an address that could not be stored
+type storageError struct {
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
+
+// selects stored recipients, the zero value matching every one that hasn't
+// been deleted
+type recipientFilter struct {
+	// addresses at this domain
+	domain string
+	// addresses containing this text
+	contains string
+	// recipients carrying this tag
+	tag string
+}
+
+// filter for the domain, contains and tag query parameters
+func emailsFilter(query url.Values) recipientFilter {
+	return recipientFilter{
+		domain:   normalizeEmail(query.Get("domain")),
+		contains: normalizeEmail(query.Get("contains")),
+		tag:      strings.TrimSpace(query.Get("tag")),
+	}
+}
+
+// persistence for stored recipients; deleted recipients are kept until they
+// are purged but are otherwise treated as absent
+type emailStore interface {
+	// report whether the address is stored
+	exists(ctx context.Context, email string) (bool, error)
+	// store the addresses that aren't stored yet and add tags to all of them,
+	// leaving deleted ones deleted, and return how many are stored along with
+	// the failures
+	insert(ctx context.Context, addresses, tags []string) (int, []storageError)
+	list(ctx context.Context, filter recipientFilter, p page) ([]storedRecipient, error)
+	count(ctx context.Context, filter recipientFilter) (int64, error)
+	// call fn with each matching recipient in turn, stopping at the first error
+	each(ctx context.Context, filter recipientFilter, fn func(storedRecipient) error) error
+	// mark the address deleted so it can be restored until it is purged
+	delete(ctx context.Context, email string) error
+	restore(ctx context.Context, email string) error
+	// replace the tags of the address, returning the updated recipient
+	setTags(ctx context.Context, email string, tags []string) (storedRecipient, error)
+	// permanently remove recipients deleted before cutoff, returning how many were
+	purge(ctx context.Context, cutoff time.Time) (int64, error)
+	// the subset of addresses that are stored as confirmed
+	confirmed(ctx context.Context, emails []string) (map[string]bool, error)
+	// store the new addresses as unconfirmed, without sending them a link
+	importUnconfirmed(ctx context.Context, addresses, tags []string) (int, []storageError)
+	// store the new addresses as unconfirmed, returning the confirmation
+	// tokens issued to them and to unconfirmed addresses that had none, along
+	// with the failures
+	insertUnconfirmed(ctx context.Context, addresses, tags []string) (map[string]string, []storageError)
+	// confirm the recipient the token was issued to, returning its address
+	confirm(ctx context.Context, token string) (string, error)
+}
+
+// emailStore backed by a MongoDB collection with a unique index on email
+type mongoEmailStore struct {
+	collection *mongo.Collection
+}
+
+// matches stored recipients that have not been deleted
+var notDeleted = bson.M{"deletedAt": bson.M{"$exists": false}}
+
+// query matching the filter; the domain and contains values are escaped so
+// they are matched literally rather than as regular expressions
+func (f recipientFilter) mongoFilter() bson.M {
+	conditions := []bson.M{notDeleted}
+	if f.domain != "" {
+		conditions = append(conditions, bson.M{"email": bson.M{"$regex": "@" + regexp.QuoteMeta(f.domain) + "$"}})
+	}
+	if f.contains != "" {
+		conditions = append(conditions, bson.M{"email": bson.M{"$regex": regexp.QuoteMeta(f.contains)}})
+	}
+	if f.tag != "" {
+		conditions = append(conditions, bson.M{"tags": f.tag})
+	}
+
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	return bson.M{"$and": conditions}
+}
+
+func (s mongoEmailStore) exists(ctx context.Context, email string) (bool, error) {
+	n, err := s.collection.CountDocuments(ctx, bson.M{"email": email, "deletedAt": bson.M{"$exists": false}},
+		options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+// upsert the addresses in a single bulk write, leaving existing documents
+// untouched apart from their tags
+func (s mongoEmailStore) insert(ctx context.Context, addresses, tags []string) (int, []storageError) {
+	return s.upsert(ctx, addresses, tags, bson.M{})
+}
+
+// store the addresses like insert, with the new ones left unconfirmed
+// without a confirmation token; they are sent one with the first email sent
+// to them
+func (s mongoEmailStore) importUnconfirmed(ctx context.Context, addresses, tags []string) (int, []storageError) {
+	return s.upsert(ctx, addresses, tags, bson.M{"status": recipientUnconfirmed})
+}
+
+// upsert the addresses, setting the fields on the documents inserted
+func (s mongoEmailStore) upsert(ctx context.Context, addresses, tags []string, onInsert bson.M) (int, []storageError) {
+	if len(addresses) == 0 {
+		return 0, nil
+	}
+	models := make([]mongo.WriteModel, 0, len(addresses))
+	for _, address := range addresses {
+		inserted := bson.M{"email": address}
+		for field, value := range onInsert {
+			inserted[field] = value
+		}
+		// deleted addresses match too, so they stay deleted rather than being
+		// stored again
+		update := bson.M{"$setOnInsert": inserted}
+		if len(tags) > 0 {
+			update["$addToSet"] = bson.M{"tags": bson.M{"$each": tags}}
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"email": address}).
+			SetUpdate(update).
+			SetUpsert(true))
+	}
+	_, err := s.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	failures := storageErrors(addresses, err)
+	return len(addresses) - len(failures), failures
+}
+
+// map a bulk write error to the addresses that failed; duplicate key errors
+// are not failures, they mean a concurrent request already stored the address
+func storageErrors(addresses []string, err error) []storageError {
+	if err == nil {
+		return nil
+	}
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		// the whole write failed
+		failures := make([]storageError, 0, len(addresses))
+		for _, address := range addresses {
+			failures = append(failures, storageError{Email: address, Error: err.Error()})
+		}
+		return failures
+	}
+
+	var failures []storageError
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.HasErrorCode(duplicateKeyErrorCode) || writeErr.Index < 0 || writeErr.Index >= len(addresses) {
+			continue
+		}
+		failures = append(failures, storageError{Email: addresses[writeErr.Index], Error: writeErr.Message})
+	}
+	return failures
+}
+
+func (s mongoEmailStore) list(ctx context.Context, filter recipientFilter, p page) ([]storedRecipient, error) {
+	// find one page of documents in a stable order
+	findOptions := options.Find().
+		SetSort(bson.M{"_id": 1}).
+		SetSkip(p.offset).
+		SetLimit(p.limit)
+	cursor, err := s.collection.Find(ctx, filter.mongoFilter(), findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	recipients := []storedRecipient{}
+	if err := cursor.All(ctx, &recipients); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+func (s mongoEmailStore) count(ctx context.Context, filter recipientFilter) (int64, error) {
+	return s.collection.CountDocuments(ctx, filter.mongoFilter())
+}
+
+// stream the matching documents through a cursor, so memory use doesn't grow
+// with the number of recipients
+func (s mongoEmailStore) each(ctx context.Context, filter recipientFilter, fn func(storedRecipient) error) error {
+	cursor, err := s.collection.Find(ctx, filter.mongoFilter(), options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		var recipient storedRecipient
+		if err := cursor.Decode(&recipient); err != nil {
+			return err
+		}
+		if err := fn(recipient); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s mongoEmailStore) delete(ctx context.Context, email string) error {
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"email": email, "deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"deletedAt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errEmailNotFound
+	}
+	return nil
+}
+
+func (s mongoEmailStore) restore(ctx context.Context, email string) error {
+	result, err := s.collection.UpdateOne(ctx,
+		bson.M{"email": email, "deletedAt": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"deletedAt": ""}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errEmailNotFound
+	}
+	return nil
+}
+
+func (s mongoEmailStore) setTags(ctx context.Context, email string, tags []string) (storedRecipient, error) {
+	var updated storedRecipient
+	err := s.collection.FindOneAndUpdate(ctx,
+		bson.M{"email": email, "deletedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"tags": tags}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return storedRecipient{}, errEmailNotFound
+	}
+	return updated, err
+}
+
+func (s mongoEmailStore) purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.collection.DeleteMany(ctx, bson.M{"deletedAt": bson.M{"$lte": cutoff}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
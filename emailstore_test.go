@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestGetAllEmailsPaginates(t *testing.T) {
+	s := &server{emails: newMemEmailStore("a@example.com", "b@example.com", "c@example.com")}
+
+	w := record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodGet, "/get-all-emails?limit=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Emails []storedRecipient `json:"emails"`
+		pageInfo
+	}
+	decodeBody(t, w, &body)
+	if len(body.Emails) != 2 || body.Emails[0].Email != "a@example.com" || body.Emails[1].Email != "b@example.com" {
+		t.Errorf("emails = %+v, want the first two", body.Emails)
+	}
+	if body.Total != 3 || body.Limit != 2 || body.NextOffset == nil || *body.NextOffset != 2 {
+		t.Errorf("page = %+v, want 3 in total and the next page at 2", body.pageInfo)
+	}
+
+	w = record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodGet, "/get-all-emails?limit=2&offset=2", nil))
+	body.NextOffset = nil
+	decodeBody(t, w, &body)
+	if len(body.Emails) != 1 || body.Emails[0].Email != "c@example.com" || body.NextOffset != nil {
+		t.Errorf("last page = %+v, next_offset = %v, want c@example.com alone", body.Emails, body.NextOffset)
+	}
+}
+
+func TestGetAllEmailsFilters(t *testing.T) {
+	s := &server{emails: newMemEmailStore("a@example.com", "b@example.org", "ab@example.org")}
+
+	w := record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodGet, "/get-all-emails?domain=Example.org&contains=ab", nil))
+	var body struct {
+		Emails []storedRecipient `json:"emails"`
+		pageInfo
+	}
+	decodeBody(t, w, &body)
+	if len(body.Emails) != 1 || body.Emails[0].Email != "ab@example.org" || body.Total != 1 {
+		t.Errorf("emails = %+v, total = %d, want ab@example.org alone", body.Emails, body.Total)
+	}
+}
+
+func TestGetAllEmailsRejectsBadRequests(t *testing.T) {
+	s := &server{emails: newMemEmailStore()}
+
+	w := record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodPost, "/get-all-emails", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+
+	w = record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodGet, "/get-all-emails?limit=-1", nil))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	s.emails.(*memEmailStore).err = errors.New("connection refused")
+	w = record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodGet, "/get-all-emails", nil))
+	assertError(t, w, http.StatusInternalServerError, errCodeInternal)
+}
+
+func TestCountEmails(t *testing.T) {
+	s := &server{emails: newMemEmailStore("a@example.com", "b@example.org")}
+
+	w := record(s.emailHandler, httptest.NewRequest(http.MethodGet, "/emails/count?domain=Example.org", nil))
+	var body struct {
+		Count int64 `json:"count"`
+	}
+	decodeBody(t, w, &body)
+	if body.Count != 1 {
+		t.Errorf("count = %d, want 1", body.Count)
+	}
+
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodPost, "/emails/count", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestDeleteEmail(t *testing.T) {
+	store := newMemEmailStore("a@example.com", "b@example.com")
+	s := &server{emails: store}
+
+	w := record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/A@Example.com", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", w.Code, w.Body.String())
+	}
+	if got := store.addresses(); !slices.Equal(got, []string{"b@example.com"}) {
+		t.Errorf("stored = %v, want b@example.com alone", got)
+	}
+
+	// deleting it again finds nothing
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/a@example.com", nil))
+	assertError(t, w, http.StatusNotFound, errCodeNotFound)
+
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/not-an-address", nil))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodGet, "/emails/b@example.com", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestRestoreEmail(t *testing.T) {
+	store := newMemEmailStore("a@example.com")
+	s := &server{emails: store}
+	record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/a@example.com", nil))
+
+	w := record(s.emailHandler, httptest.NewRequest(http.MethodPost, "/emails/A@Example.com/restore", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", w.Code, w.Body.String())
+	}
+	if got := store.addresses(); !slices.Equal(got, []string{"a@example.com"}) {
+		t.Errorf("stored = %v, want a@example.com restored", got)
+	}
+
+	// only deleted addresses can be restored
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodPost, "/emails/a@example.com/restore", nil))
+	assertError(t, w, http.StatusNotFound, errCodeNotFound)
+
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodPost, "/emails/not-an-address/restore", nil))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodGet, "/emails/a@example.com/restore", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestSendingDoesNotRestoreDeletedEmails(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	store := newMemEmailStore("a@example.com", "b@example.com")
+	s.emails = store
+	record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/a@example.com", nil))
+
+	w := record(s.sendEmailHandler, jsonRequest("/send-email?wait=true", `{"recipients":["a@example.com","c@example.com"],"subject":"Hi","message":"Hello"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if got := store.addresses(); !slices.Equal(got, []string{"b@example.com", "c@example.com"}) {
+		t.Errorf("stored = %v, want a@example.com left deleted", got)
+	}
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodPost, "/emails/a@example.com/restore", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("restore status = %d, want 204 for the still deleted address: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEmailExists(t *testing.T) {
+	s := &server{emails: newMemEmailStore("a@example.com")}
+	exists := func(email string) bool {
+		t.Helper()
+		w := record(s.emailHandler, httptest.NewRequest(http.MethodGet, "/emails/"+email+"/exists", nil))
+		var body struct {
+			Exists bool `json:"exists"`
+		}
+		decodeBody(t, w, &body)
+		return body.Exists
+	}
+
+	for email, want := range map[string]bool{"a@example.com": true, "A@EXAMPLE.COM": true, "b@example.com": false} {
+		if got := exists(email); got != want {
+			t.Errorf("%s exists = %v, want %v", email, got, want)
+		}
+	}
+
+	record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/a@example.com", nil))
+	if exists("a@example.com") {
+		t.Error("deleted address reported as existing")
+	}
+
+	w := record(s.emailHandler, httptest.NewRequest(http.MethodGet, "/emails/not-an-address/exists", nil))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodPost, "/emails/a@example.com/exists", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestEmailsFilter(t *testing.T) {
+	for query, want := range map[string]recipientFilter{
+		"":                         {},
+		"domain=Example.com":       {domain: "example.com"},
+		"contains=A%2B&tag=+beta+": {contains: "a+", tag: "beta"},
+		"domain=x.io&contains=a.b": {domain: "x.io", contains: "a.b"},
+	} {
+		values, _ := url.ParseQuery(query)
+		if got := emailsFilter(values); got != want {
+			t.Errorf("emailsFilter(%q) = %+v, want %+v", query, got, want)
+		}
+	}
+}
+
+func TestRecipientFilterMongoFilter(t *testing.T) {
+	for _, test := range []struct {
+		filter recipientFilter
+		want   bson.M
+	}{
+		{recipientFilter{}, notDeleted},
+		{recipientFilter{domain: "example.com"}, bson.M{"$and": []bson.M{notDeleted, {"email": bson.M{"$regex": `@example\.com$`}}}}},
+		{recipientFilter{contains: "a+"}, bson.M{"$and": []bson.M{notDeleted, {"email": bson.M{"$regex": `a\+`}}}}},
+		{recipientFilter{domain: "x.io", tag: "beta"}, bson.M{"$and": []bson.M{notDeleted, {"email": bson.M{"$regex": `@x\.io$`}}, {"tags": "beta"}}}},
+	} {
+		if got := test.filter.mongoFilter(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v.mongoFilter() = %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+// the addresses upserted by the update commands the mock database received
+func upsertedEmails(mt *mtest.T) []string {
+	var emails []string
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName != "update" {
+			continue
+		}
+		updates, _ := event.Command.Lookup("updates").Array().Values()
+		for _, update := range updates {
+			if update.Document().Lookup("upsert").Boolean() {
+				emails = append(emails, update.Document().Lookup("q", "email").StringValue())
+			}
+		}
+	}
+	return emails
+}
+
+func TestMongoEmailStoreInsertUsesOneUnorderedBulkWrite(t *testing.T) {
+	withMockMongo(t, func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		store := mongoEmailStore{collection: mt.Coll}
+		if stored, failures := store.insert(context.Background(), []string{"a@example.com", "b@example.com", "c@example.com"}, []string{"customers"}); stored != 3 || len(failures) != 0 {
+			t.Fatalf("stored = %d, failures = %+v, want all three stored", stored, failures)
+		}
+		events := mt.GetAllStartedEvents()
+		if len(events) != 1 || events[0].CommandName != "update" || events[0].Command.Lookup("ordered").Boolean() {
+			t.Fatalf("sent %d commands, want a single unordered bulk write", len(events))
+		}
+		if got := upsertedEmails(mt); !slices.Equal(got, []string{"a@example.com", "b@example.com", "c@example.com"}) {
+			t.Errorf("upserted %v, want every address", got)
+		}
+		update := events[0].Command.Lookup("updates").Array().Index(0).Value().Document()
+		if got := update.Lookup("u", "$addToSet", "tags", "$each").Array().Index(0).Value().StringValue(); got != "customers" {
+			t.Errorf("added tag %q, want customers", got)
+		}
+	})
+}
+
+func TestMongoEmailStoreInsertReportsWriteErrors(t *testing.T) {
+	withMockMongo(t, func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 1, Code: 121, Message: "document failed validation"}))
+		store := mongoEmailStore{collection: mt.Coll}
+		stored, failures := store.insert(context.Background(), []string{"a@example.com", "b@example.com", "c@example.com"}, nil)
+		if stored != 2 || len(failures) != 1 || failures[0].Email != "b@example.com" {
+			t.Errorf("stored = %d, failures = %+v, want b@example.com reported", stored, failures)
+		}
+	})
+}
+
+func TestMongoEmailStoreDeleteMarksTheAddress(t *testing.T) {
+	withMockMongo(t, func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		store := mongoEmailStore{collection: mt.Coll}
+		if err := store.delete(context.Background(), "a@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		// the address is marked deleted rather than removed
+		update := mt.GetStartedEvent().Command.Lookup("updates").Array().Index(0).Value().Document()
+		if _, err := update.LookupErr("u", "$set", "deletedAt"); err != nil {
+			t.Errorf("update %s does not set deletedAt", update)
+		}
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+		if err := store.delete(context.Background(), "a@example.com"); err != errEmailNotFound {
+			t.Errorf("err = %v deleting a missing address, want errEmailNotFound", err)
+		}
+	})
+}
+
+func TestMongoEmailStorePurge(t *testing.T) {
+	withMockMongo(t, func(mt *mtest.T) {
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 2}))
+		cutoff := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		purged, err := mongoEmailStore{collection: mt.Coll}.purge(context.Background(), cutoff)
+		if err != nil || purged != 2 {
+			t.Fatalf("purged = %d, %v, want 2", purged, err)
+		}
+		filter := mt.GetStartedEvent().Command.Lookup("deletes").Array().Index(0).Value().Document().Lookup("q", "deletedAt", "$lte")
+		if !filter.Time().Equal(cutoff) {
+			t.Errorf("purged recipients deleted before %s, want %s", filter.Time(), cutoff)
+		}
+	})
+}
+
+func TestStorageErrors(t *testing.T) {
+	addresses := []string{"a@example.com", "b@example.com", "c@example.com"}
+	if got := storageErrors(addresses, nil); len(got) != 0 {
+		t.Errorf("failures = %+v for a successful write", got)
+	}
+
+	// the unique index on email makes a concurrent insert of the same address
+	// fail with a duplicate key error, which means it is stored
+	err := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 0, Code: duplicateKeyErrorCode, Message: "E11000 duplicate key error"}},
+		{WriteError: mongo.WriteError{Index: 1, Code: 121, Message: "document failed validation"}},
+	}}
+	if got := storageErrors(addresses, err); len(got) != 1 || got[0] != (storageError{Email: "b@example.com", Error: "document failed validation"}) {
+		t.Errorf("failures = %+v, want only b@example.com's validation failure", got)
+	}
+
+	// write concern and connection errors fail every address
+	for _, err := range []error{
+		mongo.BulkWriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64, Message: "waiting for replication timed out"}},
+		errors.New("connection reset"),
+	} {
+		if got := storageErrors(addresses, err); len(got) != len(addresses) {
+			t.Errorf("%v: failures = %+v, want every address", err, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+)
+
+// columns of an exported recipient list
+var exportColumns = []string{"email", "tags"}
+
+// rows written between flushes of an export, keeping the response streaming
+const exportFlushRows = 1000
+
+// characters that make spreadsheet applications read a cell as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// prefix cells that would be read as a formula with a quote, so an exported
+// list opened in a spreadsheet can't run one
+func escapeCSVCell(cell string) string {
+	if cell != "" && strings.ContainsRune(csvFormulaPrefixes, rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// the cell as it was before escapeCSVCell, so exports can be imported again
+func unescapeCSVCell(cell string) string {
+	if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(cell[1])) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// handles requests to download the stored recipients, filtered like
+// getAllEmailsHandler
+func (s *server) exportEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+	if format := r.URL.Query().Get("format"); format != "" && format != "csv" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "format must be csv")
+		return
+	}
+
+	out := csv.NewWriter(w)
+	rows := 0
+	// start the response once the first recipient has been read, so a failed
+	// query can still be reported as an error
+	start := func() {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="emails.csv"`)
+		out.Write(exportColumns)
+	}
+
+	// the list may take longer to stream than a single database operation is
+	// allowed, so reading it is bounded by the client instead
+	err := s.emails.each(r.Context(), emailsFilter(r.URL.Query()), func(recipient storedRecipient) error {
+		if rows == 0 {
+			start()
+		}
+		rows++
+		if err := out.Write([]string{escapeCSVCell(recipient.Email), escapeCSVCell(strings.Join(recipient.Tags, ";"))}); err != nil {
+			return err
+		}
+		if rows%exportFlushRows == 0 {
+			out.Flush()
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil && rows == 0 {
+		writeDBError(w, r, err)
+		return
+	}
+	if rows == 0 {
+		start()
+	}
+	out.Flush()
+	if err == nil {
+		err = out.Error()
+	}
+	if err != nil {
+		// the status has been sent, all that can be done is to cut the response short
+		loggerFrom(r.Context()).Error("Could not export recipients", "error", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// a fallback SMTP server, sharing the primary server's auth and TLS modes
+type smtpEndpoint struct {
+	server   string
+	port     string
+	username string
+	password string
+}
+
+// parse SMTP_SERVERS, a comma separated list of [user:password@]host:port
+// entries; special characters in credentials must be percent-encoded
+func parseSMTPServers(raw string) ([]smtpEndpoint, error) {
+	var endpoints []smtpEndpoint
+	for _, entry := range splitList(raw) {
+		u, err := url.Parse("smtp://" + entry)
+		if err != nil || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("SMTP_SERVERS entry '%s' must be of the form [user:password@]host:port", redactUserinfo(entry))
+		}
+		host, port, err := net.SplitHostPort(u.Host)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("SMTP_SERVERS entry '%s' must include a host and port", redactUserinfo(entry))
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("SMTP_SERVERS entry '%s' has an invalid port", redactUserinfo(entry))
+		}
+
+		endpoint := smtpEndpoint{server: host, port: port}
+		if u.User != nil {
+			endpoint.username = u.User.Username()
+			endpoint.password, _ = u.User.Password()
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// hide any credentials in an SMTP_SERVERS entry so it can be reported
+func redactUserinfo(entry string) string {
+	if at := strings.LastIndex(entry, "@"); at >= 0 {
+		return "***@" + entry[at+1:]
+	}
+	return entry
+}
+
+// the configuration for sending through the endpoint, keeping the primary's
+// credentials for any the endpoint doesn't set
+func (e smtpEndpoint) apply(config emailConfig) emailConfig {
+	config.smtpServer = e.server
+	config.smtpPort = e.port
+	config.tlsConfig = &tls.Config{ServerName: e.server}
+	if e.username != "" {
+		config.username = e.username
+	}
+	if e.password != "" {
+		if config.authMode == authModeXOAUTH2 {
+			config.oauthToken = e.password
+		} else {
+			config.password = e.password
+		}
+	}
+	return config
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// the address of a local port nothing is listening on
+func closedPort(t *testing.T) (string, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port
+}
+
+func TestDeliverFailsOverToTheNextServer(t *testing.T) {
+	fallback := newFakeSMTPServer(t)
+	config := fallback.config()
+	// the primary is down
+	config.smtpServer, config.smtpPort = closedPort(t)
+	config.fallbacks = []smtpEndpoint{{server: "127.0.0.1", port: fallback.config().smtpPort, username: "backup", password: "backup-secret"}}
+
+	replies, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com", "b@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || len(fallback.received()) != 2 {
+		t.Errorf("replies = %q, fallback received %d messages, want both sent through the fallback", replies, len(fallback.received()))
+	}
+}
+
+func TestDeliverFailsWhenEveryServerIsDown(t *testing.T) {
+	host, port := closedPort(t)
+	config := emailConfig{smtpServer: host, smtpPort: port}
+	config.fallbacks = []smtpEndpoint{{server: host, port: port}}
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err == nil {
+		t.Error("delivery succeeded with every server down")
+	}
+}
+
+func TestParseSMTPServers(t *testing.T) {
+	endpoints, err := parseSMTPServers("smtp1.example.com:587, user:p%40ss@smtp2.example.com:2525")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []smtpEndpoint{
+		{server: "smtp1.example.com", port: "587"},
+		{server: "smtp2.example.com", port: "2525", username: "user", password: "p@ss"},
+	}
+	if len(endpoints) != len(want) || endpoints[0] != want[0] || endpoints[1] != want[1] {
+		t.Errorf("endpoints = %+v, want %+v", endpoints, want)
+	}
+
+	for _, raw := range []string{"smtp.example.com", "smtp.example.com:0", ":587", "user:secret@smtp.example.com:smtp"} {
+		_, err := parseSMTPServers(raw)
+		if err == nil {
+			t.Errorf("%q accepted", raw)
+		} else if strings.Contains(err.Error(), "secret") {
+			t.Errorf("%q: error %q reveals the password", raw, err)
+		}
+	}
+}
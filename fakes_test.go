@@ -0,0 +1,504 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an in-memory emailStore for handler tests, matching the MongoDB store's
+// behavior; err, when set, is returned by every call
+type memEmailStore struct {
+	mu         sync.Mutex
+	recipients []memRecipient
+	nextID     int
+	err        error
+}
+
+// a stored recipient along with the fields the API doesn't expose
+type memRecipient struct {
+	storedRecipient
+	deletedAt    *time.Time
+	confirmToken string
+}
+
+// a store holding the addresses, stored in order
+func newMemEmailStore(addresses ...string) *memEmailStore {
+	store := &memEmailStore{}
+	store.insert(context.Background(), addresses, nil)
+	return store
+}
+
+// the stored recipient with the address, deleted or not
+func (m *memEmailStore) find(email string) *memRecipient {
+	for i := range m.recipients {
+		if m.recipients[i].Email == email {
+			return &m.recipients[i]
+		}
+	}
+	return nil
+}
+
+// report whether the recipient matches the filter, as mongoFilter does
+func (f recipientFilter) matches(recipient memRecipient) bool {
+	return recipient.deletedAt == nil &&
+		(f.domain == "" || strings.HasSuffix(recipient.Email, "@"+f.domain)) &&
+		strings.Contains(recipient.Email, f.contains) &&
+		(f.tag == "" || slices.Contains(recipient.Tags, f.tag))
+}
+
+func (m *memEmailStore) exists(ctx context.Context, email string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recipient := m.find(email)
+	return recipient != nil && recipient.deletedAt == nil, m.err
+}
+
+func (m *memEmailStore) insert(ctx context.Context, addresses, tags []string) (int, []storageError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		failures := make([]storageError, 0, len(addresses))
+		for _, address := range addresses {
+			failures = append(failures, storageError{Email: address, Error: m.err.Error()})
+		}
+		return 0, failures
+	}
+	for _, address := range addresses {
+		m.addTags(m.add(address), tags)
+	}
+	return len(addresses), nil
+}
+
+func (m *memEmailStore) importUnconfirmed(ctx context.Context, addresses, tags []string) (int, []storageError) {
+	m.mu.Lock()
+	for _, address := range addresses {
+		if m.find(address) == nil {
+			m.add(address).Status = recipientUnconfirmed
+		}
+	}
+	m.mu.Unlock()
+	return m.insert(ctx, addresses, tags)
+}
+
+// the stored recipient with the address, stored now when there is none
+func (m *memEmailStore) add(address string) *memRecipient {
+	if recipient := m.find(address); recipient != nil {
+		return recipient
+	}
+	m.nextID++
+	recipient := memRecipient{storedRecipient: storedRecipient{Email: address}}
+	recipient.ID[11] = byte(m.nextID)
+	m.recipients = append(m.recipients, recipient)
+	return &m.recipients[len(m.recipients)-1]
+}
+
+func (m *memEmailStore) addTags(recipient *memRecipient, tags []string) {
+	for _, tag := range tags {
+		if !slices.Contains(recipient.Tags, tag) {
+			recipient.Tags = append(recipient.Tags, tag)
+		}
+	}
+}
+
+func (m *memEmailStore) list(ctx context.Context, filter recipientFilter, p page) ([]storedRecipient, error) {
+	var matching []storedRecipient
+	m.each(ctx, filter, func(recipient storedRecipient) error {
+		matching = append(matching, recipient)
+		return nil
+	})
+	start := min(int(p.offset), len(matching))
+	end := min(start+int(p.limit), len(matching))
+	return append([]storedRecipient{}, matching[start:end]...), m.err
+}
+
+func (m *memEmailStore) count(ctx context.Context, filter recipientFilter) (int64, error) {
+	var n int64
+	m.each(ctx, filter, func(storedRecipient) error {
+		n++
+		return nil
+	})
+	return n, m.err
+}
+
+func (m *memEmailStore) each(ctx context.Context, filter recipientFilter, fn func(storedRecipient) error) error {
+	m.mu.Lock()
+	var matching []storedRecipient
+	for _, recipient := range m.recipients {
+		if filter.matches(recipient) {
+			matching = append(matching, recipient.storedRecipient)
+		}
+	}
+	err := m.err
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, recipient := range matching {
+		if err := fn(recipient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memEmailStore) delete(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	recipient := m.find(email)
+	if recipient == nil || recipient.deletedAt != nil {
+		return errEmailNotFound
+	}
+	now := time.Now()
+	recipient.deletedAt = &now
+	return nil
+}
+
+func (m *memEmailStore) restore(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	recipient := m.find(email)
+	if recipient == nil || recipient.deletedAt == nil {
+		return errEmailNotFound
+	}
+	recipient.deletedAt = nil
+	return nil
+}
+
+func (m *memEmailStore) setTags(ctx context.Context, email string, tags []string) (storedRecipient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return storedRecipient{}, m.err
+	}
+	recipient := m.find(email)
+	if recipient == nil || recipient.deletedAt != nil {
+		return storedRecipient{}, errEmailNotFound
+	}
+	recipient.Tags = tags
+	return recipient.storedRecipient, nil
+}
+
+func (m *memEmailStore) purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return 0, m.err
+	}
+	kept := m.recipients[:0]
+	for _, recipient := range m.recipients {
+		if recipient.deletedAt == nil || recipient.deletedAt.After(cutoff) {
+			kept = append(kept, recipient)
+		}
+	}
+	purged := int64(len(m.recipients) - len(kept))
+	m.recipients = kept
+	return purged, nil
+}
+
+func (m *memEmailStore) confirmed(ctx context.Context, emails []string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := make(map[string]bool)
+	for _, email := range emails {
+		if recipient := m.find(email); recipient != nil && recipient.Status != recipientUnconfirmed {
+			set[email] = true
+		}
+	}
+	return set, m.err
+}
+
+func (m *memEmailStore) insertUnconfirmed(ctx context.Context, addresses, tags []string) (map[string]string, []storageError) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := make(map[string]string)
+	for _, address := range addresses {
+		if recipient := m.find(address); recipient != nil {
+			m.addTags(recipient, tags)
+			if recipient.deletedAt == nil && recipient.Status == recipientUnconfirmed && recipient.confirmToken == "" {
+				recipient.confirmToken = newUUID()
+				tokens[address] = recipient.confirmToken
+			}
+			continue
+		}
+		recipient := m.add(address)
+		recipient.Status, recipient.confirmToken = recipientUnconfirmed, newUUID()
+		m.addTags(recipient, tags)
+		tokens[address] = recipient.confirmToken
+	}
+	return tokens, nil
+}
+
+func (m *memEmailStore) confirm(ctx context.Context, token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.recipients {
+		if recipient := &m.recipients[i]; token != "" && recipient.confirmToken == token {
+			recipient.Status, recipient.confirmToken = recipientConfirmed, ""
+			return recipient.Email, nil
+		}
+	}
+	return "", errConfirmTokenNotFound
+}
+
+// the stored, undeleted addresses in order
+func (m *memEmailStore) addresses() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var addresses []string
+	for _, recipient := range m.recipients {
+		if recipient.deletedAt == nil {
+			addresses = append(addresses, recipient.Email)
+		}
+	}
+	return addresses
+}
+
+// an in-memory jobStore, keeping every job
+type memJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]jobRecord
+}
+
+func newMemJobStore() *memJobStore {
+	return &memJobStore{jobs: make(map[string]jobRecord)}
+}
+
+func (m *memJobStore) create(ctx context.Context, record jobRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobs[record.ID] = record
+	return nil
+}
+
+func (m *memJobStore) markStarted(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record := m.jobs[id]
+	record.Status, record.StartedAt = jobSending, &at
+	m.jobs[id] = record
+	return nil
+}
+
+func (m *memJobStore) markFinished(ctx context.Context, id, status string, results []deliveryResult, errMessage string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record := m.jobs[id]
+	record.Status, record.Results, record.Error, record.FinishedAt = status, results, errMessage, &at
+	m.jobs[id] = record
+	return nil
+}
+
+func (m *memJobStore) get(ctx context.Context, id string) (jobRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.jobs[id]
+	if !ok {
+		return jobRecord{}, errJobNotFound
+	}
+	return record, nil
+}
+
+func (m *memJobStore) claimDue(ctx context.Context, now time.Time, limit int) ([]jobRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []jobRecord
+	for id, record := range m.jobs {
+		if len(records) < limit && record.Status == jobScheduled && !record.SendAt.After(now) {
+			record.Status = jobQueued
+			m.jobs[id] = record
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (m *memJobStore) unclaim(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if record := m.jobs[id]; record.Status == jobQueued {
+		record.Status = jobScheduled
+		m.jobs[id] = record
+	}
+	return nil
+}
+
+// the number of jobs with the status
+func (m *memJobStore) count(status string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, record := range m.jobs {
+		if record.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// an in-memory suppressionStore
+type memSuppressionStore struct {
+	mu        sync.Mutex
+	addresses map[string]bool
+}
+
+func newMemSuppressionStore(addresses ...string) *memSuppressionStore {
+	store := &memSuppressionStore{addresses: make(map[string]bool)}
+	for _, address := range addresses {
+		store.addresses[address] = true
+	}
+	return store
+}
+
+func (m *memSuppressionStore) suppress(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addresses[email] = true
+	return nil
+}
+
+func (m *memSuppressionStore) suppressed(ctx context.Context, emails []string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := make(map[string]bool)
+	for _, email := range emails {
+		if m.addresses[email] {
+			set[email] = true
+		}
+	}
+	return set, nil
+}
+
+// an in-memory historyStore
+type memHistoryStore struct {
+	mu      sync.Mutex
+	records []sentEmailRecord
+}
+
+func (m *memHistoryStore) record(ctx context.Context, record sentEmailRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *memHistoryStore) list(ctx context.Context, p page) ([]sentEmailRecord, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recent := slices.Clone(m.records)
+	slices.Reverse(recent)
+	start := min(int(p.offset), len(recent))
+	end := min(start+int(p.limit), len(recent))
+	return recent[start:end], int64(len(recent)), nil
+}
+
+func (m *memHistoryStore) get(ctx context.Context, id string) (sentEmailRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, record := range m.records {
+		if record.ID == id {
+			return record, nil
+		}
+	}
+	return sentEmailRecord{}, errSentEmailNotFound
+}
+
+func (m *memHistoryStore) stats(ctx context.Context, since time.Time, topDomains int) (sendStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := sendStats{TopDomains: []domainCount{}}
+	domains := make(map[string]int64)
+	for _, record := range m.records {
+		switch record.Status {
+		case jobSent:
+			stats.TotalSent++
+		case jobFailed:
+			stats.TotalFailed++
+		case jobPartial:
+			stats.TotalPartial++
+		}
+		if !record.SentAt.Before(since) {
+			stats.SentLast24h++
+		}
+		for _, recipient := range record.Recipients {
+			domains[emailDomain(recipient)]++
+		}
+	}
+	// ordered and limited like the aggregation pipeline's domains facet
+	for domain, count := range domains {
+		stats.TopDomains = append(stats.TopDomains, domainCount{Domain: domain, Count: count})
+	}
+	slices.SortFunc(stats.TopDomains, func(a, b domainCount) int {
+		if a.Count != b.Count {
+			return cmp.Compare(b.Count, a.Count)
+		}
+		return strings.Compare(a.Domain, b.Domain)
+	})
+	stats.TopDomains = stats.TopDomains[:min(len(stats.TopDomains), topDomains)]
+	return stats, nil
+}
+
+// the record of the job, waiting for the queue to finish it
+func (m *memHistoryStore) waitFor(jobID string) (sentEmailRecord, bool) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for _, record := range m.snapshot() {
+			if record.JobID == jobID {
+				return record, true
+			}
+		}
+	}
+	return sentEmailRecord{}, false
+}
+
+// the records so far
+func (m *memHistoryStore) snapshot() []sentEmailRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.records)
+}
+
+// an in-memory idempotencyStore
+type memIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[string]idempotencyRecord
+}
+
+func newMemIdempotencyStore() *memIdempotencyStore {
+	return &memIdempotencyStore{records: make(map[string]idempotencyRecord)}
+}
+
+func (m *memIdempotencyStore) reserve(ctx context.Context, key string, expiresAt time.Time) (idempotencyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.records[key]; ok && time.Now().Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+	record := idempotencyRecord{Key: key, Pending: true, ExpiresAt: expiresAt}
+	m.records[key] = record
+	return record, true, nil
+}
+
+func (m *memIdempotencyStore) complete(ctx context.Context, key string, statusCode int, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record := m.records[key]
+	record.Pending, record.StatusCode, record.Body = false, statusCode, body
+	m.records[key] = record
+	return nil
+}
+
+func (m *memIdempotencyStore) release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, key)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+)
+
+// headers the service sets itself, which custom headers may not replace
+var reservedHeaders = map[string]bool{
+	"Bcc":                       true,
+	"Cc":                        true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"Dkim-Signature":            true,
+	"From":                      true,
+	"Importance":                true,
+	"List-Unsubscribe":          true,
+	"List-Unsubscribe-Post":     true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Reply-To":                  true,
+	"Return-Path":               true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"To":                        true,
+	"X-Msmail-Priority":         true,
+	"X-Priority":                true,
+}
+
+// check custom header names are valid field names that don't replace a
+// reserved header, and that values can't inject further headers
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !isHeaderName(name) {
+			return fmt.Errorf("header name '%s' is not valid", name)
+		}
+		if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("header '%s' cannot be set", name)
+		}
+		if _, err := sanitizeHeaderValue(value); err != nil {
+			return fmt.Errorf("header '%s' is not valid: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// report whether name is a non-empty run of printable ASCII other than
+// space and colon, as RFC 5322 requires of field names
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c <= ' ' || c > '~' || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// custom headers in canonical form, sorted by name so messages are stable
+func formatCustomHeaders(headers map[string]string) []string {
+	lines := make([]string, 0, len(headers))
+	for name, value := range headers {
+		lines = append(lines, textproto.CanonicalMIMEHeaderKey(name)+": "+encodeHeaderValue(value))
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestValidateHeaders(t *testing.T) {
+	for _, headers := range []map[string]string{
+		{"": "value"},
+		{"X Campaign": "value"},
+		{"X-Campaign:": "value"},
+		{"X-Kampagne-ü": "value"},
+		{"subject": "value"},
+		{"MESSAGE-ID": "value"},
+		{"X-Campaign": "spring\r\nBcc: victim@example.com"},
+	} {
+		if err := validateHeaders(headers); err == nil {
+			t.Errorf("headers %q were accepted", headers)
+		}
+	}
+	if err := validateHeaders(map[string]string{"X-Campaign-ID": "spring", "x-mailer-tag": "news"}); err != nil {
+		t.Errorf("custom headers rejected: %v", err)
+	}
+}
+
+func TestValidateHeadersRejectsReservedHeaders(t *testing.T) {
+	for _, name := range []string{"list-unsubscribe", "List-Unsubscribe-Post", "X-Priority", "x-msmail-priority", "IMPORTANCE", "Subject"} {
+		if err := validateHeaders(map[string]string{name: "value"}); err == nil {
+			t.Errorf("header %s was accepted, want it reserved", name)
+		}
+	}
+	if err := validateHeaders(map[string]string{"X-Campaign": "spring"}); err != nil {
+		t.Errorf("custom header rejected: %v", err)
+	}
+}
+
+func TestFormatMessageSetsCustomHeaders(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello", Headers: map[string]string{"x-campaign-id": "spring", "X-Tag": "Grüße"}})
+	if got := msg.Header.Get("X-Campaign-Id"); got != "spring" {
+		t.Errorf("X-Campaign-Id = %q, want spring", got)
+	}
+	if _, ok := msg.Header["X-Tag"]; !ok {
+		t.Error("X-Tag header missing")
+	}
+}
+
+func TestFormatCustomHeadersIsSorted(t *testing.T) {
+	lines := formatCustomHeaders(map[string]string{"x-b": "2", "x-a": "1", "x-c": "3"})
+	want := []string{"X-A: 1", "X-B: 2", "X-C: 3"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("got %q, want %q", lines, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// liveness probe, the process is up if it can answer
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readiness probe, checks the service's dependencies are available
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"mongodb": "ok", "smtp_config": "ok"}
+	ready := true
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+	if s.ping == nil {
+		checks["mongodb"] = "not connected"
+		ready = false
+	} else if err := s.ping(ctx); err != nil {
+		checks["mongodb"] = err.Error()
+		ready = false
+	}
+
+	if s.config.senderEmail == "" {
+		checks["smtp_config"] = "not loaded"
+		ready = false
+	}
+
+	// advisory, a failing SPF check hurts deliverability but doesn't stop sends
+	if s.spfStatus != "" {
+		checks["spf"] = s.spfStatus
+	}
+
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+// check the MongoDB connection is alive
+func pingMongoDB(ctx context.Context) error {
+	return client.Ping(ctx, nil)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	w := record((&server{}).healthzHandler, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200 whatever the dependencies", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	// body of a /readyz response
+	type readiness struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	ready := &server{config: emailConfig{senderEmail: "me@example.com"}, ping: func(ctx context.Context) error { return nil }}
+
+	w := record(ready.readyzHandler, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body readiness
+	decodeBody(t, w, &body)
+	if w.Code != http.StatusOK || body.Status != "ok" || body.Checks["mongodb"] != "ok" {
+		t.Errorf("status = %d, body = %+v, want ready", w.Code, body)
+	}
+
+	for name, s := range map[string]*server{
+		"database down":  {config: ready.config, ping: func(ctx context.Context) error { return errors.New("server selection timeout") }},
+		"not connected":  {config: ready.config},
+		"no SMTP config": {ping: ready.ping},
+	} {
+		w := record(s.readyzHandler, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body readiness
+		decodeBody(t, w, &body)
+		if w.Code != http.StatusServiceUnavailable || body.Status != "unavailable" {
+			t.Errorf("%s: status = %d, body = %+v, want unavailable", name, w.Code, body)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// audit record of a send attempt as stored in MongoDB
+type sentEmailRecord struct {
+	ID          string            `bson:"_id" json:"id"`
+	JobID       string            `bson:"jobId" json:"job_id"`
+	MessageIDs  map[string]string `bson:"messageIds,omitempty" json:"message_ids,omitempty"`
+	Subject     string            `bson:"subject" json:"subject"`
+	Message     string            `bson:"message" json:"message"`
+	HTMLMessage string            `bson:"htmlMessage,omitempty" json:"html_message,omitempty"`
+	Recipients  []string          `bson:"recipients" json:"recipients"`
+	Cc          []string          `bson:"cc" json:"cc"`
+	Bcc         []string          `bson:"bcc" json:"bcc"`
+	Status      string            `bson:"status" json:"status"`
+	Results     []deliveryResult  `bson:"results,omitempty" json:"results,omitempty"`
+	Error       string            `bson:"error,omitempty" json:"error,omitempty"`
+	SentAt      time.Time         `bson:"sentAt" json:"sent_at"`
+	// ID of the record this send was a resend of
+	ResendOf string `bson:"resendOf,omitempty" json:"resend_of,omitempty"`
+	// the request as sent, so it can be resent in full
+	Request *EmailRequest `bson:"request,omitempty" json:"-"`
+}
+
+// returned when a send history ID is not known
+var errSentEmailNotFound = errors.New("sent email not found")
+
+// persistence for the send history
+type historyStore interface {
+	record(ctx context.Context, record sentEmailRecord) error
+	// one page of records, most recent first, and the total number of records
+	list(ctx context.Context, page page) ([]sentEmailRecord, int64, error)
+	get(ctx context.Context, id string) (sentEmailRecord, error)
+	// counts of sends by status, of sends since the given time, and of the
+	// topDomains recipient domains sent to most
+	stats(ctx context.Context, since time.Time, topDomains int) (sendStats, error)
+}
+
+// historyStore backed by a MongoDB collection
+type mongoHistoryStore struct {
+	collection *mongo.Collection
+}
+
+func (s mongoHistoryStore) record(ctx context.Context, record sentEmailRecord) error {
+	_, err := s.collection.InsertOne(ctx, record)
+	return err
+}
+
+func (s mongoHistoryStore) list(ctx context.Context, page page) ([]sentEmailRecord, int64, error) {
+	total, err := s.collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "sentAt", Value: -1}, {Key: "_id", Value: 1}}).
+		SetSkip(page.offset).
+		SetLimit(page.limit)
+	cursor, err := s.collection.Find(ctx, bson.M{}, findOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	records := []sentEmailRecord{}
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, 0, err
+	}
+	return records, total, nil
+}
+
+func (s mongoHistoryStore) get(ctx context.Context, id string) (sentEmailRecord, error) {
+	var record sentEmailRecord
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return sentEmailRecord{}, errSentEmailNotFound
+	}
+	return record, err
+}
+
+// build the history record for a finished job
+func newSentEmailRecord(job job, status string, results []deliveryResult, err error) sentEmailRecord {
+	record := sentEmailRecord{
+		ID:          newUUID(),
+		JobID:       job.id,
+		MessageIDs:  job.request.MessageIDs,
+		Subject:     job.request.Subject,
+		Message:     job.request.Message,
+		HTMLMessage: job.request.HTMLMessage,
+		Recipients:  job.request.Recipients,
+		Cc:          job.request.Cc,
+		Bcc:         job.request.Bcc,
+		Status:      status,
+		Results:     results,
+		SentAt:      time.Now(),
+		ResendOf:    job.request.ResendOf,
+		Request:     historyRequest(job.request),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// copy of the request as kept in the history, without what only applied to
+// the original send; SMTP passwords are never stored
+func historyRequest(request EmailRequest) *EmailRequest {
+	request.SendAt, request.DryRun, request.MessageIDs, request.ResendOf = nil, false, nil, ""
+	if request.SMTP != nil {
+		smtp := *request.SMTP
+		smtp.Password = ""
+		request.SMTP = &smtp
+	}
+	return &request
+}
+
+// handles requests for the send history
+func (s *server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	page, err := parsePage(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	records, total, err := s.queue.history.list(ctx, page)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Emails []sentEmailRecord `json:"emails"`
+		pageInfo
+	}{records, page.info(total)})
+}
+
+// handles requests to send a previously sent or failed email again at
+// /resend/{id}, sending its original request through the same checks as a
+// new send, so recipients who have since unsubscribed or whose domains have
+// been blocked are left out
+func (s *server) resendHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only POST method
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	r, span := startRequestSpan(r, "resend")
+	defer span.End()
+
+	if s.smtpUnavailable(w) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/resend/")
+	ctx, cancel := dbContext(r.Context())
+	original, err := s.queue.history.get(ctx, id)
+	cancel()
+	if err == errSentEmailNotFound {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Sent email '%s' not found", id))
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	// records from before requests were kept only have the plain fields
+	request := EmailRequest{
+		Subject:     original.Subject,
+		Message:     original.Message,
+		HTMLMessage: original.HTMLMessage,
+		Recipients:  original.Recipients,
+		Cc:          original.Cc,
+		Bcc:         original.Bcc,
+	}
+	if original.Request != nil {
+		request = *original.Request
+	}
+	request.ResendOf = original.ID
+	s.send(w, r, request)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resend the history record, waiting for it to be sent
+func resend(id string) *http.Request {
+	return jsonRequest("/resend/"+id+"?wait=true", "")
+}
+
+func TestResendSendsTheFullRequest(t *testing.T) {
+	sends := recordSends(t)
+	s := newTestServer(t)
+	body := `{
+		"recipients": ["a@example.com"],
+		"subject": "Hi",
+		"template": "Hello {{.name}}",
+		"variables": {"a@example.com": {"name": "Ann"}},
+		"attachments": [{"filename": "notes.txt", "content_type": "text/plain", "content": "aGVsbG8="}],
+		"reply_to": "replies@example.com",
+		"headers": {"X-Campaign-ID": "spring"},
+		"priority": "high",
+		"charset": "iso-8859-1"
+	}`
+	w := record(s.sendEmailHandler, jsonRequest("/send-email?wait=true", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("send status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	records := s.queue.history.(*memHistoryStore).snapshot()
+	if len(records) != 1 {
+		t.Fatalf("got %d history records, want 1", len(records))
+	}
+
+	w = record(s.resendHandler, resend(records[0].ID))
+	if w.Code != http.StatusOK {
+		t.Fatalf("resend status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if response.ResendOf != records[0].ID {
+		t.Errorf("resend_of = %q, want %q", response.ResendOf, records[0].ID)
+	}
+
+	sent := sends.wait(t, 2)
+	original, resent := sent[0].msg, sent[1].msg
+	for _, want := range []string{"Hello Ann", "Reply-To: replies@example.com", "X-Campaign-Id: spring", "X-Priority: 1", "charset=iso-8859-1", "filename=notes.txt"} {
+		if !bytes.Contains(original, []byte(want)) {
+			t.Fatalf("original message doesn't contain %q:\n%s", want, original)
+		}
+		if !bytes.Contains(resent, []byte(want)) {
+			t.Errorf("resent message doesn't contain %q", want)
+		}
+	}
+	if parseMessage(t, original).Header.Get("Message-ID") == parseMessage(t, resent).Header.Get("Message-ID") {
+		t.Error("resend reused the original Message-ID")
+	}
+	if got := s.queue.history.(*memHistoryStore).snapshot(); len(got) != 2 || got[1].ResendOf != records[0].ID {
+		t.Errorf("resend history record = %+v, want it marked as a resend", got[len(got)-1])
+	}
+}
+
+// records from before requests were kept are resent from their plain fields
+func TestResendSendsTheOriginalEmail(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	history := s.queue.history.(*memHistoryStore)
+	history.record(context.Background(), sentEmailRecord{
+		ID:         "sent-1",
+		Subject:    "Hi",
+		Message:    "Hello",
+		Recipients: []string{"a@example.com"},
+		Cc:         []string{"cc@example.com"},
+		Status:     jobFailed,
+	})
+
+	w := record(s.resendHandler, resend("sent-1"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if response.ResendOf != "sent-1" {
+		t.Errorf("resend_of = %q, want sent-1", response.ResendOf)
+	}
+
+	var resentTo []string
+	for _, message := range sent.wait(t, 2) {
+		resentTo = append(resentTo, message.to...)
+	}
+	slices.Sort(resentTo)
+	if !slices.Equal(resentTo, []string{"a@example.com", "cc@example.com"}) {
+		t.Errorf("resent to %v, want the original recipients", resentTo)
+	}
+	resent, ok := history.waitFor(response.JobID)
+	if !ok || resent.ResendOf != "sent-1" || resent.Subject != "Hi" {
+		t.Errorf("resend history record = %+v, want it marked as a resend", resent)
+	}
+}
+
+func TestResendSkipsSuppressedRecipients(t *testing.T) {
+	s := newTestServer(t)
+	s.queue.history.record(context.Background(), sentEmailRecord{ID: "sent-1", Subject: "Hi", Message: "Hello", Recipients: []string{"a@example.com"}})
+	s.suppressions.suppress(context.Background(), "a@example.com")
+
+	w := record(s.resendHandler, resend("sent-1"))
+	var response struct {
+		Status     string   `json:"status"`
+		Suppressed []string `json:"suppressed"`
+	}
+	decodeBody(t, w, &response)
+	if w.Code != http.StatusOK || response.Status != statusSuppressed || len(response.Suppressed) != 1 {
+		t.Errorf("status = %d, body = %+v, want the recipient reported suppressed", w.Code, response)
+	}
+}
+
+func TestResendChecksRecipientsAgain(t *testing.T) {
+	s := newTestServer(t)
+	history := s.queue.history.(*memHistoryStore)
+	history.record(context.Background(), sentEmailRecord{ID: "sent-1", Request: &EmailRequest{
+		Subject:    "Hi",
+		Message:    "Hello",
+		Recipients: []string{"a@example.com", "b@example.com"},
+	}})
+	history.record(context.Background(), sentEmailRecord{ID: "sent-2", Request: &EmailRequest{
+		Subject:    "Hi",
+		Message:    "Hello",
+		Recipients: []string{"a@blocked.example"},
+	}})
+	s.suppressions.suppress(context.Background(), "b@example.com")
+	s.config.blockedDomains = newDomainSet([]string{"blocked.example"})
+
+	w := record(s.resendHandler, resend("sent-1"))
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if len(response.Suppressed) != 1 || response.Suppressed[0] != "b@example.com" {
+		t.Errorf("suppressed = %v, want b@example.com", response.Suppressed)
+	}
+	if len(response.Results) != 1 || response.Results[0].Recipient != "a@example.com" {
+		t.Errorf("results = %+v, want a@example.com alone sent to", response.Results)
+	}
+
+	assertError(t, record(s.resendHandler, resend("sent-2")), http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestResendUnknownRecord(t *testing.T) {
+	s := newTestServer(t)
+	assertError(t, record(s.resendHandler, resend("missing")), http.StatusNotFound, errCodeNotFound)
+
+	r := resend("missing")
+	r.Method = http.MethodGet
+	assertError(t, record(s.resendHandler, r), http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestHistoryRequestDropsSMTPPassword(t *testing.T) {
+	request := EmailRequest{Subject: "Hi", SMTP: &SMTPOverride{Password: "hunter2"}, MessageIDs: map[string]string{"a@example.com": "<id@example.com>"}}
+	stored := historyRequest(request)
+	if stored.SMTP.Password != "" || stored.MessageIDs != nil {
+		t.Errorf("stored request = %+v, want no password or Message-ID", stored)
+	}
+	if request.SMTP.Password != "hunter2" {
+		t.Error("original request's SMTP password was cleared")
+	}
+}
+
+func TestSendRecordsHistory(t *testing.T) {
+	fake := newFakeSMTPServer(t)
+	config := fake.config()
+	config.senderEmail = "me@example.com"
+	config.queueSize, config.queueWorkers = 1, 1
+	history := &memHistoryStore{}
+	queue := newEmailQueue(config, newMemJobStore(), history)
+	defer queue.stop()
+
+	before := time.Now()
+	jobID, err := queue.enqueue(context.Background(), EmailRequest{
+		Recipients: []string{"a@example.com"},
+		Cc:         []string{"cc@example.com"},
+		Subject:    "Hi",
+		Message:    "Hello",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, ok := history.waitFor(jobID)
+	if !ok {
+		t.Fatal("no history record written")
+	}
+
+	if sent.ID == "" || sent.Subject != "Hi" || sent.Message != "Hello" || sent.Status != jobSent ||
+		!slices.Equal(sent.Recipients, []string{"a@example.com"}) || !slices.Equal(sent.Cc, []string{"cc@example.com"}) {
+		t.Errorf("record = %+v, want the email as sent", sent)
+	}
+	if sent.SentAt.Before(before) {
+		t.Errorf("sent_at = %s, want the time of the send", sent.SentAt)
+	}
+	if len(sent.Results) != 2 || sent.Results[0].Response != "250 ok queued as 1234" {
+		t.Errorf("results = %+v, want the server's reply for each recipient", sent.Results)
+	}
+}
+
+func TestFailedSendRecordsHistory(t *testing.T) {
+	recordSleeps(t)
+	previous := sendMail
+	sendMail = func(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+		return nil, errors.New("550 mailbox unavailable")
+	}
+	t.Cleanup(func() { sendMail = previous })
+
+	history := &memHistoryStore{}
+	config := emailConfig{senderEmail: "me@example.com", queueSize: 1, queueWorkers: 1, retry: retryPolicy{maxAttempts: 1}}
+	queue := newEmailQueue(config, newMemJobStore(), history)
+	defer queue.stop()
+
+	jobID, err := queue.enqueue(context.Background(), EmailRequest{Recipients: []string{"a@example.com"}, Subject: "Hi", Message: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := history.waitFor(jobID)
+	if !ok || record.Status != jobFailed || !strings.Contains(record.Error, "550") || len(record.Results) != 1 {
+		t.Errorf("record = %+v, want the failure recorded", record)
+	}
+}
+
+func TestHistoryHandlerPages(t *testing.T) {
+	s := newTestServer(t)
+	history := s.queue.history.(*memHistoryStore)
+	for _, subject := range []string{"first", "second", "third"} {
+		history.record(context.Background(), sentEmailRecord{ID: subject, Subject: subject, Status: jobSent})
+	}
+
+	w := record(s.historyHandler, httptest.NewRequest(http.MethodGet, "/history?limit=2", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Emails []sentEmailRecord `json:"emails"`
+		pageInfo
+	}
+	decodeBody(t, w, &response)
+	if len(response.Emails) != 2 || response.Emails[0].Subject != "third" || response.Total != 3 ||
+		response.NextOffset == nil || *response.NextOffset != 2 {
+		t.Errorf("response = %+v, want the two most recent records and the next offset", response)
+	}
+
+	assertError(t, record(s.historyHandler, httptest.NewRequest(http.MethodGet, "/history?limit=-1", nil)), http.StatusBadRequest, errCodeInvalidRequest)
+	assertError(t, record(s.historyHandler, jsonRequest("/history", "")), http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// elements whose content is never shown as text
+var hiddenElements = map[string]bool{"head": true, "script": true, "style": true, "template": true}
+
+// elements set apart from the surrounding text by a blank line
+var paragraphElements = map[string]bool{
+	"p": true, "div": true, "blockquote": true, "pre": true, "hr": true, "table": true,
+	"ul": true, "ol": true, "section": true, "article": true, "header": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+// text written in place of the start tags of elements that break up text
+// without starting a paragraph
+var textBreaks = map[string]string{"br": "\n", "tr": "\n", "li": "\n* ", "td": " ", "th": " "}
+
+// a plain text rendering of an HTML body for clients that can't show HTML:
+// tags are stripped, entities decoded and whitespace collapsed, keeping
+// paragraphs and line breaks and the targets of links
+func htmlToText(source string) string {
+	var b strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	hidden := 0
+	// target and text offset of the link being written
+	var href string
+	linkStart := -1
+
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			return collapseLines(b.String())
+		case html.TextToken:
+			if hidden == 0 {
+				b.WriteString(collapseSpaces(string(tokenizer.Text())))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, hasAttr := tokenizer.TagName()
+			tag := string(name)
+			switch {
+			case hiddenElements[tag]:
+				if tokenType == html.StartTagToken {
+					hidden++
+				} else if tokenType == html.EndTagToken && hidden > 0 {
+					hidden--
+				}
+			case paragraphElements[tag]:
+				b.WriteString("\n\n")
+			case tag == "a" && tokenType == html.StartTagToken:
+				href, linkStart = "", b.Len()
+				for hasAttr {
+					var key, value []byte
+					key, value, hasAttr = tokenizer.TagAttr()
+					if string(key) == "href" {
+						href = string(value)
+					}
+				}
+			case tag == "a" && tokenType == html.EndTagToken:
+				// show where a link goes unless its text already does
+				text := strings.TrimSpace(b.String()[max(linkStart, 0):])
+				if (strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://")) && text != href {
+					b.WriteString(" (" + href + ")")
+				}
+				href, linkStart = "", -1
+			case tokenType != html.EndTagToken:
+				b.WriteString(textBreaks[tag])
+			}
+		}
+	}
+}
+
+// replace each run of whitespace in text with a single space, as browsers
+// display it
+func collapseSpaces(text string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range text {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// trim every line and reduce each run of blank lines to a single one,
+// dropping those at the start and end
+func collapseLines(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	for source, want := range map[string]string{
+		"<p>Hi <b>there</b></p>":            "Hi there",
+		"<p>First</p>\n\n\n<p>Second</p>":   "First\n\nSecond",
+		"Line one<br>Line two":              "Line one\nLine two",
+		"<ul><li>one</li><li>two</li></ul>": "* one\n* two",
+		"Fish &amp; chips &lt;3":            "Fish & chips <3",
+		"<head><title>Hidden</title><style>p{}</style></head><p>Shown</p><script>alert(1)</script>": "Shown",
+		`<a href="https://example.com/offer">See the offer</a>`:                                     "See the offer (https://example.com/offer)",
+		`<a href="https://example.com">https://example.com</a>`:                                     "https://example.com",
+		`<a href="mailto:me@example.com">Email us</a>`:                                              "Email us",
+		"  lots   of\n\tspace  ":                                                                    "lots of space",
+	} {
+		if got := htmlToText(source); got != want {
+			t.Errorf("htmlToText(%q) = %q, want %q", source, got, want)
+		}
+	}
+}
+
+func TestFormatHTMLOnlyMessageGeneratesText(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", HTMLMessage: "<p>Hi <b>there</b></p>"})
+	parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0].header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("parts = %+v, want a text part before the HTML", parts)
+	}
+	if got := strings.TrimSpace(parts[0].body); got != "Hi there" {
+		t.Errorf("text part = %q, want Hi there", got)
+	}
+
+	// a text version given with the HTML is kept
+	msg = formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hand written", HTMLMessage: "<p>Hi <b>there</b></p>"})
+	if parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative"); strings.TrimSpace(parts[0].body) != "Hand written" {
+		t.Errorf("text part = %q, want the request's message", parts[0].body)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// default time a key's response is replayed for
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// longest Idempotency-Key header accepted
+const maxIdempotencyKeyLength = 255
+
+// a stored response for an idempotency key, pending until the first
+// request using the key has completed
+type idempotencyRecord struct {
+	Key        string    `bson:"_id"`
+	Pending    bool      `bson:"pending"`
+	StatusCode int       `bson:"statusCode,omitempty"`
+	Body       []byte    `bson:"body,omitempty"`
+	ExpiresAt  time.Time `bson:"expiresAt"`
+}
+
+// persistence for idempotency keys
+type idempotencyStore interface {
+	// claim the key, or return the existing record when it is already claimed
+	reserve(ctx context.Context, key string, expiresAt time.Time) (record idempotencyRecord, reserved bool, err error)
+	complete(ctx context.Context, key string, statusCode int, body []byte) error
+	// forget the key so the request can be retried
+	release(ctx context.Context, key string) error
+}
+
+// idempotencyStore backed by a MongoDB collection with a TTL index on expiresAt
+type mongoIdempotencyStore struct {
+	collection *mongo.Collection
+}
+
+func (s mongoIdempotencyStore) reserve(ctx context.Context, key string, expiresAt time.Time) (idempotencyRecord, bool, error) {
+	record := idempotencyRecord{Key: key, Pending: true, ExpiresAt: expiresAt}
+	_, err := s.collection.InsertOne(ctx, record)
+	if err == nil {
+		return record, true, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return idempotencyRecord{}, false, err
+	}
+
+	var existing idempotencyRecord
+	if err := s.collection.FindOne(ctx, bson.M{"_id": key}).Decode(&existing); err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	if time.Now().Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+
+	// expired but not yet removed by the TTL monitor, take it over
+	result, err := s.collection.ReplaceOne(ctx, bson.M{"_id": key, "expiresAt": existing.ExpiresAt}, record)
+	if err != nil {
+		return idempotencyRecord{}, false, err
+	}
+	if result.ModifiedCount == 0 {
+		// another request took it over first
+		return idempotencyRecord{Key: key, Pending: true}, false, nil
+	}
+	return record, true, nil
+}
+
+func (s mongoIdempotencyStore) complete(ctx context.Context, key string, statusCode int, body []byte) error {
+	_, err := s.collection.UpdateByID(ctx, key, bson.M{"$set": bson.M{
+		"pending":    false,
+		"statusCode": statusCode,
+		"body":       body,
+	}})
+	return err
+}
+
+func (s mongoIdempotencyStore) release(ctx context.Context, key string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+// create the index that removes expired keys
+func ensureIdempotencyIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// replays the first response for requests repeating an Idempotency-Key
+type idempotency struct {
+	store idempotencyStore
+	ttl   time.Duration
+}
+
+// wrap a handler so a request repeating an Idempotency-Key gets the stored
+// response instead of being handled again; responses are only stored when
+// they aren't server errors, so those can be retried with the same key
+func (i *idempotency) handle(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength))
+			return
+		}
+		// keys are scoped to the API key so clients can't see each other's responses
+		key = idempotencyScope(r) + ":" + key
+
+		ctx, cancel := dbContext(r.Context())
+		record, reserved, err := i.store.reserve(ctx, key, time.Now().Add(i.ttl))
+		cancel()
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if !reserved {
+			if record.Pending {
+				writeJSONError(w, http.StatusConflict, errCodeConflict, "A request with this Idempotency-Key is still being processed")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		}
+
+		rec := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+		next(rec, r)
+		rec.writeTo(w)
+
+		ctx, cancel = dbContext(context.WithoutCancel(r.Context()))
+		defer cancel()
+		if rec.status >= http.StatusInternalServerError {
+			err = i.store.release(ctx, key)
+		} else {
+			err = i.store.complete(ctx, key, rec.status, rec.body.Bytes())
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("Could not store idempotent response", "error", err)
+		}
+	}
+}
+
+// hash of the request's API key, empty when authentication is off
+func idempotencyScope(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// holds a handler's response so it can be stored before being written
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+// copy the buffered response to w
+func (b *responseBuffer) writeTo(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
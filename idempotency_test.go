@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a send request carrying the Idempotency-Key
+func idempotentSend(key string) *http.Request {
+	r := jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)
+	r.Header.Set("Idempotency-Key", key)
+	return r
+}
+
+// the number of jobs the server has queued
+func queuedJobs(s *server) int {
+	return len(s.queue.store.(*memJobStore).jobs)
+}
+
+func TestIdempotencyKeyReplaysTheFirstResponse(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	handler := (&idempotency{store: newMemIdempotencyStore(), ttl: time.Hour}).handle(s.sendEmailHandler)
+
+	first := record(handler, idempotentSend("retry-1"))
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", first.Code, first.Body.String())
+	}
+	repeat := record(handler, idempotentSend("retry-1"))
+	if repeat.Code != first.Code || repeat.Body.String() != first.Body.String() || repeat.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("repeat = %d %q, want the first response replayed", repeat.Code, repeat.Body.String())
+	}
+	if jobs := queuedJobs(s); jobs != 1 {
+		t.Errorf("queued %d jobs, want exactly one", jobs)
+	}
+
+	if w := record(handler, idempotentSend("retry-2")); w.Code != http.StatusAccepted || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("another key: status = %d, replayed = %q, want it sent", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if jobs := queuedJobs(s); jobs != 2 {
+		t.Errorf("queued %d jobs, want one for each key", jobs)
+	}
+}
+
+func TestIdempotencyKeysExpire(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	handler := (&idempotency{store: newMemIdempotencyStore(), ttl: -time.Second}).handle(s.sendEmailHandler)
+
+	record(handler, idempotentSend("retry"))
+	if w := record(handler, idempotentSend("retry")); w.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("expired key was replayed")
+	}
+	if jobs := queuedJobs(s); jobs != 2 {
+		t.Errorf("queued %d jobs, want the send repeated once the key expired", jobs)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	store := newMemIdempotencyStore()
+	i := &idempotency{store: store, ttl: time.Hour}
+	var repeat int
+	handler := i.handle(func(w http.ResponseWriter, r *http.Request) {
+		// the same key arrives again while the first request is handled
+		repeat = record(i.handle(nil), idempotentSend("retry")).Code
+		writeJSON(w, http.StatusOK, map[string]string{})
+	})
+	record(handler, idempotentSend("retry"))
+	if repeat != http.StatusConflict {
+		t.Errorf("concurrent repeat status = %d, want 409", repeat)
+	}
+}
+
+func TestIdempotencyKeyIsReleasedOnServerErrors(t *testing.T) {
+	var calls int
+	handler := (&idempotency{store: newMemIdempotencyStore(), ttl: time.Hour}).handle(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed")
+	})
+	record(handler, idempotentSend("retry"))
+	record(handler, idempotentSend("retry"))
+	if calls != 2 {
+		t.Errorf("handler called %d times, want a failed request to be retryable", calls)
+	}
+}
+
+func TestIdempotencyKeysAreScopedToTheAPIKey(t *testing.T) {
+	var calls int
+	handler := (&idempotency{store: newMemIdempotencyStore(), ttl: time.Hour}).handle(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeJSON(w, http.StatusOK, map[string]string{})
+	})
+	for _, apiKey := range []string{"first-key", "second-key"} {
+		r := idempotentSend("retry")
+		r.Header.Set("X-API-Key", apiKey)
+		record(handler, r)
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want each API key's request handled", calls)
+	}
+}
+
+func TestIdempotencyKeyLength(t *testing.T) {
+	handler := (&idempotency{store: newMemIdempotencyStore(), ttl: time.Hour}).handle(nil)
+	assertError(t, record(handler, idempotentSend(strings.Repeat("k", maxIdempotencyKeyLength+1))), http.StatusBadRequest, errCodeInvalidRequest)
+}
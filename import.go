@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// addresses upserted per database write during an import
+const importBatchSize = 500
+
+// reads the addresses of an import one at a time along with the row they
+// are on, returning io.EOF once they have all been read
+type addressReader interface {
+	next() (address string, row int, err error)
+}
+
+// addresses in the first column of a CSV file, with an optional "email"
+// header row
+type csvAddresses struct {
+	reader *csv.Reader
+	row    int
+}
+
+func newCSVAddresses(r io.Reader) *csvAddresses {
+	reader := csv.NewReader(r)
+	// rows may carry extra columns, such as an exported tags column
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return &csvAddresses{reader: reader}
+}
+
+func (a *csvAddresses) next() (string, int, error) {
+	for {
+		record, err := a.reader.Read()
+		if err != nil {
+			return "", 0, err
+		}
+		a.row++
+		if a.row == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "email") {
+			continue
+		}
+		return unescapeCSVCell(record[0]), a.row, nil
+	}
+}
+
+// addresses in a JSON array of strings, decoded one element at a time
+type jsonAddresses struct {
+	decoder *json.Decoder
+	row     int
+}
+
+func (a *jsonAddresses) next() (string, int, error) {
+	if a.row == 0 {
+		if token, err := a.decoder.Token(); err != nil || token != json.Delim('[') {
+			return "", 0, fmt.Errorf("body must be a JSON array of email addresses")
+		}
+	}
+	if !a.decoder.More() {
+		return "", 0, io.EOF
+	}
+	a.row++
+	var address string
+	if err := a.decoder.Decode(&address); err != nil {
+		return "", 0, fmt.Errorf("element %d must be an email address string", a.row)
+	}
+	return address, a.row, nil
+}
+
+// a row of an import that wasn't stored
+type skippedRow struct {
+	Row    int    `json:"row"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// body of an /emails/import response
+type importReport struct {
+	Imported      int            `json:"imported"`
+	Skipped       []skippedRow   `json:"skipped"`
+	StorageErrors []storageError `json:"storage_errors,omitempty"`
+}
+
+// handles requests to store a CSV file or JSON array of recipient addresses
+func (s *server) importEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only POST method
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	if !s.limitRequestBody(w, r) {
+		return
+	}
+	var addresses addressReader
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "text/csv":
+		addresses = newCSVAddresses(r.Body)
+	case "application/json":
+		addresses = &jsonAddresses{decoder: json.NewDecoder(r.Body)}
+	default:
+		writeJSONError(w, http.StatusUnsupportedMediaType, errCodeMediaType, "Content-Type must be text/csv or application/json")
+		return
+	}
+
+	report, err := importAddresses(addresses, func(batch []string) (int, []storageError) {
+		ctx, cancel := dbContext(r.Context())
+		defer cancel()
+		// imported addresses have to confirm like any other new recipient
+		if s.config.requireConfirmation {
+			return s.emails.importUnconfirmed(ctx, batch, nil)
+		}
+		return s.emails.insert(ctx, batch, nil)
+	})
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Sprintf("Request body exceeds the maximum size of %d bytes", s.config.maxBodyBytes))
+		return
+	}
+	if err != nil {
+		// rows before the malformed one have already been stored
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Import stopped after %d stored addresses: %v", report.Imported, err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// validate and normalize every address read, passing valid ones to store in
+// batches and reporting invalid and repeated ones
+func importAddresses(addresses addressReader, store func(batch []string) (int, []storageError)) (importReport, error) {
+	report := importReport{Skipped: []skippedRow{}}
+	seen := make(map[string]bool)
+	batch := make([]string, 0, importBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		stored, failures := store(batch)
+		report.Imported += stored
+		report.StorageErrors = append(report.StorageErrors, failures...)
+		batch = batch[:0]
+	}
+
+	for {
+		value, row, err := addresses.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			flush()
+			return report, err
+		}
+
+		address := normalizeEmail(value)
+		switch {
+		case !isValidEmail(address):
+			report.Skipped = append(report.Skipped, skippedRow{Row: row, Value: value, Reason: "invalid email address"})
+		case seen[address]:
+			report.Skipped = append(report.Skipped, skippedRow{Row: row, Value: value, Reason: "duplicate"})
+		default:
+			seen[address] = true
+			batch = append(batch, address)
+			if len(batch) == importBatchSize {
+				flush()
+			}
+		}
+	}
+	flush()
+	return report, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// an import request of the body with the Content-Type
+func importRequest(contentType, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/emails/import", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func TestImportCSV(t *testing.T) {
+	store := newMemEmailStore("existing@example.com")
+	s := &server{config: emailConfig{maxBodyBytes: 1 << 20}, emails: store}
+	csv := "email\nA@example.com\nnot-an-address\nexisting@example.com\na@example.com\n b@example.com ,extra column\n"
+
+	w := record(s.importEmailsHandler, importRequest("text/csv", csv))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var report importReport
+	decodeBody(t, w, &report)
+	wantSkipped := []skippedRow{
+		{Row: 3, Value: "not-an-address", Reason: "invalid email address"},
+		{Row: 5, Value: "a@example.com", Reason: "duplicate"},
+	}
+	if report.Imported != 3 || !slices.Equal(report.Skipped, wantSkipped) {
+		t.Errorf("report = %+v, want 3 imported and the invalid and repeated rows skipped", report)
+	}
+	if got := store.addresses(); !slices.Equal(got, []string{"existing@example.com", "a@example.com", "b@example.com"}) {
+		t.Errorf("stored = %v", got)
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	store := newMemEmailStore()
+	s := &server{config: emailConfig{maxBodyBytes: 1 << 20}, emails: store}
+
+	w := record(s.importEmailsHandler, importRequest("application/json", `["a@example.com", "bad", "A@EXAMPLE.COM"]`))
+	var report importReport
+	decodeBody(t, w, &report)
+	if w.Code != http.StatusOK || report.Imported != 1 || len(report.Skipped) != 2 {
+		t.Errorf("status = %d, report = %+v, want one imported and two skipped", w.Code, report)
+	}
+
+	// a malformed element stops the import, keeping what came before it
+	w = record(s.importEmailsHandler, importRequest("application/json", `["b@example.com", 42, "c@example.com"]`))
+	if body := w.Body.String(); !strings.Contains(body, "after 1 stored") || !strings.Contains(body, "element 2") {
+		t.Errorf("body = %s, want the malformed element and stored count reported", body)
+	}
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+	if got := store.addresses(); !slices.Equal(got, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("stored = %v, want the addresses before the malformed element", got)
+	}
+
+	assertError(t, record(s.importEmailsHandler, importRequest("application/json", `{"emails":[]}`)), http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestImportStoresInBatches(t *testing.T) {
+	var rows strings.Builder
+	for i := 0; i < importBatchSize+1; i++ {
+		fmt.Fprintf(&rows, "user%d@example.com\n", i)
+	}
+	var batches []int
+	report, err := importAddresses(newCSVAddresses(strings.NewReader(rows.String())), func(batch []string) (int, []storageError) {
+		batches = append(batches, len(batch))
+		return len(batch), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != importBatchSize+1 || !slices.Equal(batches, []int{importBatchSize, 1}) {
+		t.Errorf("imported %d in batches of %v, want batches of at most %d", report.Imported, batches, importBatchSize)
+	}
+}
+
+func TestImportRejectsBadRequests(t *testing.T) {
+	s := &server{config: emailConfig{maxBodyBytes: 64}, emails: newMemEmailStore()}
+	assertError(t, record(s.importEmailsHandler, importRequest("text/plain", "a@example.com")), http.StatusUnsupportedMediaType, errCodeMediaType)
+	assertError(t, record(s.importEmailsHandler, importRequest("text/csv", strings.Repeat("a@example.com\n", 10))), http.StatusRequestEntityTooLarge, errCodeTooLarge)
+	assertError(t, record(s.importEmailsHandler, httptest.NewRequest(http.MethodGet, "/emails/import", nil)), http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// default limit on send requests handled at once
+const defaultMaxInFlightSends = 100
+
+// seconds a client turned away by the in-flight limit is asked to wait
+const inFlightRetryAfter = 1
+
+// limits how many requests are handled at once, turning away the rest
+// rather than letting goroutines and connections pile up; a nil limit
+// admits every request
+type inFlightLimit struct {
+	slots chan struct{}
+}
+
+func newInFlightLimit(max int) *inFlightLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &inFlightLimit{slots: make(chan struct{}, max)}
+}
+
+// wrap a handler so it runs only while a slot is free, responding 503 when
+// the limit has been reached
+func (l *inFlightLimit) limit(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case l.slots <- struct{}{}:
+			defer func() { <-l.slots }()
+			next(w, r)
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(inFlightRetryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Too many sends are in progress, try again later")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestInFlightLimitTurnsAwayRequestsOverTheLimit(t *testing.T) {
+	limit := newInFlightLimit(2)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := limit.limit(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := func() *http.Request { return httptest.NewRequest(http.MethodPost, "/send-email", nil) }
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = record(handler, request()).Code
+		}(i)
+		<-started
+	}
+
+	w := record(handler, request())
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+	}
+	assertError(t, w, http.StatusServiceUnavailable, errCodeUnavailable)
+
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusNoContent {
+			t.Errorf("request %d in flight: status = %d, want it handled", i+1, code)
+		}
+	}
+
+	// finished requests give their slots back
+	go func() { <-started }()
+	if w := record(handler, request()); w.Code != http.StatusNoContent {
+		t.Errorf("status = %d after the sends finished, want the request handled", w.Code)
+	}
+}
+
+func TestInFlightLimitIsOffWhenNotPositive(t *testing.T) {
+	if limit := newInFlightLimit(0); limit != nil {
+		t.Fatalf("limit = %+v, want none for 0", limit)
+	}
+	var limit *inFlightLimit
+	handler := limit.limit(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	if w := record(handler, httptest.NewRequest(http.MethodPost, "/send-email", nil)); w.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want every request handled", w.Code)
+	}
+}
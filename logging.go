@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// supported values for LOG_FORMAT
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// handler writing log lines to w at LOG_LEVEL and above in LOG_FORMAT,
+// info level JSON by default, with secrets redacted
+func newLogHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	var minLevel slog.Level
+	if level != "" {
+		if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL must be one of debug, info, warn or error")
+		}
+	}
+	options := &slog.HandlerOptions{Level: minLevel, ReplaceAttr: redactSecrets}
+	switch strings.ToLower(format) {
+	case "", logFormatJSON:
+		return slog.NewJSONHandler(w, options), nil
+	case logFormatText:
+		return slog.NewTextHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("LOG_FORMAT must be one of json or text")
+}
+
+// parts of attribute keys that mark their values as secret
+var secretLogKeys = []string{"password", "secret", "token", "apikey", "api_key", "authorization"}
+
+// written in place of secret values
+const redactedLogValue = "[REDACTED]"
+
+// replace the values of attributes whose keys name a secret, so credentials
+// never reach the logs at any level even when logged by mistake
+func redactSecrets(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, secret := range secretLogKeys {
+		if strings.Contains(key, secret) {
+			return slog.String(a.Key, redactedLogValue)
+		}
+	}
+	return a
+}
+
+// keys for values stored in a request context
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// attach a logger to the context
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// the logger attached to the context, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// the ID of the request the context belongs to, if any
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// log a startup failure and exit
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// records the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// expose the underlying writer to http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// give every request an ID, returned in X-Request-ID and attached to all of
+// its log lines
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newUUID()
+		w.Header().Set("X-Request-ID", id)
+
+		logger := slog.Default().With("request_id", id)
+		ctx := context.WithValue(withLogger(r.Context(), logger), requestIDKey, id)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		logger.Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+		)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// send the default logger's output to a buffer as JSON for the duration of
+// the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestWithRequestIDLogsEachRequest(t *testing.T) {
+	logs := captureLogs(t)
+	var seenID string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = requestIDFrom(r.Context())
+		loggerFrom(r.Context()).Info("handling")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/emails", nil))
+	id := w.Header().Get("X-Request-ID")
+	if id == "" || id != seenID {
+		t.Fatalf("X-Request-ID = %q, handler saw %q, want the same ID", id, seenID)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2:\n%s", len(lines), logs)
+	}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["request_id"] != id {
+			t.Errorf("log line %s has request_id %v, want %s", line, entry["request_id"], id)
+		}
+	}
+	var completed map[string]any
+	json.Unmarshal([]byte(lines[1]), &completed)
+	if completed["status"] != float64(http.StatusTeapot) || completed["path"] != "/emails" {
+		t.Errorf("completion line = %s, want the status and path", lines[1])
+	}
+}
+
+func TestLoggerFromDefaultsToTheDefaultLogger(t *testing.T) {
+	if loggerFrom(httptest.NewRequest(http.MethodGet, "/", nil).Context()) != slog.Default() {
+		t.Error("context without a logger did not give the default logger")
+	}
+}
+
+func TestNewLogHandlerFiltersByLevel(t *testing.T) {
+	for level, want := range map[string][]string{
+		"":      {"info", "warn", "error"},
+		"debug": {"debug", "info", "warn", "error"},
+		"WARN":  {"warn", "error"},
+		"error": {"error"},
+	} {
+		var buf bytes.Buffer
+		handler, err := newLogHandler(&buf, level, "text")
+		if err != nil {
+			t.Fatalf("LOG_LEVEL %q: %v", level, err)
+		}
+		logger := slog.New(handler)
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+		logger.Error("error")
+
+		var logged []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			logged = append(logged, strings.TrimPrefix(line[strings.Index(line, "msg="):], "msg="))
+		}
+		if strings.Join(logged, " ") != strings.Join(want, " ") {
+			t.Errorf("LOG_LEVEL %q logged %v, want %v", level, logged, want)
+		}
+	}
+}
+
+func TestNewLogHandlerFormats(t *testing.T) {
+	for format, isJSON := range map[string]bool{"": true, "json": true, "TEXT": false} {
+		var buf bytes.Buffer
+		handler, err := newLogHandler(&buf, "", format)
+		if err != nil {
+			t.Fatalf("LOG_FORMAT %q: %v", format, err)
+		}
+		slog.New(handler).Info("hello", "recipient", "a@example.com")
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); (err == nil) != isJSON {
+			t.Errorf("LOG_FORMAT %q wrote %q, want JSON %t", format, buf.String(), isJSON)
+		}
+		if !strings.Contains(buf.String(), "a@example.com") {
+			t.Errorf("LOG_FORMAT %q wrote %q, want the attribute", format, buf.String())
+		}
+	}
+}
+
+func TestNewLogHandlerRejectsUnknownSettings(t *testing.T) {
+	if _, err := newLogHandler(io.Discard, "verbose", ""); err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Errorf("err = %v, want an unknown LOG_LEVEL rejected", err)
+	}
+	if _, err := newLogHandler(io.Discard, "", "xml"); err == nil || !strings.Contains(err.Error(), "LOG_FORMAT") {
+		t.Errorf("err = %v, want an unknown LOG_FORMAT rejected", err)
+	}
+}
+
+func TestLogsRedactSecrets(t *testing.T) {
+	for _, format := range []string{logFormatJSON, logFormatText} {
+		var buf bytes.Buffer
+		handler, _ := newLogHandler(&buf, "debug", format)
+		logger := slog.New(handler)
+		logger.Debug("connecting", "smtp_password", "hunter2", "API_KEY", "key-123")
+		logger.Info("confirming", slog.Group("request", "confirmation_token", "tok-456", "email", "a@example.com"))
+		logger.With("Authorization", "Bearer abc").Error("unauthorized")
+
+		logs := buf.String()
+		for _, secret := range []string{"hunter2", "key-123", "tok-456", "Bearer abc"} {
+			if strings.Contains(logs, secret) {
+				t.Errorf("%s logs contain %q:\n%s", format, secret, logs)
+			}
+		}
+		if strings.Count(logs, redactedLogValue) != 4 || !strings.Contains(logs, "a@example.com") {
+			t.Errorf("%s logs = %s, want only the secret values redacted", format, logs)
+		}
+	}
+}
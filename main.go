@@ -3,18 +3,29 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"mime"
+	"net"
 	"net/http"
-	"net/smtp"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/net/idna"
 )
 
 // structure for the email request payload
@@ -22,205 +33,988 @@ type EmailRequest struct {
 	Subject    string   `json:"subject"`
 	Message    string   `json:"message"`
 	Recipients []string `json:"recipients"`
+	Cc         []string `json:"cc"`
+	Bcc        []string `json:"bcc"`
+	// optional HTML alternative to Message
+	HTMLMessage string       `json:"html_message,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// optional address replies should be routed to
+	ReplyTo string `json:"reply_to,omitempty"`
+	// optional RFC 3339 time to send the email at instead of immediately
+	SendAt *time.Time `json:"send_at,omitempty"`
+	// optional text/template and html/template bodies rendered per recipient,
+	// replacing Message and HTMLMessage
+	Template     string `json:"template,omitempty"`
+	HTMLTemplate string `json:"html_template,omitempty"`
+	// template variables keyed by recipient address
+	Variables map[string]map[string]string `json:"variables,omitempty"`
+	// optional Markdown body, sent as the plain text part and rendered to HTML
+	Markdown string `json:"markdown,omitempty"`
+	// validate and format the email without sending it
+	DryRun bool `json:"dry_run,omitempty"`
+	// optional SMTP settings used instead of the configured ones
+	SMTP *SMTPOverride `json:"smtp,omitempty"`
+	// optional URL notified with the outcome once the email has been sent or has failed
+	CallbackURL string `json:"callback_url,omitempty"`
+	// optional priority, one of high, normal (the default) or low
+	Priority string `json:"priority,omitempty"`
+	// optional extra headers such as X-Campaign-ID
+	Headers map[string]string `json:"headers,omitempty"`
+	// optional charset the bodies are sent in, utf-8 by default
+	Charset string `json:"charset,omitempty"`
+	// optional tags added to every stored recipient of the email
+	Tags []string `json:"tags,omitempty"`
+	// Message-ID of the message each recipient, cc and bcc address is sent,
+	// generated when the email is accepted so they can be returned to the
+	// caller; cc and bcc addresses share the one of their copy
+	MessageIDs map[string]string `json:"-"`
+	// ID of the send history record this email resends
+	ResendOf string `json:"-"`
+}
+
+// normalize every address in the request in place and drop duplicates,
+// keeping the first occurrence; an address in more than one field is kept in
+// the most visible one, recipients before cc before bcc
+func (request *EmailRequest) normalizeAddresses() {
+	seen := make(map[string]bool)
+	dedupe := func(addresses []string) []string {
+		kept := addresses[:0]
+		for _, address := range addresses {
+			address = normalizeEmail(address)
+			if seen[address] {
+				continue
+			}
+			seen[address] = true
+			kept = append(kept, address)
+		}
+		return kept
+	}
+	request.Recipients = dedupe(request.Recipients)
+	request.Cc = dedupe(request.Cc)
+	request.Bcc = dedupe(request.Bcc)
+	request.ReplyTo = normalizeEmail(request.ReplyTo)
+
+	if len(request.Variables) > 0 {
+		variables := make(map[string]map[string]string, len(request.Variables))
+		for address, vars := range request.Variables {
+			variables[normalizeEmail(address)] = vars
+		}
+		request.Variables = variables
+	}
+}
+
+// report whether the request has any message body
+func (request EmailRequest) hasBody() bool {
+	for _, body := range []string{request.Message, request.HTMLMessage, request.Markdown, request.Template, request.HTMLTemplate} {
+		if strings.TrimSpace(body) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// returns every address the request should be delivered to
+func (request EmailRequest) allAddresses() []string {
+	addresses := make([]string, 0, len(request.Recipients)+len(request.Cc)+len(request.Bcc))
+	addresses = append(addresses, request.Recipients...)
+	addresses = append(addresses, request.Cc...)
+	return append(addresses, request.Bcc...)
 }
 
 var client *mongo.Client
 
-func connectToMongoDB() {
+// database and collection names the service uses
+var mongoSettings mongoConfig
+
+// how long in-flight requests get to complete on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// how long a request waiting for its email to be sent is held before it
+// gets the asynchronous response instead
+const sendWaitTimeout = 2 * time.Minute
+
+// MongoDB error code for a unique index violation
+const duplicateKeyErrorCode = 11000
+
+// shared state for the HTTP handlers, built once at startup
+type server struct {
+	config emailConfig
+	queue  *emailQueue
+	// checks the database is reachable, used by the readiness probe
+	ping func(ctx context.Context) error
+	// checks recipient domains accept mail, nil when VALIDATE_MX is off
+	mx *mxValidator
+	// addresses that have unsubscribed
+	suppressions suppressionStore
+	// recipient addresses that have been sent to
+	emails emailStore
+	// summary of the send history
+	stats *statsCache
+	// per client limit on send requests, which batches are also counted against
+	limiter *rateLimiter
+	// outcome of the startup SPF check, empty when CHECK_SPF is off
+	spfStatus string
+}
+
+func connectToMongoDB(config mongoConfig) {
 	var err error
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
+	mongoSettings = config
+	clientOptions := options.Client().ApplyURI(config.uri)
 	client, err = mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Could not connect to MongoDB", "error", err)
 	}
-	err = client.Ping(context.TODO(), nil)
+	err = waitForMongoDB(context.Background(), config, func(ctx context.Context) error {
+		return client.Ping(ctx, nil)
+	})
 	if err != nil {
-		log.Fatal(err)
+		fatal("Could not reach MongoDB", "error", err)
+	}
+	slog.Info("Connected to MongoDB!")
+}
+
+// ping MongoDB until it answers, with backoff between attempts, so the
+// service can start alongside a database that is still coming up. Gives up
+// after the configured attempts or connect timeout, returning the last error
+func waitForMongoDB(ctx context.Context, config mongoConfig, ping func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, config.connectTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancelPing := context.WithTimeout(ctx, config.timeout)
+		err := ping(pingCtx)
+		cancelPing()
+		if err == nil {
+			return nil
+		}
+		if attempt >= config.connectRetry.maxAttempts || ctx.Err() != nil {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		backoff := min(config.connectRetry.backoff(attempt), time.Until(deadline))
+		slog.Warn("Could not reach MongoDB, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		sleep(backoff)
+	}
+}
+
+// the configured database
+func database() *mongo.Database {
+	return client.Database(mongoSettings.database)
+}
+
+// derive a context for a MongoDB operation, bounded by the configured timeout
+func dbContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, mongoSettings.timeout)
+}
+
+// collection holding stored recipient addresses
+func emailsCollection() *mongo.Collection {
+	return database().Collection(mongoSettings.collection)
+}
+
+// create the indexes the service relies on
+func ensureIndexes() {
+	// enforce one document per address, even across concurrent requests
+	collection := emailsCollection()
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		fatal("Could not create unique index on emails", "error", err)
+	}
+
+	_, err = database().Collection("suppressions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		fatal("Could not create unique index on suppressions", "error", err)
+	}
+
+	// confirmation links look recipients up by token
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "confirmToken", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		fatal("Could not create index on confirmation tokens", "error", err)
+	}
+
+	if err := ensureIdempotencyIndexes(ctx, database().Collection("idempotencyKeys")); err != nil {
+		fatal("Could not create TTL index on idempotency keys", "error", err)
 	}
-	log.Println("Connected to MongoDB!")
 }
 
 // handles the incoming HTTP request to send an email
-func sendEmailHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 	// restrict to only POST method
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	r, span := startRequestSpan(r, "send_email")
+	defer span.End()
+
+	if s.smtpUnavailable(w) {
 		return
 	}
 
-	// decode the request payload
 	var request EmailRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !s.decodeEmailRequest(w, r, &request) {
 		return
 	}
+	s.send(w, r, request)
+}
+
+// fail fast while the SMTP server is known to be down, reporting whether a
+// 503 response has been written
+func (s *server) smtpUnavailable(w http.ResponseWriter) bool {
+	retryAfter := s.config.breaker.retryAfter()
+	if retryAfter <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "SMTP server is unavailable, try again later")
+	return true
+}
 
-	collection := client.Database("micemail").Collection("emails")
+// validate a decoded send request and queue it, or preview it for a dry run
+func (s *server) send(w http.ResponseWriter, r *http.Request, request EmailRequest) {
+	emailConfig := s.config
 
-	// validate recipient email addresses
-	for _, recipient := range request.Recipients {
-		if !isValidEmail(recipient) {
-			http.Error(w, fmt.Sprintf("Recipient email address '%s' is not valid", recipient), http.StatusBadRequest)
+	dryRun, err := isDryRun(r, request)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "dry_run must be true or false")
+		return
+	}
+
+	// ?wait=true holds the response until the email has been sent, reporting
+	// the outcome for each recipient
+	wait := false
+	if raw := r.URL.Query().Get("wait"); raw != "" {
+		if wait, err = strconv.ParseBool(raw); err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "wait must be true or false")
 			return
 		}
+	}
+	if wait && request.SendAt != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "wait cannot be combined with send_at")
+		return
+	}
 
-		// check for duplicate and insert if not exists
-		filter := bson.M{"email": recipient}
-		var result struct{ Email string }
-		err := collection.FindOne(context.TODO(), filter).Decode(&result)
-		if err == mongo.ErrNoDocuments {
-			_, err := collection.InsertOne(context.TODO(), bson.M{
-				"email": recipient,
-			})
-			if err != nil {
-				log.Printf("Could not insert email %s: %v", recipient, err)
+	validateCtx, span := tracer.Start(r.Context(), "validate")
+	err = s.validateRequest(validateCtx, &request)
+	recordSpanError(span, err)
+	span.End()
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	// skip recipients who have unsubscribed
+	suppressed, err := s.suppressions.suppressed(ctx, request.allAddresses())
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	skipped := request.removeSuppressed(suppressed)
+	// recipients who haven't confirmed are asked to instead of being sent to
+	unconfirmed, err := s.removeUnconfirmed(ctx, &request)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	if len(request.allAddresses()) == 0 {
+		response := map[string]any{"status": statusSuppressed, "suppressed": skipped}
+		if len(unconfirmed) > 0 {
+			response["status"], response["unconfirmed"] = statusUnconfirmed, unconfirmed
+			if !dryRun {
+				s.requestConfirmation(ctx, unconfirmed, request.Tags)
 			}
 		}
+		writeJSON(w, http.StatusOK, response)
+		return
 	}
 
-	emailConfig, err := getEmailConfig()
+	// each message of the send gets its own Message-ID, so callers can match
+	// delivery and bounce notifications to the recipient
+	request.assignMessageIDs(emailConfig.senderEmail)
+
+	// format the messages and return their headers instead of sending
+	if dryRun {
+		envelopes, err := buildEnvelopes(emailConfig, request)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+			return
+		}
+		previews, err := previewEnvelopes(envelopes)
+		if err != nil {
+			loggerFrom(ctx).Error("Could not parse formatted message", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to format email")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"dry_run": true, "messages": previews, "suppressed": skipped})
+		return
+	}
+
+	// store recipients that haven't been seen before, reporting failures
+	// without holding up the send
+	storeCtx, span := tracer.Start(ctx, "store_recipients")
+	stored, storageErrs := s.emails.insert(storeCtx, request.allAddresses(), request.Tags)
+	span.SetAttributes(attribute.Int("recipients.stored", stored), attribute.Int("recipients.failed", len(storageErrs)))
+	if len(storageErrs) > 0 {
+		span.SetStatus(codes.Error, storageErrs[0].Error)
+		loggerFrom(ctx).Error("Could not store recipient emails", "failed", len(storageErrs), "error", storageErrs[0].Error)
+	}
+	span.End()
+
+	// hand the send off to the queue workers
+	var done chan jobOutcome
+	if wait {
+		done = make(chan jobOutcome, 1)
+	}
+	jobID, err := s.queue.submit(ctx, job{request: request, done: done})
+	if err == errQueueFull {
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeUnavailable, "Too many emails are waiting to be sent, try again later")
+		return
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Could not queue email", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "Failed to queue email")
+		return
+	}
+	// only once the send is queued, so a refused send asks nobody to confirm
+	s.requestConfirmation(ctx, unconfirmed, request.Tags)
+
+	if wait {
+		select {
+		case outcome := <-done:
+			writeJSON(w, outcomeStatusCode(outcome.status), sendResponse{
+				JobID:         jobID,
+				MessageIDs:    request.MessageIDs,
+				Status:        outcome.status,
+				Results:       outcome.results,
+				Suppressed:    skipped,
+				Unconfirmed:   unconfirmed,
+				Stored:        stored,
+				StorageErrors: storageErrs,
+				ResendOf:      request.ResendOf,
+			})
+			return
+		case <-time.After(sendWaitTimeout):
+			// still sending, fall back to the asynchronous response
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	status := jobQueued
+	if request.SendAt != nil {
+		status = jobScheduled
+	}
+
+	writeJSON(w, http.StatusAccepted, sendResponse{
+		JobID:         jobID,
+		MessageIDs:    request.MessageIDs,
+		Status:        status,
+		Suppressed:    skipped,
+		Unconfirmed:   unconfirmed,
+		Stored:        stored,
+		StorageErrors: storageErrs,
+		ResendOf:      request.ResendOf,
+	})
+}
+
+// body of a successful /send-email response
+type sendResponse struct {
+	JobID string `json:"job_id"`
+	// Message-ID of the message each address is sent, keyed by address
+	MessageIDs map[string]string `json:"message_ids"`
+	Status     string            `json:"status"`
+	// per-recipient outcome, only when the send was waited on
+	Results    []deliveryResult `json:"results,omitempty"`
+	Suppressed []string         `json:"suppressed"`
+	// recipients sent a confirmation link instead, or still to confirm
+	Unconfirmed []string `json:"unconfirmed,omitempty"`
+	// how many addresses were stored, and those that couldn't be
+	Stored        int            `json:"stored"`
+	StorageErrors []storageError `json:"storage_errors,omitempty"`
+	// ID of the send history record resent, only for resends
+	ResendOf string `json:"resend_of,omitempty"`
+}
+
+// response status for a send that was waited on: 200 when every recipient
+// was sent to, 207 when only some were and 502 when none were
+func outcomeStatusCode(status string) int {
+	switch status {
+	case jobSent:
+		return http.StatusOK
+	case jobPartial:
+		return http.StatusMultiStatus
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// decode the request payload, rejecting bodies that aren't JSON or are over
+// the size limit; reports whether decoding succeeded, having written the
+// error response if not
+func (s *server) decodeEmailRequest(w http.ResponseWriter, r *http.Request, request any) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, errCodeMediaType, "Content-Type must be application/json")
+		return false
+	}
+
+	if !s.limitRequestBody(w, r) {
+		return false
+	}
+	decoder := json.NewDecoder(r.Body)
+	// catch misspelled fields, which would otherwise be silently ignored
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(request)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Sprintf("Request body exceeds the maximum size of %d bytes", s.config.maxBodyBytes))
+		return false
+	}
+	if field, ok := strings.CutPrefix(fmt.Sprint(err), "json: unknown field "); ok {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Request contains unknown field %s", field))
+		return false
+	}
 	if err != nil {
-		log.Fatal(err)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// sanitize, normalize and validate a request in place before it is sent
+func (s *server) validateRequest(ctx context.Context, request *EmailRequest) error {
+	// reject header injection attempts through the subject
+	subject, err := sanitizeHeaderValue(request.Subject)
+	if err != nil {
+		return fmt.Errorf("Subject is not valid: %v", err)
+	}
+	request.Subject = subject
+
+	// fill in DEFAULT_SUBJECT and DEFAULT_BODY for fields the request left
+	// empty, so they pass the checks below
+	if request.Subject == "" {
+		request.Subject = s.config.defaultSubject
+	}
+	if !request.hasBody() && s.config.defaultBody != "" {
+		request.Message = s.config.defaultBody
 	}
 
-	// authenticate with the SMTP server
-	auth := smtp.PlainAuth("", emailConfig.senderEmail, emailConfig.password, emailConfig.smtpServer)
-	// format the SMTP server address
-	addr := fmt.Sprintf("%s:%s", emailConfig.smtpServer, emailConfig.smtpPort)
+	// require some content, and a subject unless ALLOW_EMPTY_SUBJECT is set
+	if request.Subject == "" {
+		if !request.hasBody() {
+			return fmt.Errorf("Subject and message must not both be empty")
+		}
+		if !s.config.allowEmptySubject {
+			return fmt.Errorf("Subject must not be empty")
+		}
+	}
 
-	msg := formatEmailMessage(request.Recipients, request.Subject, request.Message)
+	// normalize addresses so validation, storage and dedup all agree
+	request.normalizeAddresses()
 
-	maxRetries := 3
-	retryCount := 0
-	backoff := 1 * time.Second
+	if len(request.allAddresses()) == 0 {
+		return fmt.Errorf("At least one recipient, cc or bcc address is required")
+	}
+	if count := len(request.allAddresses()); count > s.config.maxRecipients {
+		return fmt.Errorf("Too many recipients: %d addresses given, at most %d are allowed", count, s.config.maxRecipients)
+	}
 
-	for {
-		if err := smtp.SendMail(addr, auth, emailConfig.senderEmail, request.Recipients, msg); err != nil {
-			retryCount++
-			if retryCount >= maxRetries {
-				// if max retries reached, return an error response
-				http.Error(w, "Failed to send email after multiple attempts", http.StatusInternalServerError)
-				return
+	// validate recipient, cc and bcc email addresses
+	for _, recipient := range request.allAddresses() {
+		if _, err := sanitizeHeaderValue(recipient); err != nil {
+			return fmt.Errorf("Recipient email address is not valid: %v", err)
+		}
+		if !isValidEmail(recipient) {
+			return fmt.Errorf("Recipient email address '%s' is not valid", recipient)
+		}
+	}
+
+	// reject throwaway domains
+	if s.config.blockedDomains != nil {
+		for _, recipient := range request.allAddresses() {
+			if s.config.blockedDomains.contains(emailDomain(recipient)) {
+				return fmt.Errorf("Recipient domain '%s' is not allowed", emailDomain(recipient))
 			}
-			// log retry attempt
-			log.Printf("Attempt %d failed, retrying in %v...\n", retryCount, backoff)
-			time.Sleep(backoff)
-			// exponential backoff
-			backoff *= 2
-		} else {
-			// store sent emails
-			sentEmailCollection := client.Database("micemail").Collection("sentEmails")
-			_, err := sentEmailCollection.InsertOne(context.TODO(), bson.M{
-				"subject":    request.Subject,
-				"message":    request.Message,
-				"recipients": request.Recipients,
-				"sentAt":     time.Now(),
-			})
-			if err != nil {
-				log.Printf("Could not store sent email details: %v", err)
+		}
+	}
+
+	// reject domains that can't receive mail
+	if s.mx != nil {
+		for _, recipient := range request.allAddresses() {
+			if !s.mx.acceptsMail(ctx, emailDomain(recipient)) {
+				return fmt.Errorf("Recipient domain '%s' does not accept mail", emailDomain(recipient))
 			}
+		}
+	}
 
-			break
+	if request.ReplyTo != "" {
+		if _, err := sanitizeHeaderValue(request.ReplyTo); err != nil || !isValidEmail(request.ReplyTo) {
+			return fmt.Errorf("Reply-To email address is not valid")
 		}
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Email sent successfully"))
+	if request.SendAt != nil && !request.SendAt.After(time.Now()) {
+		return fmt.Errorf("send_at must be in the future")
+	}
+
+	if _, ok := priorityHeaders[request.Priority]; !ok && request.Priority != "" {
+		return fmt.Errorf("priority must be one of high, normal or low")
+	}
+
+	if err := validateHeaders(request.Headers); err != nil {
+		return err
+	}
+
+	if request.Tags, err = normalizeTags(request.Tags); err != nil {
+		return err
+	}
+
+	if request.CallbackURL != "" {
+		if err := validateCallbackURL(request.CallbackURL); err != nil {
+			return err
+		}
+	}
+
+	if request.SMTP != nil {
+		if err := request.SMTP.validate(s.config.smtpServer); err != nil {
+			return err
+		}
+		// scheduled jobs are stored, and SMTP passwords never are
+		if request.SendAt != nil && request.SMTP.Password != "" {
+			return fmt.Errorf("smtp.password cannot be combined with send_at")
+		}
+	}
+
+	bodyBytes := len(request.Message) + len(request.HTMLMessage) + len(request.Markdown) + len(request.Template) + len(request.HTMLTemplate)
+	if int64(bodyBytes) > s.config.maxBodyBytes {
+		return tooLargeError(fmt.Sprintf("Message body exceeds the maximum size of %d bytes", s.config.maxBodyBytes))
+	}
+
+	if err := request.applyMarkdown(); err != nil {
+		return err
+	}
+
+	if err := validateTemplates(*request); err != nil {
+		return err
+	}
+
+	if err := request.validateCharset(); err != nil {
+		return err
+	}
+
+	if err := validateAttachments(ctx, request.Attachments, attachmentLimits{
+		maxBytes:     min(s.config.maxAttachmentBytes, s.config.maxBodyBytes),
+		maxCount:     s.config.maxAttachments,
+		allowedTypes: s.config.allowedAttachmentTypes,
+	}); err != nil {
+		return err
+	}
+
+	// templates are checked as written, references in variables aren't seen
+	return validateInlineAttachments(request.Attachments, request.HTMLMessage+request.HTMLTemplate)
 }
 
-// Handler function to get all emails from the database
-func getAllEmailsHandler(w http.ResponseWriter, r *http.Request) {
+// handles requests for the status of a queued email
+func (s *server) getJobHandler(w http.ResponseWriter, r *http.Request) {
 	// restrict to only GET method
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
 		return
 	}
 
-	collection := client.Database("micemail").Collection("emails")
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
 
-	// find all documents
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	record, err := s.queue.store.get(ctx, id)
+	if err == errJobNotFound {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Job '%s' not found", id))
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
-	defer cursor.Close(context.TODO())
 
-	var emails []bson.M
-	if err = cursor.All(context.TODO(), &emails); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	writeJSON(w, http.StatusOK, record)
+}
+
+// Handler function to get all emails from the database, optionally filtered
+// by the domain and contains query parameters
+func (s *server) getAllEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
 		return
 	}
 
-	// set response header to application/json
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	page, err := parsePage(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	filter := emailsFilter(r.URL.Query())
+	total, err := s.emails.count(ctx, filter)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	emails, err := s.emails.list(ctx, filter, page)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
 
 	// encode and send the emails as JSON
-	if err := json.NewEncoder(w).Encode(emails); err != nil {
-		log.Printf("Error encoding emails to JSON: %v", err)
+	writeJSON(w, http.StatusOK, struct {
+		Emails []storedRecipient `json:"emails"`
+		pageInfo
+	}{emails, page.info(total)})
+}
+
+// handles requests under /emails/, the count of stored recipients at
+// /emails/count, a CSV download of them at /emails/export, bulk additions at
+// /emails/import, deleting and updating a single stored recipient at
+// /emails/{email} and its restoration at /emails/{email}/restore
+func (s *server) emailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/emails/count" {
+		s.countEmailsHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/emails/export" {
+		s.exportEmailsHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/emails/import" {
+		s.importEmailsHandler(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/restore") {
+		s.restoreEmailHandler(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/exists") {
+		s.emailExistsHandler(w, r)
+		return
+	}
+
+	// restrict to only DELETE and PATCH methods
+	if r.Method != http.MethodDelete && r.Method != http.MethodPatch {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only DELETE and PATCH methods are allowed")
+		return
+	}
+
+	email := normalizeEmail(strings.TrimPrefix(r.URL.Path, "/emails/"))
+	if !isValidEmail(email) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Email address '%s' is not valid", email))
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		s.updateEmailHandler(w, r, email)
+		return
 	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	// mark the address deleted, it is purged once the retention period has passed
+	err := s.emails.delete(ctx, email)
+	if err == errEmailNotFound {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Email address '%s' not found", email))
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// structure to store email configuration
-type emailConfig struct {
-	senderEmail string
-	password    string
-	smtpServer  string
-	smtpPort    string
+// handles requests to undo the deletion of a stored recipient that has not
+// been purged yet
+func (s *server) restoreEmailHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only POST method
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	email := normalizeEmail(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/emails/"), "/restore"))
+	if !isValidEmail(email) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Email address '%s' is not valid", email))
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	err := s.emails.restore(ctx, email)
+	if err == errEmailNotFound {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Deleted email address '%s' not found", email))
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// get email configuration from environment variables
-func getEmailConfig() (emailConfig, error) {
-	config := emailConfig{
-		senderEmail: os.Getenv("SENDER_EMAIL"),
-		password:    os.Getenv("EMAIL_PASSWORD"),
-		smtpServer:  os.Getenv("SMTP_SERVER"),
-		smtpPort:    os.Getenv("SMTP_PORT"),
+// handles requests at /emails/{email}/exists to check whether an address is
+// stored, so clients can tell whether a contact is new
+func (s *server) emailExistsHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
 	}
 
-	if config.senderEmail == "" || config.password == "" || config.smtpServer == "" || config.smtpPort == "" {
-		return emailConfig{}, fmt.Errorf("one or more environment variables are not set")
+	email := normalizeEmail(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/emails/"), "/exists"))
+	if !isValidEmail(email) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Email address '%s' is not valid", email))
+		return
 	}
 
-	if !isValidEmail(config.senderEmail) {
-		return emailConfig{}, fmt.Errorf("sender email address is not valid")
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	exists, err := s.emails.exists(ctx, email)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
 	}
 
-	return config, nil
+	writeJSON(w, http.StatusOK, map[string]bool{"exists": exists})
 }
 
+// handles requests for the number of stored recipients, filtered like
+// getAllEmailsHandler
+func (s *server) countEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	count, err := s.emails.count(ctx, emailsFilter(r.URL.Query()))
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"count": count})
+}
+
+// pattern used to validate email addresses, compiled once at startup; local
+// parts may contain non-ASCII letters (RFC 6531) and domains are matched in
+// their ASCII form, which may have an internationalized top level domain
+var emailRegex = regexp.MustCompile(`(?i)^([\pL\pM\pN_+-]+\.?)*[\pL\pM\pN_+-]@([A-Z0-9][A-Z0-9-]*\.)+([A-Z]{2,}|XN--[A-Z0-9-]+)$`)
+
 // check if the provided email address is valid
 func isValidEmail(email string) bool {
-	const emailRegexPattern = `^([A-Z0-9_+-]+\.?)*[A-Z0-9_+-]@([A-Z0-9][A-Z0-9-]*\.)+[A-Z]{2,}$/i`
-
-	matched, err := regexp.MatchString(emailRegexPattern, email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain, err := idna.Lookup.ToASCII(email[at+1:])
 	if err != nil {
 		return false
 	}
-	return matched
+	return emailRegex.MatchString(email[:at] + "@" + domain)
+}
+
+// canonical form of an email address used for storage and comparison, with
+// an internationalized domain in its ASCII form so the address only needs
+// SMTPUTF8 to be sent when its local part isn't ASCII
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 || isASCII(email[at+1:]) {
+		return email
+	}
+	// an invalid domain is left for validation to reject
+	if domain, err := idna.Lookup.ToASCII(email[at+1:]); err == nil {
+		email = email[:at+1] + domain
+	}
+	return email
+}
+
+// report whether s is entirely ASCII
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
 }
 
-// format the email message
-func formatEmailMessage(recipients []string, subject, message string) []byte {
-	return []byte(fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n",
-		strings.Join(recipients, ","), subject, message))
+// ensure a value is safe to place in a message header
+func sanitizeHeaderValue(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("header value must not contain line breaks")
+	}
+	return strings.TrimSpace(value), nil
 }
 
 func main() {
-	connectToMongoDB()
+	logHandler, err := newLogHandler(os.Stdout, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
+	slog.SetDefault(slog.New(logHandler))
+
+	listenAddr, err := getListenAddr()
+	if err != nil {
+		fatal("Invalid listen address", "error", err)
+	}
+
+	mongoConfig, err := getMongoConfig()
+	if err != nil {
+		fatal("Invalid MongoDB configuration", "error", err)
+	}
+	connectToMongoDB(mongoConfig)
+	ensureIndexes()
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		fatal("Could not set up tracing", "error", err)
+	}
 	defer func() {
-		if err := client.Disconnect(context.TODO()); err != nil {
-			log.Fatalf("Error disconnecting from MongoDB: %s", err)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Could not flush traces", "error", err)
 		}
 	}()
 
-	http.HandleFunc("/send-email", sendEmailHandler)
-	http.HandleFunc("/get-all-emails", getAllEmailsHandler) // Register the new handler
+	// load and validate the email configuration once, failing fast if invalid
+	config, err := getEmailConfig()
+	if err != nil {
+		fatal("Invalid email configuration", "error", err)
+	}
+	jobs := mongoJobStore{collection: database().Collection("jobs")}
+	history := mongoHistoryStore{collection: database().Collection("sentEmails")}
+	srv := &server{
+		config: config,
+		queue:  newEmailQueue(config, jobs, history),
+		ping:   pingMongoDB,
+		emails: mongoEmailStore{collection: emailsCollection()},
+		stats:  newStatsCache(history, statsCacheTTL),
+
+		suppressions: mongoSuppressionStore{collection: database().Collection("suppressions")},
+	}
+	registerQueueDepth(srv.queue)
+	if config.sender != nil {
+		slog.Warn("SMTP_MODE is mock, emails are captured in memory and never delivered")
+	}
+	if config.validateMX {
+		srv.mx = newMXValidator(net.DefaultResolver)
+	}
+	if config.checkSPF && config.sender == nil {
+		srv.spfStatus = checkSenderSPF(context.Background(), net.DefaultResolver, config)
+	}
 
-	log.Println("Server starting on port 8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server start error: %s", err)
+	defer func() {
+		ctx, cancel := dbContext(context.Background())
+		defer cancel()
+		if err := client.Disconnect(ctx); err != nil {
+			fatal("Error disconnecting from MongoDB", "error", err)
+		}
+	}()
+
+	limiter := newRateLimiter(config.rateLimitPerMin, config.rateLimitBurst, config.trustForwardedFor)
+	srv.limiter = limiter
+	auth := &apiKeyAuth{keys: config.apiKeys}
+	if len(config.apiKeys) == 0 {
+		slog.Warn("API_KEYS is not set, the API is open to anyone who can reach it")
+	}
+
+	idempotent := &idempotency{
+		store: mongoIdempotencyStore{collection: database().Collection("idempotencyKeys")},
+		ttl:   config.idempotencyTTL,
 	}
+
+	inFlight := newInFlightLimit(config.maxInFlightSends)
+
+	http.HandleFunc("/send-email", limiter.limit(auth.require(inFlight.limit(idempotent.handle(srv.sendEmailHandler)))))
+	http.HandleFunc("/send-to-segment", limiter.limit(auth.require(inFlight.limit(idempotent.handle(srv.sendToSegmentHandler)))))
+	http.HandleFunc("/send-batch", limiter.limit(auth.require(inFlight.limit(idempotent.handle(srv.sendBatchHandler)))))
+	http.HandleFunc("/get-all-emails", auth.require(srv.getAllEmailsHandler)) // Register the new handler
+	http.HandleFunc("/preview", auth.require(srv.previewHandler))
+	http.HandleFunc("/jobs/", auth.require(srv.getJobHandler))
+	http.HandleFunc("/history", auth.require(srv.historyHandler))
+	http.HandleFunc("/stats", auth.require(srv.statsHandler))
+	http.HandleFunc("/resend/", limiter.limit(auth.require(inFlight.limit(srv.resendHandler))))
+	http.HandleFunc("/emails", auth.require(srv.getAllEmailsHandler))
+	http.HandleFunc("/emails/", auth.require(srv.emailHandler))
+	http.HandleFunc("/unsubscribe", srv.unsubscribeHandler)
+	http.HandleFunc("/confirm", srv.confirmHandler)
+	http.HandleFunc("/healthz", srv.healthzHandler)
+	http.HandleFunc("/readyz", srv.readyzHandler)
+	http.HandleFunc("/version", srv.versionHandler)
+	http.Handle("/metrics", promhttp.Handler())
+
+	// stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go purgeDeletedRecipients(ctx, srv.emails, config.recipientRetention, purgeInterval)
+
+	// answer CORS preflights before authentication, browsers don't send credentials with them
+	corsHandler := &cors{origins: config.corsAllowedOrigins}
+	httpServer := &http.Server{Addr: listenAddr, Handler: withRequestID(corsHandler.handle(http.DefaultServeMux))}
+
+	slog.Info("Server starting", "addr", listenAddr, "version", version, "commit", commit)
+	if err := serve(ctx, httpServer); err != nil {
+		fatal("Server start error", "error", err)
+	}
+
+	// let the workers finish queued sends before disconnecting from MongoDB
+	slog.Info("Server stopped, waiting for queued emails to be sent...")
+	srv.queue.stop()
+	config.pool.close()
+}
+
+// serve HTTP until ctx is cancelled, then stop listening and wait for
+// in-flight requests to complete
+func serve(ctx context.Context, httpServer *http.Server) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return httpServer.Shutdown(shutdownCtx)
 }
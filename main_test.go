@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMain(m *testing.M) {
+	// handlers use the default database and collection and bound their
+	// database calls by the timeout
+	mongoSettings = mongoConfig{uri: defaultMongoURI, database: defaultMongoDatabase, collection: defaultMongoCollection, timeout: defaultMongoTimeout}
+	// keep the output to failing tests
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// run the test with the global client talking to a mock deployment, which
+// answers each command with the next response queued through mt
+func withMockMongo(t *testing.T, test func(mt *mtest.T)) {
+	mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock)).Run("mongo", func(mt *mtest.T) {
+		previous := client
+		client = mt.Client
+		defer func() { client = previous }()
+		test(mt)
+	})
+}
+
+// serve the request with the handler and return the recorded response
+func record(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// decode the JSON body of the response into v, failing the test when it isn't
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+}
+
+// fail the test unless the response is a JSON error with the status and code
+func assertError(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+	var body errorResponse
+	decodeBody(t, w, &body)
+	if body.Error.Code != code {
+		t.Errorf("error code = %q, want %q", body.Error.Code, code)
+	}
+}
+
+// a server configured to send as me@example.com
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	config := emailConfig{
+		senderEmail:        "me@example.com",
+		password:           "secret",
+		smtpServer:         "smtp.example.com",
+		smtpPort:           "587",
+		maxAttachments:     defaultMaxAttachments,
+		maxAttachmentBytes: defaultMaxAttachmentBytes,
+		maxRecipients:      defaultMaxRecipients,
+		maxBodyBytes:       defaultMaxBodyBytes,
+		queueWorkers:       1,
+		queueSize:          10,
+	}
+	s := &server{
+		config:       config,
+		queue:        newEmailQueue(config, newMemJobStore(), &memHistoryStore{}),
+		suppressions: newMemSuppressionStore(),
+		emails:       newMemEmailStore(),
+	}
+	t.Cleanup(s.queue.stop)
+	return s
+}
+
+// serve a /send-email request with the JSON body
+func sendRequest(t *testing.T, s *server, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return record(s.sendEmailHandler, jsonRequest("/send-email", body))
+}
+
+// a message handed to sendMail
+type sentMessage struct {
+	from string
+	to   []string
+	msg  []byte
+}
+
+// messages handed to sendMail by the queue workers
+type sendRecorder struct {
+	mu   sync.Mutex
+	sent []sentMessage
+}
+
+// the messages sent so far
+func (r *sendRecorder) all() []sentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]sentMessage(nil), r.sent...)
+}
+
+// the messages sent once there are at least n of them
+func (r *sendRecorder) wait(t *testing.T, n int) []sentMessage {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if sent := r.all(); len(sent) >= n {
+			return sent
+		}
+	}
+	t.Fatalf("sent %d messages, want %d", len(r.all()), n)
+	return nil
+}
+
+// record the messages sent for the duration of the test instead of sending
+// them
+func recordSends(t *testing.T) *sendRecorder {
+	t.Helper()
+	recorder := &sendRecorder{}
+	previous := sendMail
+	sendMail = func(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+		recorder.mu.Lock()
+		defer recorder.mu.Unlock()
+		for _, envelope := range envelopes {
+			recorder.sent = append(recorder.sent, sentMessage{from: from, to: envelope.recipients, msg: envelope.msg})
+		}
+		return okReplies(len(envelopes)), nil
+	}
+	t.Cleanup(func() { sendMail = previous })
+	return recorder
+}
+
+// the replies of a server accepting n messages
+func okReplies(n int) []string {
+	replies := make([]string, n)
+	for i := range replies {
+		replies[i] = "250 ok"
+	}
+	return replies
+}
+
+// a POST of the JSON body to the path
+func jsonRequest(path, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestIsValidEmail(t *testing.T) {
+	for email, want := range map[string]bool{
+		"user@example.com":          true,
+		"first.last+tag@example.co": true,
+		"user_name@sub.example.org": true,
+		"user@xn--bcher-kva.ch":     true,
+		"user@bücher.ch":            true,
+		"josé@example.com":          true,
+		"用户@例え.jp":                  true,
+		"user@localhost":            false,
+		"user@example.c":            false,
+		"user@-example.com":         false,
+		"user..name@example.com":    false,
+		".user@example.com":         false,
+		"user.@example.com":         false,
+		"user@@example.com":         false,
+		"user example@example.com":  false,
+		"@example.com":              false,
+		"user@":                     false,
+		"no-at-sign":                false,
+		"":                          false,
+	} {
+		if got := isValidEmail(email); got != want {
+			t.Errorf("isValidEmail(%q) = %v, want %v", email, got, want)
+		}
+	}
+}
+
+// validation runs for every address of every request, so it uses the
+// pattern compiled at startup rather than compiling one per call
+func BenchmarkIsValidEmail(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		isValidEmail("first.last+tag@example.com")
+	}
+}
+
+func TestIsValidEmailDoesNotAllocatePerCall(t *testing.T) {
+	if allocs := testing.AllocsPerRun(100, func() { isValidEmail("first.last+tag@example.com") }); allocs > 2 {
+		t.Errorf("isValidEmail allocates %.0f times per call, want the pattern reused", allocs)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for email, want := range map[string]string{
+		"  User@Example.COM ": "user@example.com",
+		"user@bücher.ch":      "user@xn--bcher-kva.ch",
+		"JOSÉ@Example.com":    "josé@example.com",
+		"用户@例え.jp":            "用户@xn--r8jz45g.jp",
+		"no-at-sign":          "no-at-sign",
+	} {
+		if got := normalizeEmail(email); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", email, got, want)
+		}
+	}
+}
+
+func TestSendStoresNormalizedRecipientsOnce(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	store := s.emails.(*memEmailStore)
+	body := `{"recipients":["A@Example.com"," a@example.com","B@EXAMPLE.com "],"subject":"Hi","message":"Hello"}`
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	if got := store.addresses(); !slices.Equal(got, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("stored = %v, want each address once in lower case", got)
+	}
+}
+
+// an emailStore failing to store one address
+type partialEmailStore struct {
+	*memEmailStore
+	failing string
+}
+
+func (p partialEmailStore) insert(ctx context.Context, addresses, tags []string) (int, []storageError) {
+	var kept []string
+	var failures []storageError
+	for _, address := range addresses {
+		if address == p.failing {
+			failures = append(failures, storageError{Email: address, Error: "write failed"})
+			continue
+		}
+		kept = append(kept, address)
+	}
+	stored, more := p.memEmailStore.insert(ctx, kept, tags)
+	return stored, append(failures, more...)
+}
+
+func TestSendReportsStorageFailuresAndStillSends(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	s.emails = partialEmailStore{memEmailStore: newMemEmailStore(), failing: "b@example.com"}
+
+	w := sendRequest(t, s, `{"recipients":["a@example.com","b@example.com","c@example.com"],"subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if response.Stored != 2 || len(response.StorageErrors) != 1 || response.StorageErrors[0].Email != "b@example.com" || response.StorageErrors[0].Error == "" {
+		t.Errorf("stored = %d, storage_errors = %+v, want b@example.com reported", response.Stored, response.StorageErrors)
+	}
+	if got := sent.wait(t, 3); len(got) != 3 {
+		t.Errorf("sent %d messages, want every recipient sent to", len(got))
+	}
+}
+
+func TestNormalizeAddressesCollapsesDuplicates(t *testing.T) {
+	request := EmailRequest{
+		Recipients: []string{"b@example.com", "a@example.com", "B@example.com"},
+		Cc:         []string{"a@example.com", "c@example.com", "c@example.com"},
+		Bcc:        []string{"c@example.com", "d@example.com", "b@example.com"},
+	}
+	request.normalizeAddresses()
+
+	// an address keeps its first occurrence, to taking precedence over cc and cc over bcc
+	if !slices.Equal(request.Recipients, []string{"b@example.com", "a@example.com"}) ||
+		!slices.Equal(request.Cc, []string{"c@example.com"}) ||
+		!slices.Equal(request.Bcc, []string{"d@example.com"}) {
+		t.Errorf("recipients = %v, cc = %v, bcc = %v", request.Recipients, request.Cc, request.Bcc)
+	}
+}
+
+func TestSendDeliversOnceToRepeatedRecipients(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	body := `{"recipients":["a@example.com","a@example.com","b@example.com"],"bcc":["A@example.com"],"subject":"Hi","message":"Hello"}`
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var delivered []string
+	for _, message := range sent.wait(t, 2) {
+		delivered = append(delivered, message.to...)
+	}
+	slices.Sort(delivered)
+	if !slices.Equal(delivered, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("delivered to %v, want each address once", delivered)
+	}
+}
+
+func TestDBContextIsBoundedByTheTimeout(t *testing.T) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > mongoSettings.timeout {
+		t.Errorf("deadline = %v, %v, want one within %s", deadline, ok, mongoSettings.timeout)
+	}
+}
+
+func TestDatabaseTimeoutsAreReportedAs504(t *testing.T) {
+	s := newTestServer(t)
+	store := newMemEmailStore("a@example.com")
+	store.err = context.DeadlineExceeded
+	s.emails = store
+
+	w := record(s.getAllEmailsHandler, httptest.NewRequest(http.MethodGet, "/get-all-emails", nil))
+	assertError(t, w, http.StatusGatewayTimeout, errCodeTimeout)
+	w = record(s.emailHandler, httptest.NewRequest(http.MethodDelete, "/emails/a@example.com", nil))
+	assertError(t, w, http.StatusGatewayTimeout, errCodeTimeout)
+}
+
+// settings retrying the startup ping up to attempts times
+func mongoRetryConfig(attempts int) mongoConfig {
+	return mongoConfig{
+		timeout:        time.Second,
+		connectRetry:   retryPolicy{maxAttempts: attempts, base: 100 * time.Millisecond, max: 250 * time.Millisecond},
+		connectTimeout: time.Minute,
+	}
+}
+
+func TestWaitForMongoDBRetriesUntilItAnswers(t *testing.T) {
+	pauses := recordSleeps(t)
+	logs := captureLogs(t)
+	pings := 0
+	err := waitForMongoDB(context.Background(), mongoRetryConfig(5), func(ctx context.Context) error {
+		if pings++; pings < 4 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	if err != nil || pings != 4 {
+		t.Fatalf("err = %v after %d pings, want success on the fourth", err, pings)
+	}
+	if want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 250 * time.Millisecond}; !slices.Equal(*pauses, want) {
+		t.Errorf("pauses = %v, want backoff capped at the maximum %v", *pauses, want)
+	}
+	// each failed attempt is logged
+	for attempt := 1; attempt <= 3; attempt++ {
+		if !strings.Contains(logs.String(), fmt.Sprintf(`"attempt":%d`, attempt)) {
+			t.Errorf("logs = %s, want attempt %d logged", logs, attempt)
+		}
+	}
+}
+
+func TestWaitForMongoDBGivesUpAfterTheAttempts(t *testing.T) {
+	recordSleeps(t)
+	refused := errors.New("connection refused")
+	pings := 0
+	err := waitForMongoDB(context.Background(), mongoRetryConfig(3), func(ctx context.Context) error {
+		pings++
+		return refused
+	})
+	if !errors.Is(err, refused) || !strings.Contains(err.Error(), "gave up after 3 attempts") || pings != 3 {
+		t.Errorf("err = %v after %d pings, want the last error after 3", err, pings)
+	}
+}
+
+func TestWaitForMongoDBGivesUpAtTheConnectTimeout(t *testing.T) {
+	recordSleeps(t)
+	config := mongoRetryConfig(1000)
+	config.connectTimeout = 20 * time.Millisecond
+	start := time.Now()
+	err := waitForMongoDB(context.Background(), config, func(ctx context.Context) error {
+		// a database that never answers
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("err = %v after %s, want a failure at the connect timeout", err, time.Since(start))
+	}
+}
+
+func TestServeStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- serve(ctx, &http.Server{Addr: "127.0.0.1:0"}) }()
+
+	cancel()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("serve = %v, want a clean shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after cancellation")
+	}
+}
+
+func TestServeReportsListenErrors(t *testing.T) {
+	if err := serve(context.Background(), &http.Server{Addr: "127.0.0.1:-1"}); err == nil {
+		t.Error("serve returned no error for an invalid address")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/yuin/goldmark"
+)
+
+// converts Markdown to HTML; raw HTML in the source, including scripts, is
+// omitted and unsafe link schemes such as javascript: are dropped
+var markdownRenderer = goldmark.New()
+
+// use the request's Markdown as the plain text part and its rendering as the HTML part
+func (request *EmailRequest) applyMarkdown() error {
+	if request.Markdown == "" {
+		return nil
+	}
+	if request.Message != "" || request.HTMLMessage != "" || request.Template != "" || request.HTMLTemplate != "" {
+		return fmt.Errorf("markdown cannot be combined with message, html_message or templates")
+	}
+
+	var html bytes.Buffer
+	if err := markdownRenderer.Convert([]byte(request.Markdown), &html); err != nil {
+		return fmt.Errorf("markdown could not be rendered: %v", err)
+	}
+	request.Message = request.Markdown
+	request.HTMLMessage = html.String()
+	request.Markdown = ""
+	return nil
+}
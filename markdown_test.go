@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestApplyMarkdown(t *testing.T) {
+	request := EmailRequest{Markdown: "# Title\n\n**bold**"}
+	if err := request.applyMarkdown(); err != nil {
+		t.Fatal(err)
+	}
+	if request.Message != "# Title\n\n**bold**" {
+		t.Errorf("message = %q, want the raw Markdown", request.Message)
+	}
+	if !strings.Contains(request.HTMLMessage, "<h1>Title</h1>") || !strings.Contains(request.HTMLMessage, "<strong>bold</strong>") {
+		t.Errorf("html = %q, want <h1> and <strong>", request.HTMLMessage)
+	}
+}
+
+func TestApplyMarkdownStripsScripts(t *testing.T) {
+	request := EmailRequest{Markdown: "Hi\n\n<script>alert(1)</script>\n\n[link](javascript:alert(1))"}
+	if err := request.applyMarkdown(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(request.HTMLMessage, "<script") || strings.Contains(request.HTMLMessage, "javascript:") {
+		t.Errorf("html = %q, want scripts removed", request.HTMLMessage)
+	}
+}
+
+func TestApplyMarkdownRejectsOtherBodies(t *testing.T) {
+	for _, request := range []EmailRequest{
+		{Markdown: "Hi", Message: "Hi"},
+		{Markdown: "Hi", HTMLMessage: "<p>Hi</p>"},
+		{Markdown: "Hi", Template: "Hi {{.name}}"},
+	} {
+		if err := request.applyMarkdown(); err == nil {
+			t.Errorf("%+v accepted", request)
+		}
+	}
+}
+
+func TestSendMarkdownAsAlternative(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	body := `{"recipients":["a@example.com"],"subject":"Hi","markdown":"# Title\n\n**bold**"}`
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+
+	msg := parseMessage(t, sent.wait(t, 1)[0].msg)
+	parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative")
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want text and HTML", len(parts))
+	}
+	if !strings.Contains(parts[0].body, "**bold**") {
+		t.Errorf("text part = %q, want the raw Markdown", parts[0].body)
+	}
+	if !strings.Contains(parts[1].body, "<h1>") || !strings.Contains(parts[1].body, "<strong>") {
+		t.Errorf("HTML part = %q, want the rendered Markdown", parts[1].body)
+	}
+}
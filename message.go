@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// a single SMTP transaction: the envelope recipients and the message they receive
+type envelope struct {
+	recipients []string
+	// Message-ID the message is formatted with
+	messageID string
+	msg       []byte
+}
+
+// build one envelope per recipient, and one more carrying the cc and bcc
+// addresses so they receive a single copy; bcc never reaches the headers.
+// The cc and bcc copy is addressed to all of the recipients, or to undisclosed
+// recipients without any, and is rendered without per-recipient variables or
+// an unsubscribe link
+func buildEnvelopes(config emailConfig, request EmailRequest) ([]envelope, error) {
+	templates, err := parseTemplates(request)
+	if err != nil {
+		return nil, err
+	}
+
+	personalizedTo := request.envelopeRecipients()
+	envelopes := make([]envelope, 0, len(personalizedTo))
+	for _, recipient := range personalizedTo {
+		to, rcpt := []string{recipient}, []string{recipient}
+		if recipient == "" {
+			to = request.Recipients
+			rcpt = append(append([]string{}, request.Cc...), request.Bcc...)
+		}
+		personalized, err := templates.personalize(request, recipient)
+		if err != nil {
+			return nil, err
+		}
+		// rendered templates can only be checked once they are rendered
+		if err := personalized.checkBodiesEncode(); err != nil {
+			return nil, err
+		}
+		messageID := request.MessageIDs[rcpt[0]]
+		if messageID == "" {
+			messageID = newMessageID(config.senderEmail)
+		}
+		msg := formatEmailMessage(config, to, recipient, messageID, personalized)
+		if config.dkim != nil {
+			if msg, err = config.dkim.sign(msg); err != nil {
+				return nil, fmt.Errorf("could not DKIM sign message: %v", err)
+			}
+		}
+		envelopes = append(envelopes, envelope{recipients: rcpt, messageID: messageID, msg: msg})
+	}
+	return envelopes, nil
+}
+
+// give each message of the request its own Message-ID, recorded against
+// every address the message is sent to
+func (request *EmailRequest) assignMessageIDs(sender string) {
+	request.MessageIDs = make(map[string]string)
+	for _, recipient := range request.envelopeRecipients() {
+		messageID := newMessageID(sender)
+		if recipient != "" {
+			request.MessageIDs[recipient] = messageID
+			continue
+		}
+		for _, address := range append(append([]string{}, request.Cc...), request.Bcc...) {
+			request.MessageIDs[address] = messageID
+		}
+	}
+}
+
+// the recipients the messages of the request are personalized to, one each,
+// with an empty one standing for the shared cc and bcc copy
+func (request EmailRequest) envelopeRecipients() []string {
+	if len(request.Cc) == 0 && len(request.Bcc) == 0 {
+		return request.Recipients
+	}
+	return append(append([]string{}, request.Recipients...), "")
+}
+
+// format the email message, using a multipart/alternative body when an
+// HTML version is provided, multipart/related around the HTML when it has
+// inline images and multipart/mixed when there are other attachments. The
+// List-Unsubscribe link is for the unsubscribe address, left out when empty
+func formatEmailMessage(config emailConfig, recipients []string, unsubscribe, messageID string, request EmailRequest) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: %s\r\n", messageID)
+	fmt.Fprintf(&b, "From: %s\r\n", formatSender(config))
+	if len(recipients) == 0 {
+		// an empty group, the usual To of a message sent only to bcc addresses
+		b.WriteString("To: undisclosed-recipients:;\r\n")
+	} else {
+		fmt.Fprintf(&b, "%s\r\n", foldAddressHeader("To", recipients))
+	}
+	if len(request.Cc) > 0 {
+		fmt.Fprintf(&b, "%s\r\n", foldAddressHeader("Cc", request.Cc))
+	}
+	if request.ReplyTo != "" {
+		fmt.Fprintf(&b, "Reply-To: %s\r\n", request.ReplyTo)
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", encodeHeaderValue(request.Subject))
+	for _, header := range priorityHeaders[request.Priority] {
+		fmt.Fprintf(&b, "%s\r\n", header)
+	}
+	for _, header := range formatCustomHeaders(request.Headers) {
+		fmt.Fprintf(&b, "%s\r\n", header)
+	}
+	if unsubscribe != "" {
+		if link := unsubscribeURL(config, unsubscribe); link != "" {
+			fmt.Fprintf(&b, "List-Unsubscribe: <%s>\r\n", link)
+			// lets mailbox providers unsubscribe with a single POST (RFC 8058)
+			b.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+		}
+	}
+
+	if request.HTMLMessage == "" && len(request.Attachments) == 0 {
+		b.WriteString("MIME-Version: 1.0\r\n")
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", textContentType("text/plain", request.charset()))
+		encoding, body := encodeBody(encodeCharset(request.charset(), request.Message+"\r\n"))
+		if encoding != "" {
+			fmt.Fprintf(&b, "Content-Transfer-Encoding: %s\r\n", encoding)
+		}
+		b.WriteString("\r\n")
+		b.Write(body)
+		return b.Bytes()
+	}
+
+	inline, attached := splitInline(request.Attachments)
+	contentType, body := formatBody(request, inline)
+	if len(attached) > 0 {
+		var mixed bytes.Buffer
+		mw := multipart.NewWriter(&mixed)
+		writePart(mw, contentType, body)
+		for _, attachment := range attached {
+			writeAttachment(mw, attachment)
+		}
+		mw.Close()
+		contentType, body = "multipart/mixed; boundary="+mw.Boundary(), mixed.Bytes()
+	}
+
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s\r\n\r\n", contentType)
+	b.Write(body)
+	return b.Bytes()
+}
+
+// headers marking a message's priority, understood by most clients between
+// them; normal priority is the default and needs none
+var priorityHeaders = map[string][]string{
+	"high":   {"X-Priority: 1", "X-MSMail-Priority: High", "Importance: high"},
+	"normal": nil,
+	"low":    {"X-Priority: 5", "X-MSMail-Priority: Low", "Importance: low"},
+}
+
+// format the message body, returning its content type; inline images are
+// kept with the HTML version, the only one that can show them, and the text
+// version is generated from the HTML when the request has none
+func formatBody(request EmailRequest, inline []Attachment) (string, []byte) {
+	charset := request.charset()
+	if request.HTMLMessage == "" {
+		return textContentType("text/plain", charset), encodeCharset(charset, request.Message+"\r\n")
+	}
+
+	htmlType, html := textContentType("text/html", charset), encodeCharset(charset, request.HTMLMessage)
+	if len(inline) > 0 {
+		var related bytes.Buffer
+		mw := multipart.NewWriter(&related)
+		writePart(mw, htmlType, html)
+		for _, attachment := range inline {
+			writeAttachment(mw, attachment)
+		}
+		mw.Close()
+		htmlType = mime.FormatMediaType("multipart/related", map[string]string{"type": "text/html", "boundary": mw.Boundary()})
+		html = related.Bytes()
+	}
+
+	text := request.Message
+	if strings.TrimSpace(text) == "" {
+		// clients that can't show HTML get a text version of it instead of nothing
+		text = htmlToText(request.HTMLMessage)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	writePart(mw, textContentType("text/plain", charset), encodeCharset(charset, text))
+	writePart(mw, htmlType, html)
+	mw.Close()
+	return "multipart/alternative; boundary=" + mw.Boundary(), body.Bytes()
+}
+
+// line length header folding aims for, well within the limit of maxLineLength
+const foldLineLength = 78
+
+// format an address header, folding it onto continuation lines between
+// addresses so long lists don't exceed the line length limit
+func foldAddressHeader(name string, addresses []string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	line := b.Len()
+	for i, address := range addresses {
+		if i > 0 {
+			b.WriteString(",")
+			line++
+		}
+		if i > 0 && line+1+len(address) > foldLineLength {
+			b.WriteString("\r\n")
+			line = 0
+		}
+		b.WriteString(" " + address)
+		line += 1 + len(address)
+	}
+	return b.String()
+}
+
+// format the From header value, including the display name when configured
+func formatSender(config emailConfig) string {
+	if config.senderName == "" {
+		return config.senderEmail
+	}
+	return (&mail.Address{Name: config.senderName, Address: config.senderEmail}).String()
+}
+
+// generate a unique Message-ID of the form <uuid@senderdomain>
+func newMessageID(sender string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		domain = sender[at+1:]
+	}
+	return fmt.Sprintf("<%s@%s>", newUUID(), domain)
+}
+
+// generate a random version 4 UUID
+func newUUID() string {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// RFC 2047 encode a header value when it contains non-ASCII characters;
+// ASCII values are returned unchanged
+func encodeHeaderValue(value string) string {
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// write a single body part with the given content type
+func writePart(mw *multipart.Writer, contentType string, content []byte) {
+	header := textproto.MIMEHeader{"Content-Type": {contentType}}
+	encoding, content := encodeBody(content)
+	if encoding != "" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	// writes go to an in-memory buffer and cannot fail
+	part, _ := mw.CreatePart(header)
+	part.Write(content)
+}
+
+// longest line SMTP allows, not counting the line ending
+const maxLineLength = 998
+
+// quoted-printable encode a body containing non-ASCII bytes or overlong
+// lines, which some relays mangle or reject, returning the transfer encoding
+// used; other bodies are returned unchanged with no encoding
+func encodeBody(content []byte) (string, []byte) {
+	if !needsEncoding(content) {
+		return "", content
+	}
+	var b bytes.Buffer
+	// writes go to an in-memory buffer and cannot fail
+	qp := quotedprintable.NewWriter(&b)
+	qp.Write(content)
+	qp.Close()
+	return "quoted-printable", b.Bytes()
+}
+
+// report whether content has a byte or a line that isn't safe to send as 7-bit text
+func needsEncoding(content []byte) bool {
+	line := 0
+	for _, c := range content {
+		switch {
+		case c >= 0x80 || c == 0:
+			return true
+		case c == '\n':
+			line = 0
+		case c != '\r':
+			line++
+			if line > maxLineLength {
+				return true
+			}
+		}
+	}
+	return false
+}
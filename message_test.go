@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parse the formatted message, failing the test when it isn't valid
+func parseMessage(t *testing.T, msg []byte) *mail.Message {
+	t.Helper()
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("parsing message: %v\n%s", err, msg)
+	}
+	return parsed
+}
+
+// format a message to a@example.com from me@example.com
+func formatTestMessage(t *testing.T, config emailConfig, request EmailRequest) *mail.Message {
+	t.Helper()
+	config.senderEmail = "me@example.com"
+	return parseMessage(t, formatEmailMessage(config, []string{"a@example.com"}, "a@example.com", "<id@example.com>", request))
+}
+
+// a part of a multipart body, with the content as it was sent
+type testPart struct {
+	header textproto.MIMEHeader
+	body   string
+}
+
+// the parts of a multipart body of the media type, failing the test when it
+// isn't one
+func readParts(t *testing.T, contentType string, body io.Reader, mediaType string) []testPart {
+	t.Helper()
+	got, params, err := mime.ParseMediaType(contentType)
+	if err != nil || got != mediaType {
+		t.Fatalf("Content-Type = %q, want %s", contentType, mediaType)
+	}
+	var parts []testPart
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, testPart{header: part.Header, body: string(content)})
+	}
+}
+
+func TestFormatHTMLMessageAsAlternative(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello", HTMLMessage: "<p>Hello</p>"})
+
+	parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative")
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want text and HTML", len(parts))
+	}
+	// clients show the last part they understand, so the HTML comes last
+	if !strings.HasPrefix(parts[0].header.Get("Content-Type"), "text/plain") || strings.TrimSpace(parts[0].body) != "Hello" {
+		t.Errorf("first part = %q %q, want the text", parts[0].header.Get("Content-Type"), parts[0].body)
+	}
+	if !strings.HasPrefix(parts[1].header.Get("Content-Type"), "text/html") || parts[1].body != "<p>Hello</p>" {
+		t.Errorf("second part = %q %q, want the HTML", parts[1].header.Get("Content-Type"), parts[1].body)
+	}
+}
+
+func TestFormatTextMessageIsNotMultipart(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"})
+	if got := msg.Header.Get("Content-Type"); strings.HasPrefix(got, "multipart/") {
+		t.Errorf("Content-Type = %q, want a single text body", got)
+	}
+	if body, _ := io.ReadAll(msg.Body); string(body) != "Hello\r\n" {
+		t.Errorf("body = %q, want the message", body)
+	}
+}
+
+func TestFormatMessageEncodesNonASCIISubject(t *testing.T) {
+	raw := formatEmailMessage(emailConfig{senderEmail: "me@example.com"}, []string{"a@example.com"}, "", "<id@example.com>", EmailRequest{Subject: "Grüße aus Köln", Message: "Hallo"})
+	if !bytes.Contains(raw, []byte("Subject: =?utf-8?q?")) {
+		t.Errorf("subject not RFC 2047 encoded:\n%s", raw)
+	}
+	if got, err := new(mime.WordDecoder).DecodeHeader(parseMessage(t, raw).Header.Get("Subject")); err != nil || got != "Grüße aus Köln" {
+		t.Errorf("decoded subject = %q (%v)", got, err)
+	}
+
+	ascii := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Plain subject", Message: "Hi"})
+	if got := ascii.Header.Get("Subject"); got != "Plain subject" {
+		t.Errorf("ASCII subject = %q, want it unchanged", got)
+	}
+}
+
+func TestFormatMessageSetsDateAndMessageID(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"})
+	date, err := msg.Header.Date()
+	if err != nil || time.Since(date) > time.Minute || time.Until(date) > time.Minute {
+		t.Errorf("Date = %q (%v), want the current time", msg.Header.Get("Date"), err)
+	}
+	if got := msg.Header.Get("Message-ID"); !strings.HasSuffix(got, "@example.com>") {
+		t.Errorf("Message-ID = %q, want one at the sender domain", got)
+	}
+}
+
+func TestNewMessageIDUsesSenderDomain(t *testing.T) {
+	first, second := newMessageID("me@example.com"), newMessageID("me@example.com")
+	if !strings.HasPrefix(first, "<") || !strings.HasSuffix(first, "@example.com>") {
+		t.Errorf("Message-ID = %q, want <uuid@example.com>", first)
+	}
+	if first == second {
+		t.Errorf("two Message-IDs are both %s", first)
+	}
+	if got := newMessageID("no-domain"); !strings.HasSuffix(got, "@localhost>") {
+		t.Errorf("Message-ID without a sender domain = %q, want @localhost", got)
+	}
+}
+
+func TestFormatMessageFromDisplayName(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"})
+	if got := msg.Header.Get("From"); got != "me@example.com" {
+		t.Errorf("From without a name = %q, want the bare address", got)
+	}
+
+	for _, name := range []string{"Acme Support", "Jörg, Support", `"Quoted" Name`} {
+		msg := formatTestMessage(t, emailConfig{senderName: name}, EmailRequest{Subject: "Hi", Message: "Hello"})
+		from, err := msg.Header.AddressList("From")
+		if err != nil || len(from) != 1 || from[0].Name != name || from[0].Address != "me@example.com" {
+			t.Errorf("From with name %q = %q (%v)", name, msg.Header.Get("From"), err)
+		}
+	}
+}
+
+func TestFormatMessageSetsReplyTo(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello", ReplyTo: "support@example.com"})
+	if got := msg.Header.Get("Reply-To"); got != "support@example.com" {
+		t.Errorf("Reply-To = %q, want support@example.com", got)
+	}
+	msg = formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"})
+	if _, ok := msg.Header["Reply-To"]; ok {
+		t.Error("Reply-To set without one in the request")
+	}
+}
+
+func TestFormatMessageSetsListUnsubscribe(t *testing.T) {
+	config := emailConfig{publicURL: "https://mail.example.com", unsubscribeSecret: "secret"}
+	msg := formatTestMessage(t, config, EmailRequest{Subject: "Hi", Message: "Hello"})
+	if got, want := msg.Header.Get("List-Unsubscribe"), "<"+unsubscribeURL(config, "a@example.com")+">"; got != want || !strings.Contains(got, "&token=") {
+		t.Errorf("List-Unsubscribe = %q, want %q", got, want)
+	}
+	if got := msg.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post = %q, want the one-click form", got)
+	}
+
+	// a shared message can't carry one recipient's link
+	config.senderEmail = "me@example.com"
+	shared := parseMessage(t, formatEmailMessage(config, []string{"a@example.com", "b@example.com"}, "", "<id@example.com>", EmailRequest{Subject: "Hi", Message: "Hello"}))
+	if _, ok := shared.Header["List-Unsubscribe"]; ok {
+		t.Error("List-Unsubscribe set on a message to several recipients")
+	}
+	if _, ok := shared.Header["List-Unsubscribe-Post"]; ok {
+		t.Error("List-Unsubscribe-Post set on a message to several recipients")
+	}
+	if msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"}); msg.Header.Get("List-Unsubscribe") != "" {
+		t.Error("List-Unsubscribe set without PUBLIC_URL")
+	}
+}
+
+func TestFormatMessageSetsPriorityHeaders(t *testing.T) {
+	for priority, want := range map[string]map[string]string{
+		"high":   {"X-Priority": "1", "Importance": "high", "X-Msmail-Priority": "High"},
+		"low":    {"X-Priority": "5", "Importance": "low", "X-Msmail-Priority": "Low"},
+		"normal": {"X-Priority": "", "Importance": "", "X-Msmail-Priority": ""},
+		"":       {"X-Priority": "", "Importance": "", "X-Msmail-Priority": ""},
+	} {
+		msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello", Priority: priority})
+		for header, value := range want {
+			if got := msg.Header.Get(header); got != value {
+				t.Errorf("priority %q: %s = %q, want %q", priority, header, got, value)
+			}
+		}
+	}
+}
+
+// the lines of the message, without their line endings
+func messageLines(msg []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(msg), "\r\n"), "\r\n")
+}
+
+func TestFormatMessageEncodesLongLines(t *testing.T) {
+	body := strings.Repeat("0123456789", 200)
+	msg := formatEmailMessage(emailConfig{senderEmail: "me@example.com"}, []string{"a@example.com"}, "", "<id@example.com>", EmailRequest{Subject: "Hi", Message: body})
+	for _, line := range messageLines(msg) {
+		if len(line) > maxLineLength {
+			t.Fatalf("line of %d characters sent", len(line))
+		}
+	}
+
+	parsed := parseMessage(t, msg)
+	if got := parsed.Header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+		t.Fatalf("Content-Transfer-Encoding = %q, want quoted-printable", got)
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the message ends with a line break after the body
+	if strings.TrimSuffix(string(decoded), "\r\n") != body {
+		t.Errorf("decoded body of %d characters, want the original %d", len(decoded), len(body))
+	}
+}
+
+func TestFormatMessageEncodesNonASCIIBodies(t *testing.T) {
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Grüße", HTMLMessage: "<p>Grüße</p>"})
+	for _, part := range readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative") {
+		if got := part.header.Get("Content-Transfer-Encoding"); got != "quoted-printable" {
+			t.Errorf("%s part has Content-Transfer-Encoding %q, want quoted-printable", part.header.Get("Content-Type"), got)
+		}
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(part.body)))
+		if err != nil || !strings.Contains(string(decoded), "Grüße") {
+			t.Errorf("%s part decodes to %q (%v), want the original text", part.header.Get("Content-Type"), decoded, err)
+		}
+	}
+
+	msg = formatTestMessage(t, emailConfig{}, EmailRequest{Subject: "Hi", Message: "Hello"})
+	if got := msg.Header.Get("Content-Transfer-Encoding"); got != "" {
+		t.Errorf("short ASCII body has Content-Transfer-Encoding %q, want none", got)
+	}
+}
+
+func TestFormatMessageFoldsLongAddressHeaders(t *testing.T) {
+	var recipients, cc []string
+	for i := 0; i < 50; i++ {
+		recipients = append(recipients, fmt.Sprintf("recipient-with-a-long-name-%02d@example.com", i))
+		cc = append(cc, fmt.Sprintf("cc-%02d@example.com", i))
+	}
+	msg := formatEmailMessage(emailConfig{senderEmail: "me@example.com"}, recipients, "", "<id@example.com>",
+		EmailRequest{Subject: "Hi", Message: "Hello", Cc: cc})
+
+	for _, line := range messageLines(msg) {
+		if len(line) > maxLineLength {
+			t.Fatalf("header line of %d characters sent", len(line))
+		}
+	}
+	parsed := parseMessage(t, msg)
+	for header, want := range map[string][]string{"To": recipients, "Cc": cc} {
+		addresses, err := parsed.Header.AddressList(header)
+		if err != nil {
+			t.Fatalf("%s: %v", header, err)
+		}
+		var got []string
+		for _, address := range addresses {
+			got = append(got, address.Address)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s unfolds to %v, want every address", header, got)
+		}
+	}
+}
+
+func TestFoldAddressHeader(t *testing.T) {
+	if got := foldAddressHeader("To", []string{"a@example.com", "b@example.com"}); got != "To: a@example.com, b@example.com" {
+		t.Errorf("short header = %q, want it on one line", got)
+	}
+
+	addresses := []string{strings.Repeat("a", 40) + "@example.com", strings.Repeat("b", 40) + "@example.com"}
+	lines := strings.Split(foldAddressHeader("To", addresses), "\r\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], " ") {
+		t.Errorf("lines = %q, want the second address on a continuation line", lines)
+	}
+}
+
+func TestFormatMessageWithInlineImages(t *testing.T) {
+	logo := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\nlogo"))
+	msg := formatTestMessage(t, emailConfig{}, EmailRequest{
+		Subject:     "Hi",
+		Message:     "Hello",
+		HTMLMessage: `<p>Hello</p><img src="cid:logo@example.com">`,
+		Attachments: []Attachment{
+			{Filename: "logo.png", ContentType: "image/png", Content: logo, ContentID: "logo@example.com"},
+			{Filename: "notes.txt", ContentType: "text/plain", Content: base64.StdEncoding.EncodeToString([]byte("notes"))},
+		},
+	})
+
+	// the regular attachment is kept outside the alternative body
+	mixed := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/mixed")
+	if len(mixed) != 2 || !strings.HasPrefix(mixed[1].header.Get("Content-Disposition"), "attachment") {
+		t.Fatalf("mixed parts = %+v, want the body and notes.txt", mixed)
+	}
+	alternative := readParts(t, mixed[0].header.Get("Content-Type"), strings.NewReader(mixed[0].body), "multipart/alternative")
+	if len(alternative) != 2 {
+		t.Fatalf("got %d alternative parts, want text and HTML", len(alternative))
+	}
+	if _, params, _ := mime.ParseMediaType(alternative[1].header.Get("Content-Type")); params["type"] != "text/html" {
+		t.Errorf("related part type = %q, want text/html", params["type"])
+	}
+	related := readParts(t, alternative[1].header.Get("Content-Type"), strings.NewReader(alternative[1].body), "multipart/related")
+	if len(related) != 2 || !strings.HasPrefix(related[0].header.Get("Content-Type"), "text/html") {
+		t.Fatalf("related parts = %+v, want the HTML and the image", related)
+	}
+
+	image := related[1]
+	if got := image.header.Get("Content-ID"); got != "<logo@example.com>" {
+		t.Errorf("Content-ID = %q, want <logo@example.com>", got)
+	}
+	if got := image.header.Get("Content-Disposition"); !strings.HasPrefix(got, "inline") {
+		t.Errorf("Content-Disposition = %q, want inline", got)
+	}
+	if got := strings.ReplaceAll(image.body, "\r\n", ""); got != logo {
+		t.Errorf("image body = %q, want the base64 image", got)
+	}
+}
+
+func TestValidateInlineAttachments(t *testing.T) {
+	logo := Attachment{Filename: "logo.png", ContentID: "logo@example.com"}
+	if err := validateInlineAttachments([]Attachment{logo}, `<img src="CID:logo%40example.com">`); err != nil {
+		t.Errorf("URL encoded reference rejected: %v", err)
+	}
+
+	for name, test := range map[string]struct {
+		attachments []Attachment
+		html        string
+	}{
+		"unreferenced":      {[]Attachment{logo}, "<p>Hello</p>"},
+		"missing reference": {[]Attachment{logo}, `<img src="cid:logo@example.com"><img src="cid:banner@example.com">`},
+		"no html":           {[]Attachment{logo}, ""},
+		"repeated id":       {[]Attachment{logo, logo}, `<img src="cid:logo@example.com">`},
+		"invalid id":        {[]Attachment{{Filename: "logo.png", ContentID: "<logo@example.com>"}}, `<img src="cid:logo@example.com">`},
+		"cid without image": {nil, `<img src="cid:logo@example.com">`},
+	} {
+		if err := validateInlineAttachments(test.attachments, test.html); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestBuildEnvelopesGivesCcAndBccTheirOwnCopy(t *testing.T) {
+	config := emailConfig{senderEmail: "me@example.com", publicURL: "https://mail.example.com"}
+	request := EmailRequest{
+		Recipients: []string{"a@example.com", "b@example.com"},
+		Cc:         []string{"cc@example.com"},
+		Bcc:        []string{"bcc@example.com"},
+		Subject:    "Hello",
+		// index, unlike .name, renders missing variables as empty
+		Template: `Hi {{with index . "name"}}{{.}}{{else}}everyone{{end}}`,
+		Variables: map[string]map[string]string{
+			"a@example.com": {"name": "Ann"},
+			"b@example.com": {"name": "Bob"},
+		},
+	}
+
+	envelopes, err := buildEnvelopes(config, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != 3 {
+		t.Fatalf("got %d envelopes, want 3", len(envelopes))
+	}
+	for i, recipient := range request.Recipients {
+		if !slices.Equal(envelopes[i].recipients, []string{recipient}) {
+			t.Errorf("envelope %d recipients = %v, want %s alone", i, envelopes[i].recipients, recipient)
+		}
+		msg := parseMessage(t, envelopes[i].msg)
+		if got := msg.Header.Get("List-Unsubscribe"); !strings.Contains(got, "email="+strings.Replace(recipient, "@", "%40", 1)) {
+			t.Errorf("envelope %d List-Unsubscribe = %q, want a link for %s", i, got, recipient)
+		}
+	}
+	if !bytes.Contains(envelopes[0].msg, []byte("Hi Ann")) || !bytes.Contains(envelopes[1].msg, []byte("Hi Bob")) {
+		t.Error("recipient messages not rendered with their own variables")
+	}
+
+	copied := envelopes[2]
+	if !slices.Equal(copied.recipients, []string{"cc@example.com", "bcc@example.com"}) {
+		t.Errorf("cc and bcc envelope recipients = %v", copied.recipients)
+	}
+	msg := parseMessage(t, copied.msg)
+	if got := msg.Header.Get("List-Unsubscribe"); got != "" {
+		t.Errorf("cc and bcc copy has List-Unsubscribe %q", got)
+	}
+	if got := msg.Header.Get("To"); got != "a@example.com, b@example.com" {
+		t.Errorf("cc and bcc copy To = %q, want both recipients", got)
+	}
+	if got := msg.Header.Get("Bcc"); got != "" || bytes.Contains(copied.msg, []byte("bcc@example.com")) {
+		t.Error("bcc address reached the message")
+	}
+	if !bytes.Contains(copied.msg, []byte("Hi everyone")) {
+		t.Errorf("cc and bcc copy not rendered without variables:\n%s", copied.msg)
+	}
+}
+
+func TestBuildEnvelopesRejectsVariablesForCcAndBcc(t *testing.T) {
+	request := EmailRequest{
+		Recipients: []string{"a@example.com"},
+		Cc:         []string{"cc@example.com"},
+		Subject:    "Hello",
+		Template:   "Hi {{.name}}",
+		Variables:  map[string]map[string]string{"a@example.com": {"name": "Ann"}},
+	}
+	_, err := buildEnvelopes(emailConfig{senderEmail: "me@example.com"}, request)
+	if err == nil || !strings.Contains(err.Error(), "cc and bcc recipients") {
+		t.Errorf("err = %v, want the cc and bcc copy failing to render", err)
+	}
+}
+
+func TestBuildEnvelopesWithOnlyBcc(t *testing.T) {
+	request := EmailRequest{Bcc: []string{"x@example.com", "y@example.com"}, Subject: "Hello", Message: "Hi"}
+	envelopes, err := buildEnvelopes(emailConfig{senderEmail: "me@example.com"}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != 1 || !slices.Equal(envelopes[0].recipients, request.Bcc) {
+		t.Fatalf("envelopes = %+v, want one carrying the bcc addresses", envelopes)
+	}
+	if got := parseMessage(t, envelopes[0].msg).Header.Get("To"); got != "undisclosed-recipients:;" {
+		t.Errorf("To = %q, want undisclosed recipients", got)
+	}
+}
+
+func TestBuildEnvelopesUsesAMessageIDPerMessage(t *testing.T) {
+	request := EmailRequest{
+		Recipients: []string{"a@example.com", "b@example.com"},
+		Cc:         []string{"cc@example.com"},
+		Bcc:        []string{"bcc@example.com"},
+		Subject:    "Hello",
+		Message:    "Hi",
+	}
+	request.assignMessageIDs("me@example.com")
+	if request.MessageIDs["cc@example.com"] != request.MessageIDs["bcc@example.com"] {
+		t.Error("cc and bcc addresses given different Message-IDs for their shared copy")
+	}
+
+	envelopes, err := buildEnvelopes(emailConfig{senderEmail: "me@example.com"}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, envelope := range envelopes {
+		header := parseMessage(t, envelope.msg).Header.Get("Message-ID")
+		if header != envelope.messageID || header != request.MessageIDs[envelope.recipients[0]] {
+			t.Errorf("envelope for %v has Message-ID %s, want %s", envelope.recipients, header, request.MessageIDs[envelope.recipients[0]])
+		}
+		if seen[header] {
+			t.Errorf("Message-ID %s used for more than one message", header)
+		}
+		seen[header] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("got %d Message-IDs, want 3", len(seen))
+	}
+}
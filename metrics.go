@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed on /metrics
+var (
+	emailsSentTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_server_emails_sent_total",
+		Help: "Recipients an email was delivered to.",
+	})
+	sendFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_server_send_failures_total",
+		Help: "Recipients delivery failed for after all retries.",
+	})
+	sendRetriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp_server_send_retries_total",
+		Help: "SMTP send attempts that were retried.",
+	})
+	sendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp_server_send_duration_seconds",
+		Help:    "Time taken by each SMTP send attempt.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// report the number of jobs waiting for a worker
+func registerQueueDepth(q *emailQueue) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "smtp_server_queue_depth",
+		Help: "Emails waiting for a send worker.",
+	}, func() float64 {
+		return float64(len(q.jobs))
+	})
+}
+
+// count the outcome of each recipient
+func recordResults(results []deliveryResult) {
+	for _, result := range results {
+		if result.Status == recipientSent {
+			emailsSentTotal.Inc()
+		} else {
+			sendFailuresTotal.Inc()
+		}
+	}
+}
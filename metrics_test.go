@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordResultsCountsOutcomes(t *testing.T) {
+	sent, failed := testutil.ToFloat64(emailsSentTotal), testutil.ToFloat64(sendFailuresTotal)
+	recordResults([]deliveryResult{
+		{Recipient: "a@example.com", Status: recipientSent},
+		{Recipient: "b@example.com", Status: recipientSent},
+		{Recipient: "c@example.com", Status: recipientFailed},
+	})
+	if got := testutil.ToFloat64(emailsSentTotal) - sent; got != 2 {
+		t.Errorf("sent counter rose by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(sendFailuresTotal) - failed; got != 1 {
+		t.Errorf("failure counter rose by %v, want 1", got)
+	}
+}
+
+func TestSendRecordsMetrics(t *testing.T) {
+	s := newTestServer(t)
+	recordSends(t)
+	sent := testutil.ToFloat64(emailsSentTotal)
+	w := sendRequest(t, s, `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response jobResponse
+	decodeBody(t, w, &response)
+	waitForJob(t, s.queue.store, response.JobID)
+	if got := testutil.ToFloat64(emailsSentTotal) - sent; got != 2 {
+		t.Errorf("sent counter rose by %v, want 2", got)
+	}
+}
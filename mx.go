@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a domain's MX lookup result is reused
+const mxCacheTTL = 5 * time.Minute
+
+// DNS lookups needed to check a domain accepts mail, satisfied by *net.Resolver
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// checks recipient domains have MX (or A/AAAA fallback) records
+type mxValidator struct {
+	resolver mxResolver
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	cache     map[string]mxCacheEntry
+	lastSweep time.Time
+}
+
+// a cached lookup result
+type mxCacheEntry struct {
+	acceptsMail bool
+	expires     time.Time
+}
+
+func newMXValidator(resolver mxResolver) *mxValidator {
+	return &mxValidator{
+		resolver: resolver,
+		ttl:      mxCacheTTL,
+		now:      time.Now,
+		cache:    make(map[string]mxCacheEntry),
+	}
+}
+
+// the domain part of an email address
+func emailDomain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+// report whether the domain can receive mail; lookups that fail for reasons
+// other than the records not existing are treated as valid and not cached
+func (v *mxValidator) acceptsMail(ctx context.Context, domain string) bool {
+	v.mu.Lock()
+	entry, ok := v.cache[domain]
+	v.mu.Unlock()
+	if ok && v.now().Before(entry.expires) {
+		return entry.acceptsMail
+	}
+
+	acceptsMail, err := v.lookup(ctx, domain)
+	if err != nil {
+		return true
+	}
+
+	v.mu.Lock()
+	now := v.now()
+	v.sweep(now)
+	v.cache[domain] = mxCacheEntry{acceptsMail: acceptsMail, expires: now.Add(v.ttl)}
+	v.mu.Unlock()
+	return acceptsMail
+}
+
+// drop expired entries so the cache doesn't grow with every domain ever
+// looked up; called with mu held
+func (v *mxValidator) sweep(now time.Time) {
+	if now.Sub(v.lastSweep) < v.ttl {
+		return
+	}
+	for domain, entry := range v.cache {
+		if !now.Before(entry.expires) {
+			delete(v.cache, domain)
+		}
+	}
+	v.lastSweep = now
+}
+
+// look up MX records, falling back to address records per RFC 5321
+func (v *mxValidator) lookup(ctx context.Context, domain string) (bool, error) {
+	records, err := v.resolver.LookupMX(ctx, domain)
+	if err == nil && len(records) > 0 {
+		// a single "." record is a null MX, the domain explicitly accepts no mail
+		if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+			return false, nil
+		}
+		return true, nil
+	}
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+
+	hosts, err := v.resolver.LookupHost(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(hosts) > 0, nil
+}
+
+// report whether a DNS error means the records don't exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
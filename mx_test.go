@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resolves every domain to a single MX host unless it has records or an
+// error of its own, counting the MX lookups
+type fakeResolver struct {
+	lookups int
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	errs    map[string]error
+}
+
+// returned for names without records
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if err := r.errs[name]; err != nil {
+		return nil, err
+	}
+	if records, ok := r.mx[name]; ok {
+		if len(records) == 0 {
+			return nil, notFound(name)
+		}
+		return records, nil
+	}
+	return []*net.MX{{Host: "mx." + name, Pref: 10}}, nil
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, notFound(host)
+}
+
+func TestMXValidatorCachesLookups(t *testing.T) {
+	resolver := &fakeResolver{}
+	v := newMXValidator(resolver)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !v.acceptsMail(context.Background(), "example.com") {
+			t.Fatal("example.com does not accept mail, want it to")
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("lookups = %d, want the second answered from the cache", resolver.lookups)
+	}
+
+	now = now.Add(mxCacheTTL)
+	v.acceptsMail(context.Background(), "example.com")
+	if resolver.lookups != 2 {
+		t.Errorf("lookups = %d, want the expired entry looked up again", resolver.lookups)
+	}
+}
+
+func TestMXValidatorSweepsExpiredEntries(t *testing.T) {
+	v := newMXValidator(&fakeResolver{})
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	v.acceptsMail(context.Background(), "a.example")
+	v.acceptsMail(context.Background(), "b.example")
+	now = now.Add(mxCacheTTL + time.Second)
+	v.acceptsMail(context.Background(), "c.example")
+
+	if _, ok := v.cache["c.example"]; len(v.cache) != 1 || !ok {
+		t.Errorf("cache = %v, want c.example alone", v.cache)
+	}
+}
+
+func TestMXValidatorLookups(t *testing.T) {
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"null.example":    {{Host: ".", Pref: 0}},
+			"a-only.example":  {},
+			"nothing.example": {},
+		},
+		hosts: map[string][]string{"a-only.example": {"192.0.2.10"}},
+		errs: map[string]error{
+			"servfail.example": &net.DNSError{Err: "server misbehaving", Name: "servfail.example", IsTemporary: true},
+		},
+	}
+	v := newMXValidator(resolver)
+	for domain, want := range map[string]bool{
+		"example.com": true,
+		// a null MX says the domain takes no mail
+		"null.example": false,
+		// without MX records mail goes to the address records
+		"a-only.example":  true,
+		"nothing.example": false,
+		// lookups that fail for other reasons don't reject the address
+		"servfail.example": true,
+	} {
+		if got := v.acceptsMail(context.Background(), domain); got != want {
+			t.Errorf("acceptsMail(%s) = %v, want %v", domain, got, want)
+		}
+	}
+	if _, ok := v.cache["servfail.example"]; ok {
+		t.Error("failed lookup was cached")
+	}
+}
+
+func TestSendRejectsDomainsWithoutMail(t *testing.T) {
+	s := newTestServer(t)
+	s.mx = newMXValidator(&fakeResolver{mx: map[string][]*net.MX{"nothing.example": {}}})
+
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@nothing.example"],"subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+	recordSends(t)
+	if w := sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`); w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want 202 for a domain with MX records: %s", w.Code, w.Body.String())
+	}
+}
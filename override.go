@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// SMTP settings that replace the environment configuration for a single
+// request; omitted fields keep their configured values
+type SMTPOverride struct {
+	Server   string `json:"server,omitempty"`
+	Port     string `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	// password for plain auth or access token for xoauth2, never stored or logged
+	Password string `json:"password,omitempty" bson:"-"`
+	AuthMode string `json:"auth_mode,omitempty"`
+}
+
+// log the override without its password
+func (o SMTPOverride) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("server", o.Server),
+		slog.String("port", o.Port),
+		slog.String("username", o.Username),
+		slog.String("auth_mode", o.AuthMode),
+	)
+}
+
+// check the override's fields are usable against the configured server; an
+// override naming another server must be public and bring its own password,
+// as the configured credentials are never sent to it
+func (o SMTPOverride) validate(configuredServer string) error {
+	for name, value := range map[string]string{"server": o.Server, "username": o.Username} {
+		if _, err := sanitizeHeaderValue(value); err != nil {
+			return fmt.Errorf("smtp.%s is not valid: %v", name, err)
+		}
+	}
+	if o.Server != "" && o.Server != configuredServer {
+		if ip, err := netip.ParseAddr(o.Server); (err == nil && !isPublicAddr(ip)) || strings.EqualFold(o.Server, "localhost") {
+			return fmt.Errorf("smtp.server must not be a private address")
+		}
+		if o.Password == "" {
+			return fmt.Errorf("smtp.password is required when smtp.server is another server")
+		}
+	}
+	if o.Port != "" {
+		if n, err := strconv.Atoi(o.Port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("smtp.port must be a number between 1 and 65535")
+		}
+	}
+	switch o.AuthMode {
+	case "", authModePlain, authModeXOAUTH2:
+	default:
+		return fmt.Errorf("smtp.auth_mode must be one of plain or xoauth2")
+	}
+	return nil
+}
+
+// the configuration with the override applied
+func (o SMTPOverride) apply(config emailConfig) emailConfig {
+	if o.Server != "" && o.Server != config.smtpServer {
+		config.smtpServer = o.Server
+		config.tlsConfig = &tls.Config{ServerName: o.Server}
+		// the configured fallbacks, breaker and send rate stand in for the
+		// configured server, not this one
+		config.fallbacks = nil
+		config.breaker = nil
+		config.throttle = nil
+		// nor do its credentials, and hostnames resolving to private
+		// addresses are refused when dialed
+		config.username, config.password, config.oauthToken = "", "", ""
+		config.publicOnly = true
+	}
+	// connections to the servers of one-off overrides aren't kept open
+	config.pool = nil
+	if o.Port != "" {
+		config.smtpPort = o.Port
+	}
+	if o.Username != "" {
+		config.username = o.Username
+	}
+	if o.AuthMode != "" {
+		config.authMode = o.AuthMode
+	}
+	if o.Password != "" {
+		if config.authMode == authModeXOAUTH2 {
+			config.oauthToken = o.Password
+		} else {
+			config.password = o.Password
+		}
+	}
+	return config
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSMTPOverrideRoutesTheSend(t *testing.T) {
+	configured, override := newFakeSMTPServer(t), newFakeSMTPServer(t)
+	config := configured.config()
+	config.queueSize, config.queueWorkers = 1, 1
+	history := &memHistoryStore{}
+	queue := newEmailQueue(config, newMemJobStore(), history)
+	defer queue.stop()
+
+	port := override.config().smtpPort
+	jobID, err := queue.enqueue(context.Background(), EmailRequest{
+		Recipients: []string{"a@example.com"},
+		Subject:    "Hi",
+		Message:    "Hello",
+		SMTP:       &SMTPOverride{Port: port, Username: "relay", Password: "relay-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent, ok := history.waitFor(jobID); !ok || sent.Status != jobSent {
+		t.Fatalf("record = %+v, want the job sent", sent)
+	}
+
+	if got := configured.received(); len(got) != 0 {
+		t.Errorf("configured server received %d messages, want none", len(got))
+	}
+	if got := override.received(); len(got) != 1 {
+		t.Fatalf("override server received %d messages, want 1", len(got))
+	}
+	override.mu.Lock()
+	auths := override.auths
+	override.mu.Unlock()
+	if want := "AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00relay\x00relay-secret")); len(auths) != 1 || auths[0] != want {
+		t.Errorf("auths = %q, want the override's credentials", auths)
+	}
+}
+
+func TestSMTPOverrideApply(t *testing.T) {
+	config := emailConfig{smtpServer: "smtp.example.com", smtpPort: "587", username: "me", password: "secret", authMode: authModePlain,
+		fallbacks: []smtpEndpoint{{server: "backup.example.com", port: "587"}}}
+
+	// omitted fields keep their configured values
+	if got := (SMTPOverride{Username: "other"}).apply(config); got.smtpServer != "smtp.example.com" || got.smtpPort != "587" || got.username != "other" || got.password != "secret" {
+		t.Errorf("config = %+v, want only the username replaced", got)
+	}
+
+	got := SMTPOverride{Server: "relay.example.com", AuthMode: authModeXOAUTH2, Password: "token"}.apply(config)
+	if got.smtpServer != "relay.example.com" || got.tlsConfig.ServerName != "relay.example.com" {
+		t.Errorf("server = %s, TLS server name = %s, want relay.example.com", got.smtpServer, got.tlsConfig.ServerName)
+	}
+	if len(got.fallbacks) != 0 {
+		t.Errorf("fallbacks = %+v, want none for another server", got.fallbacks)
+	}
+	if got.oauthToken != "token" || got.password != "" {
+		t.Errorf("oauthToken = %q, password = %q, want the password used as the access token", got.oauthToken, got.password)
+	}
+	if !got.publicOnly {
+		t.Error("another server dialed without the public address check")
+	}
+
+	// the configured credentials are never sent to another server
+	got = SMTPOverride{Server: "relay.example.com", Password: "relay-secret"}.apply(config)
+	if got.username != "" || got.password != "relay-secret" || got.oauthToken != "" {
+		t.Errorf("username = %q, password = %q, oauthToken = %q, want only the override's credentials", got.username, got.password, got.oauthToken)
+	}
+	config.authMode, config.oauthToken = authModeXOAUTH2, "configured-token"
+	if got := (SMTPOverride{Server: "relay.example.com", Username: "relay", Password: "relay-secret"}).apply(config); got.oauthToken != "relay-secret" || got.password != "" || got.username != "relay" {
+		t.Errorf("password = %q, oauthToken = %q, want the override's access token alone", got.password, got.oauthToken)
+	}
+	if got := (SMTPOverride{Server: "smtp.example.com"}).apply(config); got.oauthToken != "configured-token" || got.publicOnly {
+		t.Errorf("oauthToken = %q, publicOnly = %v, want the configured server's settings kept", got.oauthToken, got.publicOnly)
+	}
+}
+
+func TestSMTPOverrideValidate(t *testing.T) {
+	for name, override := range map[string]SMTPOverride{
+		"server line break": {Server: "smtp.example.com\r\nRCPT TO:<x@example.com>"},
+		"port not a number": {Port: "submission"},
+		"port out of range": {Port: "70000"},
+		"unknown auth mode": {AuthMode: "cram-md5"},
+		"loopback server":   {Server: "127.0.0.1", Password: "secret"},
+		"localhost":         {Server: "LOCALHOST", Password: "secret"},
+		"private server":    {Server: "10.0.0.5", Password: "secret"},
+		"metadata server":   {Server: "169.254.169.254", Password: "secret"},
+		"no password":       {Server: "relay.example.com", Username: "relay"},
+	} {
+		if err := override.validate("smtp.example.com"); err == nil {
+			t.Errorf("%s: override accepted", name)
+		}
+	}
+	for _, override := range []SMTPOverride{
+		{Server: "smtp.example.com", Port: "465", AuthMode: authModePlain},
+		{Server: "relay.example.com", Username: "relay", Password: "secret"},
+	} {
+		if err := override.validate("smtp.example.com"); err != nil {
+			t.Errorf("valid override %+v rejected: %v", override, err)
+		}
+	}
+}
+
+func TestSMTPOverrideRefusesServersResolvingToPrivateAddresses(t *testing.T) {
+	fake := newFakeSMTPServer(t)
+	// the fake server listens on 127.0.0.1, which localhost resolves to
+	config := SMTPOverride{Server: "localhost", Password: "secret"}.apply(fake.config())
+	if _, _, err := dialSMTP(config); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("err = %v, want the loopback address refused", err)
+	}
+}
+
+func TestSMTPOverrideIsLoggedWithoutItsPassword(t *testing.T) {
+	logs := captureLogs(t)
+	recordSends(t)
+	queue := newEmailQueue(emailConfig{senderEmail: "me@example.com", queueSize: 1, queueWorkers: 1}, newMemJobStore(), &memHistoryStore{})
+	jobID, err := queue.enqueue(context.Background(), EmailRequest{
+		Recipients: []string{"a@example.com"},
+		Subject:    "Hi",
+		Message:    "Hello",
+		SMTP:       &SMTPOverride{Server: "relay.example.com", Password: "hunter2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.stop()
+
+	if !strings.Contains(logs.String(), "relay.example.com") || strings.Contains(logs.String(), "hunter2") {
+		t.Errorf("logs for job %s = %s, want the override logged without its password", jobID, logs.String())
+	}
+}
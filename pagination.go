@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// page sizes for list endpoints
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// a requested slice of a list
+type page struct {
+	limit  int64
+	offset int64
+}
+
+// pagination metadata returned alongside list results
+type pageInfo struct {
+	Total  int64 `json:"total"`
+	Limit  int64 `json:"limit"`
+	Offset int64 `json:"offset"`
+	// offset of the following page, omitted on the last page
+	NextOffset *int64 `json:"next_offset,omitempty"`
+}
+
+// read ?limit= and ?offset= from the request, applying defaults and the cap
+func parsePage(r *http.Request) (page, error) {
+	p := page{limit: defaultPageLimit}
+	query := r.URL.Query()
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 1 {
+			return page{}, fmt.Errorf("limit must be a positive integer")
+		}
+		p.limit = min(limit, maxPageLimit)
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || offset < 0 {
+			return page{}, fmt.Errorf("offset must be a non-negative integer")
+		}
+		p.offset = offset
+	}
+	return p, nil
+}
+
+// describe the page within a list of total items
+func (p page) info(total int64) pageInfo {
+	info := pageInfo{Total: total, Limit: p.limit, Offset: p.offset}
+	if next := p.offset + p.limit; next < total {
+		info.NextOffset = &next
+	}
+	return info
+}
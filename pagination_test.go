@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	for query, want := range map[string]page{
+		"":                    {limit: defaultPageLimit},
+		"?limit=10&offset=20": {limit: 10, offset: 20},
+		"?limit=1000000":      {limit: maxPageLimit},
+	} {
+		got, err := parsePage(httptest.NewRequest(http.MethodGet, "/get-all-emails"+query, nil))
+		if err != nil || got != want {
+			t.Errorf("parsePage(%q) = %+v, %v, want %+v", query, got, err, want)
+		}
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=ten", "?offset=-1", "?offset=1.5"} {
+		if _, err := parsePage(httptest.NewRequest(http.MethodGet, "/get-all-emails"+query, nil)); err == nil {
+			t.Errorf("parsePage(%q) accepted, want an error", query)
+		}
+	}
+}
+
+func TestPageInfo(t *testing.T) {
+	info := page{limit: 10, offset: 10}.info(25)
+	if info.Total != 25 || info.Limit != 10 || info.Offset != 10 || info.NextOffset == nil || *info.NextOffset != 20 {
+		t.Errorf("info = %+v, want the next page at 20", info)
+	}
+	if info := (page{limit: 10, offset: 20}).info(25); info.NextOffset != nil {
+		t.Errorf("last page has next_offset %d", *info.NextOffset)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// default time an idle pooled SMTP connection is kept before it is closed,
+// below the few minutes servers usually allow
+const defaultSMTPPoolIdleTimeout = time.Minute
+
+// an authenticated SMTP connection ready for transactions
+type smtpSession struct {
+	client *smtp.Client
+	conn   net.Conn
+	// when the session was last returned to the pool
+	idleSince time.Time
+}
+
+// open a connection to the SMTP server and authenticate when it supports it
+func openSession(config emailConfig) (*smtpSession, error) {
+	c, conn, err := dialSMTP(config)
+	if err != nil {
+		return nil, err
+	}
+	if ok, _ := c.Extension("AUTH"); ok {
+		// authenticate with the SMTP server
+		if err := c.Auth(config.smtpAuth()); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return &smtpSession{client: c, conn: conn}, nil
+}
+
+// identifies the server and account a pooled session was opened for
+type poolKey struct {
+	server, port, tlsMode      string
+	authMode, username, secret string
+}
+
+func poolKeyFor(config emailConfig) poolKey {
+	secret := config.password
+	if config.authMode == authModeXOAUTH2 {
+		secret = config.oauthToken
+	}
+	return poolKey{
+		server:   config.smtpServer,
+		port:     config.smtpPort,
+		tlsMode:  config.tlsMode,
+		authMode: config.authMode,
+		username: config.username,
+		secret:   secret,
+	}
+}
+
+// keeps SMTP sessions open between sends so they don't each dial and
+// authenticate again; a nil pool opens a session for every send and closes
+// it afterwards
+type smtpPool struct {
+	// idle sessions kept per server
+	size        int
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mu   sync.Mutex
+	idle map[poolKey][]*smtpSession
+}
+
+func newSMTPPool(size int, idleTimeout time.Duration) *smtpPool {
+	return &smtpPool{size: size, idleTimeout: idleTimeout, now: time.Now, idle: make(map[poolKey][]*smtpSession)}
+}
+
+// take an idle session for the configured server, checking it is still alive
+// with RSET, or open a new one when there is none
+func (p *smtpPool) get(config emailConfig) (*smtpSession, error) {
+	if p == nil {
+		return openSession(config)
+	}
+	key := poolKeyFor(config)
+	for {
+		session := p.take(key)
+		if session == nil {
+			return openSession(config)
+		}
+		extendDeadline(session.conn, config.smtpTimeout)
+		if err := session.client.Reset(); err != nil {
+			// the server has hung up, try the next one
+			slog.Debug("Pooled SMTP connection is gone, reconnecting", "server", config.smtpServer, "error", err)
+			session.client.Close()
+			continue
+		}
+		return session, nil
+	}
+}
+
+// remove the most recently used unexpired session for key from the pool,
+// closing the expired ones
+func (p *smtpPool) take(key poolKey) *smtpSession {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sessions := p.idle[key]
+	for len(sessions) > 0 {
+		session := sessions[len(sessions)-1]
+		sessions = sessions[:len(sessions)-1]
+		if p.idleTimeout <= 0 || p.now().Sub(session.idleSince) < p.idleTimeout {
+			p.idle[key] = sessions
+			return session
+		}
+		session.client.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// hand a session back once the caller is done with it, err being the error
+// that ended its use if any. Sessions the server gave a reply on are kept
+// for reuse while there is room, others are in an unknown state and closed.
+// Without a pool the session is closed with QUIT, which is only logged when
+// it fails as the messages have been accepted by then
+func (p *smtpPool) put(config emailConfig, session *smtpSession, err error) {
+	if p == nil {
+		if err != nil {
+			session.client.Close()
+			return
+		}
+		if err := session.client.Quit(); err != nil {
+			slog.Warn("Could not close SMTP connection after sending", "server", config.smtpServer, "error", err)
+			session.client.Close()
+		}
+		return
+	}
+	var protoErr *textproto.Error
+	if err != nil && !errors.As(err, &protoErr) {
+		session.client.Close()
+		return
+	}
+
+	key := poolKeyFor(config)
+	p.mu.Lock()
+	if len(p.idle[key]) < p.size {
+		session.idleSince = p.now()
+		p.idle[key] = append(p.idle[key], session)
+		session = nil
+	}
+	p.mu.Unlock()
+	if session != nil {
+		// the pool is full, and the messages have been sent either way
+		session.client.Quit()
+	}
+}
+
+// close every idle session, for shutdown
+func (p *smtpPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, sessions := range p.idle {
+		for _, session := range sessions {
+			session.client.Quit()
+		}
+		delete(p.idle, key)
+	}
+}
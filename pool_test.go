@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// configuration delivering to the server through a pool of the size, on a
+// clock the test moves
+func pooledConfig(server *fakeSMTPServer, size int) (emailConfig, *time.Time) {
+	now := time.Now()
+	config := server.config()
+	config.pool = newSMTPPool(size, time.Minute)
+	config.pool.now = func() time.Time { return now }
+	return config, &now
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config, _ := pooledConfig(server, 2)
+	defer config.pool.close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := server.connectionCount(); got != 1 {
+		t.Errorf("%d connections opened for 3 sends, want 1", got)
+	}
+	server.mu.Lock()
+	auths := len(server.auths)
+	server.mu.Unlock()
+	if auths != 1 {
+		t.Errorf("authenticated %d times, want once", auths)
+	}
+	if got := len(server.received()); got != 3 {
+		t.Errorf("received %d messages, want 3", got)
+	}
+}
+
+func TestPoolReplacesDeadConnections(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config, _ := pooledConfig(server, 1)
+	defer config.pool.close()
+
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	// the connection drops while it is idle
+	for _, session := range config.pool.idle[poolKeyFor(config)] {
+		session.conn.Close()
+	}
+
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("b@example.com")); err != nil {
+		t.Fatalf("send after the connection dropped: %v", err)
+	}
+	if got := server.connectionCount(); got != 2 {
+		t.Errorf("%d connections opened, want the dead one replaced", got)
+	}
+}
+
+func TestPoolClosesIdleConnections(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config, now := pooledConfig(server, 1)
+	defer config.pool.close()
+
+	deliverMail(config, "me@example.com", testEnvelopes("a@example.com"))
+	*now = now.Add(time.Minute)
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("b@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.connectionCount(); got != 2 {
+		t.Errorf("%d connections opened, want the idle one replaced after the idle timeout", got)
+	}
+}
+
+func TestPoolKeepsAtMostSizeConnections(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config, _ := pooledConfig(server, 1)
+	defer config.pool.close()
+
+	// two workers hold a connection each, only one of them is kept
+	if _, err := sendConcurrently(context.Background(), config, "me@example.com", testEnvelopes("a@example.com", "b@example.com"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(config.pool.idle[poolKeyFor(config)]); got != 1 {
+		t.Errorf("%d idle connections kept, want the pool size of 1", got)
+	}
+}
+
+func TestPoolSeparatesAccounts(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config, _ := pooledConfig(server, 1)
+	defer config.pool.close()
+
+	deliverMail(config, "me@example.com", testEnvelopes("a@example.com"))
+	other := config
+	other.username = "other"
+	if _, err := deliverMail(other, "me@example.com", testEnvelopes("b@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.connectionCount(); got != 2 {
+		t.Errorf("%d connections opened, want another account's session kept apart", got)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+)
+
+// headers and envelope recipients of a message that would be sent
+type messagePreview struct {
+	Recipients []string            `json:"recipients"`
+	Headers    map[string][]string `json:"headers"`
+}
+
+// report whether the request asks for a dry run, via the dry_run query
+// parameter or body field
+func isDryRun(r *http.Request, request EmailRequest) (bool, error) {
+	if raw := r.URL.Query().Get("dry_run"); raw != "" {
+		return strconv.ParseBool(raw)
+	}
+	return request.DryRun, nil
+}
+
+// summarize the messages that would be sent for the envelopes
+func previewEnvelopes(envelopes []envelope) ([]messagePreview, error) {
+	previews := make([]messagePreview, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		msg, err := mail.ReadMessage(bytes.NewReader(envelope.msg))
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, messagePreview{
+			Recipients: envelope.recipients,
+			Headers:    msg.Header,
+		})
+	}
+	return previews, nil
+}
+
+// handles requests to render an email without sending it, returning the
+// message for the recipient query parameter or else the first recipient
+func (s *server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only POST method
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	var request EmailRequest
+	if !s.decodeEmailRequest(w, r, &request) {
+		return
+	}
+	if err := s.validateRequest(r.Context(), &request); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	envelopes, err := buildEnvelopes(s.config, request)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(envelopes) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "At least one recipient is required")
+		return
+	}
+
+	msg := envelopes[0].msg
+	if recipient := normalizeEmail(r.URL.Query().Get("recipient")); recipient != "" {
+		i := slices.Index(request.Recipients, recipient)
+		if i < 0 {
+			writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("'%s' is not a recipient", recipient))
+			return
+		}
+		msg = envelopes[i].msg
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(msg)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSendDryRunFormatsWithoutSending(t *testing.T) {
+	for name, test := range map[string]struct{ path, body string }{
+		"query": {"/send-email?dry_run=true", `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello"}`},
+		"body":  {"/send-email", `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello","dry_run":true}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sent := recordSends(t)
+			s := newTestServer(t)
+			// nothing is stored, so no database is mocked
+			w := record(s.sendEmailHandler, jsonRequest(test.path, test.body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+			}
+			var response struct {
+				DryRun   bool             `json:"dry_run"`
+				Messages []messagePreview `json:"messages"`
+			}
+			decodeBody(t, w, &response)
+			if !response.DryRun || len(response.Messages) != 2 {
+				t.Fatalf("response = %+v, want a preview of each message", response)
+			}
+			for _, preview := range response.Messages {
+				if len(preview.Recipients) != 1 || preview.Headers["To"][0] != preview.Recipients[0] || preview.Headers["Subject"][0] != "Hi" {
+					t.Errorf("preview = %+v, want the headers sent to its recipient", preview)
+				}
+			}
+
+			if jobs := s.queue.store.(*memJobStore).jobs; len(jobs) != 0 {
+				t.Errorf("queued %d jobs, want none", len(jobs))
+			}
+			if messages := sent.all(); len(messages) != 0 {
+				t.Errorf("%d messages sent, want none", len(messages))
+			}
+		})
+	}
+}
+
+func TestSendDryRunStillValidates(t *testing.T) {
+	s := newTestServer(t)
+	w := record(s.sendEmailHandler, jsonRequest("/send-email?dry_run=true", `{"recipients":["not-an-address"],"subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.sendEmailHandler, jsonRequest("/send-email?dry_run=maybe", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+// the message with its boundaries, Date and Message-ID replaced, as they
+// differ between two formattings of the same request
+func stableMessage(msg []byte) string {
+	stable := string(msg)
+	for _, boundary := range boundaryPattern.FindAllStringSubmatch(stable, -1) {
+		stable = strings.ReplaceAll(stable, boundary[1], "BOUNDARY")
+	}
+	return volatileHeaders.ReplaceAllString(stable, "$1: -\r\n")
+}
+
+var (
+	boundaryPattern = regexp.MustCompile(`boundary="?([0-9a-f]+)`)
+	volatileHeaders = regexp.MustCompile(`(?m)^(Date|Message-Id|Message-ID): .*\r\n`)
+)
+
+func TestPreviewMatchesTheSentMessage(t *testing.T) {
+	for name, fields := range map[string]string{
+		"plain":      `"message":"Hello"`,
+		"html":       `"message":"Hello","html_message":"<p>Hello</p>"`,
+		"attachment": `"message":"Hello","attachments":[{"filename":"notes.txt","content_type":"text/plain","content":"aGVsbG8="}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			sent := recordSends(t)
+			s := newTestServer(t)
+			body := `{"recipients":["a@example.com"],"subject":"Hi",` + fields + `}`
+
+			w := record(s.previewHandler, jsonRequest("/preview", body))
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+				t.Fatalf("status = %d, Content-Type = %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+			}
+			if messages := sent.all(); len(messages) != 0 {
+				t.Fatalf("previewing sent %d messages", len(messages))
+			}
+
+			if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+				t.Fatalf("send status = %d: %s", w.Code, w.Body.String())
+			}
+			message := sent.wait(t, 1)[0]
+			if got, want := stableMessage(w.Body.Bytes()), stableMessage(message.msg); got != want {
+				t.Errorf("preview:\n%s\nwant the sent message:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestPreviewSelectsTheRecipient(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello"}`
+
+	w := record(s.previewHandler, jsonRequest("/preview?recipient=B@example.com", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if to := parseMessage(t, w.Body.Bytes()).Header.Get("To"); to != "b@example.com" {
+		t.Errorf("To = %q, want b@example.com", to)
+	}
+
+	assertError(t, record(s.previewHandler, jsonRequest("/preview?recipient=c@example.com", body)), http.StatusBadRequest, errCodeInvalidRequest)
+	assertError(t, record(s.previewHandler, jsonRequest("/preview", `{"recipients":["nope"],"subject":"Hi","message":"Hello"}`)), http.StatusBadRequest, errCodeInvalidRequest)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// default time a deleted recipient can be restored for
+const defaultRecipientRetention = 30 * 24 * time.Hour
+
+// how often deleted recipients past their retention are purged
+const purgeInterval = time.Hour
+
+// purge recipients deleted longer than retention ago every interval, until
+// ctx is cancelled
+func purgeDeletedRecipients(ctx context.Context, store emailStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		dbCtx, cancel := dbContext(ctx)
+		purged, err := store.purge(dbCtx, time.Now().Add(-retention))
+		cancel()
+		if err != nil {
+			slog.Error("Could not purge deleted recipients", "error", err)
+		} else if purged > 0 {
+			slog.Info("Purged deleted recipients", "count", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// a store reporting each purge's cutoff
+type signallingEmailStore struct {
+	*memEmailStore
+	cutoffs chan time.Time
+}
+
+func (s signallingEmailStore) purge(ctx context.Context, cutoff time.Time) (int64, error) {
+	purged, err := s.memEmailStore.purge(ctx, cutoff)
+	s.cutoffs <- cutoff
+	return purged, err
+}
+
+func TestPurgeDeletedRecipientsPastRetention(t *testing.T) {
+	store := newMemEmailStore("old@example.com", "recent@example.com", "kept@example.com")
+	longAgo, lately := time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour)
+	store.find("old@example.com").deletedAt = &longAgo
+	store.find("recent@example.com").deletedAt = &lately
+
+	// a cancelled context purges once and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	purgeDeletedRecipients(ctx, store, 24*time.Hour, time.Hour)
+
+	if store.find("old@example.com") != nil {
+		t.Error("recipient deleted before the cutoff was kept")
+	}
+	if recipient := store.find("recent@example.com"); recipient == nil || recipient.deletedAt == nil {
+		t.Error("recipient deleted after the cutoff was purged, want it kept for restoring")
+	}
+	if store.find("kept@example.com") == nil {
+		t.Error("recipient that was never deleted was purged")
+	}
+}
+
+func TestPurgeDeletedRecipientsStopsWhenCancelled(t *testing.T) {
+	store := signallingEmailStore{newMemEmailStore(), make(chan time.Time)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		purgeDeletedRecipients(ctx, store, time.Hour, time.Millisecond)
+		close(done)
+	}()
+
+	// purges repeat every interval, each with a cutoff retention ago
+	for i := 0; i < 2; i++ {
+		select {
+		case cutoff := <-store.cutoffs:
+			if ago := time.Since(cutoff); ago < time.Hour || ago > time.Hour+time.Minute {
+				t.Errorf("cutoff %s ago, want the retention", ago)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("purge %d did not run", i+1)
+		}
+	}
+
+	cancel()
+	// a purge already started may still report its cutoff
+	for {
+		select {
+		case <-store.cutoffs:
+			continue
+		case <-done:
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("purging did not stop once the context was cancelled")
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// default number of workers and pending jobs for the send queue, and of
+// connections each worker may send a job's envelopes over at once
+const (
+	defaultQueueWorkers    = 4
+	defaultQueueSize       = 100
+	defaultSendConcurrency = 4
+)
+
+// how often the scheduler checks for scheduled jobs that are due
+const scheduleInterval = time.Second
+
+// states a send job moves through
+const (
+	// waiting for its send_at time
+	jobScheduled = "scheduled"
+	jobQueued    = "queued"
+	jobSending   = "sending"
+	jobSent      = "sent"
+	jobFailed    = "failed"
+	// some recipients were sent to and others failed
+	jobPartial = "partial"
+)
+
+// returned when the queue has no room for another job
+var errQueueFull = errors.New("send queue is full")
+
+// returned when a job ID is not known
+var errJobNotFound = errors.New("job not found")
+
+// an email request waiting to be sent by a worker
+type job struct {
+	id      string
+	request EmailRequest
+	// ID of the HTTP request that created the job, for log correlation
+	requestID string
+	// span of the request that created the job, the parent of its send span
+	span trace.SpanContext
+	// receives the outcome when a caller waits for the job, buffered so the
+	// worker never blocks on it
+	done chan jobOutcome
+}
+
+// how a finished job went
+type jobOutcome struct {
+	status  string
+	results []deliveryResult
+	err     error
+}
+
+// status and delivery outcome of a send job as stored in MongoDB
+type jobRecord struct {
+	ID         string           `bson:"_id" json:"id"`
+	Status     string           `bson:"status" json:"status"`
+	Results    []deliveryResult `bson:"results,omitempty" json:"results,omitempty"`
+	Error      string           `bson:"error,omitempty" json:"error,omitempty"`
+	SendAt     *time.Time       `bson:"sendAt,omitempty" json:"send_at,omitempty"`
+	EnqueuedAt time.Time        `bson:"enqueuedAt" json:"enqueued_at"`
+	StartedAt  *time.Time       `bson:"startedAt,omitempty" json:"started_at,omitempty"`
+	FinishedAt *time.Time       `bson:"finishedAt,omitempty" json:"finished_at,omitempty"`
+	RequestID  string           `bson:"requestId,omitempty" json:"request_id,omitempty"`
+	// the request to send, kept for scheduled jobs until they are due
+	Request *EmailRequest `bson:"request,omitempty" json:"-"`
+}
+
+// persistence for job status
+type jobStore interface {
+	create(ctx context.Context, record jobRecord) error
+	markStarted(ctx context.Context, id string, at time.Time) error
+	markFinished(ctx context.Context, id, status string, results []deliveryResult, errMessage string, at time.Time) error
+	get(ctx context.Context, id string) (jobRecord, error)
+	// move at most limit scheduled jobs that are due to queued and return them
+	claimDue(ctx context.Context, now time.Time, limit int) ([]jobRecord, error)
+	// move a claimed job that couldn't be queued back to scheduled
+	unclaim(ctx context.Context, id string) error
+}
+
+// jobStore backed by a MongoDB collection
+type mongoJobStore struct {
+	collection *mongo.Collection
+}
+
+func (s mongoJobStore) create(ctx context.Context, record jobRecord) error {
+	_, err := s.collection.InsertOne(ctx, record)
+	return err
+}
+
+func (s mongoJobStore) markStarted(ctx context.Context, id string, at time.Time) error {
+	_, err := s.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{
+		"status":    jobSending,
+		"startedAt": at,
+	}})
+	return err
+}
+
+func (s mongoJobStore) markFinished(ctx context.Context, id, status string, results []deliveryResult, errMessage string, at time.Time) error {
+	_, err := s.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{
+		"status":     status,
+		"results":    results,
+		"error":      errMessage,
+		"finishedAt": at,
+	}})
+	return err
+}
+
+func (s mongoJobStore) get(ctx context.Context, id string) (jobRecord, error) {
+	var record jobRecord
+	err := s.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return jobRecord{}, errJobNotFound
+	}
+	return record, err
+}
+
+func (s mongoJobStore) claimDue(ctx context.Context, now time.Time, limit int) ([]jobRecord, error) {
+	filter := bson.M{"status": jobScheduled, "sendAt": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"status": jobQueued}}
+
+	// claim jobs one at a time so each is only picked up once
+	var records []jobRecord
+	for len(records) < limit {
+		var record jobRecord
+		err := s.collection.FindOneAndUpdate(ctx, filter, update).Decode(&record)
+		if err == mongo.ErrNoDocuments {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (s mongoJobStore) unclaim(ctx context.Context, id string) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": jobQueued},
+		bson.M{"$set": bson.M{"status": jobScheduled}})
+	return err
+}
+
+// in-process queue of send jobs processed by a pool of workers
+type emailQueue struct {
+	config emailConfig
+	store  jobStore
+	jobs   chan job
+	// audit log of finished jobs
+	history historyStore
+
+	// closed to stop the scheduler, which must exit before jobs is closed
+	done      chan struct{}
+	scheduler sync.WaitGroup
+	workers   sync.WaitGroup
+	// callbacks still being delivered
+	callbacks sync.WaitGroup
+}
+
+// create a queue and start its workers
+func newEmailQueue(config emailConfig, store jobStore, history historyStore) *emailQueue {
+	q := &emailQueue{
+		config:  config,
+		store:   store,
+		jobs:    make(chan job, config.queueSize),
+		history: history,
+		done:    make(chan struct{}),
+	}
+	q.workers.Add(config.queueWorkers)
+	for i := 0; i < config.queueWorkers; i++ {
+		go q.work()
+	}
+	q.scheduler.Add(1)
+	go q.schedule(scheduleInterval)
+	return q
+}
+
+// stop accepting scheduled jobs and wait for the workers to finish the
+// jobs already queued; nothing may be enqueued once stop has been called
+func (q *emailQueue) stop() {
+	close(q.done)
+	q.scheduler.Wait()
+	close(q.jobs)
+	q.workers.Wait()
+	q.callbacks.Wait()
+}
+
+// record a new job and hand it to the workers, returning its ID; jobs with a
+// future send_at are stored for the scheduler instead
+func (q *emailQueue) enqueue(ctx context.Context, request EmailRequest) (string, error) {
+	return q.submit(ctx, job{request: request})
+}
+
+// enqueue a job built by the caller, assigning its ID
+func (q *emailQueue) submit(ctx context.Context, j job) (string, error) {
+	id := newUUID()
+	requestID := requestIDFrom(ctx)
+	j.id, j.requestID = id, requestID
+	j.span = trace.SpanContextFromContext(ctx)
+	request := j.request
+	if request.SendAt != nil && request.SendAt.After(time.Now()) {
+		record := jobRecord{ID: id, Status: jobScheduled, SendAt: request.SendAt, EnqueuedAt: time.Now(), RequestID: requestID, Request: &request}
+		if err := q.store.create(ctx, record); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	if err := q.store.create(ctx, jobRecord{ID: id, Status: jobQueued, EnqueuedAt: time.Now(), RequestID: requestID}); err != nil {
+		return "", err
+	}
+
+	select {
+	case q.jobs <- j:
+		return id, nil
+	default:
+		q.finish(ctx, id, jobFailed, nil, errQueueFull)
+		return "", errQueueFull
+	}
+}
+
+// periodically hand scheduled jobs that are due to the workers
+func (q *emailQueue) schedule(interval time.Duration) {
+	defer q.scheduler.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-ticker.C:
+		}
+
+		if !q.enqueueDue() {
+			return
+		}
+	}
+}
+
+// hand the scheduled jobs that are due to the workers, claiming no more than
+// there is room for in the queue so claimed jobs aren't left waiting on it;
+// reports false when the queue stopped before they were all handed over
+func (q *emailQueue) enqueueDue() bool {
+	free := cap(q.jobs) - len(q.jobs)
+	if free <= 0 {
+		return true
+	}
+	ctx, cancel := dbContext(context.Background())
+	records, err := q.store.claimDue(ctx, time.Now(), free)
+	cancel()
+	if err != nil {
+		slog.Error("Could not load scheduled jobs", "error", err)
+	}
+	for i, record := range records {
+		if record.Request == nil {
+			q.finish(context.Background(), record.ID, jobFailed, nil, errors.New("scheduled job has no request"))
+			continue
+		}
+		select {
+		case q.jobs <- job{id: record.ID, request: *record.Request, requestID: record.RequestID}:
+		case <-q.done:
+			// leave the rest for the scheduler of the next start
+			q.unclaim(records[i:])
+			return false
+		}
+	}
+	return true
+}
+
+// move claimed jobs back to scheduled
+func (q *emailQueue) unclaim(records []jobRecord) {
+	ctx, cancel := dbContext(context.Background())
+	defer cancel()
+	for _, record := range records {
+		if err := q.store.unclaim(ctx, record.ID); err != nil {
+			slog.Error("Could not return scheduled job", "job_id", record.ID, "error", err)
+		}
+	}
+}
+
+// process jobs until the queue is closed
+func (q *emailQueue) work() {
+	defer q.workers.Done()
+	for job := range q.jobs {
+		q.process(job)
+	}
+}
+
+// send a single job, recording its progress
+func (q *emailQueue) process(job job) {
+	logger := slog.Default().With("job_id", job.id)
+	if job.requestID != "" {
+		logger = logger.With("request_id", job.requestID)
+	}
+	ctx := withLogger(context.Background(), logger)
+
+	dbCtx, cancel := dbContext(ctx)
+	err := q.store.markStarted(dbCtx, job.id, time.Now())
+	cancel()
+	if err != nil {
+		logger.Error("Could not update job status", "error", err)
+	}
+
+	config := q.config
+	if job.request.SMTP != nil {
+		config = job.request.SMTP.apply(config)
+		logger.Info("Using SMTP override", "smtp", *job.request.SMTP)
+	}
+
+	sendCtx, span := tracer.Start(trace.ContextWithSpanContext(ctx, job.span), "smtp_send",
+		trace.WithAttributes(attribute.String("job.id", job.id)))
+	envelopes, err := buildEnvelopes(config, job.request)
+	if err != nil {
+		logger.Error("Could not build message", "error", err)
+		recordSpanError(span, err)
+		span.End()
+		q.complete(ctx, job, jobFailed, nil, err)
+		return
+	}
+
+	results, err := sendConcurrently(sendCtx, config, config.envelopeSender(), envelopes, config.sendConcurrency)
+	if err != nil {
+		logger.Error("Job failed", "error", err)
+	}
+	status := jobStatus(results)
+	span.SetAttributes(attribute.Int("envelopes", len(envelopes)), attribute.String("job.status", status))
+	recordSpanError(span, err)
+	span.End()
+	q.complete(ctx, job, status, results, err)
+}
+
+// record the outcome of a processed job and report it to whoever is waiting
+func (q *emailQueue) complete(ctx context.Context, job job, status string, results []deliveryResult, err error) {
+	q.finish(ctx, job.id, status, results, err)
+	q.recordHistory(ctx, job, status, results, err)
+	q.notify(ctx, job, status, results, err)
+	if job.done != nil {
+		job.done <- jobOutcome{status: status, results: results, err: err}
+	}
+}
+
+// deliver the job's callback in the background so workers aren't held up by
+// slow callback URLs
+func (q *emailQueue) notify(ctx context.Context, job job, status string, results []deliveryResult, err error) {
+	if job.request.CallbackURL == "" {
+		return
+	}
+	payload := webhookPayload{JobID: job.id, MessageIDs: job.request.MessageIDs, Status: status, Results: results}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	q.callbacks.Add(1)
+	go func() {
+		defer q.callbacks.Done()
+		if err := notifyWebhook(ctx, q.config, job.request.CallbackURL, payload); err != nil {
+			loggerFrom(ctx).Error("Could not deliver callback", "error", err)
+		}
+	}()
+}
+
+// record the final outcome of a job, logging rather than failing on storage errors
+func (q *emailQueue) finish(ctx context.Context, id, status string, results []deliveryResult, err error) {
+	var errMessage string
+	if err != nil {
+		errMessage = err.Error()
+	}
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if err := q.store.markFinished(dbCtx, id, status, results, errMessage, time.Now()); err != nil {
+		loggerFrom(ctx).Error("Could not update job status", "job_id", id, "error", err)
+	}
+}
+
+// add a finished job to the send history, logging rather than failing on storage errors
+func (q *emailQueue) recordHistory(ctx context.Context, job job, status string, results []deliveryResult, err error) {
+	dbCtx, cancel := dbContext(ctx)
+	defer cancel()
+	if err := q.history.record(dbCtx, newSentEmailRecord(job, status, results, err)); err != nil {
+		loggerFrom(ctx).Error("Could not store sent email details", "error", err)
+	}
+}
+
+// derive the overall job status from the per-recipient results
+func jobStatus(results []deliveryResult) string {
+	var sent, failed int
+	for _, result := range results {
+		if result.Status == recipientSent {
+			sent++
+		} else {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return jobSent
+	case sent == 0:
+		return jobFailed
+	default:
+		return jobPartial
+	}
+}
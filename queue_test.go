@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// the response to an accepted send
+type jobResponse struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+}
+
+// a queue with room for size jobs and no workers, so queued jobs stay put
+func newIdleQueue(store jobStore, size int) *emailQueue {
+	return &emailQueue{store: store, jobs: make(chan job, size), history: &memHistoryStore{}, done: make(chan struct{})}
+}
+
+// the job once the queue has finished with it
+func waitForJob(t *testing.T, store jobStore, id string) jobRecord {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		record, err := store.get(context.Background(), id)
+		if err == nil && record.FinishedAt != nil {
+			return record
+		}
+	}
+	t.Fatalf("job %s did not finish", id)
+	return jobRecord{}
+}
+
+func TestQueueSendsInTheBackground(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	w := sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response jobResponse
+	decodeBody(t, w, &response)
+	if response.JobID == "" || response.Status != jobQueued {
+		t.Fatalf("response = %+v, want a queued job", response)
+	}
+
+	if job := waitForJob(t, s.queue.store, response.JobID); job.Status != jobSent || job.StartedAt == nil || len(job.Results) != 1 {
+		t.Errorf("job = %+v, want it sent", job)
+	}
+	if messages := sent.wait(t, 1); messages[0].to[0] != "a@example.com" {
+		t.Errorf("sent to %v, want a@example.com", messages[0].to)
+	}
+}
+
+func TestQueueRejectsJobsWhenFull(t *testing.T) {
+	store := newMemJobStore()
+	q := newIdleQueue(store, 1)
+	request := EmailRequest{Subject: "Hi", Message: "Hello", Recipients: []string{"a@example.com"}}
+
+	if _, err := q.enqueue(context.Background(), request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.enqueue(context.Background(), request); err != errQueueFull {
+		t.Fatalf("err = %v, want errQueueFull", err)
+	}
+	// the rejected job is recorded as failed rather than left queued
+	if queued, failed := store.count(jobQueued), store.count(jobFailed); queued != 1 || failed != 1 {
+		t.Errorf("store has %d queued and %d failed jobs, want 1 and 1", queued, failed)
+	}
+}
+
+func TestSendReportsAFullQueue(t *testing.T) {
+	s := newTestServer(t)
+	s.queue = newIdleQueue(newMemJobStore(), 0)
+	w := sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)
+	assertError(t, w, http.StatusServiceUnavailable, errCodeUnavailable)
+}
+
+func TestGetJob(t *testing.T) {
+	s := newTestServer(t)
+	recordSends(t)
+	w := sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)
+	var response jobResponse
+	decodeBody(t, w, &response)
+	waitForJob(t, s.queue.store, response.JobID)
+
+	w = record(s.getJobHandler, httptest.NewRequest(http.MethodGet, "/jobs/"+response.JobID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var job jobRecord
+	decodeBody(t, w, &job)
+	if job.ID != response.JobID || job.Status != jobSent || len(job.Results) != 1 || job.Results[0].Status != recipientSent {
+		t.Errorf("job = %+v, want it sent to a@example.com", job)
+	}
+
+	w = record(s.getJobHandler, httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil))
+	assertError(t, w, http.StatusNotFound, errCodeNotFound)
+	w = record(s.getJobHandler, httptest.NewRequest(http.MethodPost, "/jobs/"+response.JobID, nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestSendSchedulesFutureSends(t *testing.T) {
+	s := newTestServer(t)
+	recordSends(t)
+	store := s.queue.store.(*memJobStore)
+	sendAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w := sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","send_at":"`+sendAt+`"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response jobResponse
+	decodeBody(t, w, &response)
+	if response.Status != jobScheduled {
+		t.Fatalf("status = %q, want scheduled", response.Status)
+	}
+	job, err := store.get(context.Background(), response.JobID)
+	if err != nil || job.Status != jobScheduled || job.Request == nil {
+		t.Fatalf("job = %+v (%v), want it stored with its request", job, err)
+	}
+
+	// sent by the scheduler once it is due
+	past := time.Now().Add(-time.Second)
+	store.mu.Lock()
+	job.SendAt = &past
+	store.jobs[job.ID] = job
+	store.mu.Unlock()
+	if job := waitForJob(t, store, response.JobID); job.Status != jobSent {
+		t.Errorf("job status = %q once due, want sent", job.Status)
+	}
+}
+
+func TestSendRejectsPastSendAt(t *testing.T) {
+	s := newTestServer(t)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	w := sendRequest(t, s, `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","send_at":"`+past+`"}`)
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestJobStatus(t *testing.T) {
+	sent := deliveryResult{Recipient: "a@example.com", Status: recipientSent}
+	failed := deliveryResult{Recipient: "b@example.com", Status: recipientFailed}
+	for _, tc := range []struct {
+		results []deliveryResult
+		want    string
+	}{
+		{[]deliveryResult{sent, sent}, jobSent},
+		{[]deliveryResult{failed}, jobFailed},
+		{[]deliveryResult{sent, failed}, jobPartial},
+	} {
+		if got := jobStatus(tc.results); got != tc.want {
+			t.Errorf("jobStatus(%+v) = %q, want %q", tc.results, got, tc.want)
+		}
+	}
+}
+
+func TestStopFinishesQueuedJobs(t *testing.T) {
+	sent := recordSends(t)
+	config := emailConfig{senderEmail: "me@example.com", queueSize: 10, queueWorkers: 1}
+	q := newEmailQueue(config, newMemJobStore(), &memHistoryStore{})
+	for i := 0; i < 5; i++ {
+		if _, err := q.enqueue(context.Background(), EmailRequest{Subject: "Hi", Message: "Hello", Recipients: []string{"a@example.com"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.stop()
+	if n := len(sent.all()); n != 5 {
+		t.Errorf("%d of 5 queued emails sent before stop returned", n)
+	}
+}
+
+// store n scheduled jobs that are due
+func scheduleDue(t *testing.T, store *memJobStore, n int) {
+	t.Helper()
+	due := time.Now().Add(-time.Minute)
+	for i := 0; i < n; i++ {
+		request := &EmailRequest{Subject: "Hi", Message: "Hello", Recipients: []string{"a@example.com"}, SendAt: &due}
+		if err := store.create(context.Background(), jobRecord{ID: newUUID(), Status: jobScheduled, SendAt: &due, Request: request}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEnqueueDueClaimsOnlyWhatFits(t *testing.T) {
+	store := newMemJobStore()
+	scheduleDue(t, store, 3)
+	q := newIdleQueue(store, 2)
+
+	if !q.enqueueDue() {
+		t.Fatal("enqueueDue reported the queue stopping")
+	}
+	if len(q.jobs) != 2 {
+		t.Errorf("queued %d jobs, want 2", len(q.jobs))
+	}
+	if queued, scheduled := store.count(jobQueued), store.count(jobScheduled); queued != 2 || scheduled != 1 {
+		t.Errorf("store has %d queued and %d scheduled jobs, want 2 and 1", queued, scheduled)
+	}
+
+	// nothing more is claimed while the queue is full
+	q.enqueueDue()
+	if store.count(jobScheduled) != 1 {
+		t.Error("claimed a job without room for it")
+	}
+
+	<-q.jobs
+	q.enqueueDue()
+	if store.count(jobScheduled) != 0 || len(q.jobs) != 2 {
+		t.Errorf("remaining job not queued once there was room")
+	}
+}
+
+func TestUnclaimReturnsJobsToScheduled(t *testing.T) {
+	store := newMemJobStore()
+	scheduleDue(t, store, 2)
+	records, err := store.claimDue(context.Background(), time.Now(), 2)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("claimed %d jobs, err %v", len(records), err)
+	}
+
+	newIdleQueue(store, 1).unclaim(records)
+	if store.count(jobScheduled) != 2 {
+		t.Errorf("%d jobs scheduled after unclaiming, want 2", store.count(jobScheduled))
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default token bucket settings for the send endpoint
+const (
+	defaultRateLimitPerMin = 60
+	defaultRateLimitBurst  = 10
+)
+
+// buckets untouched for this long are full again and can be forgotten
+const rateLimitIdleTimeout = 10 * time.Minute
+
+// token bucket rate limiter keyed by client IP
+type rateLimiter struct {
+	// tokens added per second and the bucket capacity
+	rate  float64
+	burst float64
+	// identify clients by X-Forwarded-For instead of the socket address
+	trustForwardedFor bool
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// tokens remaining for a single client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int, trustForwardedFor bool) *rateLimiter {
+	return &rateLimiter{
+		rate:              float64(perMinute) / 60,
+		burst:             float64(burst),
+		trustForwardedFor: trustForwardedFor,
+		buckets:           make(map[string]*tokenBucket),
+		now:               time.Now,
+	}
+}
+
+// take a token for the key, returning how long to wait when none are left
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	return l.allowN(key, 1)
+}
+
+// report whether requests are limited at all
+func (l *rateLimiter) enabled() bool {
+	return l != nil && l.rate > 0
+}
+
+// take n tokens for the key at once, returning how long to wait when there
+// aren't that many left
+func (l *rateLimiter) allowN(key string, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	// refill for the time since the last request
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= float64(n) {
+		bucket.tokens -= float64(n)
+		return true, 0
+	}
+	wait := time.Duration((float64(n) - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// drop idle buckets so the map doesn't grow without bound
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitIdleTimeout {
+		return
+	}
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > rateLimitIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// identify the client making the request
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.trustForwardedFor {
+		// the right-most entry was added by the trusted proxy, entries to its
+		// left come from the client and can be forged
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if client := strings.TrimSpace(entries[len(entries)-1]); client != "" {
+				return client
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// wrap a handler so each client IP is limited to the configured rate
+func (l *rateLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
+	if !l.enabled() {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.allow(l.clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests, try again later")
+			return
+		}
+		next(w, r)
+	}
+}
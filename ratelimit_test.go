@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     bool
+		forwarded []string
+		want      string
+	}{
+		{name: "remote address", want: "192.0.2.1"},
+		{name: "untrusted header ignored", forwarded: []string{"203.0.113.9"}, want: "192.0.2.1"},
+		{name: "single entry", trust: true, forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "forged entries to the left", trust: true, forwarded: []string{"10.0.0.1, 198.51.100.7 , 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "repeated header", trust: true, forwarded: []string{"10.0.0.1", "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "empty entry", trust: true, forwarded: []string{"203.0.113.9, "}, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/send-email", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := newRateLimiter(60, 10, tt.trust).clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterLimitsEachClient(t *testing.T) {
+	limiter := newRateLimiter(60, 2, false)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow("a"); !ok {
+			t.Fatalf("request %d within the burst refused", i+1)
+		}
+	}
+	if ok, wait := limiter.allow("a"); ok || wait <= 0 {
+		t.Errorf("request over the burst allowed, wait %s", wait)
+	}
+	if ok, _ := limiter.allow("b"); !ok {
+		t.Error("another client limited by the first one's requests")
+	}
+
+	// a token is refilled each second at 60 a minute
+	now = now.Add(time.Second)
+	if ok, _ := limiter.allow("a"); !ok {
+		t.Error("request refused after a token was refilled")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	limiter := newRateLimiter(1, 1, false)
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	handler := limiter.limit(next)
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/send-email", nil)
+		r.RemoteAddr = "192.0.2.1:4321"
+		return r
+	}
+
+	if w := record(handler, request()); w.Code != http.StatusNoContent {
+		t.Fatalf("first request status = %d, want it passed through", w.Code)
+	}
+	w := record(handler, request())
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60 at one request a minute", got)
+	}
+	assertError(t, w, http.StatusTooManyRequests, errCodeRateLimited)
+
+	// a zero rate turns limiting off
+	unlimited := newRateLimiter(0, 1, false).limit(next)
+	for i := 0; i < 3; i++ {
+		if w := record(unlimited, request()); w.Code == http.StatusTooManyRequests {
+			t.Fatal("request limited with a zero rate")
+		}
+	}
+}
+
+func TestRateLimiterSweepsIdleClients(t *testing.T) {
+	limiter := newRateLimiter(60, 2, false)
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	limiter.allow("a")
+
+	now = now.Add(rateLimitIdleTimeout + time.Second)
+	limiter.allow("b")
+	if _, ok := limiter.buckets["a"]; ok || len(limiter.buckets) != 1 {
+		t.Errorf("buckets = %v, want the idle client dropped", limiter.buckets)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// machine readable error codes returned in JSON error responses
+const (
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeInvalidRequest   = "invalid_request"
+	errCodeNotFound         = "not_found"
+	errCodeConflict         = "conflict"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeRateLimited      = "rate_limited"
+	errCodeTooLarge         = "too_large"
+	errCodeMediaType        = "unsupported_media_type"
+	errCodeUnavailable      = "unavailable"
+	errCodeTimeout          = "timeout"
+	errCodeInternal         = "internal_error"
+)
+
+// body of a JSON error response
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// write v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Error encoding response to JSON", "error", err)
+	}
+}
+
+// write an error response of the form {"error":{"code":...,"message":...}}
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, errorResponse{Error: errorDetail{Code: code, Message: message}})
+}
+
+// validation error for input over a size limit, reported as 413
+type tooLargeError string
+
+func (e tooLargeError) Error() string {
+	return string(e)
+}
+
+// write the response for a request that failed validation
+func writeValidationError(w http.ResponseWriter, err error) {
+	var tooLarge tooLargeError
+	if errors.As(err, &tooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, err.Error())
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+}
+
+// write the response for a failed database operation, reporting timeouts as 504;
+// the cause is logged rather than returned to the client
+func writeDBError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFrom(r.Context()).Error("Database operation failed", "error", err)
+	if errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err) {
+		writeJSONError(w, http.StatusGatewayTimeout, errCodeTimeout, "Database operation timed out")
+		return
+	}
+	writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "database error")
+}
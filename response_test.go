@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSONError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSONError(w, http.StatusNotFound, errCodeNotFound, "Job 'x' not found")
+
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got, want := w.Body.String(), `{"error":{"code":"not_found","message":"Job 'x' not found"}}`+"\n"; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+	assertError(t, w, http.StatusNotFound, errCodeNotFound)
+}
+
+func TestWriteDBError(t *testing.T) {
+	logs := captureLogs(t)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	writeDBError(w, r, fmt.Errorf("find: %w", context.DeadlineExceeded))
+	assertError(t, w, http.StatusGatewayTimeout, errCodeTimeout)
+
+	// the cause is logged, never sent to the client
+	w = httptest.NewRecorder()
+	writeDBError(w, r, errors.New("connection reset by 10.0.0.5:27017"))
+	if !strings.Contains(w.Body.String(), `"message":"database error"`) {
+		t.Errorf("body = %s, want a generic database error", w.Body.String())
+	}
+	assertError(t, w, http.StatusInternalServerError, errCodeInternal)
+	if !strings.Contains(logs.String(), "connection reset by 10.0.0.5:27017") {
+		t.Errorf("cause not logged: %s", logs.String())
+	}
+}
+
+func TestHandlersReportWrongMethodsAsJSON(t *testing.T) {
+	s := newTestServer(t)
+	for path, handler := range map[string]http.HandlerFunc{
+		"/send-email":     s.sendEmailHandler,
+		"/get-all-emails": s.getAllEmailsHandler,
+		"/jobs/x":         s.getJobHandler,
+	} {
+		w := record(handler, httptest.NewRequest(http.MethodPut, path, nil))
+		assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	for name, body := range map[string]string{
+		"subject":   `{"recipients":["a@example.com"],"subject":"Hi\r\nBcc: victim@example.com","message":"Hello"}`,
+		"recipient": `{"recipients":["a@example.com\r\nBcc: victim@example.com"],"subject":"Hi","message":"Hello"}`,
+		"cc":        `{"recipients":["a@example.com"],"cc":["b@example.com\nBcc: victim@example.com"],"subject":"Hi","message":"Hello"}`,
+		"reply_to":  `{"recipients":["a@example.com"],"reply_to":"r@example.com\r\nBcc: victim@example.com","subject":"Hi","message":"Hello"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			assertError(t, sendRequest(t, s, body), http.StatusBadRequest, errCodeInvalidRequest)
+		})
+	}
+	if n := len(sent.all()); n != 0 {
+		t.Errorf("%d messages sent, want none", n)
+	}
+}
+
+func TestSanitizeHeaderValue(t *testing.T) {
+	if got, err := sanitizeHeaderValue("  Hello there "); err != nil || got != "Hello there" {
+		t.Errorf("sanitizeHeaderValue = %q, %v, want the value trimmed", got, err)
+	}
+	for _, value := range []string{"Hi\r\nBcc: victim@example.com", "Hi\nBcc: victim@example.com", "Hi\r"} {
+		if _, err := sanitizeHeaderValue(value); err == nil {
+			t.Errorf("sanitizeHeaderValue(%q) accepted a line break", value)
+		}
+	}
+}
+
+func TestSendDeliversToEachRecipientSeparately(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	body := `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello"}`
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+
+	for _, message := range sent.wait(t, 2) {
+		if len(message.to) != 1 {
+			t.Fatalf("message sent to %v, want a single recipient", message.to)
+		}
+		if got := parseMessage(t, message.msg).Header.Get("To"); got != message.to[0] {
+			t.Errorf("message to %s has To %q, want only its own address", message.to[0], got)
+		}
+	}
+}
+
+func TestSendDeliversCcAndBcc(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	body := `{"recipients":["a@example.com","b@example.com"],"cc":["cc@example.com"],"bcc":["bcc@example.com"],"subject":"Hi","message":"Hello"}`
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+
+	delivered := make(map[string]int)
+	for _, message := range sent.wait(t, 3) {
+		msg := parseMessage(t, message.msg)
+		if got := msg.Header.Get("Cc"); got != "cc@example.com" {
+			t.Errorf("message to %v has Cc %q, want cc@example.com", message.to, got)
+		}
+		if strings.Contains(string(message.msg), "bcc@example.com") {
+			t.Errorf("message to %v reveals the bcc address", message.to)
+		}
+		for _, address := range message.to {
+			delivered[address]++
+		}
+	}
+	// cc and bcc addresses get a single copy however many recipients there are
+	for _, address := range []string{"a@example.com", "b@example.com", "cc@example.com", "bcc@example.com"} {
+		if delivered[address] != 1 {
+			t.Errorf("%d messages delivered to %s, want 1", delivered[address], address)
+		}
+	}
+}
+
+func TestSendToBccOnly(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	body := `{"bcc":["x@example.com","y@example.com"],"subject":"Hi","message":"Hello {{.Email}}"}`
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+
+	// a single copy goes to every bcc address, naming none of them
+	messages := sent.wait(t, 1)
+	if len(messages) != 1 || !slices.Equal(messages[0].to, []string{"x@example.com", "y@example.com"}) {
+		t.Fatalf("sent %+v, want one message to both bcc addresses", messages)
+	}
+	msg := parseMessage(t, messages[0].msg)
+	if got := msg.Header.Get("To"); got != "undisclosed-recipients:;" {
+		t.Errorf("To = %q, want undisclosed-recipients:;", got)
+	}
+	if strings.Contains(string(messages[0].msg), "x@example.com") {
+		t.Error("message reveals a bcc address")
+	}
+
+	// with no address at all there is nothing to send to
+	w := sendRequest(t, s, `{"recipients":[],"cc":[],"subject":"Hi","message":"Hello"}`)
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestSendReturnsTheMessageIDs(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	w := sendRequest(t, s, `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response sendResponse
+	decodeBody(t, w, &response)
+	for address, messageID := range response.MessageIDs {
+		if !strings.HasPrefix(messageID, "<") || !strings.HasSuffix(messageID, "@example.com>") {
+			t.Errorf("message_ids[%s] = %q, want a Message-ID at the sender's domain", address, messageID)
+		}
+	}
+
+	// every recipient's message carries its own, as does the history record
+	for _, message := range sent.wait(t, 2) {
+		if got, want := parseMessage(t, message.msg).Header.Get("Message-ID"), response.MessageIDs[message.to[0]]; got != want {
+			t.Errorf("message to %v has Message-ID %q, want %q", message.to, got, want)
+		}
+	}
+	if record, ok := s.queue.history.(*memHistoryStore).waitFor(response.JobID); !ok || len(record.MessageIDs) != 2 || record.MessageIDs["a@example.com"] != response.MessageIDs["a@example.com"] {
+		t.Errorf("history record = %+v, want the Message-IDs", record)
+	}
+}
+
+func TestSendRejectsInvalidCcAndBcc(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	for _, body := range []string{
+		`{"recipients":["a@example.com"],"cc":["not-an-address"],"subject":"Hi","message":"Hello"}`,
+		`{"recipients":["a@example.com"],"bcc":["bcc@"],"subject":"Hi","message":"Hello"}`,
+	} {
+		assertError(t, sendRequest(t, s, body), http.StatusBadRequest, errCodeInvalidRequest)
+	}
+	if n := len(sent.all()); n != 0 {
+		t.Errorf("%d messages sent, want none", n)
+	}
+}
+
+func TestSendValidatesReplyTo(t *testing.T) {
+	s := newTestServer(t)
+	sent := recordSends(t)
+	w := sendRequest(t, s, `{"recipients":["a@example.com"],"reply_to":"not-an-address","subject":"Hi","message":"Hello"}`)
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = sendRequest(t, s, `{"recipients":["a@example.com"],"reply_to":"support@example.com","subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	if got := parseMessage(t, sent.wait(t, 1)[0].msg).Header.Get("Reply-To"); got != "support@example.com" {
+		t.Errorf("Reply-To = %q, want support@example.com", got)
+	}
+}
+
+func TestSendReportsPerRecipientResults(t *testing.T) {
+	for name, test := range map[string]struct {
+		reject     []string
+		wantCode   int
+		wantStatus string
+	}{
+		"all sent": {nil, http.StatusOK, jobSent},
+		"mixed":    {[]string{"b@example.com"}, http.StatusMultiStatus, jobPartial},
+		"none":     {[]string{"a@example.com"}, http.StatusBadGateway, jobFailed},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sends := recordConcurrentSends(t, test.reject...)
+			s := newTestServer(t)
+			s.config.retry = retryPolicy{maxAttempts: 1}
+			s.queue = newEmailQueue(s.config, newMemJobStore(), &memHistoryStore{})
+			t.Cleanup(s.queue.stop)
+
+			w := record(s.sendEmailHandler, jsonRequest("/send-email?wait=true", `{"recipients":["a@example.com","b@example.com"],"subject":"Hi","message":"Hello"}`))
+			if w.Code != test.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.wantCode, w.Body.String())
+			}
+			var response struct {
+				Status  string           `json:"status"`
+				Results []deliveryResult `json:"results"`
+			}
+			decodeBody(t, w, &response)
+			if response.Status != test.wantStatus || len(response.Results) != 2 {
+				t.Fatalf("response = %+v, want status %s with a result for each recipient", response, test.wantStatus)
+			}
+			for _, result := range response.Results {
+				// a rejected first recipient leaves the second unsent too
+				failed := sends.reject[result.Recipient] || sends.reject["a@example.com"]
+				if failed != (result.Status == recipientFailed) || failed != (result.Error != "") {
+					t.Errorf("result = %+v, want failed only for rejected recipients", result)
+				}
+			}
+		})
+	}
+}
+
+func TestSendEnforcesTheRecipientLimit(t *testing.T) {
+	s := newTestServer(t)
+	s.config.maxRecipients = 3
+
+	// recipients, cc and bcc addresses count towards the limit together
+	atLimit := `{"recipients":["a@example.com"],"cc":["b@example.com"],"bcc":["c@example.com"],"subject":"Hi","message":"Hello","dry_run":true}`
+	if w := record(s.sendEmailHandler, jsonRequest("/send-email", atLimit)); w.Code != http.StatusOK {
+		t.Errorf("exactly the limit: status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	overLimit := `{"recipients":["a@example.com","d@example.com"],"cc":["b@example.com"],"bcc":["c@example.com"],"subject":"Hi","message":"Hello"}`
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", overLimit))
+	if body := w.Body.String(); !strings.Contains(body, "at most 3") {
+		t.Errorf("body = %s, want the limit named", body)
+	}
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestSendEnforcesTheBodySizeLimit(t *testing.T) {
+	s := newTestServer(t)
+	request := func(message string) string {
+		return `{"recipients":["a@example.com"],"subject":"Hi","message":"` + message + `","dry_run":true}`
+	}
+	envelope := len(request(""))
+	s.config.maxBodyBytes = int64(envelope + 100)
+
+	if w := record(s.sendEmailHandler, jsonRequest("/send-email", request(strings.Repeat("a", 100)))); w.Code != http.StatusOK {
+		t.Errorf("body at the limit: status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	assertError(t, record(s.sendEmailHandler, jsonRequest("/send-email", request(strings.Repeat("a", 101)))),
+		http.StatusRequestEntityTooLarge, errCodeTooLarge)
+}
+
+func TestValidateRequestLimitsDecodedSizes(t *testing.T) {
+	s := newTestServer(t)
+	s.config.maxBodyBytes = 16
+
+	// the bodies are limited together once decoded
+	request := EmailRequest{Recipients: []string{"a@example.com"}, Subject: "Hi", Message: "Hello", HTMLMessage: "<p>Hello, world</p>"}
+	var tooLarge tooLargeError
+	if err := s.validateRequest(context.Background(), &request); !errors.As(err, &tooLarge) {
+		t.Errorf("err = %v, want the message body rejected as too large", err)
+	}
+
+	// attachments are limited together, each of them fitting on its own
+	content := base64.StdEncoding.EncodeToString([]byte("ten bytes!"))
+	request = EmailRequest{Recipients: []string{"a@example.com"}, Subject: "Hi", Message: "Hello", Attachments: []Attachment{
+		{Filename: "a.txt", ContentType: "text/plain", Content: content},
+		{Filename: "b.txt", ContentType: "text/plain", Content: content},
+	}}
+	if err := s.validateRequest(context.Background(), &request); !errors.As(err, &tooLarge) {
+		t.Errorf("err = %v, want the attachments rejected as too large together", err)
+	}
+	request.Attachments = request.Attachments[:1]
+	if err := s.validateRequest(context.Background(), &request); err != nil {
+		t.Errorf("err = %v, want a single attachment accepted", err)
+	}
+}
+
+func TestSendRequiresASubjectAndBody(t *testing.T) {
+	for name, test := range map[string]struct {
+		body              string
+		allowEmptySubject bool
+		wantStatus        int
+	}{
+		"both empty":                      {`"subject":"","message":" "`, true, http.StatusBadRequest},
+		"empty subject":                   {`"subject":"","message":"Hello"`, false, http.StatusBadRequest},
+		"empty subject allowed":           {`"subject":"","message":"Hello"`, true, http.StatusOK},
+		"empty subject with html allowed": {`"subject":"","html_message":"<p>Hello</p>"`, true, http.StatusOK},
+		"empty body":                      {`"subject":"Hi"`, false, http.StatusOK},
+		"populated":                       {`"subject":"Hi","message":"Hello"`, false, http.StatusOK},
+	} {
+		s := newTestServer(t)
+		s.config.allowEmptySubject = test.allowEmptySubject
+		w := record(s.sendEmailHandler, jsonRequest("/send-email?dry_run=true", `{"recipients":["a@example.com"],`+test.body+`}`))
+		if w.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", name, w.Code, test.wantStatus, w.Body.String())
+		}
+	}
+}
+
+func TestSendFillsInTheDefaultSubjectAndBody(t *testing.T) {
+	for name, test := range map[string]struct {
+		fields                   string
+		wantSubject, wantMessage string
+	}{
+		"both omitted":    {``, "Notification", "You have a new notification."},
+		"blank":           {`,"subject":" ","message":" "`, "Notification", "You have a new notification."},
+		"subject given":   {`,"subject":"Hi"`, "Hi", "You have a new notification."},
+		"message given":   {`,"message":"Hello"`, "Notification", "Hello"},
+		"both given":      {`,"subject":"Hi","message":"Hello"`, "Hi", "Hello"},
+		"html body given": {`,"html_message":"<p>Hello</p>"`, "Notification", "Hello"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			sent := recordSends(t)
+			s := newTestServer(t)
+			s.config.defaultSubject = "Notification"
+			s.config.defaultBody = "You have a new notification."
+			if w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"]`+test.fields+`}`)); w.Code != http.StatusAccepted {
+				t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+			}
+
+			msg := parseMessage(t, sent.wait(t, 1)[0].msg)
+			if got := msg.Header.Get("Subject"); got != test.wantSubject {
+				t.Errorf("subject = %q, want %q", got, test.wantSubject)
+			}
+			body, _ := io.ReadAll(msg.Body)
+			if !strings.Contains(string(body), test.wantMessage) {
+				t.Errorf("body = %q, want %q", body, test.wantMessage)
+			}
+			if test.wantMessage != s.config.defaultBody && strings.Contains(string(body), s.config.defaultBody) {
+				t.Errorf("body = %q, want the default body left out", body)
+			}
+		})
+	}
+}
+
+func TestSendValidatesPriority(t *testing.T) {
+	s := newTestServer(t)
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","priority":"urgent"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestSendRejectsReservedHeaders(t *testing.T) {
+	s := newTestServer(t)
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","headers":{"From":"boss@example.com"}}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestSendValidatesWait(t *testing.T) {
+	s := newTestServer(t)
+	for _, request := range []*http.Request{
+		jsonRequest("/send-email?wait=maybe", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`),
+		jsonRequest("/send-email?wait=true", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","send_at":"2099-01-01T00:00:00Z"}`),
+	} {
+		w := record(s.sendEmailHandler, request)
+		assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+	}
+}
+
+func TestSendRequiresJSONContentType(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","dry_run":true}`
+	for contentType, wantStatus := range map[string]int{
+		"application/json":                  http.StatusOK,
+		"application/json; charset=utf-8":   http.StatusOK,
+		"Application/JSON":                  http.StatusOK,
+		"application/x-www-form-urlencoded": http.StatusUnsupportedMediaType,
+		"text/plain":                        http.StatusUnsupportedMediaType,
+		"":                                  http.StatusUnsupportedMediaType,
+	} {
+		r := jsonRequest("/send-email", body)
+		if contentType == "" {
+			r.Header.Del("Content-Type")
+		} else {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := record(s.sendEmailHandler, r)
+		if w.Code != wantStatus {
+			t.Errorf("Content-Type %q: status = %d, want %d: %s", contentType, w.Code, wantStatus, w.Body.String())
+		} else if wantStatus == http.StatusUnsupportedMediaType {
+			assertError(t, w, wantStatus, errCodeMediaType)
+		}
+	}
+}
+
+func TestSendRejectsUnknownFields(t *testing.T) {
+	s := newTestServer(t)
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipient":["a@example.com"],"subject":"Hi","message":"Hello"}`))
+	if body := w.Body.String(); !strings.Contains(body, `unknown field \"recipient\"`) {
+		t.Errorf("body = %s, want the misspelled field named", body)
+	}
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	// nested objects are checked too
+	w = record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello","smtp":{"host":"smtp.example.com"}}`))
+	if body := w.Body.String(); !strings.Contains(body, `unknown field \"host\"`) {
+		t.Errorf("body = %s, want the misspelled smtp field named", body)
+	}
+}
+
+func TestSendUsesTheReturnPathAsEnvelopeSender(t *testing.T) {
+	messages := recordSends(t)
+	s := newTestServer(t)
+	s.config.returnPath = "bounces@example.com"
+	s.queue = newEmailQueue(s.config, newMemJobStore(), &memHistoryStore{})
+	t.Cleanup(s.queue.stop)
+
+	if w := record(s.sendEmailHandler, jsonRequest("/send-email?wait=true", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	sent := messages.wait(t, 1)[0]
+	if sent.from != "bounces@example.com" {
+		t.Errorf("envelope sender = %s, want the return path", sent.from)
+	}
+	if from := parseMessage(t, sent.msg).Header.Get("From"); from != "me@example.com" {
+		t.Errorf("From = %q, want the sender email", from)
+	}
+}
+
+func TestSendReturnsMessageIDsPerRecipient(t *testing.T) {
+	sends := recordSends(t)
+	s := newTestServer(t)
+	body := `{"recipients":["a@example.com","b@example.com"],"bcc":["bcc@example.com"],"subject":"Hi","message":"Hello"}`
+
+	w := record(s.sendEmailHandler, jsonRequest("/send-email?wait=true", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var response sendResponse
+	decodeBody(t, w, &response)
+	if len(response.MessageIDs) != 3 || response.MessageIDs["a@example.com"] == response.MessageIDs["b@example.com"] {
+		t.Errorf("message_ids = %v, want a distinct one for each recipient", response.MessageIDs)
+	}
+	for _, result := range response.Results {
+		if result.MessageID == "" || result.MessageID != response.MessageIDs[result.Recipient] {
+			t.Errorf("result for %s has message_id %q, want %q", result.Recipient, result.MessageID, response.MessageIDs[result.Recipient])
+		}
+	}
+
+	sentIDs := make(map[string]string)
+	for _, sent := range sends.wait(t, 3) {
+		sentIDs[sent.to[0]] = parseMessage(t, sent.msg).Header.Get("Message-ID")
+	}
+	for address, messageID := range response.MessageIDs {
+		if sentIDs[address] != messageID {
+			t.Errorf("%s was sent Message-ID %s, response gave %s", address, sentIDs[address], messageID)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// supported values for SMTP_MODE
+const (
+	// deliver through the configured SMTP servers
+	smtpModeSMTP = "smtp"
+	// capture messages in memory without delivering them, for tests and local development
+	smtpModeMock = "mock"
+)
+
+// delivers a message to its envelope recipients
+type Sender interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// a Sender able to deliver several envelopes at once, returning the reply
+// to each envelope sent before the first failure
+type batchSender interface {
+	Sender
+	sendEnvelopes(from string, envelopes []envelope) ([]string, error)
+}
+
+// reply reported for messages given to a Sender that doesn't return one
+const defaultSendReply = "250 OK"
+
+// Sender delivering through the configured SMTP servers, reusing a
+// connection for a batch of envelopes
+type smtpSender struct {
+	config emailConfig
+}
+
+func (s smtpSender) Send(from string, to []string, msg []byte) error {
+	_, err := s.sendEnvelopes(from, []envelope{{recipients: to, msg: msg}})
+	return err
+}
+
+func (s smtpSender) sendEnvelopes(from string, envelopes []envelope) ([]string, error) {
+	return deliverMail(s.config, from, envelopes)
+}
+
+// a message captured by mockSender
+type mockMessage struct {
+	from string
+	to   []string
+	msg  []byte
+}
+
+// number of messages mockSender keeps by default
+const defaultMockSenderCapacity = 1000
+
+// Sender that records messages in memory instead of delivering them, keeping
+// only the most recent ones so a long running mock server's memory use
+// doesn't keep growing
+type mockSender struct {
+	mu   sync.Mutex
+	sent []mockMessage
+	// messages kept, defaultMockSenderCapacity when zero
+	capacity int
+}
+
+func (m *mockSender) Send(from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	capacity := m.capacity
+	if capacity <= 0 {
+		capacity = defaultMockSenderCapacity
+	}
+	if len(m.sent) >= capacity {
+		m.sent = slices.Delete(m.sent, 0, len(m.sent)-capacity+1)
+	}
+	m.sent = append(m.sent, mockMessage{from: from, to: slices.Clone(to), msg: slices.Clone(msg)})
+	slog.Info("Captured email with the mock sender", "from", from, "to", to, "bytes", len(msg))
+	return nil
+}
+
+// the messages kept, in the order they were sent
+func (m *mockSender) messages() []mockMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.sent)
+}
+
+// send the envelopes with the configured Sender, over SMTP unless another
+// one has been configured, returning the reply to each envelope sent before
+// the first failure
+func sendEnvelopes(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+	var sender Sender = smtpSender{config: config}
+	if config.sender != nil {
+		sender = config.sender
+	}
+	if batch, ok := sender.(batchSender); ok {
+		return batch.sendEnvelopes(from, envelopes)
+	}
+
+	replies := make([]string, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		if err := sender.Send(from, envelope.recipients, envelope.msg); err != nil {
+			return replies, envelopeError{err}
+		}
+		replies = append(replies, defaultSendReply)
+	}
+	return replies, nil
+}
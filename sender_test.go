@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// a Sender failing for the recipients in reject
+type rejectingSender struct {
+	reject map[string]bool
+	sent   []string
+}
+
+func (r *rejectingSender) Send(from string, to []string, msg []byte) error {
+	if r.reject[to[0]] {
+		return errors.New("550 no such user")
+	}
+	r.sent = append(r.sent, to...)
+	return nil
+}
+
+func TestSendEnvelopesUsesTheConfiguredSender(t *testing.T) {
+	sender := &mockSender{}
+	replies, err := sendEnvelopes(emailConfig{sender: sender}, "me@example.com", testEnvelopes("a@example.com", "b@example.com"))
+	if err != nil || !slices.Equal(replies, []string{defaultSendReply, defaultSendReply}) {
+		t.Fatalf("replies = %v, %v, want one for each envelope", replies, err)
+	}
+	messages := sender.messages()
+	if len(messages) != 2 || messages[0].from != "me@example.com" || messages[1].to[0] != "b@example.com" {
+		t.Errorf("captured %+v, want both envelopes", messages)
+	}
+}
+
+func TestSendEnvelopesStopsAtTheFirstFailure(t *testing.T) {
+	sender := &rejectingSender{reject: map[string]bool{"b@example.com": true}}
+	replies, err := sendEnvelopes(emailConfig{sender: sender}, "me@example.com", testEnvelopes("a@example.com", "b@example.com", "c@example.com"))
+	if err == nil || len(replies) != 1 || !slices.Equal(sender.sent, []string{"a@example.com"}) {
+		t.Errorf("replies = %v, %v after sending to %v, want the send stopped at b@example.com", replies, err, sender.sent)
+	}
+}
+
+func TestSMTPModeSetting(t *testing.T) {
+	setConfigEnv(t, map[string]string{"SMTP_MODE": "mock", "SMTP_SERVER": "", "SMTP_PORT": "", "EMAIL_PASSWORD": ""})
+	config, err := getEmailConfig()
+	if err != nil {
+		t.Fatalf("mock mode without SMTP settings: %v", err)
+	}
+	if _, ok := config.sender.(*mockSender); !ok {
+		t.Errorf("sender = %T, want the mock sender", config.sender)
+	}
+
+	setConfigEnv(t, map[string]string{"SMTP_MODE": "smtp"})
+	if config, err := getEmailConfig(); err != nil || config.sender != nil {
+		t.Errorf("sender = %T, %v, want SMTP delivery", config.sender, err)
+	}
+
+	setConfigEnv(t, map[string]string{"SMTP_MODE": "carrier-pigeon"})
+	if _, err := getEmailConfig(); err == nil {
+		t.Error("SMTP_MODE=carrier-pigeon accepted, want an error")
+	}
+}
+
+func TestMockSenderKeepsTheMostRecentMessages(t *testing.T) {
+	sender := &mockSender{capacity: 3}
+	for i := 0; i < 5; i++ {
+		if err := sender.Send("me@example.com", []string{fmt.Sprintf("%d@example.com", i)}, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages := sender.messages()
+	if len(messages) != 3 {
+		t.Fatalf("kept %d messages, want 3", len(messages))
+	}
+	for i, msg := range messages {
+		if want := fmt.Sprintf("%d@example.com", i+2); msg.to[0] != want {
+			t.Errorf("message %d to %s, want %s", i, msg.to[0], want)
+		}
+	}
+}
+
+func TestMockSenderDefaultCapacity(t *testing.T) {
+	sender := &mockSender{}
+	for i := 0; i < defaultMockSenderCapacity+10; i++ {
+		sender.Send("me@example.com", []string{"a@example.com"}, nil)
+	}
+	if got := len(sender.messages()); got != defaultMockSenderCapacity {
+		t.Errorf("kept %d messages, want %d", got, defaultMockSenderCapacity)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// supported values for SMTP_TLS_MODE
+const (
+	// plain connection without encryption
+	tlsModeNone = "none"
+	// plain connection upgraded with a mandatory STARTTLS
+	tlsModeStartTLS = "starttls"
+	// TLS from the start of the connection (implicit TLS, usually port 465)
+	tlsModeTLS = "tls"
+)
+
+// supported values for SMTP_AUTH
+const (
+	authModePlain   = "plain"
+	authModeXOAUTH2 = "xoauth2"
+)
+
+// address given in MAIL FROM, where bounces are sent
+func (config emailConfig) envelopeSender() string {
+	if config.returnPath != "" {
+		return config.returnPath
+	}
+	return config.senderEmail
+}
+
+// select the SMTP authentication mechanism for the configuration
+func (config emailConfig) smtpAuth() smtp.Auth {
+	username := config.username
+	if username == "" {
+		username = config.senderEmail
+	}
+	if config.authMode == authModeXOAUTH2 {
+		return &xoauth2Auth{username: username, token: config.oauthToken}
+	}
+	return smtp.PlainAuth("", username, config.password, config.smtpServer)
+}
+
+// smtp.Auth implementation of the XOAUTH2 mechanism used by Gmail and Office 365
+type xoauth2Auth struct {
+	username string
+	token    string
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// the bearer token is sent in the clear, so refuse unencrypted connections
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, fmt.Errorf("unencrypted connection")
+	}
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server replies to a rejected token with a JSON error challenge,
+		// which must be answered with an empty response to get the final status
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// report whether the host refers to the local machine
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+// function used to deliver mail, replaceable in tests
+var sendMail = sendEnvelopes
+
+// deliver the envelopes through the configured server, moving the unsent
+// remainder on to each fallback server in turn when one fails
+func deliverMail(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+	replies, err := deliverTo(config, from, envelopes)
+	for _, fallback := range config.fallbacks {
+		// another server would refuse the message just the same
+		if err == nil || isPermanent(err) {
+			break
+		}
+		slog.Warn("SMTP server failed, trying the next one", "server", config.smtpServer, "next", fallback.server, "error", err)
+		config = fallback.apply(config)
+		var more []string
+		more, err = deliverTo(config, from, envelopes[len(replies):])
+		replies = append(replies, more...)
+	}
+	return replies, err
+}
+
+// deliver the envelopes over a single SMTP connection, pooled when pooling is
+// enabled, returning the server's reply to each envelope sent before the
+// first failure
+func deliverTo(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+	session, err := config.pool.get(config)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make([]string, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		slog.Debug("Sending message", "server", config.smtpServer, "recipients", envelope.recipients)
+		config.throttle.wait()
+		// a stalled server fails the send, however many envelopes
+		// the connection carries
+		extendDeadline(session.conn, config.smtpTimeout)
+		reply, err := sendEnvelope(session.client, from, envelope)
+		if err != nil {
+			config.pool.put(config, session, err)
+			return replies, envelopeError{err}
+		}
+		replies = append(replies, reply)
+	}
+	config.pool.put(config, session, nil)
+	return replies, nil
+}
+
+// run a single MAIL FROM/RCPT TO/DATA transaction on an open connection,
+// returning the server's reply to the message
+func sendEnvelope(c *smtp.Client, from string, envelope envelope) (string, error) {
+	// non-ASCII addresses need a server with SMTPUTF8 (RFC 6531), for which
+	// c.Mail adds the SMTPUTF8 parameter to MAIL FROM
+	ascii := isASCII(from)
+	for _, recipient := range envelope.recipients {
+		ascii = ascii && isASCII(recipient)
+	}
+	if !ascii {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return "", errSMTPUTF8Unsupported
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return "", err
+	}
+	for _, recipient := range envelope.recipients {
+		if err := c.Rcpt(recipient); err != nil {
+			return "", err
+		}
+	}
+
+	// issue DATA directly rather than through c.Data, which discards the
+	// final reply that usually carries the server's queue ID
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+	w := c.Text.DotWriter()
+	if _, err := w.Write(envelope.msg); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	code, reply, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s", code, reply), nil
+}
+
+// default limit on connecting to the SMTP server and on each step of a send
+const defaultSMTPTimeout = 30 * time.Second
+
+// open a connection to the SMTP server secured according to the TLS mode,
+// returning the underlying connection so its deadline can be extended
+func dialSMTP(config emailConfig) (*smtp.Client, net.Conn, error) {
+	// format the SMTP server address
+	addr := net.JoinHostPort(config.smtpServer, config.smtpPort)
+
+	dialer := &net.Dialer{Timeout: config.smtpTimeout}
+	if config.publicOnly {
+		dialer.Control = publicDialer.Control
+	}
+	var conn net.Conn
+	var err error
+	if config.tlsMode == tlsModeTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// bound the greeting, STARTTLS and authentication
+	extendDeadline(conn, config.smtpTimeout)
+	c, err := smtp.NewClient(conn, config.smtpServer)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if config.tlsMode == tlsModeStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, nil, fmt.Errorf("SMTP server does not support STARTTLS")
+		}
+		if err := c.StartTLS(config.tlsConfig); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+	return c, conn, nil
+}
+
+// give the conversation on conn another timeout to progress, when one is set
+func extendDeadline(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// delivery states of an individual recipient
+const (
+	recipientSent   = "sent"
+	recipientFailed = "failed"
+)
+
+// outcome of delivering to a single address
+type deliveryResult struct {
+	Recipient string `bson:"recipient" json:"recipient"`
+	// Message-ID of the message the recipient was sent
+	MessageID string `bson:"messageId,omitempty" json:"message_id,omitempty"`
+	Status    string `bson:"status" json:"status"`
+	Error     string `bson:"error,omitempty" json:"error,omitempty"`
+	// the server's reply to the message, such as "250 OK queued as 1234"
+	Response string `bson:"response,omitempty" json:"response,omitempty"`
+}
+
+// an error in the transaction for a single envelope, rather than in
+// connecting to or authenticating with the server
+type envelopeError struct {
+	err error
+}
+
+func (e envelopeError) Error() string { return e.err.Error() }
+func (e envelopeError) Unwrap() error { return e.err }
+
+// returned for envelopes with internationalized addresses when the server
+// can't take them
+var errSMTPUTF8Unsupported = errors.New("the SMTP server does not support SMTPUTF8, which non-ASCII addresses require")
+
+// report whether err is a permanent 5xx SMTP rejection or an envelope the
+// server can't take, which retrying won't change; other SMTP replies and
+// network failures are transient
+func isPermanent(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500 || errors.Is(err, errSMTPUTF8Unsupported)
+}
+
+// sends the envelopes, retrying the unsent remainder with exponential backoff on
+// transient failures, and reports the outcome for every recipient; an
+// envelope permanently rejected by the server fails without holding up the
+// others, while any other permanent failure fails them all at once
+func sendWithRetry(ctx context.Context, config emailConfig, from string, envelopes []envelope) ([]deliveryResult, error) {
+	retryCount := 0
+	// the last permanent rejection of an envelope, reported once the rest are sent
+	var rejected error
+
+	var results []deliveryResult
+	defer func() { recordResults(results) }()
+
+	for {
+		if !config.breaker.allow() {
+			results = appendResults(results, envelopes, recipientFailed, nil, errCircuitOpen)
+			return results, errCircuitOpen
+		}
+
+		start := time.Now()
+		replies, err := sendMail(config, from, envelopes)
+		sendDuration.Observe(time.Since(start).Seconds())
+		config.breaker.record(err)
+
+		results = appendResults(results, envelopes[:len(replies)], recipientSent, replies, nil)
+		envelopes = envelopes[len(replies):]
+		if err == nil {
+			return results, rejected
+		}
+		if isPermanent(err) {
+			var envErr envelopeError
+			if !errors.As(err, &envErr) {
+				results = appendResults(results, envelopes, recipientFailed, nil, err)
+				return results, err
+			}
+			loggerFrom(ctx).Warn("Message rejected by the SMTP server", "recipients", envelopes[0].recipients, "error", err)
+			results = appendResults(results, envelopes[:1], recipientFailed, nil, err)
+			envelopes, rejected = envelopes[1:], err
+			if len(envelopes) == 0 {
+				return results, rejected
+			}
+			continue
+		}
+		retryCount++
+		if retryCount >= config.retry.maxAttempts {
+			results = appendResults(results, envelopes, recipientFailed, nil, err)
+			return results, err
+		}
+		sendRetriesTotal.Inc()
+		backoff := config.retry.delay(retryCount)
+		// log retry attempt
+		loggerFrom(ctx).Warn("Send attempt failed, retrying", "attempt", retryCount, "backoff", backoff, "error", err)
+		sleep(backoff)
+	}
+}
+
+// send the envelopes over up to concurrency connections at once, each
+// handling a contiguous share of them with its own retries, and report the
+// outcome for every recipient in envelope order along with the first error
+func sendConcurrently(ctx context.Context, config emailConfig, from string, envelopes []envelope, concurrency int) ([]deliveryResult, error) {
+	workers := min(concurrency, len(envelopes))
+	if workers <= 1 {
+		return sendWithRetry(ctx, config, from, envelopes)
+	}
+
+	results := make([][]deliveryResult, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		// split as evenly as possible
+		start, end := i*len(envelopes)/workers, (i+1)*len(envelopes)/workers
+		wg.Add(1)
+		go func(i int, share []envelope) {
+			defer wg.Done()
+			results[i], errs[i] = sendWithRetry(ctx, config, from, share)
+		}(i, envelopes[start:end])
+	}
+	wg.Wait()
+
+	var combined []deliveryResult
+	var firstErr error
+	for i := range results {
+		combined = append(combined, results[i]...)
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+	return combined, firstErr
+}
+
+// default retry policy for failed sends
+const (
+	defaultMaxAttempts = 3
+	defaultBackoffBase = time.Second
+	defaultBackoffMax  = 30 * time.Second
+)
+
+// pause between attempts and the source of jitter, replaceable in tests
+var (
+	sleep  = time.Sleep
+	jitter = rand.Int63n
+)
+
+// how failed sends are retried
+type retryPolicy struct {
+	// total attempts including the first
+	maxAttempts int
+	// delay before the first retry, doubled for each one after
+	base time.Duration
+	// upper bound on the delay
+	max time.Duration
+}
+
+// exponential backoff before the given retry (starting at 1), capped at max
+func (p retryPolicy) backoff(retry int) time.Duration {
+	backoff := p.base
+	for i := 1; i < retry && backoff < p.max; i++ {
+		backoff *= 2
+	}
+	return min(backoff, p.max)
+}
+
+// the backoff with "full jitter" applied, a random duration in [0, backoff],
+// so clients retrying together don't hit the server in lockstep
+func (p retryPolicy) delay(retry int) time.Duration {
+	backoff := p.backoff(retry)
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(jitter(int64(backoff) + 1))
+}
+
+// record the same outcome for every recipient of the envelopes, along with
+// the server reply to each envelope when known
+func appendResults(results []deliveryResult, envelopes []envelope, status string, replies []string, err error) []deliveryResult {
+	for i, envelope := range envelopes {
+		for _, recipient := range envelope.recipients {
+			result := deliveryResult{Recipient: recipient, MessageID: envelope.messageID, Status: status}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			if i < len(replies) {
+				result.Response = replies[i]
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/smtp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// a message received by fakeSMTPServer
+type receivedMessage struct {
+	from       string
+	recipients []string
+	data       string
+	// whether the connection was encrypted when it was sent
+	tls bool
+}
+
+// a minimal SMTP server accepting every message, for testing delivery
+type fakeSMTPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	// trusts the server's certificate for example.com
+	roots *x509.CertPool
+
+	// offer STARTTLS, or speak TLS from the start
+	startTLS    bool
+	implicitTLS bool
+	// reply to RCPT TO instead of accepting the recipient
+	rcptReply string
+	// offer SMTPUTF8 for non-ASCII addresses
+	smtpUTF8 bool
+	// drop the connection on QUIT instead of replying
+	dropQuit bool
+
+	mu          sync.Mutex
+	connections int
+	// AUTH commands received, with their initial response
+	auths    []string
+	messages []receivedMessage
+}
+
+// listen on a local port, configured by the options before it accepts
+// connections
+func newFakeSMTPServer(t *testing.T, options ...func(*fakeSMTPServer)) *fakeSMTPServer {
+	t.Helper()
+	// borrow httptest's certificate, valid for example.com and 127.0.0.1
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+
+	f := &fakeSMTPServer{
+		tlsConfig: &tls.Config{Certificates: certServer.TLS.Certificates},
+		roots:     roots,
+	}
+	for _, option := range options {
+		option(f)
+	}
+	var err error
+	if f.implicitTLS {
+		f.listener, err = tls.Listen("tcp", "127.0.0.1:0", f.tlsConfig)
+	} else {
+		f.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.listener.Close() })
+	go f.serve()
+	return f
+}
+
+// configuration delivering to the server as me@example.com
+func (f *fakeSMTPServer) config() emailConfig {
+	host, port, _ := net.SplitHostPort(f.listener.Addr().String())
+	tlsMode := tlsModeNone
+	switch {
+	case f.implicitTLS:
+		tlsMode = tlsModeTLS
+	case f.startTLS:
+		tlsMode = tlsModeStartTLS
+	}
+	return emailConfig{
+		senderEmail: "me@example.com",
+		password:    "secret",
+		authMode:    authModePlain,
+		smtpServer:  host,
+		smtpPort:    port,
+		tlsMode:     tlsMode,
+		tlsConfig:   &tls.Config{ServerName: "example.com", RootCAs: f.roots},
+		smtpTimeout: 5 * time.Second,
+	}
+}
+
+// how many connections have been accepted
+func (f *fakeSMTPServer) connectionCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connections
+}
+
+// the messages received so far
+func (f *fakeSMTPServer) received() []receivedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]receivedMessage(nil), f.messages...)
+}
+
+func (f *fakeSMTPServer) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.connections++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeSMTPServer) handle(conn net.Conn) {
+	// conn is replaced by the TLS connection after STARTTLS
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\r\n"))
+		}
+	}
+	encrypted := f.implicitTLS
+	var message receivedMessage
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			lines := []string{"250-fake"}
+			if f.startTLS && !encrypted {
+				lines = append(lines, "250-STARTTLS")
+			}
+			if f.smtpUTF8 {
+				lines = append(lines, "250-SMTPUTF8")
+			}
+			reply(append(lines, "250-AUTH PLAIN XOAUTH2", "250 8BITMIME")...)
+		case command == "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader, encrypted = tlsConn, bufio.NewReader(tlsConn), true
+		case strings.HasPrefix(command, "AUTH"):
+			f.mu.Lock()
+			f.auths = append(f.auths, line)
+			f.mu.Unlock()
+			reply("235 authenticated")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message = receivedMessage{from: line[len("MAIL FROM:"):], tls: encrypted}
+			reply("250 ok")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			if f.rcptReply != "" {
+				reply(f.rcptReply)
+				continue
+			}
+			address := strings.Trim(line[len("RCPT TO:"):], "<>")
+			message.recipients = append(message.recipients, address)
+			reply("250 ok")
+		case command == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			message.data = data.String()
+			f.mu.Lock()
+			f.messages = append(f.messages, message)
+			f.mu.Unlock()
+			reply("250 ok queued as 1234")
+		case command == "RSET", command == "NOOP":
+			reply("250 ok")
+		case command == "QUIT":
+			if !f.dropQuit {
+				reply("221 bye")
+			}
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// an envelope for each address with a minimal message
+func testEnvelopes(addresses ...string) []envelope {
+	envelopes := make([]envelope, len(addresses))
+	for i, address := range addresses {
+		envelopes[i] = envelope{recipients: []string{address}, msg: []byte("Subject: Hi\r\n\r\nHello\r\n")}
+	}
+	return envelopes
+}
+
+func TestDeliverOverStartTLS(t *testing.T) {
+	server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.startTLS = true })
+
+	if _, err := deliverMail(server.config(), "me@example.com", testEnvelopes("a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.received(); len(got) != 1 || !got[0].tls {
+		t.Errorf("received = %+v, want one message sent after STARTTLS", got)
+	}
+}
+
+func TestDeliverOverImplicitTLS(t *testing.T) {
+	server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.implicitTLS = true })
+
+	if _, err := deliverMail(server.config(), "me@example.com", testEnvelopes("a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.received(); len(got) != 1 || !got[0].tls {
+		t.Errorf("received = %+v, want one message sent over TLS", got)
+	}
+}
+
+func TestDeliverIgnoresAFailedQuit(t *testing.T) {
+	logs := captureLogs(t)
+	server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.dropQuit = true })
+
+	// the message was accepted before QUIT, so the send must not be retried
+	replies, err := deliverMail(server.config(), "me@example.com", testEnvelopes("a@example.com"))
+	if err != nil || len(replies) != 1 {
+		t.Fatalf("replies = %v, err = %v, want the accepted message reported sent", replies, err)
+	}
+	if got := server.received(); len(got) != 1 {
+		t.Errorf("received %d messages, want 1", len(got))
+	}
+	if !strings.Contains(logs.String(), "Could not close SMTP connection") {
+		t.Errorf("logs = %s, want the failed QUIT logged", logs.String())
+	}
+}
+
+func TestDeliverRequiresStartTLS(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config := server.config()
+	config.tlsMode = tlsModeStartTLS
+
+	_, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com"))
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("err = %v, want the send refused without STARTTLS", err)
+	}
+	if got := server.received(); len(got) != 0 {
+		t.Errorf("received = %+v over an unencrypted connection", got)
+	}
+}
+
+func TestDeliverVerifiesCertificate(t *testing.T) {
+	server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.startTLS = true })
+	config := server.config()
+	config.tlsConfig = &tls.Config{ServerName: "example.com"}
+
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err == nil {
+		t.Error("sent to a server with an untrusted certificate")
+	}
+	config.tlsConfig = &tls.Config{ServerName: "mail.other.example", RootCAs: server.roots}
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err == nil {
+		t.Error("sent to a server whose certificate is for another name")
+	}
+}
+
+func TestDeliverAuthenticatesWithXOAUTH2(t *testing.T) {
+	server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.startTLS = true })
+	config := server.config()
+	config.authMode, config.oauthToken, config.password = authModeXOAUTH2, "ya29.token", ""
+
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	auths := server.auths
+	server.mu.Unlock()
+	want := "AUTH XOAUTH2 " + base64.StdEncoding.EncodeToString([]byte("user=me@example.com\x01auth=Bearer ya29.token\x01\x01"))
+	if len(auths) != 1 || auths[0] != want {
+		t.Errorf("AUTH commands = %q, want %q", auths, want)
+	}
+}
+
+func TestXOAUTH2RefusesUnencryptedConnections(t *testing.T) {
+	auth := &xoauth2Auth{username: "me@example.com", token: "ya29.token"}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: false}); err == nil {
+		t.Error("token sent over an unencrypted connection")
+	}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true}); err != nil {
+		t.Errorf("TLS connection refused: %v", err)
+	}
+	// a rejected token gets a JSON challenge, answered empty to get the final reply
+	if response, err := auth.Next([]byte(`{"status":"401"}`), true); err != nil || response == nil || len(response) != 0 {
+		t.Errorf("Next = %q, %v, want an empty response", response, err)
+	}
+}
+
+func TestDeliverSendsEveryEnvelopeOverOneConnection(t *testing.T) {
+	server := newFakeSMTPServer(t)
+
+	replies, err := deliverMail(server.config(), "me@example.com", testEnvelopes("a@example.com", "b@example.com", "c@example.com"))
+	if err != nil || len(replies) != 3 {
+		t.Fatalf("replies = %v, %v, want one for each of the three envelopes", replies, err)
+	}
+	if replies[0] != "250 ok queued as 1234" {
+		t.Errorf("reply = %q, want the server's final reply to DATA", replies[0])
+	}
+	received := server.received()
+	if len(received) != 3 || received[2].recipients[0] != "c@example.com" {
+		t.Errorf("received = %+v, want the three envelopes in order", received)
+	}
+	if got := server.connectionCount(); got != 1 {
+		t.Errorf("opened %d connections, want 1", got)
+	}
+}
+
+func TestSendWithRetryResendsOnlyTheUnsentEnvelopes(t *testing.T) {
+	var attempts [][]envelope
+	previous := sendMail
+	sendMail = func(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+		attempts = append(attempts, envelopes)
+		if len(attempts) == 1 {
+			return okReplies(1), errors.New("connection reset")
+		}
+		return okReplies(len(envelopes)), nil
+	}
+	t.Cleanup(func() { sendMail = previous })
+
+	recordSleeps(t)
+	retries := testutil.ToFloat64(sendRetriesTotal)
+	config := emailConfig{retry: retryPolicy{maxAttempts: 3, base: time.Millisecond, max: time.Millisecond}}
+	results, err := sendWithRetry(context.Background(), config, "me@example.com", testEnvelopes("a@example.com", "b@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || len(attempts[1]) != 1 || attempts[1][0].recipients[0] != "b@example.com" {
+		t.Errorf("attempts = %+v, want the second to resend only b@example.com", attempts)
+	}
+	if len(results) != 2 || results[0].Status != recipientSent || results[1].Status != recipientSent {
+		t.Errorf("results = %+v, want both recipients sent", results)
+	}
+	if got := testutil.ToFloat64(sendRetriesTotal) - retries; got != 1 {
+		t.Errorf("retry counter rose by %v, want 1", got)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 10, base: time.Second, max: 5 * time.Second}
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 9: 5 * time.Second} {
+		if got := policy.backoff(retry); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", retry, got, want)
+		}
+	}
+}
+
+func TestRetryPolicyDelayAddsFullJitter(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 5, base: time.Second, max: 10 * time.Second}
+	previous := jitter
+	defer func() { jitter = previous }()
+
+	var bound int64
+	jitter = func(n int64) int64 { bound = n; return n - 1 }
+	if got := policy.delay(2); got != 2*time.Second || bound != int64(2*time.Second)+1 {
+		t.Errorf("delay(2) = %s drawn below %d, want up to and including the 2s backoff", got, bound)
+	}
+	jitter = func(n int64) int64 { return 0 }
+	if got := policy.delay(2); got != 0 {
+		t.Errorf("delay(2) = %s, want the smallest draw to give no pause", got)
+	}
+
+	// the real source stays within the backoff
+	jitter = previous
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(3); got < 0 || got > 4*time.Second {
+			t.Fatalf("delay(3) = %s, want it within [0, 4s]", got)
+		}
+	}
+	if got := (retryPolicy{}).delay(1); got != 0 {
+		t.Errorf("delay without a backoff = %s, want 0", got)
+	}
+}
+
+// replace sleep for the duration of the test, recording the pauses
+func recordSleeps(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var pauses []time.Duration
+	previous := sleep
+	sleep = func(d time.Duration) { pauses = append(pauses, d) }
+	t.Cleanup(func() { sleep = previous })
+	return &pauses
+}
+
+// replace sendMail with one that fails the first failures attempts, counting
+// every attempt
+func flakySendMail(t *testing.T, failures int) *int {
+	t.Helper()
+	var attempts int
+	previous := sendMail
+	sendMail = func(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+		attempts++
+		if attempts <= failures {
+			return nil, errors.New("connection reset")
+		}
+		return okReplies(len(envelopes)), nil
+	}
+	t.Cleanup(func() { sendMail = previous })
+	return &attempts
+}
+
+func TestSendWithRetryRetriesTransientFailures(t *testing.T) {
+	pauses := recordSleeps(t)
+	attempts := flakySendMail(t, 2)
+	config := emailConfig{retry: retryPolicy{maxAttempts: 3, base: time.Millisecond, max: time.Millisecond}}
+
+	results, err := sendWithRetry(context.Background(), config, "me@example.com", testEnvelopes("a@example.com"))
+	if err != nil || len(results) != 1 || results[0].Status != recipientSent {
+		t.Fatalf("results = %+v, %v, want sent on the third attempt", results, err)
+	}
+	if *attempts != 3 || len(*pauses) != 2 {
+		t.Errorf("%d attempts with %d pauses, want 3 and 2", *attempts, len(*pauses))
+	}
+
+	attempts = flakySendMail(t, 3)
+	results, err = sendWithRetry(context.Background(), config, "me@example.com", testEnvelopes("a@example.com"))
+	if err == nil || *attempts != 3 || results[0].Status != recipientFailed {
+		t.Errorf("results = %+v, %v after %d attempts, want failed after 3", results, err, *attempts)
+	}
+}
+
+// stub sendMail recording how many sends run at once, and failing at the
+// first envelope addressed to a recipient in reject
+type concurrentSends struct {
+	mu        sync.Mutex
+	active    int
+	peak      int
+	attempted []string
+	reject    map[string]bool
+}
+
+func recordConcurrentSends(t *testing.T, reject ...string) *concurrentSends {
+	t.Helper()
+	c := &concurrentSends{reject: map[string]bool{}}
+	for _, address := range reject {
+		c.reject[address] = true
+	}
+	previous := sendMail
+	sendMail = func(config emailConfig, from string, envelopes []envelope) ([]string, error) {
+		c.mu.Lock()
+		c.active++
+		c.peak = max(c.peak, c.active)
+		c.mu.Unlock()
+
+		// give the other workers time to start sending
+		time.Sleep(10 * time.Millisecond)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.active--
+		var replies []string
+		for _, e := range envelopes {
+			c.attempted = append(c.attempted, e.recipients...)
+			if c.reject[e.recipients[0]] {
+				return replies, errors.New("550 no such user")
+			}
+			replies = append(replies, "250 ok")
+		}
+		return replies, nil
+	}
+	t.Cleanup(func() { sendMail = previous })
+	return c
+}
+
+func TestSendConcurrentlyKeepsEnvelopeOrder(t *testing.T) {
+	addresses := []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com", "f@example.com", "g@example.com", "h@example.com"}
+	sends := recordConcurrentSends(t, "c@example.com")
+	config := emailConfig{retry: retryPolicy{maxAttempts: 1}}
+
+	results, err := sendConcurrently(context.Background(), config, "me@example.com", testEnvelopes(addresses...), 4)
+	if err == nil {
+		t.Error("err = nil, want the rejection reported")
+	}
+	if sends.peak < 2 || sends.peak > 4 {
+		t.Errorf("%d sends at once, want between 2 and the concurrency of 4", sends.peak)
+	}
+	if len(results) != len(addresses) {
+		t.Fatalf("got %d results, want one per recipient", len(results))
+	}
+	for i, result := range results {
+		wantStatus := recipientSent
+		// c@example.com shares a connection with d@example.com, which is
+		// never reached
+		if result.Recipient == "c@example.com" || result.Recipient == "d@example.com" {
+			wantStatus = recipientFailed
+		}
+		if result.Recipient != addresses[i] || result.Status != wantStatus {
+			t.Errorf("result %d = %+v, want %s %s in envelope order", i, result, addresses[i], wantStatus)
+		}
+	}
+}
+
+func TestSendConcurrentlyRespectsALimitOfOne(t *testing.T) {
+	sends := recordConcurrentSends(t)
+	config := emailConfig{retry: retryPolicy{maxAttempts: 1}}
+	results, err := sendConcurrently(context.Background(), config, "me@example.com", testEnvelopes("a@example.com", "b@example.com", "c@example.com"), 1)
+	if err != nil || len(results) != 3 || sends.peak != 1 {
+		t.Errorf("results = %+v, %v with %d at once, want all sent over one connection", results, err, sends.peak)
+	}
+}
+
+func TestSendConcurrentlyOpensAConnectionPerWorker(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	config := server.config()
+	config.retry = retryPolicy{maxAttempts: 1}
+	results, err := sendConcurrently(context.Background(), config, "me@example.com",
+		testEnvelopes("a@example.com", "b@example.com", "c@example.com", "d@example.com"), 2)
+	if err != nil || len(results) != 4 {
+		t.Fatalf("results = %+v, %v, want all four sent", results, err)
+	}
+	if got := server.connectionCount(); got != 2 {
+		t.Errorf("%d connections opened, want one for each of the 2 workers", got)
+	}
+}
+
+func TestDeliverTimesOutOnAStalledServer(t *testing.T) {
+	// accepts connections but never greets them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	config := emailConfig{smtpServer: host, smtpPort: port, smtpTimeout: 50 * time.Millisecond}
+	start := time.Now()
+	if _, err := deliverMail(config, "me@example.com", testEnvelopes("a@example.com")); err == nil {
+		t.Fatal("delivered to a server that never replied")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, want the 50ms timeout", elapsed)
+	}
+}
+
+func TestSendWithRetryClassifiesSMTPReplies(t *testing.T) {
+	pauses := recordSleeps(t)
+	for reply, wantConnections := range map[string]int{
+		"550 mailbox does not exist":   1,
+		"451 try again later":          3,
+		"421 service not available":    3,
+		"553 mailbox name not allowed": 1,
+	} {
+		*pauses = nil
+		server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.rcptReply = reply })
+		config := server.config()
+		config.retry = retryPolicy{maxAttempts: 3, base: time.Millisecond, max: time.Millisecond}
+
+		results, err := sendWithRetry(context.Background(), config, "me@example.com", testEnvelopes("a@example.com"))
+		if err == nil || len(results) != 1 || results[0].Status != recipientFailed {
+			t.Errorf("%s: results = %+v, %v, want the recipient failed", reply, results, err)
+		}
+		if got := server.connectionCount(); got != wantConnections || len(*pauses) != wantConnections-1 {
+			t.Errorf("%s: %d attempts with %d pauses, want %d attempts", reply, got, len(*pauses), wantConnections)
+		}
+		if permanent := wantConnections == 1; isPermanent(err) != permanent {
+			t.Errorf("%s: isPermanent = %v, want %v", reply, !permanent, permanent)
+		}
+	}
+}
+
+func TestDeliverToInternationalizedAddresses(t *testing.T) {
+	server := newFakeSMTPServer(t, func(f *fakeSMTPServer) { f.smtpUTF8 = true })
+	recipient := normalizeEmail("用户@例え.jp")
+	if _, err := deliverMail(server.config(), "me@example.com", testEnvelopes(recipient)); err != nil {
+		t.Fatal(err)
+	}
+	got := server.received()
+	if len(got) != 1 || !strings.HasSuffix(got[0].from, " SMTPUTF8") || !slices.Equal(got[0].recipients, []string{"用户@xn--r8jz45g.jp"}) {
+		t.Errorf("received = %+v, want the address sent with the SMTPUTF8 parameter", got)
+	}
+}
+
+func TestDeliverRejectsInternationalizedAddressesWithoutSMTPUTF8(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	_, err := deliverMail(server.config(), "me@example.com", testEnvelopes("用户@xn--r8jz45g.jp"))
+	if !errors.Is(err, errSMTPUTF8Unsupported) {
+		t.Errorf("err = %v, want SMTPUTF8 reported as unsupported", err)
+	}
+	if got := server.received(); len(got) != 0 {
+		t.Errorf("received = %+v, want nothing sent", got)
+	}
+
+	// an internationalized domain alone is sent in its ASCII form
+	if _, err := deliverMail(server.config(), "me@example.com", testEnvelopes(normalizeEmail("user@bücher.ch"))); err != nil {
+		t.Errorf("err = %v, want an ASCII local part sent without SMTPUTF8", err)
+	}
+}
+
+func TestNetworkFailuresAreTransient(t *testing.T) {
+	if isPermanent(errors.New("connection refused")) || isPermanent(envelopeError{errors.New("i/o timeout")}) {
+		t.Error("network failure treated as permanent")
+	}
+	if !isPermanent(errSMTPUTF8Unsupported) {
+		t.Error("an address the server can't take treated as transient")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SPF check results (RFC 7208)
+const (
+	spfPass      = "pass"
+	spfFail      = "fail"
+	spfSoftFail  = "softfail"
+	spfNeutral   = "neutral"
+	spfNone      = "none"
+	spfPermError = "permerror"
+	spfTempError = "temperror"
+)
+
+// limit on the DNS queries an SPF evaluation may make, as RFC 7208 requires
+const spfMaxLookups = 10
+
+// how long the startup SPF check may take
+const spfCheckTimeout = 10 * time.Second
+
+// DNS lookups needed to evaluate SPF records, satisfied by *net.Resolver
+type spfResolver interface {
+	mxResolver
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// look up the SPF record of the envelope sender's domain and check that the
+// configured SMTP server's addresses are authorized by it, logging a warning
+// when they aren't. The check is advisory: a relay often sends from addresses
+// other than the one it is reached on. Returns a summary for /readyz
+func checkSenderSPF(ctx context.Context, resolver spfResolver, config emailConfig) string {
+	ctx, cancel := context.WithTimeout(ctx, spfCheckTimeout)
+	defer cancel()
+
+	domain := emailDomain(config.envelopeSender())
+	addresses, err := resolver.LookupHost(ctx, config.smtpServer)
+	if err != nil {
+		slog.Warn("Could not check SPF, the SMTP server address lookup failed", "server", config.smtpServer, "error", err)
+		return spfTempError + ": " + err.Error()
+	}
+
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		evaluation := &spfEvaluation{resolver: resolver, ip: ip}
+		result, err := evaluation.check(ctx, domain)
+		if result == spfPass {
+			continue
+		}
+		summary := fmt.Sprintf("%s: SMTP server address %s is not authorized by the SPF record of %s", result, address, domain)
+		if result == spfNone {
+			summary = fmt.Sprintf("%s: %s has no SPF record", result, domain)
+		}
+		if err != nil {
+			summary += ": " + err.Error()
+		}
+		slog.Warn("SPF check did not pass, mail may be rejected or marked as spam",
+			"domain", domain, "server", config.smtpServer, "address", address, "result", result, "error", err)
+		return summary
+	}
+	slog.Info("SPF check passed", "domain", domain, "server", config.smtpServer)
+	return spfPass
+}
+
+// the evaluation of SPF records for a single IP address
+type spfEvaluation struct {
+	resolver spfResolver
+	ip       net.IP
+	// DNS querying terms evaluated so far
+	lookups int
+}
+
+// evaluate the SPF record of domain, following includes and redirects; the
+// rarely used exists and ptr mechanisms never match
+func (e *spfEvaluation) check(ctx context.Context, domain string) (string, error) {
+	record, err := e.record(ctx, domain)
+	if record == "" || err != nil {
+		return spfResultFor(record, err)
+	}
+
+	redirect := ""
+	for _, term := range strings.Fields(record)[1:] {
+		if name, value, ok := strings.Cut(term, "="); ok && !strings.ContainsAny(name, ":/") {
+			// modifiers, of which only redirect affects the result
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = spfFail, term[1:]
+		case '~':
+			qualifier, term = spfSoftFail, term[1:]
+		case '?':
+			qualifier, term = spfNeutral, term[1:]
+		}
+
+		matched, err := e.matches(ctx, domain, term)
+		if err != nil {
+			return spfResultFor(record, err)
+		}
+		if matched {
+			return qualifier, nil
+		}
+	}
+
+	if redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return spfPermError, err
+		}
+		result, err := e.check(ctx, redirect)
+		if result == spfNone {
+			return spfPermError, spfPermanentError(fmt.Sprintf("redirect to %s, which has no SPF record", redirect))
+		}
+		return result, err
+	}
+	return spfNeutral, nil
+}
+
+// the v=spf1 record of domain, empty when there is none
+func (e *spfEvaluation) record(ctx context.Context, domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) > 1 {
+		return "", spfPermanentError(fmt.Sprintf("%s has more than one SPF record", domain))
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+// report whether the mechanism (without its qualifier) matches the address
+func (e *spfEvaluation) matches(ctx context.Context, domain, mechanism string) (bool, error) {
+	name, arg, _ := strings.Cut(mechanism, ":")
+	// the a and mx mechanisms may be followed by prefix lengths without a domain
+	if slash := strings.Index(name, "/"); slash >= 0 {
+		name, arg = name[:slash], domain+name[slash:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(arg, "/") {
+			if ip := net.ParseIP(arg); ip != nil {
+				return ip.Equal(e.ip), nil
+			}
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			return false, spfPermanentError(fmt.Sprintf("invalid %s mechanism %s", name, mechanism))
+		}
+		return network.Contains(e.ip), nil
+	case "a", "mx":
+		target, v4, v6, err := spfTarget(domain, arg)
+		if err != nil {
+			return false, err
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			records, err := e.resolver.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, err
+			}
+			hosts = hosts[:0]
+			for _, record := range records {
+				hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+			}
+		}
+		for _, host := range hosts {
+			addresses, err := e.resolver.LookupHost(ctx, host)
+			if err != nil && !isNotFound(err) {
+				return false, err
+			}
+			for _, address := range addresses {
+				if ip := net.ParseIP(address); ip != nil && spfPrefixMatch(ip, e.ip, v4, v6) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "include":
+		if arg == "" {
+			return false, spfPermanentError("include mechanism without a domain")
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		result, err := e.check(ctx, arg)
+		switch result {
+		case spfPass:
+			return true, nil
+		case spfNone:
+			return false, spfPermanentError(fmt.Sprintf("include of %s, which has no SPF record", arg))
+		case spfTempError, spfPermError:
+			return false, err
+		}
+		return false, nil
+	case "exists", "ptr":
+		return false, e.countLookup()
+	}
+	return false, spfPermanentError(fmt.Sprintf("unknown mechanism %s", mechanism))
+}
+
+// count a DNS querying term, failing once there have been too many
+func (e *spfEvaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > spfMaxLookups {
+		return spfPermanentError(fmt.Sprintf("more than %d DNS lookups", spfMaxLookups))
+	}
+	return nil
+}
+
+// split an a or mx argument of the form domain/v4-length//v6-length, either
+// part being optional, defaulting to domain and full length prefixes
+func spfTarget(domain, arg string) (target string, v4, v6 int, err error) {
+	target, v4, v6 = arg, 32, 128
+	if slash := strings.Index(arg, "/"); slash >= 0 {
+		target = arg[:slash]
+		lengths := arg[slash+1:]
+		v4Length, v6Length, dual := strings.Cut(lengths, "//")
+		if strings.HasPrefix(lengths, "/") {
+			v4Length, v6Length, dual = "", lengths[1:], true
+		}
+		if v4Length != "" {
+			if v4, err = strconv.Atoi(v4Length); err != nil || v4 < 0 || v4 > 32 {
+				return "", 0, 0, spfPermanentError(fmt.Sprintf("invalid prefix length in %s", arg))
+			}
+		}
+		if dual {
+			if v6, err = strconv.Atoi(v6Length); err != nil || v6 < 0 || v6 > 128 {
+				return "", 0, 0, spfPermanentError(fmt.Sprintf("invalid prefix length in %s", arg))
+			}
+		}
+	}
+	if target == "" {
+		target = domain
+	}
+	return target, v4, v6, nil
+}
+
+// report whether ip is within the prefix of host, of length v4 or v6
+// depending on the address family
+func spfPrefixMatch(host, ip net.IP, v4, v6 int) bool {
+	bits, length := 128, v6
+	if host.To4() != nil {
+		bits, length = 32, v4
+	}
+	if (host.To4() != nil) != (ip.To4() != nil) {
+		return false
+	}
+	mask := net.CIDRMask(length, bits)
+	return host.Mask(mask).Equal(ip.Mask(mask))
+}
+
+// an SPF record that can't be evaluated, as opposed to a DNS failure
+type spfPermanentError string
+
+func (e spfPermanentError) Error() string {
+	return string(e)
+}
+
+// the result for an evaluation that stopped early: none without a record,
+// permerror for a broken record and temperror for a failed lookup
+func spfResultFor(record string, err error) (string, error) {
+	switch err.(type) {
+	case nil:
+		if record == "" {
+			return spfNone, nil
+		}
+		return spfNeutral, nil
+	case spfPermanentError:
+		return spfPermError, err
+	}
+	return spfTempError, err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// answers TXT lookups from txts as well as the lookups of fakeResolver
+type fakeSPFResolver struct {
+	fakeResolver
+	txts map[string][]string
+}
+
+func (r *fakeSPFResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if err := r.errs["txt:"+name]; err != nil {
+		return nil, err
+	}
+	if txts, ok := r.txts[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+// a resolver for the SMTP server smtp.example.com at 192.0.2.10 sending for
+// example.com, whose mail host is on the same network, with the TXT records
+func spfResolverWith(txts map[string][]string) *fakeSPFResolver {
+	return &fakeSPFResolver{
+		fakeResolver: fakeResolver{hosts: map[string][]string{"smtp.example.com": {"192.0.2.10"}, "mx.example.com": {"192.0.2.1"}}},
+		txts:         txts,
+	}
+}
+
+func spfConfig() emailConfig {
+	return emailConfig{senderEmail: "me@example.com", smtpServer: "smtp.example.com"}
+}
+
+func TestCheckSenderSPF(t *testing.T) {
+	for name, test := range map[string]struct {
+		txts map[string][]string
+		want string
+	}{
+		"ip4 address":  {map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.10 -all"}}, spfPass},
+		"ip4 network":  {map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.0/24 -all"}}, spfPass},
+		"a":            {map[string][]string{"example.com": {"v=spf1 a:smtp.example.com -all"}}, spfPass},
+		"mx prefix":    {map[string][]string{"example.com": {"v=spf1 mx/24 -all"}}, spfPass},
+		"include":      {map[string][]string{"example.com": {"v=spf1 include:_spf.relay.example -all"}, "_spf.relay.example": {"v=spf1 ip4:192.0.2.10 ~all"}}, spfPass},
+		"redirect":     {map[string][]string{"example.com": {"v=spf1 redirect=_spf.relay.example"}, "_spf.relay.example": {"v=spf1 ip4:192.0.2.10 -all"}}, spfPass},
+		"other TXT":    {map[string][]string{"example.com": {"google-site-verification=abc", "v=spf1 ip4:192.0.2.10 -all"}}, spfPass},
+		"fail":         {map[string][]string{"example.com": {"v=spf1 ip4:198.51.100.1 -all"}}, "fail: SMTP server address 192.0.2.10 is not authorized by the SPF record of example.com"},
+		"softfail":     {map[string][]string{"example.com": {"v=spf1 ip4:198.51.100.1 ~all"}}, "softfail: "},
+		"mx elsewhere": {map[string][]string{"example.com": {"v=spf1 mx -all"}}, "fail: "},
+		"no all":       {map[string][]string{"example.com": {"v=spf1 ip4:198.51.100.1"}}, "neutral: "},
+		"no record":    {nil, "none: example.com has no SPF record"},
+		"two records":  {map[string][]string{"example.com": {"v=spf1 -all", "v=spf1 +all"}}, "permerror: "},
+		"unknown term": {map[string][]string{"example.com": {"v=spf1 bogus -all"}}, "permerror: "},
+		"bad include":  {map[string][]string{"example.com": {"v=spf1 include:_spf.missing.example -all"}}, "permerror: "},
+		// includes that loop stop at the lookup limit
+		"lookup limit": {map[string][]string{"example.com": {"v=spf1 include:example.com -all"}}, "more than 10 DNS lookups"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := checkSenderSPF(context.Background(), spfResolverWith(test.txts), spfConfig())
+			if got != test.want && (test.want == spfPass || !strings.Contains(got, test.want)) {
+				t.Errorf("result = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckSenderSPFReportsLookupFailures(t *testing.T) {
+	resolver := spfResolverWith(nil)
+	resolver.errs = map[string]error{"txt:example.com": &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}}
+	if got := checkSenderSPF(context.Background(), resolver, spfConfig()); !strings.HasPrefix(got, spfTempError+": ") {
+		t.Errorf("result = %q, want temperror for a failed TXT lookup", got)
+	}
+
+	config := spfConfig()
+	config.smtpServer = "unknown.example.com"
+	if got := checkSenderSPF(context.Background(), resolver, config); !strings.HasPrefix(got, spfTempError+": ") {
+		t.Errorf("result = %q, want temperror for an unknown SMTP server", got)
+	}
+}
+
+func TestCheckSenderSPFUsesTheEnvelopeSenderDomain(t *testing.T) {
+	resolver := spfResolverWith(map[string][]string{
+		"example.com":         {"v=spf1 -all"},
+		"bounces.example.com": {"v=spf1 ip4:192.0.2.10 -all"},
+	})
+	config := spfConfig()
+	config.returnPath = "return@bounces.example.com"
+	if got := checkSenderSPF(context.Background(), resolver, config); got != spfPass {
+		t.Errorf("result = %q, want the RETURN_PATH domain checked", got)
+	}
+}
+
+func TestCheckSenderSPFWarnsWithoutFailing(t *testing.T) {
+	logs := captureLogs(t)
+	checkSenderSPF(context.Background(), spfResolverWith(map[string][]string{"example.com": {"v=spf1 -all"}}), spfConfig())
+	if !strings.Contains(logs.String(), `"level":"WARN"`) || !strings.Contains(logs.String(), `"result":"fail"`) {
+		t.Errorf("logs = %s, want a warning with the result", logs)
+	}
+}
+
+func TestReadyzReportsTheSPFCheck(t *testing.T) {
+	s := &server{
+		config:    emailConfig{senderEmail: "me@example.com"},
+		ping:      func(ctx context.Context) error { return nil },
+		spfStatus: "fail: SMTP server address 192.0.2.10 is not authorized by the SPF record of example.com",
+	}
+	w := record(s.readyzHandler, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	decodeBody(t, w, &body)
+	// a failed SPF check doesn't make the service unready
+	if w.Code != http.StatusOK || body.Checks["spf"] != s.spfStatus {
+		t.Errorf("status = %d, checks = %v, want ready with the SPF result", w.Code, body.Checks)
+	}
+
+	s.spfStatus = ""
+	w = record(s.readyzHandler, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if strings.Contains(w.Body.String(), "spf") {
+		t.Errorf("body = %s, want no SPF check when CHECK_SPF is off", w.Body.String())
+	}
+}
+
+func TestSPFTarget(t *testing.T) {
+	for arg, want := range map[string]struct {
+		target string
+		v4, v6 int
+	}{
+		"":                    {"example.com", 32, 128},
+		"mail.example.com":    {"mail.example.com", 32, 128},
+		"mail.example.com/24": {"mail.example.com", 24, 128},
+		"/24//64":             {"example.com", 24, 64},
+		"//64":                {"example.com", 32, 64},
+	} {
+		target, v4, v6, err := spfTarget("example.com", arg)
+		if err != nil || target != want.target || v4 != want.v4 || v6 != want.v6 {
+			t.Errorf("spfTarget(%q) = %s %d %d, %v, want %+v", arg, target, v4, v6, err, want)
+		}
+	}
+	if _, _, _, err := spfTarget("example.com", "/33"); !errors.As(err, new(spfPermanentError)) {
+		t.Errorf("err = %v, want an invalid prefix length rejected", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// how long computed send statistics are served before they are recomputed
+const statsCacheTTL = 30 * time.Second
+
+// number of recipient domains listed in the send statistics
+const statsTopDomains = 10
+
+// body of a /stats response, summarizing the send history
+type sendStats struct {
+	TotalSent    int64 `json:"total_sent"`
+	TotalFailed  int64 `json:"total_failed"`
+	TotalPartial int64 `json:"total_partial"`
+	// sends of any outcome in the last 24 hours
+	SentLast24h int64 `json:"sent_last_24h"`
+	// most sent to recipient domains, most frequent first
+	TopDomains []domainCount `json:"top_domains"`
+}
+
+// number of sends to a recipient domain
+type domainCount struct {
+	Domain string `bson:"_id" json:"domain"`
+	Count  int64  `bson:"count" json:"count"`
+}
+
+// aggregate the send history in a single pipeline, counting sends by status,
+// sends since the given time, and the recipient domains sent to most
+func (s mongoHistoryStore) stats(ctx context.Context, since time.Time, topDomains int) (sendStats, error) {
+	pipeline := bson.A{
+		bson.M{"$facet": bson.M{
+			"statuses": bson.A{
+				bson.M{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}},
+			},
+			"recent": bson.A{
+				bson.M{"$match": bson.M{"sentAt": bson.M{"$gte": since}}},
+				bson.M{"$count": "count"},
+			},
+			"domains": bson.A{
+				bson.M{"$unwind": "$recipients"},
+				bson.M{"$group": bson.M{
+					"_id":   bson.M{"$arrayElemAt": bson.A{bson.M{"$split": bson.A{"$recipients", "@"}}, -1}},
+					"count": bson.M{"$sum": 1},
+				}},
+				// ties are broken by name so the list is stable
+				bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$limit": topDomains},
+			},
+		}},
+	}
+	cursor, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return sendStats{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var facets []struct {
+		Statuses []struct {
+			Status string `bson:"_id"`
+			Count  int64  `bson:"count"`
+		} `bson:"statuses"`
+		Recent []struct {
+			Count int64 `bson:"count"`
+		} `bson:"recent"`
+		Domains []domainCount `bson:"domains"`
+	}
+	if err := cursor.All(ctx, &facets); err != nil {
+		return sendStats{}, err
+	}
+
+	stats := sendStats{TopDomains: []domainCount{}}
+	if len(facets) == 0 {
+		return stats, nil
+	}
+	for _, status := range facets[0].Statuses {
+		switch status.Status {
+		case jobSent:
+			stats.TotalSent = status.Count
+		case jobFailed:
+			stats.TotalFailed = status.Count
+		case jobPartial:
+			stats.TotalPartial = status.Count
+		}
+	}
+	// $count produces no document at all when nothing matched
+	if len(facets[0].Recent) > 0 {
+		stats.SentLast24h = facets[0].Recent[0].Count
+	}
+	if facets[0].Domains != nil {
+		stats.TopDomains = facets[0].Domains
+	}
+	return stats, nil
+}
+
+// the send statistics, recomputed at most once per ttl as the aggregation
+// reads the whole send history
+type statsCache struct {
+	history historyStore
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu       sync.Mutex
+	stats    sendStats
+	computed time.Time
+}
+
+func newStatsCache(history historyStore, ttl time.Duration) *statsCache {
+	return &statsCache{history: history, ttl: ttl, now: time.Now}
+}
+
+// the cached statistics, or freshly aggregated ones when they have expired;
+// concurrent callers wait for a single aggregation
+func (c *statsCache) get(ctx context.Context) (sendStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if !c.computed.IsZero() && now.Sub(c.computed) < c.ttl {
+		return c.stats, nil
+	}
+	stats, err := c.history.stats(ctx, now.Add(-24*time.Hour), statsTopDomains)
+	if err != nil {
+		return sendStats{}, err
+	}
+	c.stats, c.computed = stats, now
+	return stats, nil
+}
+
+// handles requests for statistics summarizing the send history
+func (s *server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	stats, err := s.stats.get(ctx)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStatsHandler(t *testing.T) {
+	history := &memHistoryStore{}
+	now := time.Now()
+	for _, record := range []sentEmailRecord{
+		{Status: jobSent, SentAt: now.Add(-time.Hour), Recipients: []string{"a@example.com", "b@example.com"}},
+		{Status: jobSent, SentAt: now.Add(-48 * time.Hour), Recipients: []string{"c@example.org"}},
+		{Status: jobFailed, SentAt: now.Add(-2 * time.Hour), Recipients: []string{"d@example.com"}},
+		{Status: jobPartial, SentAt: now.Add(-72 * time.Hour), Recipients: []string{"e@example.net"}},
+	} {
+		history.record(context.Background(), record)
+	}
+	s := &server{stats: newStatsCache(history, time.Minute)}
+
+	w := record(s.statsHandler, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var stats sendStats
+	decodeBody(t, w, &stats)
+	if stats.TotalSent != 2 || stats.TotalFailed != 1 || stats.TotalPartial != 1 || stats.SentLast24h != 2 {
+		t.Errorf("stats = %+v, want 2 sent, 1 failed, 1 partial and 2 in the last day", stats)
+	}
+	want := []domainCount{{"example.com", 3}, {"example.net", 1}, {"example.org", 1}}
+	if !slices.Equal(stats.TopDomains, want) {
+		t.Errorf("top_domains = %v, want %v", stats.TopDomains, want)
+	}
+
+	assertError(t, record(s.statsHandler, httptest.NewRequest(http.MethodPost, "/stats", nil)), http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestStatsCache(t *testing.T) {
+	history := &memHistoryStore{}
+	cache := newStatsCache(history, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.get(context.Background())
+	history.record(context.Background(), sentEmailRecord{Status: jobSent, SentAt: now})
+	if stats, _ := cache.get(context.Background()); stats.TotalSent != 0 {
+		t.Errorf("total_sent = %d, want the cached value within the TTL", stats.TotalSent)
+	}
+
+	now = now.Add(time.Minute)
+	if stats, _ := cache.get(context.Background()); stats.TotalSent != 1 {
+		t.Errorf("total_sent = %d, want it recomputed after the TTL", stats.TotalSent)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// reported for recipients skipped because they unsubscribed
+const statusSuppressed = "suppressed"
+
+// persistence for addresses that must not be sent to
+type suppressionStore interface {
+	suppress(ctx context.Context, email string) error
+	// the subset of addresses that are suppressed
+	suppressed(ctx context.Context, emails []string) (map[string]bool, error)
+}
+
+// suppressionStore backed by a MongoDB collection
+type mongoSuppressionStore struct {
+	collection *mongo.Collection
+}
+
+func (s mongoSuppressionStore) suppress(ctx context.Context, email string) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"email": email},
+		bson.M{"$setOnInsert": bson.M{"email": email, "suppressedAt": time.Now()}},
+		options.Update().SetUpsert(true))
+	// a concurrent request already suppressed the address
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (s mongoSuppressionStore) suppressed(ctx context.Context, emails []string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	if len(emails) == 0 {
+		return set, nil
+	}
+	cursor, err := s.collection.Find(ctx, bson.M{"email": bson.M{"$in": emails}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			Email string `bson:"email"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		set[doc.Email] = true
+	}
+	return set, cursor.Err()
+}
+
+// remove suppressed addresses from the request, returning the ones removed
+func (request *EmailRequest) removeSuppressed(suppressed map[string]bool) []string {
+	removed := []string{}
+	filter := func(addresses []string) []string {
+		kept := addresses[:0]
+		for _, address := range addresses {
+			if suppressed[address] {
+				removed = append(removed, address)
+				continue
+			}
+			kept = append(kept, address)
+		}
+		return kept
+	}
+	request.Recipients = filter(request.Recipients)
+	request.Cc = filter(request.Cc)
+	request.Bcc = filter(request.Bcc)
+	return removed
+}
+
+// link recipients can follow to unsubscribe, empty when PUBLIC_URL is not set
+func unsubscribeURL(config emailConfig, email string) string {
+	if config.publicURL == "" {
+		return ""
+	}
+	return config.publicURL + "/unsubscribe?email=" + url.QueryEscape(email) +
+		"&token=" + unsubscribeToken(config.unsubscribeSecret, email)
+}
+
+// HMAC-SHA256 of the address with the secret, proving an unsubscribe link
+// was sent to it
+func unsubscribeToken(secret, email string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(email))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// report whether the token is the one the address's unsubscribe links carry
+func validUnsubscribeToken(config emailConfig, email, token string) bool {
+	if config.unsubscribeSecret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(unsubscribeToken(config.unsubscribeSecret, email)))
+}
+
+// page shown when an unsubscribe link is opened in a browser, so the address
+// is only suppressed once the recipient confirms; link scanners only GET it
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}<p>{{.Email}} has been unsubscribed and won't receive any more emails.</p>
+{{else}}<form method="post">
+<p>Stop sending emails to {{.Email}}?</p>
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// write the unsubscribe page for the address
+func writeUnsubscribePage(w http.ResponseWriter, email string, done bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := unsubscribePage.Execute(w, struct {
+		Email string
+		Done  bool
+	}{email, done}); err != nil {
+		slog.Error("Error writing unsubscribe page", "error", err)
+	}
+}
+
+// body mailbox providers post to a List-Unsubscribe URL for a one-click
+// unsubscribe (RFC 8058)
+const oneClickUnsubscribe = "One-Click"
+
+// handles opt-out requests, taking the address and its token from the email
+// and token query parameters as used by List-Unsubscribe links or from a JSON
+// body. Opening a link shows a page confirming the unsubscribe, and one-click
+// unsubscribes and the page post a List-Unsubscribe=One-Click form to it
+func (s *server) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET and POST methods
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET and POST methods are allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	email, token := query.Get("email"), query.Get("token")
+	form := false
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.maxBodyBytes)
+		var maxBytesErr *http.MaxBytesError
+		switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			var err error
+			if mediaType == "multipart/form-data" {
+				err = r.ParseMultipartForm(s.config.maxBodyBytes)
+			} else {
+				err = r.ParseForm()
+			}
+			if errors.As(err, &maxBytesErr) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Sprintf("Request body exceeds the maximum size of %d bytes", s.config.maxBodyBytes))
+				return
+			}
+			if r.PostFormValue("List-Unsubscribe") != oneClickUnsubscribe {
+				writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "form body must be List-Unsubscribe=One-Click")
+				return
+			}
+			form = true
+		default:
+			if email != "" {
+				break
+			}
+			var body struct {
+				Email string `json:"email"`
+				Token string `json:"token"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&body)
+			if errors.As(err, &maxBytesErr) {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, fmt.Sprintf("Request body exceeds the maximum size of %d bytes", s.config.maxBodyBytes))
+				return
+			}
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+				return
+			}
+			email, token = body.Email, body.Token
+		}
+	}
+	email = normalizeEmail(email)
+	if !isValidEmail(email) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Email address '%s' is not valid", email))
+		return
+	}
+	if !validUnsubscribeToken(s.config, email, token) {
+		writeJSONError(w, http.StatusForbidden, errCodeUnauthorized, "Unsubscribe link is invalid")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeUnsubscribePage(w, email, false)
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	if err := s.suppressions.suppress(ctx, email); err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	if form {
+		writeUnsubscribePage(w, email, true)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"email": email, "status": statusSuppressed})
+}
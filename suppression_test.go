@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// a server with unsubscribe links enabled
+func newUnsubscribeServer() (*server, *memSuppressionStore) {
+	suppressions := newMemSuppressionStore()
+	config := emailConfig{publicURL: "https://mail.example.com", unsubscribeSecret: "secret", maxBodyBytes: 1 << 20}
+	return &server{config: config, suppressions: suppressions}, suppressions
+}
+
+// the path and query of the address's unsubscribe link
+func unsubscribePath(t *testing.T, config emailConfig, email string) string {
+	t.Helper()
+	link, err := url.Parse(unsubscribeURL(config, email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.RequestURI()
+}
+
+func TestUnsubscribeURLIsSigned(t *testing.T) {
+	config := emailConfig{publicURL: "https://mail.example.com", unsubscribeSecret: "secret"}
+	link, err := url.Parse(unsubscribeURL(config, "a@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := link.Query()
+	if query.Get("email") != "a@example.com" || !validUnsubscribeToken(config, "a@example.com", query.Get("token")) {
+		t.Errorf("link %s doesn't carry a valid token for the address", link)
+	}
+	if validUnsubscribeToken(config, "b@example.com", query.Get("token")) {
+		t.Error("token valid for another address")
+	}
+	if validUnsubscribeToken(emailConfig{unsubscribeSecret: "other"}, "a@example.com", query.Get("token")) {
+		t.Error("token valid under another secret")
+	}
+	if got := unsubscribeURL(emailConfig{}, "a@example.com"); got != "" {
+		t.Errorf("link without PUBLIC_URL = %q, want none", got)
+	}
+}
+
+func TestUnsubscribeGetShowsConfirmationPage(t *testing.T) {
+	s, suppressions := newUnsubscribeServer()
+
+	w := record(s.unsubscribeHandler, httptest.NewRequest(http.MethodGet, unsubscribePath(t, s.config, "a@example.com"), nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status = %d, content type = %q, want an HTML page", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), `<form method="post">`) || !strings.Contains(w.Body.String(), "a@example.com") {
+		t.Errorf("page doesn't offer to unsubscribe the address:\n%s", w.Body.String())
+	}
+	if len(suppressions.addresses) != 0 {
+		t.Error("opening the link suppressed the address")
+	}
+}
+
+func TestUnsubscribeOneClick(t *testing.T) {
+	s, suppressions := newUnsubscribeServer()
+
+	r := httptest.NewRequest(http.MethodPost, unsubscribePath(t, s.config, "a@example.com"), strings.NewReader("List-Unsubscribe=One-Click"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := record(s.unsubscribeHandler, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if !suppressions.addresses["a@example.com"] {
+		t.Error("address not suppressed")
+	}
+
+	// a form without the one-click value is refused
+	r = httptest.NewRequest(http.MethodPost, unsubscribePath(t, s.config, "b@example.com"), strings.NewReader("List-Unsubscribe=Yes"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assertError(t, record(s.unsubscribeHandler, r), http.StatusBadRequest, errCodeInvalidRequest)
+	if suppressions.addresses["b@example.com"] {
+		t.Error("b@example.com suppressed by a form without List-Unsubscribe=One-Click")
+	}
+}
+
+func TestUnsubscribeJSONBody(t *testing.T) {
+	s, suppressions := newUnsubscribeServer()
+	token := unsubscribeToken(s.config.unsubscribeSecret, "a@example.com")
+
+	w := record(s.unsubscribeHandler, jsonRequest("/unsubscribe", `{"email":"A@example.com","token":"`+token+`"}`))
+	if w.Code != http.StatusOK || !suppressions.addresses["a@example.com"] {
+		t.Fatalf("status = %d, suppressed = %v: %s", w.Code, suppressions.addresses, w.Body.String())
+	}
+}
+
+func TestUnsubscribeRejectsInvalidTokens(t *testing.T) {
+	s, suppressions := newUnsubscribeServer()
+	forged := unsubscribeToken("guess", "a@example.com")
+
+	for name, r := range map[string]*http.Request{
+		"get without token":  httptest.NewRequest(http.MethodGet, "/unsubscribe?email=a@example.com", nil),
+		"get forged token":   httptest.NewRequest(http.MethodGet, "/unsubscribe?email=a@example.com&token="+forged, nil),
+		"json forged token":  jsonRequest("/unsubscribe", `{"email":"a@example.com","token":"`+forged+`"}`),
+		"json without token": jsonRequest("/unsubscribe", `{"email":"a@example.com"}`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assertError(t, record(s.unsubscribeHandler, r), http.StatusForbidden, errCodeUnauthorized)
+		})
+	}
+
+	// a token for one address doesn't unsubscribe another
+	path := strings.Replace(unsubscribePath(t, s.config, "a@example.com"), "email=a", "email=b", 1)
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("List-Unsubscribe=One-Click"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assertError(t, record(s.unsubscribeHandler, r), http.StatusForbidden, errCodeUnauthorized)
+
+	if len(suppressions.addresses) != 0 {
+		t.Errorf("suppressed %v", suppressions.addresses)
+	}
+
+	assertError(t, record(s.unsubscribeHandler, httptest.NewRequest(http.MethodDelete, "/unsubscribe", nil)),
+		http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestUnsubscribeRejectsBadRequests(t *testing.T) {
+	s, suppressions := newUnsubscribeServer()
+
+	assertError(t, record(s.unsubscribeHandler, jsonRequest("/unsubscribe", `{"email":"not-an-address"}`)),
+		http.StatusBadRequest, errCodeInvalidRequest)
+	assertError(t, record(s.unsubscribeHandler, jsonRequest("/unsubscribe", `{`)),
+		http.StatusBadRequest, errCodeInvalidRequest)
+	if len(suppressions.addresses) != 0 {
+		t.Errorf("suppressed %v", suppressions.addresses)
+	}
+}
+
+func TestUnsubscribeRejectsOversizedBodies(t *testing.T) {
+	s, suppressions := newUnsubscribeServer()
+	s.config.maxBodyBytes = 64
+	padding := strings.Repeat("x", 100)
+
+	form := httptest.NewRequest(http.MethodPost, unsubscribePath(t, s.config, "a@example.com"), strings.NewReader("List-Unsubscribe=One-Click&padding="+padding))
+	form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assertError(t, record(s.unsubscribeHandler, form), http.StatusRequestEntityTooLarge, errCodeTooLarge)
+
+	token := unsubscribeToken(s.config.unsubscribeSecret, "a@example.com")
+	body := jsonRequest("/unsubscribe", `{"email":"a@example.com","token":"`+token+`","padding":"`+padding+`"}`)
+	assertError(t, record(s.unsubscribeHandler, body), http.StatusRequestEntityTooLarge, errCodeTooLarge)
+
+	if len(suppressions.addresses) != 0 {
+		t.Errorf("suppressed %v", suppressions.addresses)
+	}
+}
+
+func TestSendSkipsSuppressedRecipients(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	s.suppressions = newMemSuppressionStore("b@example.com", "bcc@example.com")
+
+	w := sendRequest(t, s, `{"recipients":["a@example.com","b@example.com"],"bcc":["bcc@example.com"],"subject":"Hi","message":"Hello"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Suppressed []string `json:"suppressed"`
+	}
+	decodeBody(t, w, &response)
+	if strings.Join(response.Suppressed, ",") != "b@example.com,bcc@example.com" {
+		t.Errorf("suppressed = %v, want b@example.com and bcc@example.com", response.Suppressed)
+	}
+
+	messages := sent.wait(t, 1)
+	if len(messages) != 1 || strings.Join(messages[0].to, ",") != "a@example.com" {
+		t.Fatalf("sent %v, want only a@example.com", messages)
+	}
+	if to := parseMessage(t, messages[0].msg).Header.Get("To"); strings.Contains(to, "b@example.com") {
+		t.Errorf("To = %q names a suppressed recipient", to)
+	}
+}
+
+func TestSendToOnlySuppressedRecipientsSendsNothing(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	s.suppressions = newMemSuppressionStore("a@example.com")
+
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`))
+	var response struct {
+		Status     string   `json:"status"`
+		Suppressed []string `json:"suppressed"`
+	}
+	decodeBody(t, w, &response)
+	if w.Code != http.StatusOK || response.Status != statusSuppressed || len(response.Suppressed) != 1 {
+		t.Errorf("status = %d, body = %+v, want every recipient reported suppressed", w.Code, response)
+	}
+	// suppressed sends never reach the queue
+	if jobs := s.queue.store.(*memJobStore).jobs; len(jobs) != 0 {
+		t.Errorf("queued %d jobs, want none", len(jobs))
+	}
+	if messages := sent.all(); len(messages) != 0 {
+		t.Errorf("%d messages sent, want none", len(messages))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// longest tag accepted on a stored recipient
+const maxTagLength = 64
+
+// trim and deduplicate tags in place, rejecting empty and overlong ones
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	kept := tags[:0]
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, fmt.Errorf("tags must not be empty")
+		}
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag '%s' is longer than %d characters", tag, maxTagLength)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			kept = append(kept, tag)
+		}
+	}
+	return kept, nil
+}
+
+// body of a PATCH /emails/{email} request
+type emailUpdate struct {
+	// replaces the recipient's tags, an empty list removes them
+	Tags *[]string `json:"tags"`
+}
+
+// handles requests to update a stored recipient's tags
+func (s *server) updateEmailHandler(w http.ResponseWriter, r *http.Request, email string) {
+	var update emailUpdate
+	if !s.decodeEmailRequest(w, r, &update) {
+		return
+	}
+	if update.Tags == nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "tags is required")
+		return
+	}
+	tags, err := normalizeTags(*update.Tags)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	updated, err := s.emails.setTags(ctx, email, tags)
+	if err == errEmailNotFound {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Email address '%s' not found", email))
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// body of a /send-to-segment request, an email sent to every stored
+// recipient with the tag
+type segmentRequest struct {
+	Tag string `json:"tag"`
+	EmailRequest
+}
+
+// handles requests to send an email to every stored recipient with a tag,
+// answered like /send-batch with a result for each page of recipients
+func (s *server) sendToSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only POST method
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	r, span := startRequestSpan(r, "send_to_segment")
+	defer span.End()
+
+	if s.smtpUnavailable(w) {
+		return
+	}
+
+	var request segmentRequest
+	if !s.decodeEmailRequest(w, r, &request) {
+		return
+	}
+	request.Tag = strings.TrimSpace(request.Tag)
+	if request.Tag == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "tag is required")
+		return
+	}
+	if len(request.allAddresses()) > 0 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "recipients, cc and bcc cannot be combined with tag")
+		return
+	}
+
+	// page through the segment, sending each page of up to MAX_RECIPIENTS
+	// addresses as its own /send-email request; each recipient gets their
+	// own envelope, so they never see one another
+	var results []batchResult
+	status := http.StatusOK
+	p := page{limit: int64(s.config.maxRecipients)}
+	// a page can't take more of the client's rate limit than its burst
+	if s.limiter.enabled() && p.limit > int64(s.limiter.burst) {
+		p.limit = int64(s.limiter.burst)
+	}
+	for {
+		ctx, cancel := dbContext(r.Context())
+		recipients, err := taggedRecipients(ctx, s.emails, request.Tag, p)
+		cancel()
+		if err != nil && len(results) == 0 {
+			writeDBError(w, r, err)
+			return
+		}
+		if err != nil {
+			// the pages already sent can't be taken back, so report how far it got
+			rec := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+			writeDBError(rec, r, err)
+			results = append(results, batchResult{Index: len(results), StatusCode: rec.status, Body: bytes.TrimSpace(rec.body.Bytes())})
+			status = http.StatusMultiStatus
+			break
+		}
+		if len(recipients) == 0 {
+			break
+		}
+		// each email of the page counts against the client's rate limit
+		if s.limiter.enabled() {
+			if ok, wait := s.limiter.allowN(s.limiter.clientIP(r), len(recipients)); !ok {
+				rec := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+				rec.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeJSONError(rec, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests, try again later")
+				if len(results) == 0 {
+					rec.writeTo(w)
+					return
+				}
+				results = append(results, batchResult{Index: len(results), StatusCode: rec.status, Body: bytes.TrimSpace(rec.body.Bytes())})
+				status = http.StatusMultiStatus
+				break
+			}
+		}
+
+		chunk := request.EmailRequest
+		chunk.Recipients = recipients
+		rec := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+		s.send(rec, r, chunk)
+		// every page would be rejected the same way, so the first one's
+		// response stands for the whole send
+		if len(results) == 0 && rec.status >= http.StatusBadRequest && rec.status < http.StatusInternalServerError {
+			rec.writeTo(w)
+			return
+		}
+		results = append(results, batchResult{Index: len(results), StatusCode: rec.status, Body: bytes.TrimSpace(rec.body.Bytes())})
+		if rec.status >= http.StatusMultipleChoices {
+			status = http.StatusMultiStatus
+		}
+		if int64(len(recipients)) < p.limit {
+			break
+		}
+		p.offset += p.limit
+	}
+	if len(results) == 0 {
+		writeJSONError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("No stored recipients are tagged '%s'", request.Tag))
+		return
+	}
+
+	writeJSON(w, status, map[string]any{"results": results})
+}
+
+// addresses of one page of the stored recipients with the tag
+func taggedRecipients(ctx context.Context, store emailStore, tag string, p page) ([]string, error) {
+	stored, err := store.list(ctx, recipientFilter{tag: tag}, p)
+	recipients := make([]string, 0, len(stored))
+	for _, recipient := range stored {
+		recipients = append(recipients, recipient.Email)
+	}
+	return recipients, err
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{" customers", "beta", "customers "})
+	if err != nil || !slices.Equal(tags, []string{"customers", "beta"}) {
+		t.Errorf("tags = %v, %v, want trimmed and deduplicated", tags, err)
+	}
+	for _, tags := range [][]string{{" "}, {strings.Repeat("t", maxTagLength+1)}} {
+		if _, err := normalizeTags(tags); err == nil {
+			t.Errorf("tags %q accepted", tags)
+		}
+	}
+}
+
+func TestUpdateEmailTags(t *testing.T) {
+	s := &server{config: emailConfig{maxBodyBytes: 1 << 20}, emails: newMemEmailStore("a@example.com")}
+	patch := func(email, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPatch, "/emails/"+email, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+
+	w := record(s.emailHandler, patch("A@Example.com", `{"tags":[" customers "]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var updated storedRecipient
+	decodeBody(t, w, &updated)
+	if updated.Email != "a@example.com" || !slices.Equal(updated.Tags, []string{"customers"}) {
+		t.Errorf("updated = %+v, want a@example.com tagged customers", updated)
+	}
+
+	w = record(s.emailHandler, patch("b@example.com", `{"tags":[]}`))
+	assertError(t, w, http.StatusNotFound, errCodeNotFound)
+
+	for _, body := range []string{`{}`, `{"tags":[""]}`} {
+		w := record(s.emailHandler, patch("a@example.com", body))
+		assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+	}
+}
+
+func TestSendToSegment(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	store := s.emails.(*memEmailStore)
+	store.insert(context.Background(), []string{"a@example.com", "b@example.com"}, []string{"customers"})
+	store.insert(context.Background(), []string{"c@example.com"}, nil)
+
+	w := record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", `{"tag":"customers","subject":"Hi","message":"Hello"}`))
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	decodeBody(t, w, &body)
+	if w.Code != http.StatusOK || len(body.Results) != 1 || body.Results[0].StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want one queued page: %s", w.Code, w.Body.String())
+	}
+
+	var sentTo []string
+	for _, message := range sent.wait(t, 2) {
+		sentTo = append(sentTo, message.to...)
+	}
+	slices.Sort(sentTo)
+	if !slices.Equal(sentTo, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("sent to %v, want each tagged recipient", sentTo)
+	}
+}
+
+func TestSendToSegmentSendsInPages(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	s.config.maxRecipients = 2
+	store := s.emails.(*memEmailStore)
+	var tagged []string
+	for _, address := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		store.insert(context.Background(), []string{address}, []string{"customers"})
+		tagged = append(tagged, address)
+	}
+	store.insert(context.Background(), []string{"other@example.com"}, nil)
+
+	w := record(s.sendToSegmentHandler, jsonRequest("/send-to-segment?wait=true", `{"tag":"customers","subject":"Hi","message":"Hello"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	decodeBody(t, w, &body)
+	if len(body.Results) != 3 {
+		t.Fatalf("got %d results, want one for each of 3 pages", len(body.Results))
+	}
+	var sentTo []string
+	for _, result := range body.Results {
+		var response sendResponse
+		if err := json.Unmarshal(result.Body, &response); err != nil {
+			t.Fatal(err)
+		}
+		if result.StatusCode != http.StatusOK || len(response.Results) > 2 {
+			t.Errorf("page %d: status %d with %d recipients", result.Index, result.StatusCode, len(response.Results))
+		}
+		for _, delivery := range response.Results {
+			sentTo = append(sentTo, delivery.Recipient)
+		}
+	}
+	if !slices.Equal(sentTo, tagged) {
+		t.Errorf("sent to %v, want %v", sentTo, tagged)
+	}
+}
+
+func TestSendToSegmentChargesTheRateLimitPerPage(t *testing.T) {
+	recordSends(t)
+	s := newTestServer(t)
+	s.config.maxRecipients = 2
+	s.limiter = newRateLimiter(60, 3, false)
+	now := time.Now()
+	s.limiter.now = func() time.Time { return now }
+	for _, address := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		s.emails.insert(context.Background(), []string{address}, []string{"customers"})
+	}
+	send := `{"tag":"customers","subject":"Hi","message":"Hello"}`
+
+	// the first page fits the burst, the second doesn't
+	w := record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", send))
+	var body struct {
+		Results []batchResult `json:"results"`
+	}
+	decodeBody(t, w, &body)
+	if w.Code != http.StatusMultiStatus || len(body.Results) != 2 ||
+		body.Results[0].StatusCode != http.StatusAccepted || body.Results[1].StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want the second page rate limited: %s", w.Code, w.Body.String())
+	}
+
+	// with nothing left the whole send is refused
+	w = record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", send))
+	assertError(t, w, http.StatusTooManyRequests, errCodeRateLimited)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After not set")
+	}
+
+	// pages never exceed the burst
+	s.limiter = newRateLimiter(60, 1, false)
+	s.limiter.now = func() time.Time { return now }
+	w = record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", send))
+	decodeBody(t, w, &body)
+	if len(body.Results) != 2 || body.Results[0].StatusCode != http.StatusAccepted {
+		t.Errorf("status = %d, want a page of one sent: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSendToSegmentRejections(t *testing.T) {
+	s := newTestServer(t)
+	s.emails.insert(context.Background(), []string{"a@example.com"}, []string{"customers"})
+
+	// a request every page would fail gets the single page's response
+	w := record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", `{"tag":"customers","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", `{"tag":"nobody","subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusNotFound, errCodeNotFound)
+
+	w = record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", `{"subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.sendToSegmentHandler, jsonRequest("/send-to-segment", `{"tag":"customers","recipients":["b@example.com"],"subject":"Hi","message":"Hello"}`))
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+
+	w = record(s.sendToSegmentHandler, httptest.NewRequest(http.MethodGet, "/send-to-segment", nil))
+	assertError(t, w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
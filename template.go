@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// parsed body templates of a request, either may be nil
+type messageTemplates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// parse the request's templates, failing on variables a recipient doesn't define
+func parseTemplates(request EmailRequest) (messageTemplates, error) {
+	var templates messageTemplates
+	var err error
+	if request.Template != "" {
+		templates.text, err = texttemplate.New("template").Option("missingkey=error").Parse(request.Template)
+		if err != nil {
+			return messageTemplates{}, fmt.Errorf("template is not valid: %v", err)
+		}
+	}
+	if request.HTMLTemplate != "" {
+		templates.html, err = htmltemplate.New("html_template").Option("missingkey=error").Parse(request.HTMLTemplate)
+		if err != nil {
+			return messageTemplates{}, fmt.Errorf("html_template is not valid: %v", err)
+		}
+	}
+	return templates, nil
+}
+
+// copy of the request with the templates rendered into Message and
+// HTMLMessage using the recipient's variables
+func (t messageTemplates) personalize(request EmailRequest, recipient string) (EmailRequest, error) {
+	vars := request.Variables[recipient]
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	if recipient == "" {
+		recipient = "cc and bcc recipients"
+	}
+	var b bytes.Buffer
+	if t.text != nil {
+		if err := t.text.Execute(&b, vars); err != nil {
+			return EmailRequest{}, fmt.Errorf("could not render template for %s: %v", recipient, err)
+		}
+		request.Message = b.String()
+		b.Reset()
+	}
+	if t.html != nil {
+		if err := t.html.Execute(&b, vars); err != nil {
+			return EmailRequest{}, fmt.Errorf("could not render html_template for %s: %v", recipient, err)
+		}
+		request.HTMLMessage = b.String()
+	}
+	return request, nil
+}
+
+// check the request's templates render for every message, including the cc
+// and bcc copy rendered without variables
+func validateTemplates(request EmailRequest) error {
+	if request.Template == "" && request.HTMLTemplate == "" {
+		return nil
+	}
+	templates, err := parseTemplates(request)
+	if err != nil {
+		return err
+	}
+	for _, recipient := range request.envelopeRecipients() {
+		if _, err := templates.personalize(request, recipient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
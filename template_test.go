@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name    string
+		request EmailRequest
+		wantErr string
+	}{
+		{
+			name: "variables for every recipient",
+			request: EmailRequest{
+				Recipients: []string{"a@example.com", "b@example.com"},
+				Template:   "Hi {{.name}}",
+				Variables:  map[string]map[string]string{"a@example.com": {"name": "Ann"}, "b@example.com": {"name": "Bob"}},
+			},
+		},
+		{
+			name: "recipient missing a variable",
+			request: EmailRequest{
+				Recipients: []string{"a@example.com", "b@example.com"},
+				Template:   "Hi {{.name}}",
+				Variables:  map[string]map[string]string{"a@example.com": {"name": "Ann"}},
+			},
+			wantErr: "b@example.com",
+		},
+		{
+			name:    "unparseable html template",
+			request: EmailRequest{Recipients: []string{"a@example.com"}, HTMLTemplate: "<p>{{.name</p>"},
+			wantErr: "html_template is not valid",
+		},
+		{
+			name:    "no templates",
+			request: EmailRequest{Recipients: []string{"a@example.com"}, Message: "Hi {{.name}}"},
+		},
+		{
+			name:    "only cc and bcc with variables",
+			request: EmailRequest{Cc: []string{"cc@example.com"}, HTMLTemplate: "<p>Hi {{.name}}</p>"},
+			wantErr: "cc and bcc recipients",
+		},
+		{
+			name:    "only bcc without variables",
+			request: EmailRequest{Bcc: []string{"bcc@example.com"}, Template: "Hi all"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTemplates(tt.request)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildEnvelopesRendersTemplatesPerRecipient(t *testing.T) {
+	request := EmailRequest{
+		Recipients:   []string{"a@example.com", "b@example.com"},
+		Subject:      "Hi",
+		Template:     "Hi {{.name}}",
+		HTMLTemplate: "<p>Hi {{.name}}</p>",
+		Variables: map[string]map[string]string{
+			"a@example.com": {"name": "Ann"},
+			"b@example.com": {"name": "<Bob>"},
+		},
+	}
+	envelopes, err := buildEnvelopes(emailConfig{senderEmail: "me@example.com"}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != 2 {
+		t.Fatalf("built %d envelopes, want 2", len(envelopes))
+	}
+
+	for i, want := range []struct{ text, html string }{
+		{"Hi Ann", "<p>Hi Ann</p>"},
+		{"Hi <Bob>", "<p>Hi &lt;Bob&gt;</p>"},
+	} {
+		msg := parseMessage(t, envelopes[i].msg)
+		parts := readParts(t, msg.Header.Get("Content-Type"), msg.Body, "multipart/alternative")
+		if len(parts) != 2 || strings.TrimSpace(parts[0].body) != want.text || strings.TrimSpace(parts[1].body) != want.html {
+			t.Errorf("envelope %d parts = %+v, want %q and %q", i, parts, want.text, want.html)
+		}
+	}
+}
+
+func TestSendRendersTemplateVariables(t *testing.T) {
+	sent := recordSends(t)
+	s := newTestServer(t)
+	body := `{"recipients":["A@Example.com"],"subject":"Hello","template":"Hi {{.name}}","variables":{"a@example.com":{"name":"Ann"}}}`
+
+	if w := sendRequest(t, s, body); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202: %s", w.Code, w.Body.String())
+	}
+	msg := parseMessage(t, sent.wait(t, 1)[0].msg)
+	if text, _ := io.ReadAll(msg.Body); strings.TrimSpace(string(text)) != "Hi Ann" {
+		t.Errorf("body = %q, want the rendered template", text)
+	}
+}
+
+func TestSendRejectsTemplatesMissingVariables(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"recipients":["a@example.com"],"subject":"Hello","template":"Hi {{.name}}"}`
+	assertError(t, record(s.sendEmailHandler, jsonRequest("/send-email", body)), http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestSendRejectsCcOnlyTemplateNeedingVariables(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"cc":["cc@example.com"],"subject":"Hello","template":"Hi {{.name}}"}`
+
+	w := record(s.sendEmailHandler, jsonRequest("/send-email", body))
+	if !strings.Contains(w.Body.String(), "cc and bcc recipients") {
+		t.Errorf("body = %s, want the cc and bcc copy failing to render", w.Body.String())
+	}
+	assertError(t, w, http.StatusBadRequest, errCodeInvalidRequest)
+}
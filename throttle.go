@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// spaces out the messages sent through the SMTP servers so they stay within
+// the provider's account wide send rate however many workers are sending;
+// a nil throttle never waits
+type sendThrottle struct {
+	// time between consecutive messages
+	interval time.Duration
+	now      func() time.Time
+	sleep    func(time.Duration)
+
+	mu sync.Mutex
+	// earliest time the next message may be sent
+	next time.Time
+}
+
+func newSendThrottle(perSecond int) *sendThrottle {
+	return &sendThrottle{interval: time.Second / time.Duration(perSecond), now: time.Now, sleep: time.Sleep}
+}
+
+// block until a message may be sent, reserving its slot so concurrent
+// callers queue up one interval apart
+func (t *sendThrottle) wait() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	now := t.now()
+	slot := t.next
+	if slot.Before(now) {
+		slot = now
+	}
+	t.next = slot.Add(t.interval)
+	t.mu.Unlock()
+
+	if delay := slot.Sub(now); delay > 0 {
+		t.sleep(delay)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a throttle of the rate on a clock that only moves when it sleeps,
+// recording the pauses
+func newTestThrottle(perSecond int) (*sendThrottle, *time.Time, *[]time.Duration) {
+	now := time.Now()
+	var pauses []time.Duration
+	throttle := newSendThrottle(perSecond)
+	throttle.now = func() time.Time { return now }
+	throttle.sleep = func(d time.Duration) { pauses = append(pauses, d) }
+	return throttle, &now, &pauses
+}
+
+func TestSendThrottleSpacesOutBursts(t *testing.T) {
+	throttle, now, pauses := newTestThrottle(10)
+	for i := 0; i < 4; i++ {
+		throttle.wait()
+	}
+	if want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}; !slices.Equal(*pauses, want) {
+		t.Errorf("pauses = %v, want %v", *pauses, want)
+	}
+
+	// after a quiet spell the next message goes straight away
+	*pauses = nil
+	*now = now.Add(time.Second)
+	throttle.wait()
+	if len(*pauses) != 0 {
+		t.Errorf("pauses = %v, want none after sending had stopped", *pauses)
+	}
+}
+
+func TestSendThrottleIsSharedBetweenWorkers(t *testing.T) {
+	throttle := newSendThrottle(100)
+	var mu sync.Mutex
+	var sentAt []time.Time
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			throttle.wait()
+			mu.Lock()
+			sentAt = append(sentAt, time.Now())
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// each message waits for its own slot, so however the workers are
+	// scheduled the nth one goes no sooner than n intervals in
+	slices.SortFunc(sentAt, func(a, b time.Time) int { return a.Compare(b) })
+	for i, at := range sentAt {
+		// allow for the clock's granularity
+		if want := time.Duration(i)*10*time.Millisecond - time.Millisecond; at.Sub(start) < want {
+			t.Errorf("message %d sent %s in, want at least %s", i, at.Sub(start), want)
+		}
+	}
+}
+
+func TestNilSendThrottleNeverWaits(t *testing.T) {
+	var throttle *sendThrottle
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		throttle.wait()
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("waited %s without a throttle", elapsed)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// record the spans started for the duration of the test, propagating
+// incoming W3C trace context
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousTracer, previousPropagator := tracer, otel.GetTextMapPropagator()
+	tracer = provider.Tracer("test")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = previousTracer
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func TestSendSpanHierarchy(t *testing.T) {
+	recorder := recordSpans(t)
+	recordSends(t)
+	s := newTestServer(t)
+	r := jsonRequest("/send-email?wait=true", `{"recipients":["a@example.com"],"subject":"Hi","message":"Hello"}`)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if w := record(s.sendEmailHandler, r); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["send_email"]
+	if !ok {
+		t.Fatalf("spans = %v, want a send_email span", spans)
+	}
+	if got := root.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the caller's", got)
+	}
+	if got := root.Parent().SpanID().String(); got != "00f067aa0ba902b7" || !root.Parent().IsRemote() {
+		t.Errorf("send_email parent = %s, want the caller's span", got)
+	}
+	if root.SpanKind() != trace.SpanKindServer {
+		t.Errorf("send_email kind = %s, want server", root.SpanKind())
+	}
+
+	for _, name := range []string{"validate", "store_recipients", "smtp_send"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span's parent = %s, want send_email", name, span.Parent().SpanID())
+		}
+	}
+}
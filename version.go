@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+// handles requests for the build the server is running
+func (s *server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	// restrict to only GET method
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only GET method is allowed")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+		"go_version": runtime.Version(),
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	s := &server{}
+	w := record(s.versionHandler, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var info map[string]string
+	decodeBody(t, w, &info)
+	want := map[string]string{"version": "dev", "commit": "dev", "build_time": "dev", "go_version": runtime.Version()}
+	if len(info) != len(want) {
+		t.Errorf("fields = %v, want %v", info, want)
+	}
+	for field, value := range want {
+		if info[field] != value {
+			t.Errorf("%s = %q, want %q", field, info[field], value)
+		}
+	}
+
+	assertError(t, record(s.versionHandler, httptest.NewRequest(http.MethodPost, "/version", nil)), http.StatusMethodNotAllowed, errCodeMethodNotAllowed)
+}
+
+func TestVersionHandlerReportsBuildInfo(t *testing.T) {
+	previous := [3]string{version, commit, buildTime}
+	version, commit, buildTime = "1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+	defer func() { version, commit, buildTime = previous[0], previous[1], previous[2] }()
+
+	var info map[string]string
+	decodeBody(t, record((&server{}).versionHandler, httptest.NewRequest(http.MethodGet, "/version", nil)), &info)
+	if info["version"] != "1.2.3" || info["commit"] != "abc1234" || info["build_time"] != "2024-01-02T03:04:05Z" {
+		t.Errorf("info = %v, want the values set at build time", info)
+	}
+}
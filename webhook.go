@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// attempts made to deliver a callback before giving up
+const webhookAttempts = 3
+
+// client used to deliver callbacks, replaceable in tests; like
+// attachmentClient it only connects to public addresses, and it doesn't
+// follow redirects, which count as failed deliveries
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         publicDialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// body POSTed to a request's callback_url once its job has finished
+type webhookPayload struct {
+	JobID string `json:"job_id"`
+	// Message-ID of the message each address was sent, keyed by address
+	MessageIDs map[string]string `json:"message_ids,omitempty"`
+	Status     string            `json:"status"`
+	Results    []deliveryResult  `json:"results"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// check a callback URL is an absolute https URL, so signed payloads aren't
+// sent in the clear, catching non-public IP addresses up front; hosts that
+// resolve to one are refused by webhookClient when the callback is made
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("callback_url must be an absolute https URL")
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !isPublicAddr(ip) {
+		return fmt.Errorf("callback_url must not be a private address")
+	}
+	return nil
+}
+
+// HMAC-SHA256 of the body with the secret, as sent in X-Webhook-Signature
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POST the payload to the callback URL, retrying with backoff until it is
+// accepted with a 2xx response or the attempts run out
+func notifyWebhook(ctx context.Context, config emailConfig, callbackURL string, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(ctx, config, callbackURL, body)
+		if err == nil || attempt >= webhookAttempts {
+			return err
+		}
+		backoff := config.retry.delay(attempt)
+		loggerFrom(ctx).Warn("Callback failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		sleep(backoff)
+	}
+}
+
+// make a single callback attempt
+func postWebhook(ctx context.Context, config emailConfig, callbackURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.webhookSecret != "" {
+		req.Header.Set("X-Webhook-Signature", webhookSignature(config.webhookSecret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// receive callbacks over TLS, pointing webhookClient at the server for the
+// duration of the test; the client keeps its redirect policy
+func newWebhookServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	previous := webhookClient
+	webhookClient = srv.Client()
+	webhookClient.CheckRedirect = previous.CheckRedirect
+	t.Cleanup(func() { webhookClient = previous })
+	return srv
+}
+
+func TestValidateCallbackURL(t *testing.T) {
+	for raw, wantErr := range map[string]bool{
+		"https://hooks.example.com/email":  false,
+		"http://hooks.example.com/email":   true,
+		"https://127.0.0.1/hook":           true,
+		"https://[::1]:8443/hook":          true,
+		"https://169.254.169.254/metadata": true,
+		"https://10.0.0.5/hook":            true,
+		"hooks.example.com/email":          true,
+		"ftp://hooks.example.com/email":    true,
+	} {
+		if err := validateCallbackURL(raw); (err != nil) != wantErr {
+			t.Errorf("validateCallbackURL(%q) = %v, want error %v", raw, err, wantErr)
+		}
+	}
+}
+
+func TestNotifyWebhookSignsPayload(t *testing.T) {
+	var signature, body string
+	srv := newWebhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		signature, body = r.Header.Get("X-Webhook-Signature"), string(data)
+	})
+
+	config := emailConfig{webhookSecret: "secret"}
+	if err := notifyWebhook(context.Background(), config, srv.URL, webhookPayload{JobID: "job-1", Status: jobSent}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(body, `"job_id":"job-1"`) || signature != webhookSignature("secret", []byte(body)) {
+		t.Errorf("signature %q doesn't match body %s", signature, body)
+	}
+}
+
+func TestNotifyWebhookRetriesFailures(t *testing.T) {
+	pauses := recordSleeps(t)
+	var attempts atomic.Int32
+	srv := newWebhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	err := notifyWebhook(context.Background(), emailConfig{}, srv.URL, webhookPayload{JobID: "job-1"})
+	if err == nil || !strings.Contains(err.Error(), "status 502") {
+		t.Errorf("err = %v, want the failing status reported", err)
+	}
+	if got := attempts.Load(); got != webhookAttempts || len(*pauses) != webhookAttempts-1 {
+		t.Errorf("made %d attempts with %d pauses, want %d attempts", got, len(*pauses), webhookAttempts)
+	}
+}
+
+func TestNotifyWebhookRetriesAndDoesNotFollowRedirects(t *testing.T) {
+	recordSleeps(t)
+	var attempts atomic.Int32
+	srv := newWebhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		http.Redirect(w, r, "https://169.254.169.254/", http.StatusTemporaryRedirect)
+	})
+
+	err := notifyWebhook(context.Background(), emailConfig{}, srv.URL, webhookPayload{JobID: "job-1"})
+	if err == nil || !strings.Contains(err.Error(), "status 307") {
+		t.Errorf("err = %v, want the redirect treated as a failure", err)
+	}
+	if got := attempts.Load(); got != webhookAttempts {
+		t.Errorf("made %d attempts, want %d", got, webhookAttempts)
+	}
+}
+
+func TestWebhookClientRefusesNonPublicAddresses(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("callback delivered to a loopback address")
+	}))
+	defer srv.Close()
+
+	err := postWebhook(context.Background(), emailConfig{}, srv.URL, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("err = %v, want the loopback address refused", err)
+	}
+}
+
+func TestQueueCallsBackWhenAJobFinishes(t *testing.T) {
+	recordSends(t)
+	payloads := make(chan webhookPayload, 1)
+	srv := newWebhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		payloads <- payload
+	})
+
+	queue := newEmailQueue(emailConfig{senderEmail: "me@example.com", queueSize: 1, queueWorkers: 1}, newMemJobStore(), &memHistoryStore{})
+	jobID, err := queue.enqueue(context.Background(), EmailRequest{
+		Recipients:  []string{"a@example.com"},
+		Subject:     "Hi",
+		Message:     "Hello",
+		CallbackURL: srv.URL,
+		MessageIDs:  map[string]string{"a@example.com": "<1234@example.com>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stopping waits for callbacks still being delivered
+	queue.stop()
+
+	select {
+	case payload := <-payloads:
+		if payload.JobID != jobID || payload.MessageIDs["a@example.com"] != "<1234@example.com>" || payload.Status != jobSent || len(payload.Results) != 1 {
+			t.Errorf("payload = %+v, want the job's outcome", payload)
+		}
+	default:
+		t.Fatal("no callback delivered")
+	}
+}
+
+func TestCallbackCarriesMessageIDs(t *testing.T) {
+	var body []byte
+	srv := newWebhookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+	})
+	s := newTestServer(t)
+
+	request := EmailRequest{CallbackURL: srv.URL, MessageIDs: map[string]string{"a@example.com": "<one@example.com>"}}
+	results := []deliveryResult{{Recipient: "a@example.com", MessageID: "<one@example.com>", Status: recipientSent}}
+	s.queue.notify(context.Background(), job{id: "job-1", request: request}, jobSent, results, nil)
+	s.queue.callbacks.Wait()
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("decoding callback %q: %v", body, err)
+	}
+	if payload.MessageIDs["a@example.com"] != "<one@example.com>" || payload.Results[0].MessageID != "<one@example.com>" {
+		t.Errorf("payload = %+v, want the recipient's Message-ID", payload)
+	}
+}